@@ -1,21 +1,365 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bonniesimon/log-go/internal/ingest"
 )
 
 func main() {
+	ingest.WALDir = walDir()
+	if err := configureHints(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureDedup(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureMaxRequestBytes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureRouting(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRoutingPins(); err != nil {
+		log.Fatal(err)
+	}
+	for _, assignment := range ingest.Routing.Assignments() {
+		fmt.Println("[INGEST/ROUTING]", "partition=", assignment.Partition, "nodes=", assignment.Nodes, "pinned=", assignment.Pinned)
+	}
+	if err := configureQueue(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureReplication(); err != nil {
+		log.Fatal(err)
+	}
+	configureMetadata()
+	if err := configureMembership(); err != nil {
+		log.Fatal(err)
+	}
+
 	storage := ingest.NewStorageClient()
 	service := ingest.NewService(storage)
+	if err := service.Open(); err != nil {
+		log.Fatal(err)
+	}
+
 	handler := ingest.NewHandler(service)
 
 	http.HandleFunc("/v1/logs", handler.HandleCreate)
 	http.HandleFunc("/v1/query", handler.HandleQuery)
+	http.HandleFunc("/v1/admin/breakers", handler.HandleBreakers)
+	http.HandleFunc("/v1/admin/queue", handler.HandleQueue)
+	http.HandleFunc("/v1/admin/hints", handler.HandleHints)
+	http.HandleFunc("/v1/admin/routing", handler.HandleRouting)
+	http.HandleFunc("/v1/admin/moves", handler.HandleMoves)
+	http.HandleFunc("/v1/admin/replication", handler.HandleReplication)
+	http.HandleFunc("/v1/admin/failover", handler.HandleFailover)
+	http.HandleFunc("/v1/members", handler.HandleMembers)
+
+	server := &http.Server{Addr: ":8080"}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdownOnSignal(server, service)
+	}()
+
+	fmt.Println("Server listening on 8080", "wal=", ingest.WALDir, "queue=", ingest.QueueCapacity)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-stopped
+}
+
+// shutdownOnSignal stops accepting requests on SIGINT/SIGTERM and stops the
+// WAL replay once in-flight requests have been answered.
+func shutdownOnSignal(server *http.Server, service *ingest.Service) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("[INGEST/SHUTDOWN]", "error=", err)
+	}
+	service.Close()
+}
+
+// walDir is where undeliverable batches are kept, INGEST_WAL_DIR or
+// tmp/ingest-wal. Setting INGEST_WAL_DIR to "off" disables the WAL.
+func walDir() string {
+	dir := os.Getenv("INGEST_WAL_DIR")
+
+	switch dir {
+	case "":
+		return "tmp/ingest-wal"
+	case "off":
+		return ""
+	}
+
+	return dir
+}
+
+// configureHints reads how long batches wait in the WAL for their storage
+// node from INGEST_HINT_MAX_AGE and how many bytes they may take up from
+// INGEST_HINT_MAX_BYTES. "0" removes either bound.
+func configureHints() error {
+	if maxAge := os.Getenv("INGEST_HINT_MAX_AGE"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid INGEST_HINT_MAX_AGE %q", maxAge)
+		}
+		ingest.HintMaxAge = d
+	}
+
+	if maxBytes := os.Getenv("INGEST_HINT_MAX_BYTES"); maxBytes != "" {
+		n, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid INGEST_HINT_MAX_BYTES %q", maxBytes)
+		}
+		ingest.HintMaxBytes = n
+	}
+
+	return nil
+}
+
+// configureDedup reads how long retried batches are recognized from
+// INGEST_DEDUP_WINDOW, "0" disables deduplication, and how many batches are
+// remembered at most from INGEST_DEDUP_MAX_KEYS.
+func configureDedup() error {
+	if window := os.Getenv("INGEST_DEDUP_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid INGEST_DEDUP_WINDOW %q", window)
+		}
+		ingest.DedupWindow = d
+	}
+
+	if maxKeys := os.Getenv("INGEST_DEDUP_MAX_KEYS"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid INGEST_DEDUP_MAX_KEYS %q", maxKeys)
+		}
+		ingest.DedupMaxKeys = n
+	}
+
+	return nil
+}
+
+// configureMaxRequestBytes reads how large request bodies may be from
+// INGEST_MAX_REQUEST_BYTES. "0" removes the limit.
+func configureMaxRequestBytes() error {
+	if maxBytes := os.Getenv("INGEST_MAX_REQUEST_BYTES"); maxBytes != "" {
+		n, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid INGEST_MAX_REQUEST_BYTES %q", maxBytes)
+		}
+		ingest.MaxRequestBytes = n
+	}
+
+	return nil
+}
+
+// configureRouting builds the routing table from INGEST_STORAGE_NODES, a comma
+// separated list of storage node URLs, INGEST_PARTITIONS and
+// INGEST_REPLICATION_FACTOR. INGEST_VIRTUAL_NODES is how many points every
+// node gets on the hash ring.
+func configureRouting() error {
+	nodes := ingest.Routing.Nodes()
+	partitions := ingest.Routing.Partitions()
+	replicationFactor := ingest.Routing.ReplicationFactor()
+
+	if list := os.Getenv("INGEST_STORAGE_NODES"); list != "" {
+		nodes = nil
+		for _, node := range strings.Split(list, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				nodes = append(nodes, node)
+			}
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("invalid INGEST_STORAGE_NODES %q", list)
+		}
+	}
+
+	if count := os.Getenv("INGEST_PARTITIONS"); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid INGEST_PARTITIONS %q", count)
+		}
+		partitions = n
+	}
+
+	if factor := os.Getenv("INGEST_REPLICATION_FACTOR"); factor != "" {
+		n, err := strconv.Atoi(factor)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid INGEST_REPLICATION_FACTOR %q", factor)
+		}
+		replicationFactor = n
+	}
+
+	if vnodes := os.Getenv("INGEST_VIRTUAL_NODES"); vnodes != "" {
+		n, err := strconv.Atoi(vnodes)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid INGEST_VIRTUAL_NODES %q", vnodes)
+		}
+		ingest.VirtualNodes = n
+	}
+
+	ingest.Routing = ingest.NewRoutingTable(partitions, replicationFactor, nodes...)
+
+	return nil
+}
+
+// loadRoutingPins routes the partitions moved by earlier runs to where their
+// data is now. Pins are kept in INGEST_ROUTING_PINS or
+// tmp/ingest-routing.json; setting it to "off" keeps them in memory only.
+// Without saved pins, the partitions of the legacy placement stay on their
+// node; partitions that were never moved follow the hash ring.
+func loadRoutingPins() error {
+	switch path := os.Getenv("INGEST_ROUTING_PINS"); path {
+	case "":
+		ingest.RoutingPinsFile = "tmp/ingest-routing.json"
+	case "off":
+		ingest.Routing.PinLegacyPlacement()
+		return nil
+	default:
+		ingest.RoutingPinsFile = path
+	}
+
+	return ingest.Routing.LoadPins(ingest.RoutingPinsFile)
+}
+
+// configureQueue enables the asynchronous ingest queue with INGEST_QUEUE_SIZE
+// batches and INGEST_QUEUE_WORKERS workers. INGEST_QUEUE_WAIT is how long a
+// request may wait for room in a full queue before it gets a 429.
+func configureQueue() error {
+	if size := os.Getenv("INGEST_QUEUE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid INGEST_QUEUE_SIZE %q", size)
+		}
+		ingest.QueueCapacity = n
+	}
+
+	if workers := os.Getenv("INGEST_QUEUE_WORKERS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid INGEST_QUEUE_WORKERS %q", workers)
+		}
+		ingest.QueueWorkers = n
+	}
+
+	if wait := os.Getenv("INGEST_QUEUE_WAIT"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid INGEST_QUEUE_WAIT %q", wait)
+		}
+		ingest.QueueWaitTimeout = d
+	}
+
+	return nil
+}
+
+// configureReplication reads how often followers are synced with their
+// leaders from INGEST_REPLICATION_SYNC_INTERVAL, how many records a follower
+// may miss to be promoted in place of an unreachable leader from
+// INGEST_MAX_FAILOVER_LAG, the acks of writes that do not ask for any from
+// INGEST_ACKS and how long a single attempt to reach a storage node may take
+// from INGEST_ATTEMPT_TIMEOUT.
+func configureReplication() error {
+	if acks := os.Getenv("INGEST_ACKS"); acks != "" {
+		parsed, err := ingest.ParseAcks(acks)
+		if err != nil {
+			return fmt.Errorf("invalid INGEST_ACKS: %w", err)
+		}
+		ingest.DefaultAcks = parsed
+	}
+
+	if interval := os.Getenv("INGEST_REPLICATION_SYNC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid INGEST_REPLICATION_SYNC_INTERVAL %q", interval)
+		}
+		ingest.ReplicationSyncInterval = d
+	}
+
+	if lag := os.Getenv("INGEST_MAX_FAILOVER_LAG"); lag != "" {
+		n, err := strconv.ParseUint(lag, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid INGEST_MAX_FAILOVER_LAG %q", lag)
+		}
+		ingest.MaxFailoverLag = n
+	}
+
+	if timeout := os.Getenv("INGEST_ATTEMPT_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid INGEST_ATTEMPT_TIMEOUT %q", timeout)
+		}
+		ingest.DefaultRetryPolicy.AttemptTimeout = d
+	}
+
+	return nil
+}
+
+// configureMetadata routes partitions according to the cluster metadata
+// served by INGEST_METADATA_NODES, a comma separated list of storage node
+// URLs, instead of the hash ring.
+func configureMetadata() {
+	list := os.Getenv("INGEST_METADATA_NODES")
+
+	ingest.MetadataNodes = nil
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			ingest.MetadataNodes = append(ingest.MetadataNodes, node)
+		}
+	}
+}
+
+// configureMembership reads the file listing storage nodes from
+// INGEST_MEMBERS_FILE, how often storage nodes are health checked from
+// INGEST_HEALTH_CHECK_INTERVAL ("0" disables it), how many failed checks take
+// one off the hash ring from INGEST_HEALTH_CHECK_FAILURES and how long a
+// storage node stays registered without a heartbeat from
+// INGEST_MEMBER_TIMEOUT.
+func configureMembership() error {
+	ingest.MembersFile = os.Getenv("INGEST_MEMBERS_FILE")
+
+	if interval := os.Getenv("INGEST_HEALTH_CHECK_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid INGEST_HEALTH_CHECK_INTERVAL %q", interval)
+		}
+		ingest.HealthCheckInterval = d
+	}
+
+	if failures := os.Getenv("INGEST_HEALTH_CHECK_FAILURES"); failures != "" {
+		n, err := strconv.Atoi(failures)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid INGEST_HEALTH_CHECK_FAILURES %q", failures)
+		}
+		ingest.HealthCheckFailures = n
+	}
+
+	if timeout := os.Getenv("INGEST_MEMBER_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid INGEST_MEMBER_TIMEOUT %q", timeout)
+		}
+		ingest.MemberTimeout = d
+	}
 
-	fmt.Println("Server listening on 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	return nil
 }
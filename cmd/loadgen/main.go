@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -139,14 +143,28 @@ func main() {
 	batchSize := flag.Int("batch", 10, "Logs per batch")
 	total := flag.Int("total", 100, "Total logs to send")
 	delay := flag.Int("delay", 100, "Delay between batches in milliseconds")
+	acks := flag.String("acks", "", "Replicas that must have a batch: 0, 1 or all (default: ingest default)")
+	retries := flag.Int("retries", 3, "Times a batch failing with a transport error, 429 or 5xx is sent again with the same producer sequence")
 	flag.Parse()
 
+	if *acks != "" {
+		separator := "?"
+		if strings.Contains(*url, "?") {
+			separator = "&"
+		}
+		*url += separator + "acks=" + *acks
+	}
+
 	fmt.Printf("🚀 Log Generator Starting\n")
 	fmt.Printf("   URL: %s\n", *url)
 	fmt.Printf("   Batch Size: %d\n", *batchSize)
 	fmt.Printf("   Total Logs: %d\n", *total)
 	fmt.Printf("   Delay: %dms\n\n", *delay)
 
+	// Retries of a batch carry the same producer ID and sequence, so the
+	// ingest node stores it only once.
+	producerID := fmt.Sprintf("loadgen-%d-%08x", os.Getpid(), rand.Uint32())
+
 	timestamp := uint64(time.Now().UnixMilli())
 	sent := 0
 	batchNum := 0
@@ -165,7 +183,17 @@ func main() {
 			logs = append(logs, log)
 		}
 
-		err := sendBatch(*url, logs)
+		var err error
+		for attempt := 0; attempt <= *retries; attempt++ {
+			if attempt > 0 {
+				fmt.Printf("🔁 Retrying batch %d (attempt %d): %v\n", batchNum, attempt+1, err)
+				time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+			}
+			var retryable bool
+			if retryable, err = sendBatch(*url, logs, producerID, batchNum); err == nil || !retryable {
+				break
+			}
+		}
 		if err != nil {
 			fmt.Printf("❌ Batch %d failed: %v\n", batchNum, err)
 		} else {
@@ -229,29 +257,56 @@ func randomChoice(choices []string) string {
 	return choices[rand.Intn(len(choices))]
 }
 
-func sendBatch(url string, logs []LogEntry) error {
+// sendBatch sends logs with the producer sequence of the batch and tells
+// whether a failed batch is worth sending again: after a transport error, a
+// 429 or a 5xx, or when a partition of a partially stored batch failed with
+// one of them. Other failures would fail again.
+func sendBatch(url string, logs []LogEntry, producerID string, sequence int) (bool, error) {
 	payload, err := json.Marshal(logs)
 	if err != nil {
-		return fmt.Errorf("failed to marshal logs: %w", err)
+		return false, fmt.Errorf("failed to marshal logs: %w", err)
 	}
 
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return false, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Producer-ID", producerID)
+	req.Header.Set("X-Producer-Sequence", strconv.Itoa(sequence))
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		// The batch may have been stored, resending it with the same
+		// producer sequence does not store it twice.
+		return true, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	// Retrying a partially stored batch only resends its failed partitions,
+	// since the ingest node recognizes the producer sequence.
+	if resp.StatusCode == http.StatusMultiStatus {
+		var response struct {
+			Partitions []struct {
+				Status string `json:"status"`
+			} `json:"partitions"`
+		}
+		json.NewDecoder(resp.Body).Decode(&response)
+
+		retryable := false
+		for _, partition := range response.Partitions {
+			retryable = retryable || partition.Status == "retriable"
+		}
+		return retryable, fmt.Errorf("server returned %d: batch partially stored", resp.StatusCode)
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %d", resp.StatusCode)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retryable, fmt.Errorf("server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
 	}
 
-	return nil
+	return false, nil
 }
@@ -1,22 +1,139 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/bonniesimon/log-go/internal/metadata"
+	"github.com/bonniesimon/log-go/internal/raft"
 	"github.com/bonniesimon/log-go/internal/storage"
 )
 
 func main() {
-	handler := storage.NewHandler(&storage.Service{})
+	configureDir()
+	if err := configureDurability(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureRetention(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureCompression(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureReplication(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureAntiEntropy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureMaxRequestBytes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureDedup(); err != nil {
+		log.Fatal(err)
+	}
+
+	service := &storage.Service{}
+	if err := service.Open(); err != nil {
+		log.Fatal(err)
+	}
+	service.StartRetention()
+	service.StartCompression()
+	service.StartAntiEntropy()
+
+	cluster, err := startMetadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cluster != nil {
+		service.WatchCluster(cluster, cluster.ID())
+
+		raftHandler := raft.NewHandler(cluster.Node())
+		metadataHandler := metadata.NewHandler(cluster)
+
+		http.HandleFunc("/v1/raft/vote", raftHandler.HandleVote)
+		http.HandleFunc("/v1/raft/append", raftHandler.HandleAppend)
+		http.HandleFunc("/v1/metadata", metadataHandler.HandleState)
+		http.HandleFunc("/v1/metadata/partitions", metadataHandler.HandlePartitions)
+		http.HandleFunc("/v1/metadata/raft", metadataHandler.HandleRaft)
+	}
+
+	handler := storage.NewHandler(service)
 
 	http.HandleFunc("/v1/storage", handler.HandleCreate)
+	http.HandleFunc("/v1/storage/batch", handler.HandleBatch)
 	http.HandleFunc("/v1/read", handler.HandleRead)
+	http.HandleFunc("/v1/retention", handler.HandleRetention)
+	http.HandleFunc("/v1/stats", handler.HandleStats)
+	http.HandleFunc("/v1/replicate", handler.HandleReplicate)
+	http.HandleFunc("/v1/fence", handler.HandleFence)
+	http.HandleFunc("/v1/partition", handler.HandlePartition)
+	http.HandleFunc("/v1/follow", handler.HandleFollow)
+	http.HandleFunc("/v1/replication", handler.HandleReplication)
+	http.HandleFunc("/v1/fetch", handler.HandleFetch)
+	http.HandleFunc("/v1/health", handler.HandleHealth)
+	http.HandleFunc("/v1/digest", handler.HandleDigest)
+	http.HandleFunc("/v1/repair", handler.HandleRepair)
+
+	if err := announce(service); err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{Addr: address()}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdownOnSignal(server, service, cluster)
+	}()
+
+	fmt.Println("Storage server listening on", port(), "fsync=", storage.Durability)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 
-	fmt.Println("Storage server listening on", port())
-	log.Fatal(http.ListenAndServe(address(), nil))
+	<-stopped
+}
+
+// shutdownOnSignal stops accepting requests on SIGINT/SIGTERM and closes the
+// open partitions once in-flight writes have been answered, then leaves the
+// metadata group.
+func shutdownOnSignal(server *http.Server, service *storage.Service, cluster *metadata.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("[STORAGE/SHUTDOWN]", "error=", err)
+	}
+	if err := service.Close(); err != nil {
+		fmt.Println("[STORAGE/SHUTDOWN]", "error=", err)
+	}
+	if cluster != nil {
+		cluster.Close()
+	}
+}
+
+// selfURL is the URL other nodes reach this node at, STORAGE_URL or
+// http://localhost:PORT.
+func selfURL() string {
+	if url := os.Getenv("STORAGE_URL"); url != "" {
+		return url
+	}
+
+	return "http://localhost:" + port()
 }
 
 func address() string {
@@ -34,3 +151,262 @@ func port() string {
 
 	return port
 }
+
+// configureDir keeps the partitions of this node in STORAGE_DIR, tmp/PORT by
+// default, so nodes sharing a machine never share partition directories.
+func configureDir() {
+	storage.BaseLogDir = os.Getenv("STORAGE_DIR")
+	if storage.BaseLogDir == "" {
+		storage.BaseLogDir = filepath.Join("tmp", port())
+	}
+}
+
+// configureDurability reads the fsync mode from STORAGE_FSYNC (request,
+// interval or none) and the group fsync interval from STORAGE_FSYNC_INTERVAL.
+func configureDurability() error {
+	if mode := os.Getenv("STORAGE_FSYNC"); mode != "" {
+		durability, err := storage.ParseDurabilityMode(mode)
+		if err != nil {
+			return err
+		}
+		storage.Durability = durability
+	}
+
+	if interval := os.Getenv("STORAGE_FSYNC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid STORAGE_FSYNC_INTERVAL %q", interval)
+		}
+		storage.SyncInterval = d
+	}
+
+	return nil
+}
+
+// configureMaxRequestBytes reads how large request bodies may be from
+// STORAGE_MAX_REQUEST_BYTES. "0" removes the limit.
+func configureMaxRequestBytes() error {
+	if maxBytes := os.Getenv("STORAGE_MAX_REQUEST_BYTES"); maxBytes != "" {
+		n, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid STORAGE_MAX_REQUEST_BYTES %q", maxBytes)
+		}
+		storage.MaxRequestBytes = n
+	}
+
+	return nil
+}
+
+// configureDedup reads how long batches stored with an idempotency key are
+// recognized from STORAGE_DEDUP_WINDOW, "0" disables deduplication, and how
+// many keys every partition remembers at most from STORAGE_DEDUP_MAX_KEYS.
+func configureDedup() error {
+	if window := os.Getenv("STORAGE_DEDUP_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid STORAGE_DEDUP_WINDOW %q", window)
+		}
+		storage.DedupWindow = d
+	}
+
+	if maxKeys := os.Getenv("STORAGE_DEDUP_MAX_KEYS"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid STORAGE_DEDUP_MAX_KEYS %q", maxKeys)
+		}
+		storage.DedupMaxKeys = n
+	}
+
+	return nil
+}
+
+// configureRetention reads the retention policy from STORAGE_RETENTION_MAX_AGE
+// and STORAGE_RETENTION_MAX_BYTES and how often it is enforced from
+// STORAGE_RETENTION_INTERVAL.
+func configureRetention() error {
+	if maxAge := os.Getenv("STORAGE_RETENTION_MAX_AGE"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid STORAGE_RETENTION_MAX_AGE %q", maxAge)
+		}
+		storage.RetentionMaxAge = d
+	}
+
+	if maxBytes := os.Getenv("STORAGE_RETENTION_MAX_BYTES"); maxBytes != "" {
+		n, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid STORAGE_RETENTION_MAX_BYTES %q", maxBytes)
+		}
+		storage.RetentionMaxBytes = n
+	}
+
+	if interval := os.Getenv("STORAGE_RETENTION_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid STORAGE_RETENTION_INTERVAL %q", interval)
+		}
+		storage.RetentionCheckInterval = d
+	}
+
+	return nil
+}
+
+// configureCompression reads whether sealed segments are compressed from
+// STORAGE_COMPRESS and how often they are looked for from
+// STORAGE_COMPRESS_INTERVAL.
+func configureCompression() error {
+	if compress := os.Getenv("STORAGE_COMPRESS"); compress != "" {
+		enabled, err := strconv.ParseBool(compress)
+		if err != nil {
+			return fmt.Errorf("invalid STORAGE_COMPRESS %q", compress)
+		}
+		storage.CompressSegments = enabled
+	}
+
+	if interval := os.Getenv("STORAGE_COMPRESS_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid STORAGE_COMPRESS_INTERVAL %q", interval)
+		}
+		storage.CompressionCheckInterval = d
+	}
+
+	return nil
+}
+
+// configureReplication reads the name this node gives the leaders it follows
+// from STORAGE_NODE_ID, localhost:PORT by default, how many replicas must be
+// in sync for acks=all writes from STORAGE_MIN_INSYNC_REPLICAS, how long a
+// follower stays in sync without catching up from STORAGE_REPLICA_LAG_TIMEOUT
+// and how long acks=all writes wait for followers from STORAGE_ACKS_TIMEOUT.
+func configureReplication() error {
+	storage.NodeID = "localhost:" + port()
+	if id := os.Getenv("STORAGE_NODE_ID"); id != "" {
+		storage.NodeID = id
+	}
+
+	if minInSync := os.Getenv("STORAGE_MIN_INSYNC_REPLICAS"); minInSync != "" {
+		n, err := strconv.Atoi(minInSync)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid STORAGE_MIN_INSYNC_REPLICAS %q", minInSync)
+		}
+		storage.MinInSyncReplicas = n
+	}
+
+	if timeout := os.Getenv("STORAGE_REPLICA_LAG_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid STORAGE_REPLICA_LAG_TIMEOUT %q", timeout)
+		}
+		storage.ReplicaLagTimeout = d
+	}
+
+	if timeout := os.Getenv("STORAGE_ACKS_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid STORAGE_ACKS_TIMEOUT %q", timeout)
+		}
+		storage.AcksTimeout = d
+	}
+
+	return nil
+}
+
+// configureAntiEntropy reads how often followed partitions are compared with
+// their leaders from STORAGE_ANTI_ENTROPY_INTERVAL ("0" disables it) and how
+// many offsets every compared range spans from STORAGE_DIGEST_RANGE.
+func configureAntiEntropy() error {
+	if interval := os.Getenv("STORAGE_ANTI_ENTROPY_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid STORAGE_ANTI_ENTROPY_INTERVAL %q", interval)
+		}
+		storage.AntiEntropyInterval = d
+	}
+
+	if offsets := os.Getenv("STORAGE_DIGEST_RANGE"); offsets != "" {
+		n, err := strconv.ParseUint(offsets, 10, 64)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid STORAGE_DIGEST_RANGE %q", offsets)
+		}
+		storage.DigestRangeOffsets = n
+	}
+
+	return nil
+}
+
+// startMetadata runs the cluster metadata server of this node when
+// STORAGE_RAFT_PEERS, a comma separated list of the URLs of the storage nodes
+// keeping the metadata, is set. The URL of this node is skipped in the list.
+// STORAGE_RAFT_DIR is where the raft log is kept, tmp/raft-PORT by default.
+// STORAGE_NODE_FAILURE_TIMEOUT is how long a node goes unheard before the
+// partitions it leads get new leaders.
+func startMetadata() (*metadata.Server, error) {
+	list := os.Getenv("STORAGE_RAFT_PEERS")
+	if list == "" {
+		return nil, nil
+	}
+
+	self := selfURL()
+
+	var peers []string
+	for _, peer := range strings.Split(list, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" && peer != self {
+			peers = append(peers, peer)
+		}
+	}
+
+	dir := os.Getenv("STORAGE_RAFT_DIR")
+	if dir == "" {
+		dir = filepath.Join("tmp", "raft-"+port())
+	}
+
+	if timeout := os.Getenv("STORAGE_NODE_FAILURE_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid STORAGE_NODE_FAILURE_TIMEOUT %q", timeout)
+		}
+		metadata.NodeFailureTimeout = d
+	}
+
+	cluster, err := metadata.NewServer(self, peers, dir, raft.NewHTTPTransport())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the metadata server: %w", err)
+	}
+	cluster.Start()
+
+	fmt.Println("[STORAGE/METADATA]", "node=", self, "peers=", peers, "dir=", dir)
+
+	return cluster, nil
+}
+
+// announce registers this node with the ingest nodes listed in
+// STORAGE_ANNOUNCE, a comma separated list of their URLs, and keeps sending
+// them heartbeats every STORAGE_ANNOUNCE_INTERVAL.
+func announce(service *storage.Service) error {
+	list := os.Getenv("STORAGE_ANNOUNCE")
+	if list == "" {
+		return nil
+	}
+
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+
+	if interval := os.Getenv("STORAGE_ANNOUNCE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid STORAGE_ANNOUNCE_INTERVAL %q", interval)
+		}
+		storage.AnnounceInterval = d
+	}
+
+	service.Announce(targets, selfURL())
+
+	fmt.Println("[STORAGE/MEMBERS]", "node=", selfURL(), "announced to", targets)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Codes of the errors, each answered with one status code.
+const (
+	CodeInvalidRequest   = "invalid_request"    // 400
+	CodeNotFound         = "not_found"          // 404
+	CodeMethodNotAllowed = "method_not_allowed" // 405
+	CodeConflict         = "conflict"           // 409
+	CodePayloadTooLarge  = "payload_too_large"  // 413
+	CodeTooManyRequests  = "too_many_requests"  // 429
+	CodeInternal         = "internal"           // 500
+	CodeUnavailable      = "unavailable"        // 503
+	CodeTimeout          = "timeout"            // 504
+)
+
+var codes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusTooManyRequests:       CodeTooManyRequests,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusGatewayTimeout:        CodeTimeout,
+}
+
+// CodeFor returns the code of the errors answered with status.
+func CodeFor(status int) string {
+	if code, ok := codes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+
+	return CodeInvalidRequest
+}
+
+// Error is an error a request can fail with, and the status code it is
+// answered with. Services declare their errors as *Error, so handlers answer
+// them, however they were wrapped, without knowing each of them.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+// New returns an error answered with status and its code.
+func New(status int, message string) *Error {
+	return &Error{Status: status, Code: CodeFor(status), Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Response is the body every failed request of the ingest and storage nodes
+// is answered with, for example
+// {"code": "not_found", "message": "partition 3: partition not found"}.
+type Response struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Write answers with status and a body of code and message.
+func Write(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Response{Code: code, Message: message})
+}
+
+// WriteError answers with the status and code of the first *Error err wraps
+// and the message of err. Any other error is a 500.
+func WriteError(w http.ResponseWriter, err error) {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		Write(w, apiErr.Status, apiErr.Code, err.Error())
+		return
+	}
+
+	Write(w, http.StatusInternalServerError, CodeInternal, err.Error())
+}
+
+// BadRequest answers a request that is invalid with 400.
+func BadRequest(w http.ResponseWriter, message string) {
+	Write(w, http.StatusBadRequest, CodeInvalidRequest, message)
+}
+
+// MethodNotAllowed answers a request with a method other than allowed with
+// 405.
+func MethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	Write(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+}
+
+// DecodeJSON decodes the body of r into v. Bodies over maxBytes, unless it is
+// zero, fail with a 413 error and bodies that are not valid JSON with a 400
+// error.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, maxBytes int64, v any) error {
+	body := r.Body
+	if maxBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+
+	err := json.NewDecoder(body).Decode(v)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return New(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit))
+	}
+	if err != nil {
+		return &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "invalid json: " + err.Error(), Err: err}
+	}
+
+	return nil
+}
+
+// Parse returns the code and message of the body of a failed request, or
+// the body itself as the message when it is not a Response.
+func Parse(body []byte) Response {
+	var response Response
+	if err := json.Unmarshal(body, &response); err != nil || response.Code == "" {
+		return Response{Message: strings.TrimSpace(string(body))}
+	}
+
+	return response
+}
@@ -0,0 +1,83 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteError_UsesStatusOfWrappedError(t *testing.T) {
+	errFull := New(http.StatusTooManyRequests, "queue is full")
+
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("partition 2: %w", errFull), http.StatusTooManyRequests, CodeTooManyRequests},
+		{errors.Join(errors.New("other"), errFull), http.StatusTooManyRequests, CodeTooManyRequests},
+		{errors.New("disk failed"), http.StatusInternalServerError, CodeInternal},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		WriteError(w, test.err)
+
+		var response Response
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != test.status || response.Code != test.code || response.Message != test.err.Error() {
+			t.Errorf("%v: expected %d %s, got %d %+v", test.err, test.status, test.code, w.Code, response)
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("expected a JSON body, got %q", w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"partition": 1}`, 0},
+		{`{"partition": `, http.StatusBadRequest},
+		{`{"partition": 1, "padding": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		var v struct{ Partition int }
+
+		err := DecodeJSON(httptest.NewRecorder(), r, 32, &v)
+
+		var apiErr *Error
+		switch {
+		case test.status == 0 && err != nil:
+			t.Errorf("%s: unexpected error %v", test.body, err)
+		case test.status != 0 && (!errors.As(err, &apiErr) || apiErr.Status != test.status):
+			t.Errorf("%s: expected status %d, got %v", test.body, test.status, err)
+		}
+	}
+}
+
+func TestMethodNotAllowed_ListsAllowedMethods(t *testing.T) {
+	w := httptest.NewRecorder()
+	MethodNotAllowed(w, http.MethodGet, http.MethodPost)
+
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("expected 405 allowing GET and POST, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestParse(t *testing.T) {
+	if got := Parse([]byte(`{"code":"not_found","message":"partition not found"}`)); got.Code != CodeNotFound || got.Message != "partition not found" {
+		t.Errorf("unexpected response %+v", got)
+	}
+	if got := Parse([]byte("storing logs failed\n")); got.Code != "" || got.Message != "storing logs failed" {
+		t.Errorf("expected a plain body to be the message, got %+v", got)
+	}
+}
@@ -0,0 +1,68 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// Acks is how many replicas of a partition must have a write before
+// /v1/logs acknowledges it.
+type Acks string
+
+const (
+	// AcksNone answers right away and forwards the logs in the background.
+	AcksNone Acks = "0"
+	// AcksLeader waits until the leader of the partition stored the logs.
+	AcksLeader Acks = "1"
+	// AcksAll waits until every in-sync replica of the partition has the
+	// logs, and never falls back to the WAL or the ingest queue.
+	AcksAll Acks = "all"
+)
+
+// DefaultAcks is used for writes that do not ask for acks.
+// This can be overridden for testing or configuration.
+var DefaultAcks = AcksLeader
+
+var (
+	// ErrNotEnoughReplicas is returned for writes with AcksAll when too few
+	// replicas of the partition are in sync. Nothing was stored.
+	ErrNotEnoughReplicas = apierror.New(http.StatusServiceUnavailable, "not enough in-sync replicas")
+	// ErrReplicationIncomplete is returned for writes with AcksAll that the
+	// leader stored but too few in-sync replicas acknowledged.
+	ErrReplicationIncomplete = apierror.New(http.StatusGatewayTimeout, "stored on the leader but not on enough in-sync replicas")
+)
+
+// ParseAcks parses the acks of a write, DefaultAcks when empty.
+func ParseAcks(value string) (Acks, error) {
+	switch Acks(value) {
+	case "":
+		return DefaultAcks, nil
+	case AcksNone, AcksLeader, AcksAll:
+		return Acks(value), nil
+	default:
+		return "", fmt.Errorf("invalid acks %q, expected 0, 1 or all", value)
+	}
+}
+
+// quorumError tells apart the failures of a write with AcksAll whose quorum
+// could not be met: storage nodes answer 503 when they stored nothing and
+// 504 when the leader stored the logs but its followers did not acknowledge
+// them.
+func quorumError(err error) error {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return err
+	}
+
+	switch statusErr.StatusCode {
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: %w", ErrNotEnoughReplicas, err)
+	case http.StatusGatewayTimeout:
+		return fmt.Errorf("%w: %w", ErrReplicationIncomplete, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,163 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// quorumStorage answers every partition of a batch with status and records
+// the acks of every request
+func quorumStorage(status int, acks *sync.Map, requests *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		acks.Store(r.URL.Query().Get("acks"), true)
+
+		var batch batchRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+
+		var response struct {
+			Results []map[string]any `json:"results"`
+		}
+		for _, partition := range batch.Partitions {
+			response.Results = append(response.Results, map[string]any{
+				"partition": partition.Partition,
+				"status":    status,
+				"error":     http.StatusText(status),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func TestParseAcks(t *testing.T) {
+	original := DefaultAcks
+	DefaultAcks = AcksAll
+	defer func() { DefaultAcks = original }()
+
+	tests := map[string]Acks{"": AcksAll, "0": AcksNone, "1": AcksLeader, "all": AcksAll}
+	for value, expected := range tests {
+		acks, err := ParseAcks(value)
+		if err != nil || acks != expected {
+			t.Errorf("ParseAcks(%q) = %q, %v; expected %q", value, acks, err, expected)
+		}
+	}
+
+	if _, err := ParseAcks("quorum"); err == nil {
+		t.Error("expected error for acks=quorum")
+	}
+}
+
+func TestSubmit_AcksAllIsNeverQueued(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	setupWAL(t)
+	setupQueue(t, 10, 1, 0)
+
+	var acks sync.Map
+	var requests atomic.Int32
+	_, cleanup := setupMockStorage(quorumStorage(http.StatusServiceUnavailable, &acks, &requests))
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	_, err := service.Submit(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "all"}}, "10.0.0.1", AcksAll)
+	if !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("expected ErrNotEnoughReplicas, got %v", err)
+	}
+
+	if _, ok := acks.Load("all"); !ok {
+		t.Errorf("expected the storage node to be asked for acks=all")
+	}
+	if stats := service.QueueStats(); stats.Enqueued != 0 {
+		t.Errorf("expected nothing queued, got %+v", stats)
+	}
+	if partitions := service.wal.partitions(); len(partitions) != 0 {
+		t.Errorf("expected nothing written to the WAL, got partitions %v", partitions)
+	}
+}
+
+func TestSubmit_AcksNoneForwardsInBackground(t *testing.T) {
+	var acks sync.Map
+	var requests atomic.Int32
+	release := make(chan struct{})
+	store := mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
+		return AppendResult{}
+	})
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		requests.Add(1)
+		acks.Store(r.URL.Query().Get("acks"), true)
+		store(w, r)
+	})
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+
+	results, err := service.Submit(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "fire and forget"}}, "10.0.0.1", AcksNone)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || !results[0].Queued {
+		t.Errorf("expected the partition to be reported as queued, got %+v", results)
+	}
+
+	// Close waits for the write still being forwarded
+	close(release)
+	service.Close()
+
+	if requests.Load() != 1 {
+		t.Fatalf("expected 1 request to storage, got %d", requests.Load())
+	}
+	if _, ok := acks.Load("0"); !ok {
+		t.Errorf("expected the storage node to be asked for acks=0")
+	}
+}
+
+func TestHandleCreate_Acks(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	var acks sync.Map
+	var requests atomic.Int32
+	_, cleanup := setupMockStorage(quorumStorage(http.StatusGatewayTimeout, &acks, &requests))
+	defer cleanup()
+
+	handler := setupHandler()
+	body, _ := json.Marshal([]IncomingLogBody{{Service: "test-service", Message: "all"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs?acks=2", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for acks=2, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/logs?acks=all", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", w.Code)
+	}
+
+	// The leader stored the logs, sending them again would duplicate them
+	time.Sleep(10 * time.Millisecond)
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request to storage, got %d", requests.Load())
+	}
+}
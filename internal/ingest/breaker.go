@@ -0,0 +1,198 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// BreakerFailureThreshold is how many consecutive failed requests to a
+// storage node open its circuit breaker.
+// This can be overridden for testing or configuration.
+var BreakerFailureThreshold = 5
+
+// BreakerOpenTimeout is how long an open breaker fails requests fast before
+// it lets a single probe through.
+// This can be overridden for testing or configuration.
+var BreakerOpenTimeout = 10 * time.Second
+
+// ErrBreakerOpen is returned without contacting the storage node while its
+// circuit breaker is open.
+var ErrBreakerOpen = apierror.New(http.StatusServiceUnavailable, "circuit breaker is open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerStatus is the state of the circuit breaker of a storage node.
+type BreakerStatus struct {
+	Node                string       `json:"node"`
+	Partitions          []int        `json:"partitions"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
+// breaker tracks the consecutive failures of a storage node. While open,
+// requests fail fast; after BreakerOpenTimeout a single probe is let through
+// and its outcome closes or reopens the breaker.
+type breaker struct {
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a request may be sent to the node.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < BreakerOpenTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+
+	return true
+}
+
+// record updates the breaker with the outcome of a request let through by
+// allow. Requests cancelled by the caller say nothing about the node.
+func (b *breaker) record(err error, cancelled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if cancelled {
+		return
+	}
+
+	if !nodeFailure(err) {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= BreakerFailureThreshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+
+	return status
+}
+
+// nodeFailure reports whether err means the storage node is unhealthy: it
+// could not be reached or failed with a 500 or 502. A node that answers 503
+// or 504 is up, only a partition on it is fenced or short of replicas, and
+// other partitions on it must still be written.
+func nodeFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusInternalServerError || statusErr.StatusCode == http.StatusBadGateway
+	}
+
+	return true
+}
+
+// breakers holds the circuit breaker of every storage node by URL.
+type breakers struct {
+	mu    sync.Mutex
+	nodes map[string]*breaker
+}
+
+func (b *breakers) get(url string) *breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.nodes == nil {
+		b.nodes = make(map[string]*breaker)
+	}
+
+	node, ok := b.nodes[url]
+	if !ok {
+		node = &breaker{state: BreakerClosed}
+		b.nodes[url] = node
+	}
+
+	return node
+}
+
+// guard runs attempt unless the breaker of url is open and records its
+// outcome.
+func (b *breakers) guard(ctx context.Context, url string, attempt func() error) error {
+	node := b.get(url)
+	if !node.allow() {
+		return fmt.Errorf("%s: %w", url, ErrBreakerOpen)
+	}
+
+	err := attempt()
+	node.record(err, ctx.Err() == context.Canceled)
+
+	return err
+}
+
+// Breakers returns the circuit breaker state of every storage node in
+// Routing, along with the partitions it is the primary of.
+func (node *StorageClient) Breakers() []BreakerStatus {
+	partitions := make(map[string][]int)
+	for _, url := range Routing.Nodes() {
+		partitions[url] = []int{}
+	}
+	for _, assignment := range Routing.Assignments() {
+		if len(assignment.Nodes) > 0 {
+			primary := assignment.Nodes[0]
+			partitions[primary] = append(partitions[primary], assignment.Partition)
+		}
+	}
+
+	statuses := []BreakerStatus{}
+	for url, nodePartitions := range partitions {
+		status := node.breakers.get(url).status()
+		status.Node = url
+		status.Partitions = nodePartitions
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Node < statuses[j].Node
+	})
+
+	return statuses
+}
@@ -0,0 +1,152 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupBreakers overrides the circuit breaker settings for a single test
+func setupBreakers(t *testing.T, threshold int, openTimeout time.Duration) {
+	originalThreshold, originalTimeout := BreakerFailureThreshold, BreakerOpenTimeout
+	BreakerFailureThreshold, BreakerOpenTimeout = threshold, openTimeout
+
+	t.Cleanup(func() {
+		BreakerFailureThreshold, BreakerOpenTimeout = originalThreshold, originalTimeout
+	})
+}
+
+func singleAttemptPolicy() RetryPolicy {
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 1
+	return policy
+}
+
+func TestBreaker_OpensAfterConsecutiveFailures(t *testing.T) {
+	setupRetryPolicy(t, singleAttemptPolicy())
+	setupBreakers(t, 3, time.Hour)
+
+	var requests atomic.Int32
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer cleanup()
+
+	client := NewStorageClient()
+	for i := 0; i < 5; i++ {
+		_, err := client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader)
+		if i >= 3 && !errors.Is(err, ErrBreakerOpen) {
+			t.Errorf("request %d: expected ErrBreakerOpen, got %v", i, err)
+		}
+	}
+
+	if requests.Load() != 3 {
+		t.Errorf("expected requests to fail fast once the breaker opened, storage saw %d", requests.Load())
+	}
+
+	// Partitions on the same node share the breaker
+	if _, err := client.Read(context.Background(), 1, ReadRequest{Limit: 1}); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("expected ErrBreakerOpen for another partition of the node, got %v", err)
+	}
+}
+
+func TestBreaker_HalfOpenProbe(t *testing.T) {
+	setupRetryPolicy(t, singleAttemptPolicy())
+	setupBreakers(t, 1, 20*time.Millisecond)
+
+	var healthy atomic.Bool
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(AppendResult{})
+	})
+	defer cleanup()
+
+	client := NewStorageClient()
+	client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader)
+
+	if state := client.breakers.get(client.URL(0)).status().State; state != BreakerOpen {
+		t.Fatalf("expected the breaker to be open, got %s", state)
+	}
+
+	// A failed probe opens the breaker again
+	time.Sleep(30 * time.Millisecond)
+	if _, err := client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); errors.Is(err, ErrBreakerOpen) {
+		t.Fatal("expected a probe to be let through after the open timeout")
+	}
+	if _, err := client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("expected the breaker to reopen after a failed probe, got %v", err)
+	}
+
+	// A successful probe closes it
+	healthy.Store(true)
+	time.Sleep(30 * time.Millisecond)
+	if _, err := client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state := client.breakers.get(client.URL(0)).status().State; state != BreakerClosed {
+		t.Errorf("expected the breaker to close, got %s", state)
+	}
+}
+
+func TestBreaker_ClientErrorsDoNotOpen(t *testing.T) {
+	setupRetryPolicy(t, singleAttemptPolicy())
+	setupBreakers(t, 1, time.Hour)
+
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	defer cleanup()
+
+	client := NewStorageClient()
+	client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader)
+
+	if _, err := client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); errors.Is(err, ErrBreakerOpen) {
+		t.Error("expected a node answering 400 to keep its breaker closed")
+	}
+}
+
+func TestBreaker_PartitionErrorsDoNotOpen(t *testing.T) {
+	setupRetryPolicy(t, singleAttemptPolicy())
+	setupBreakers(t, 1, time.Hour)
+
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	})
+	defer cleanup()
+
+	// A fenced partition or one short of in-sync replicas
+	client := NewStorageClient()
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		status.Store(int32(code))
+		client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader)
+
+		if _, err := client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); errors.Is(err, ErrBreakerOpen) {
+			t.Errorf("expected a node answering %d to keep its breaker closed", code)
+		}
+	}
+}
+
+func TestBreakers_ListsEveryNode(t *testing.T) {
+	client := NewStorageClient()
+
+	statuses := client.Breakers()
+	if len(statuses) != 2 {
+		t.Fatalf("expected a breaker per storage node, got %+v", statuses)
+	}
+
+	for _, status := range statuses {
+		if status.State != BreakerClosed || len(status.Partitions) != 2 {
+			t.Errorf("unexpected status %+v", status)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DedupWindow is how long the outcome of a batch sent with an idempotency
+// key is remembered, so a retry of it is answered without storing it twice.
+// Zero disables deduplication.
+// This can be overridden for testing or configuration.
+var DedupWindow = 5 * time.Minute
+
+// DedupMaxKeys caps how many idempotency keys are remembered. The oldest are
+// forgotten first.
+// This can be overridden for testing or configuration.
+var DedupMaxKeys = 100000
+
+// dedupKeyContext is the context key of the idempotency key a batch is
+// forwarded with.
+type dedupKeyContext struct{}
+
+// withDedupKey returns a copy of ctx that forwards batches with key.
+func withDedupKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, dedupKeyContext{}, key)
+}
+
+// dedupKey returns the idempotency key batches are forwarded with in ctx.
+func dedupKey(ctx context.Context) string {
+	key, _ := ctx.Value(dedupKeyContext{}).(string)
+	return key
+}
+
+// dedupEntry is the outcome of the batch sent with an idempotency key.
+type dedupEntry struct {
+	key     string
+	at      time.Time
+	done    chan struct{}  // closed once the attempt in flight finished
+	results []AppendResult // partitions stored or queued so far
+	failed  bool           // the last attempt left partitions unstored
+}
+
+// dedupCache remembers the batches sent with an idempotency key within
+// DedupWindow.
+type dedupCache struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	order   []*dedupEntry // oldest first
+}
+
+// claim returns the entry of key. The caller owns it, and has to finish it,
+// when the key is new or its last attempt failed; otherwise it waits on the
+// returned channel for the attempt in flight.
+func (c *dedupCache) claim(key string, now time.Time) (*dedupEntry, <-chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prune(now)
+
+	if c.entries == nil {
+		c.entries = make(map[string]*dedupEntry)
+	}
+
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &dedupEntry{key: key, at: now, done: make(chan struct{})}
+		c.entries[key] = entry
+		c.order = append(c.order, entry)
+		return entry, entry.done, true
+	}
+
+	select {
+	case <-entry.done:
+		if entry.failed {
+			entry.done = make(chan struct{})
+			entry.failed = false
+			return entry, entry.done, true
+		}
+	default:
+	}
+
+	return entry, entry.done, false
+}
+
+// finish records the outcome of the attempt of the owner of entry.
+func (c *dedupCache) finish(entry *dedupEntry, results []AppendResult, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.results = append(entry.results, results...)
+	entry.failed = err != nil
+	close(entry.done)
+}
+
+// outcome returns the partitions stored so far for entry and whether its
+// last attempt failed.
+func (c *dedupCache) outcome(entry *dedupEntry) ([]AppendResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]AppendResult(nil), entry.results...), entry.failed
+}
+
+// prune forgets keys older than DedupWindow and the oldest keys beyond
+// DedupMaxKeys.
+func (c *dedupCache) prune(now time.Time) {
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if now.Sub(oldest.at) <= DedupWindow && len(c.order) <= DedupMaxKeys {
+			break
+		}
+
+		c.order = c.order[1:]
+		if c.entries[oldest.key] == oldest {
+			delete(c.entries, oldest.key)
+		}
+	}
+}
+
+// SubmitOnce submits logs like Submit, at most once per key within
+// DedupWindow. A retry of a batch that was stored is answered with the
+// original results and reported as a duplicate; a retry that arrives while
+// the batch is in flight waits for it. When an attempt failed for some
+// partitions, the retry only submits the partitions that were not stored.
+// The key is forwarded with the batch, and kept with it in the WAL, so the
+// storage nodes also recognize retries that reach another ingest node or
+// arrive after a restart.
+func (s *Service) SubmitOnce(ctx context.Context, key string, logs []IncomingLogBody, clientIP string, acks Acks) ([]AppendResult, bool, error) {
+	if DedupWindow <= 0 || key == "" {
+		results, err := s.Submit(ctx, logs, clientIP, acks)
+		return results, false, err
+	}
+
+	for {
+		entry, done, owner := s.dedup.claim(key, time.Now())
+		if !owner {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+
+			results, failed := s.dedup.outcome(entry)
+			if !failed {
+				return results, true, nil
+			}
+
+			// The attempt in flight failed, this one takes over.
+			continue
+		}
+
+		stored, _ := s.dedup.outcome(entry)
+
+		partitionedLogs := partitionLogs(logs, clientIP)
+		for _, result := range stored {
+			delete(partitionedLogs, result.Partition)
+		}
+
+		var results []AppendResult
+		var err error
+		if len(partitionedLogs) > 0 {
+			results, err = s.submit(withDedupKey(ctx, key), partitionedLogs, acks)
+		}
+		s.dedup.finish(entry, results, err)
+
+		// Every partition was stored by an earlier attempt, seen by the
+		// storage nodes only.
+		duplicate := err == nil && len(results) > 0
+		for _, result := range results {
+			duplicate = duplicate && result.Duplicate
+		}
+
+		results = append(stored, results...)
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Partition < results[j].Partition
+		})
+
+		return results, duplicate, err
+	}
+}
@@ -0,0 +1,213 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubmitOnce_RetryIsNotStoredTwice(t *testing.T) {
+	var mu sync.Mutex
+	stored := 0
+	_, cleanup := setupMockStorage(mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
+		mu.Lock()
+		defer mu.Unlock()
+		stored += len(logs)
+		return AppendResult{BaseOffset: 7, LastOffset: 7}
+	}))
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	logs := []IncomingLogBody{{Service: "test-service", Message: "once"}}
+
+	first, duplicate, err := service.SubmitOnce(context.Background(), "producer/a/1", logs, "10.0.0.1", AcksLeader)
+	if err != nil || duplicate {
+		t.Fatalf("unexpected first attempt: %v %v", duplicate, err)
+	}
+
+	retry, duplicate, err := service.SubmitOnce(context.Background(), "producer/a/1", logs, "10.0.0.1", AcksLeader)
+	if err != nil || !duplicate {
+		t.Fatalf("expected the retry to be reported as a duplicate, got %v %v", duplicate, err)
+	}
+	if !slices.Equal(first, retry) {
+		t.Errorf("expected the retry to get the original results %+v, got %+v", first, retry)
+	}
+
+	if _, _, err := service.SubmitOnce(context.Background(), "producer/a/2", logs, "10.0.0.1", AcksLeader); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored != 2 {
+		t.Errorf("expected 2 logs stored, got %d", stored)
+	}
+}
+
+func TestSubmitOnce_RetryOnlyResendsFailedPartitions(t *testing.T) {
+	first, firstServer := newMemStorage(t)
+	second, secondServer := newMemStorage(t)
+	setupRouting(t, 8, firstServer.URL, secondServer.URL)
+
+	// One service whose partition the first node leads, one for the second
+	var logs []IncomingLogBody
+	var partitions []int
+	for _, node := range []string{firstServer.URL, secondServer.URL} {
+		for i := 0; ; i++ {
+			name := fmt.Sprintf("service-%d", i)
+			if Routing.Primary(partitionForKey(name)) == node {
+				logs = append(logs, IncomingLogBody{Service: name, Message: "partial"})
+				partitions = append(partitions, partitionForKey(name))
+				break
+			}
+		}
+	}
+
+	service := NewService(NewStorageClient())
+
+	second.fail = func(r *http.Request) bool { return true }
+	results, _, err := service.SubmitOnce(context.Background(), "key/partial", logs, "10.0.0.1", AcksLeader)
+	if err == nil || len(results) != 1 || results[0].Partition != partitions[0] {
+		t.Fatalf("expected only the first partition to be stored, got %+v %v", results, err)
+	}
+
+	second.fail = nil
+	results, duplicate, err := service.SubmitOnce(context.Background(), "key/partial", logs, "10.0.0.1", AcksLeader)
+	if err != nil || duplicate || len(results) != 2 {
+		t.Fatalf("expected the retry to store the second partition, got %+v %v %v", results, duplicate, err)
+	}
+
+	if got := len(first.logs(partitions[0])); got != 1 {
+		t.Errorf("expected the first partition to be stored once, got %d logs", got)
+	}
+	if got := len(second.logs(partitions[1])); got != 1 {
+		t.Errorf("expected the second partition to be stored once, got %d logs", got)
+	}
+}
+
+func TestDedupCache_ForgetsKeysAfterWindow(t *testing.T) {
+	original := DedupWindow
+	DedupWindow = time.Minute
+	t.Cleanup(func() { DedupWindow = original })
+
+	var cache dedupCache
+	now := time.Now()
+
+	entry, _, owner := cache.claim("key/a", now)
+	if !owner {
+		t.Fatal("expected the first attempt to own the key")
+	}
+	cache.finish(entry, []AppendResult{{Partition: 0}}, nil)
+
+	if _, _, owner := cache.claim("key/a", now.Add(30*time.Second)); owner {
+		t.Error("expected a retry within the window to be a duplicate")
+	}
+	if _, _, owner := cache.claim("key/a", now.Add(2*time.Minute)); !owner {
+		t.Error("expected the key to be forgotten after the window")
+	}
+}
+
+func TestHandleCreate_ReplaysIdempotentBatch(t *testing.T) {
+	var mu sync.Mutex
+	stored := 0
+	_, cleanup := setupMockStorage(mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
+		mu.Lock()
+		defer mu.Unlock()
+		stored += len(logs)
+		return AppendResult{LastOffset: uint64(len(logs) - 1)}
+	}))
+	defer cleanup()
+
+	handler := setupHandler()
+	body, _ := json.Marshal([]IncomingLogBody{{Service: "test-service", Message: "retried"}})
+
+	for attempt := 0; attempt < 2; attempt++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+		req.Header.Set("X-Producer-ID", "loadgen")
+		req.Header.Set("X-Producer-Sequence", "1")
+		w := httptest.NewRecorder()
+
+		handler.HandleCreate(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != (attempt == 1) {
+			t.Errorf("attempt %d: unexpected Idempotent-Replayed %q", attempt, w.Header().Get("Idempotent-Replayed"))
+		}
+	}
+
+	if stored != 1 {
+		t.Errorf("expected the batch to be stored once, got %d logs", stored)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+	req.Header.Set("X-Producer-ID", "loadgen")
+	req.Header.Set("X-Producer-Sequence", "first")
+	w := httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid sequence, got %d", w.Code)
+	}
+}
+
+func TestSubmitOnce_ForwardsKeySoAnotherIngestNodeRecognizesRetry(t *testing.T) {
+	var mu sync.Mutex
+	keys := make(map[string]AppendResult)
+	stored := 0
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		var batch batchRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var response struct {
+			Results []map[string]any `json:"results"`
+		}
+		for _, partition := range batch.Partitions {
+			result, duplicate := keys[partition.Key]
+			if !duplicate {
+				result = AppendResult{BaseOffset: uint64(stored), LastOffset: uint64(stored + len(partition.Logs) - 1)}
+				stored += len(partition.Logs)
+				keys[partition.Key] = result
+			}
+			response.Results = append(response.Results, map[string]any{
+				"partition":   partition.Partition,
+				"base_offset": result.BaseOffset,
+				"last_offset": result.LastOffset,
+				"duplicate":   duplicate,
+				"status":      http.StatusOK,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	defer cleanup()
+
+	logs := []IncomingLogBody{{Service: "test-service", Message: "once"}}
+
+	first, duplicate, err := NewService(NewStorageClient()).SubmitOnce(context.Background(), "key/shared", logs, "10.0.0.1", AcksLeader)
+	if err != nil || duplicate {
+		t.Fatalf("unexpected first attempt: %v %v", duplicate, err)
+	}
+
+	// The retry reaches an ingest node that never saw the key.
+	retry, duplicate, err := NewService(NewStorageClient()).SubmitOnce(context.Background(), "key/shared", logs, "10.0.0.1", AcksLeader)
+	if err != nil || !duplicate {
+		t.Fatalf("expected the retry to be reported as a duplicate, got %v %v", duplicate, err)
+	}
+	if len(retry) != 1 || retry[0].BaseOffset != first[0].BaseOffset || retry[0].LastOffset != first[0].LastOffset {
+		t.Errorf("expected the retry to get the original offsets %+v, got %+v", first, retry)
+	}
+	if stored != 1 {
+		t.Errorf("expected the batch to be stored once, got %d logs", stored)
+	}
+}
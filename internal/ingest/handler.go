@@ -1,15 +1,19 @@
 package ingest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/fnv"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
-)
 
-const partitionCount = 4
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
 
 type IncomingLogBody struct {
 	Timestamp uint64            `json:"timestamp"`
@@ -20,16 +24,43 @@ type IncomingLogBody struct {
 }
 
 type LogEntry struct {
+	Offset uint64 `json:"offset"`
 	IncomingLogBody
 	ReceivedAt     int64  `json:"received_at"`
 	IngestedNodeId string `json:"ingested_node_id"`
 	ClientIP       string `json:"client_ip"`
 }
 
+// Statuses of the partitions of a batch sent to /v1/logs. A rejected
+// partition fails again when it is resent as it is, a retriable one may be
+// stored by a later attempt.
+const (
+	PartitionAccepted  = "accepted"
+	PartitionRejected  = "rejected"
+	PartitionRetriable = "retriable"
+)
+
+// PartitionStatus is the outcome of the entries of a batch that belong to one
+// partition. Entries are their indexes in the request, so a client can resend
+// only the entries of the partitions that failed.
+type PartitionStatus struct {
+	AppendResult
+	Status  string `json:"status"`
+	Entries []int  `json:"entries"`
+	Error   string `json:"error,omitempty"`
+}
+
 type IngestResponse struct {
-	Received int `json:"received"`
+	Received   int               `json:"received"`
+	Accepted   int               `json:"accepted"`
+	Partitions []PartitionStatus `json:"partitions"`
 }
 
+// MaxRequestBytes caps the body of every request an ingest node decodes.
+// Larger requests are answered with 413. Zero removes the limit.
+// This can be overridden for testing or configuration.
+var MaxRequestBytes int64 = 10 * 1024 * 1024
+
 type Handler struct {
 	service *Service
 }
@@ -40,70 +71,386 @@ func NewHandler(service *Service) *Handler {
 
 func (h *Handler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		apierror.MethodNotAllowed(w, http.MethodPost)
 		return
 	}
 
 	var incomingLogs []IncomingLogBody
 
-	if err := json.NewDecoder(r.Body).Decode(&incomingLogs); err != nil {
-		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &incomingLogs); err != nil {
+		apierror.WriteError(w, err)
 		return
 	}
 
 	if len(incomingLogs) == 0 {
-		http.Error(w, "empty body", http.StatusBadRequest)
+		apierror.BadRequest(w, "empty body")
+		return
+	}
+
+	acks, err := ParseAcks(r.URL.Query().Get("acks"))
+	if err != nil {
+		apierror.BadRequest(w, err.Error())
+		return
+	}
+
+	key, err := idempotencyKey(r)
+	if err != nil {
+		apierror.BadRequest(w, err.Error())
 		return
 	}
 
 	clientIP := clientIPFromRequest(r)
 
-	err := h.service.Ingest(incomingLogs, clientIP)
+	// Entries are partitioned by service, the same way the service does it.
+	entries := make(map[int][]int)
+	for i, incomingLog := range incomingLogs {
+		partition := partitionForKey(incomingLog.Service)
+		entries[partition] = append(entries[partition], i)
+	}
+
+	results, duplicate, err := h.service.SubmitOnce(r.Context(), key, incomingLogs, clientIP, acks)
+
+	// Some partitions were stored, so the request answers 207 with the
+	// status of each partition instead of failing as a whole.
+	failures := partitionErrors(err)
+	if len(results) > 0 && len(failures) > 0 {
+		err = nil
+	}
+
+	if errors.Is(err, ErrQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(QueueRetryAfter.Seconds()))))
+	}
 	if err != nil {
-		http.Error(w, "error at ingest node: "+err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
+	response := IngestResponse{Received: len(incomingLogs), Partitions: []PartitionStatus{}}
+	for _, result := range results {
+		response.Accepted += len(entries[result.Partition])
+		response.Partitions = append(response.Partitions, PartitionStatus{
+			AppendResult: result,
+			Status:       PartitionAccepted,
+			Entries:      entries[result.Partition],
+		})
+	}
+	for partition, err := range failures {
+		response.Partitions = append(response.Partitions, PartitionStatus{
+			AppendResult: AppendResult{Partition: partition},
+			Status:       failureStatus(err),
+			Entries:      entries[partition],
+			Error:        err.Error(),
+		})
+	}
+	sort.Slice(response.Partitions, func(i, j int) bool {
+		return response.Partitions[i].Partition < response.Partitions[j].Partition
+	})
+
+	// Batches written to the WAL or the ingest queue are not stored yet.
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Queued {
+			status = http.StatusAccepted
+		}
+	}
+	if len(failures) > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	if duplicate {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(IngestResponse{Received: len(incomingLogs)})
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// failureStatus tells whether the batch of a partition that failed with err
+// may be stored when it is resent. Storage nodes answering with a 4xx other
+// than 429 rejected the batch itself.
+func failureStatus(err error) string {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 && statusErr.StatusCode != http.StatusTooManyRequests {
+		return PartitionRejected
+	}
+
+	return PartitionRetriable
+}
+
+// idempotencyKey identifies a batch by its Idempotency-Key header, or by the
+// X-Producer-ID and X-Producer-Sequence headers of the producer that sent
+// it. Batches without either are not deduplicated.
+func idempotencyKey(r *http.Request) (string, error) {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return "key/" + key, nil
+	}
+
+	producer, sequence := r.Header.Get("X-Producer-ID"), r.Header.Get("X-Producer-Sequence")
+	if producer == "" && sequence == "" {
+		return "", nil
+	}
+	if producer == "" {
+		return "", errors.New("X-Producer-Sequence requires X-Producer-ID")
+	}
+	if _, err := strconv.ParseUint(sequence, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid X-Producer-Sequence %q", sequence)
+	}
+
+	return "producer/" + producer + "/" + sequence, nil
 }
 
+// HandleQuery returns a page of the partition holding service. from_offset
+// and max_bytes are passed through to the storage node, and next_offset in
+// the response can be sent back as from_offset to resume reading.
 func (h *Handler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		apierror.MethodNotAllowed(w, http.MethodGet)
 		return
 	}
 
 	service := r.URL.Query().Get("service")
 	limitQuery := r.URL.Query().Get("limit")
+	fromOffsetQuery := r.URL.Query().Get("from_offset")
+	maxBytesQuery := r.URL.Query().Get("max_bytes")
 
-	fmt.Printf("[INGEST/QUERY] service=%s limit=%s\n", service, limitQuery)
+	fmt.Printf("[INGEST/QUERY] service=%s limit=%s from_offset=%s\n", service, limitQuery, fromOffsetQuery)
 
 	limit, err := strconv.Atoi(limitQuery)
 	if err != nil || limit < 0 {
-		http.Error(w, "invalid limit query param value", http.StatusBadRequest)
+		apierror.BadRequest(w, "invalid limit query param value")
 		return
 	}
 
-	logs, err := h.service.Query(service, limit)
+	req := ReadRequest{Limit: limit}
+
+	if fromOffsetQuery != "" {
+		fromOffset, err := strconv.ParseUint(fromOffsetQuery, 10, 64)
+		if err != nil {
+			apierror.BadRequest(w, "invalid from_offset query param value")
+			return
+		}
+		req.FromOffset = &fromOffset
+	}
+
+	if maxBytesQuery != "" {
+		req.MaxBytes, err = strconv.ParseInt(maxBytesQuery, 10, 64)
+		if err != nil || req.MaxBytes < 0 {
+			apierror.BadRequest(w, "invalid max_bytes query param value")
+			return
+		}
+	}
+
+	result, err := h.service.Query(r.Context(), service, req)
 	if err != nil {
-		http.Error(w, "Error reading from storage node", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(logs); err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeError answers a request that failed with err. Errors of the ingest
+// node answer with their own status. Requests a storage node rejected are
+// answered as it answered them, and storage nodes that cannot be reached or
+// fail are 503.
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *apierror.Error
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &apiErr):
+		apierror.WriteError(w, err)
+	case errors.As(err, &statusErr) && statusErr.StatusCode < 500:
+		code := statusErr.Code
+		if code == "" {
+			code = apierror.CodeFor(statusErr.StatusCode)
+		}
+		apierror.Write(w, statusErr.StatusCode, code, err.Error())
+	case retryable(err, true) || errors.Is(err, context.DeadlineExceeded):
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, err.Error())
+	default:
+		apierror.WriteError(w, err)
+	}
+}
+
+// HandleBreakers reports the circuit breaker state of every storage node.
+func (h *Handler) HandleBreakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.service.Breakers())
 }
 
-func partitionForKey(key string) int {
-	h := fnv.New32a()
-	h.Write([]byte(key))
+// HandleQueue reports the depth and counters of the ingest queue.
+func (h *Handler) HandleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.service.QueueStats())
+}
+
+// HandleHints reports the batches waiting in the WAL for their storage nodes.
+func (h *Handler) HandleHints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.service.Hints())
+}
+
+func (h *Handler) HandleRouting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
 
-	return int(h.Sum32() % partitionCount)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Routing.Status())
+}
+
+// MoveRequest asks for a partition to be moved to another storage node.
+type MoveRequest struct {
+	Partition int    `json:"partition"`
+	Target    string `json:"target"`
+}
+
+// FailoverRequest asks for a follower of a partition to be promoted to its
+// leader. Without Follower the most caught-up follower is promoted.
+type FailoverRequest struct {
+	Partition int    `json:"partition"`
+	Follower  string `json:"follower,omitempty"`
+}
+
+// RegisterRequest is the heartbeat of a storage node announcing itself.
+type RegisterRequest struct {
+	URL string `json:"url"`
+}
+
+// HandleMoves starts moving a partition to another storage node with POST
+// and reports the latest move of every partition with GET.
+func (h *Handler) HandleMoves(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(h.service.Moves())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		apierror.MethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	var req MoveRequest
+
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &req); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	target, err := url.Parse(req.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		apierror.BadRequest(w, "invalid target storage node URL")
+		return
+	}
+
+	status, err := h.service.StartMove(req.Partition, req.Target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleReplication reports the leader of every partition and how far behind
+// it each of its followers is.
+func (h *Handler) HandleReplication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.service.Replication(r.Context()))
+}
+
+// HandleFailover promotes a follower of a partition to its leader.
+func (h *Handler) HandleFailover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.MethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req FailoverRequest
+
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &req); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	result, err := h.service.Failover(r.Context(), req.Partition, req.Follower)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleMembers registers the heartbeat of a storage node with POST and
+// reports every known storage node and its health with GET.
+func (h *Handler) HandleMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(h.service.Members())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		apierror.MethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	var req RegisterRequest
+
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &req); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	node, err := url.Parse(req.URL)
+	if err != nil || (node.Scheme != "http" && node.Scheme != "https") || node.Host == "" {
+		apierror.BadRequest(w, "invalid storage node URL")
+		return
+	}
+
+	h.service.Register(req.URL)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func partitionForKey(key string) int {
+	return Routing.PartitionForKey(key)
 }
 
 func clientIPFromRequest(r *http.Request) string {
@@ -3,10 +3,17 @@ package ingest
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
 )
 
 // setupHandler creates the handler with all dependencies for testing
@@ -16,39 +23,56 @@ func setupHandler() *Handler {
 	return NewHandler(service)
 }
 
-// setupMockStorage creates a mock storage server and overrides StorageNodeURLs
-// Returns a cleanup function that should be deferred
+// setupMockStorage creates a mock storage server and routes every partition
+// to it. Returns a cleanup function that should be deferred
 func setupMockStorage(handler http.HandlerFunc) (*httptest.Server, func()) {
 	mockStorage := httptest.NewServer(handler)
 
-	originalURLs := make(map[int]string)
-	for k, v := range StorageNodeURLs {
-		originalURLs[k] = v
-		StorageNodeURLs[k] = mockStorage.URL
-	}
+	originalRouting := Routing
+	Routing = NewRoutingTable(originalRouting.Partitions(), 1, mockStorage.URL)
 
 	cleanup := func() {
 		mockStorage.Close()
-		for k, v := range originalURLs {
-			StorageNodeURLs[k] = v
-		}
+		Routing = originalRouting
 	}
 
 	return mockStorage, cleanup
 }
 
+// mockBatchStorage answers /v1/storage/batch requests, storing every
+// partition of a batch with store
+func mockBatchStorage(store func(partition int, logs []LogEntry) AppendResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var batch batchRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+
+		var response struct {
+			Results []map[string]any `json:"results"`
+		}
+		for _, partition := range batch.Partitions {
+			result := store(partition.Partition, partition.Logs)
+			response.Results = append(response.Results, map[string]any{
+				"partition":   partition.Partition,
+				"base_offset": result.BaseOffset,
+				"last_offset": result.LastOffset,
+				"status":      http.StatusOK,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
 func TestHandleCreate(t *testing.T) {
 	var receivedLogs []LogEntry
 	var mu sync.Mutex
-	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
-		var logs []LogEntry
-		json.NewDecoder(r.Body).Decode(&logs)
+	_, cleanup := setupMockStorage(mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
 		mu.Lock()
 		receivedLogs = append(receivedLogs, logs...)
 		mu.Unlock()
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
+		return AppendResult{LastOffset: uint64(len(logs) - 1)}
+	}))
 	defer cleanup()
 
 	handler := setupHandler()
@@ -151,7 +175,7 @@ func TestHandleQuery(t *testing.T) {
 	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(mockLogs)
+		json.NewEncoder(w).Encode(ReadResult{Logs: mockLogs, NextOffset: 1})
 	})
 	defer cleanup()
 
@@ -166,8 +190,9 @@ func TestHandleQuery(t *testing.T) {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
 
-	var responseLogs []LogEntry
-	json.NewDecoder(w.Body).Decode(&responseLogs)
+	var result ReadResult
+	json.NewDecoder(w.Body).Decode(&result)
+	responseLogs := result.Logs
 
 	if len(responseLogs) != 1 {
 		t.Fatalf("expected 1 log, got %d", len(responseLogs))
@@ -247,7 +272,343 @@ func TestHandleQuery_StorageError(t *testing.T) {
 
 	handler.HandleQuery(w, req)
 
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+
+	var response apierror.Response
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Code != apierror.CodeUnavailable {
+		t.Errorf("expected code %q, got %+v", apierror.CodeUnavailable, response)
+	}
+}
+
+func TestHandleQuery_PassesStorageRejectionThrough(t *testing.T) {
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "partition not found")
+	})
+	defer cleanup()
+
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/query?service=test&limit=10", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleQuery(w, req)
+
+	var response apierror.Response
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusNotFound || response.Code != apierror.CodeNotFound {
+		t.Errorf("expected the 404 of the storage node, got %d %+v", w.Code, response)
+	}
+}
+
+func TestHandleCreate_PayloadTooLarge(t *testing.T) {
+	original := MaxRequestBytes
+	MaxRequestBytes = 64
+	t.Cleanup(func() { MaxRequestBytes = original })
+
+	handler := setupHandler()
+
+	body, _ := json.Marshal([]IncomingLogBody{{Service: "test-service", Message: strings.Repeat("x", 100)}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	var response apierror.Response
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusRequestEntityTooLarge || response.Code != apierror.CodePayloadTooLarge {
+		t.Errorf("expected a 413 payload_too_large error, got %d %+v", w.Code, response)
+	}
+}
+
+func TestHandleQuery_PassesCursorThrough(t *testing.T) {
+	var receivedQuery url.Values
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		receivedQuery = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ReadResult{NextOffset: 42})
+	})
+	defer cleanup()
+
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/query?service=test-service&limit=10&from_offset=30&max_bytes=4096", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleQuery(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if receivedQuery.Get("from_offset") != "30" || receivedQuery.Get("max_bytes") != "4096" || receivedQuery.Get("limit") != "10" {
+		t.Errorf("expected cursor to be passed to storage, got %v", receivedQuery)
+	}
+
+	var result ReadResult
+	json.NewDecoder(w.Body).Decode(&result)
+
+	if result.NextOffset != 42 {
+		t.Errorf("expected next_offset 42, got %d", result.NextOffset)
+	}
+	if result.Partition != partitionForKey("test-service") {
+		t.Errorf("expected partition %d, got %d", partitionForKey("test-service"), result.Partition)
+	}
+}
+
+func TestHandleQuery_InvalidFromOffset(t *testing.T) {
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/query?service=test&limit=10&from_offset=abc", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleQuery(w, req)
+
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected status 400, got %d", w.Code)
 	}
 }
+
+func TestHandleCreate_AcceptedWhenQueued(t *testing.T) {
+	setupWAL(t)
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+	handler := NewHandler(service)
+
+	body, _ := json.Marshal([]IncomingLogBody{{Service: "test-service", Message: "queued"}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	var response IngestResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Partitions) != 1 || !response.Partitions[0].Queued {
+		t.Errorf("expected the batch to be reported as queued, got %+v", response)
+	}
+}
+
+func TestHandleCreate_BreakerOpen(t *testing.T) {
+	setupRetryPolicy(t, singleAttemptPolicy())
+	setupBreakers(t, 1, time.Hour)
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer cleanup()
+
+	handler := setupHandler()
+	body, _ := json.Marshal([]IncomingLogBody{{Service: "test-service", Message: "fails"}})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.HandleCreate(w, req)
+
+		if i == 1 && w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status 503 once the breaker is open, got %d", w.Code)
+		}
+	}
+}
+
+// servicesInPartitions returns n service names that hash to different
+// partitions
+func servicesInPartitions(n int) []string {
+	var services []string
+	seen := make(map[int]bool)
+	for i := 0; len(services) < n; i++ {
+		name := fmt.Sprintf("service-%d", i)
+		if partition := partitionForKey(name); !seen[partition] {
+			seen[partition] = true
+			services = append(services, name)
+		}
+	}
+
+	return services
+}
+
+func TestHandleCreate_PartialSuccessReportsRejectedPartition(t *testing.T) {
+	services := servicesInPartitions(2)
+	rejected := partitionForKey(services[1])
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		var batch batchRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+
+		var response struct {
+			Results []map[string]any `json:"results"`
+		}
+		for _, partition := range batch.Partitions {
+			result := map[string]any{"partition": partition.Partition, "status": http.StatusOK}
+			if partition.Partition == rejected {
+				result["status"] = http.StatusBadRequest
+				result["error"] = "invalid entry"
+			}
+			response.Results = append(response.Results, result)
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+	defer cleanup()
+
+	handler := setupHandler()
+
+	body, _ := json.Marshal([]IncomingLogBody{
+		{Service: services[0], Message: "stored"},
+		{Service: services[1], Message: "rejected"},
+		{Service: services[0], Message: "stored too"},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status 207, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response IngestResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Received != 3 || response.Accepted != 2 || len(response.Partitions) != 2 {
+		t.Fatalf("expected 2 of 3 entries accepted in 2 partitions, got %+v", response)
+	}
+	for _, partition := range response.Partitions {
+		switch partition.Partition {
+		case rejected:
+			if partition.Status != PartitionRejected || !slices.Equal(partition.Entries, []int{1}) || !strings.Contains(partition.Error, "invalid entry") {
+				t.Errorf("expected entry 1 to be rejected, got %+v", partition)
+			}
+		default:
+			if partition.Status != PartitionAccepted || !slices.Equal(partition.Entries, []int{0, 2}) {
+				t.Errorf("expected entries 0 and 2 to be accepted, got %+v", partition)
+			}
+		}
+	}
+}
+
+func TestHandleCreate_PartialSuccessReportsRetriablePartition(t *testing.T) {
+	setupRetryPolicy(t, singleAttemptPolicy())
+	_, firstServer := newMemStorage(t)
+	second, secondServer := newMemStorage(t)
+	setupRouting(t, 8, firstServer.URL, secondServer.URL)
+	second.fail = func(r *http.Request) bool { return true }
+
+	// One service whose partition the first node leads, one for the second
+	var logs []IncomingLogBody
+	for _, node := range []string{firstServer.URL, secondServer.URL} {
+		for i := 0; ; i++ {
+			name := fmt.Sprintf("service-%d", i)
+			if Routing.Primary(partitionForKey(name)) == node {
+				logs = append(logs, IncomingLogBody{Service: name, Message: "partial"})
+				break
+			}
+		}
+	}
+
+	handler := setupHandler()
+
+	body, _ := json.Marshal(logs)
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status 207, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response IngestResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	statuses := make(map[int]string)
+	for _, partition := range response.Partitions {
+		statuses[partition.Partition] = partition.Status
+	}
+	if statuses[partitionForKey(logs[0].Service)] != PartitionAccepted || statuses[partitionForKey(logs[1].Service)] != PartitionRetriable {
+		t.Errorf("expected the first partition accepted and the second retriable, got %+v", response.Partitions)
+	}
+}
+
+func TestHandleBreakers(t *testing.T) {
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/admin/breakers", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleBreakers(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var statuses []BreakerStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(statuses) == 0 || statuses[0].State != BreakerClosed {
+		t.Errorf("unexpected breakers %+v", statuses)
+	}
+}
+
+func TestHandleCreate_QueueFull(t *testing.T) {
+	setupQueue(t, 1, 1, 0)
+	storage := newBlockingStorage()
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+	defer close(storage.release)
+	handler := NewHandler(service)
+
+	body, _ := json.Marshal([]IncomingLogBody{{Service: "test-service", Message: "shed"}})
+
+	codes := make([]int, 3)
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.HandleCreate(w, req)
+		codes[i] = w.Code
+
+		if i == 0 {
+			<-storage.received
+		}
+		if i == 2 && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("expected Retry-After: 1, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+
+	if codes[0] != http.StatusAccepted || codes[1] != http.StatusAccepted || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("expected 202, 202, 429, got %v", codes)
+	}
+}
+
+func TestHandleQueue(t *testing.T) {
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/admin/queue", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleQueue(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var stats QueueStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if stats.Enabled {
+		t.Errorf("expected the queue to be disabled by default, got %+v", stats)
+	}
+}
@@ -0,0 +1,424 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckInterval is how often every storage node is health checked and
+// MembersFile is looked at. Zero disables both.
+// This can be overridden for testing or configuration.
+var HealthCheckInterval = 5 * time.Second
+
+// HealthCheckFailures is how many health checks in a row a storage node must
+// fail to be marked unhealthy, which takes it off the hash ring and fails
+// over the partitions it leads. It is healthy again after its first
+// successful check.
+// This can be overridden for testing or configuration.
+var HealthCheckFailures = 3
+
+// MemberTimeout is how long a storage node that registered itself stays a
+// member without sending another heartbeat.
+// This can be overridden for testing or configuration.
+var MemberTimeout = 30 * time.Second
+
+// MembersFile lists storage nodes, one URL per line, and is reloaded whenever
+// it changes. Empty disables it.
+// This can be overridden for testing or configuration.
+var MembersFile = ""
+
+// Where a storage node was learned from. Static members come from the
+// routing configuration and are never removed.
+const (
+	MemberStatic    = "static"
+	MemberFile      = "file"
+	MemberHeartbeat = "heartbeat"
+	MemberMetadata  = "metadata"
+)
+
+// MemberStatus describes a storage node of the cluster. Healthy members are
+// on the hash ring: partitions the ring places on a new member are moved to
+// it, partitions of a member that leaves are moved off it and the partitions
+// an unhealthy member leads are taken over by other nodes.
+type MemberStatus struct {
+	URL           string     `json:"url"`
+	Source        string     `json:"source"`
+	Healthy       bool       `json:"healthy"`
+	Failures      int        `json:"failures,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	LastCheck     *time.Time `json:"last_check,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// membership tracks the storage nodes the ingest node knows of.
+type membership struct {
+	mu      sync.Mutex
+	members map[string]*MemberStatus
+
+	// MembersFile is only read again once its modification time or size
+	// changed.
+	fileModTime time.Time
+	fileSize    int64
+}
+
+// add makes url a member, learned from source, and reports whether it is
+// new.
+func (m *membership) add(url string, source string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.member(url, source)
+
+	return ok
+}
+
+// member returns the member url, adding it first when it is new. The caller
+// must hold mu.
+func (m *membership) member(url string, source string) (*MemberStatus, bool) {
+	if member, ok := m.members[url]; ok {
+		return member, false
+	}
+
+	if m.members == nil {
+		m.members = make(map[string]*MemberStatus)
+	}
+	member := &MemberStatus{URL: url, Source: source, Healthy: true}
+	m.members[url] = member
+
+	return member, true
+}
+
+// Register adds a storage node announcing itself, or records its heartbeat.
+func (s *Service) Register(url string) {
+	now := time.Now()
+
+	s.members.mu.Lock()
+	member, added := s.members.member(url, MemberHeartbeat)
+	member.LastHeartbeat = &now
+	s.members.mu.Unlock()
+
+	if added {
+		fmt.Println("[INGEST/MEMBERS]", "registered storage node=", url)
+		s.updateRing()
+	}
+}
+
+// Members returns every known storage node.
+func (s *Service) Members() []MemberStatus {
+	s.members.mu.Lock()
+	defer s.members.mu.Unlock()
+
+	members := make([]MemberStatus, 0, len(s.members.members))
+	for _, member := range s.members.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].URL < members[j].URL
+	})
+
+	return members
+}
+
+// runMembership checks the members every HealthCheckInterval.
+func (s *Service) runMembership(stop chan struct{}) {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.CheckMembers(context.Background(), time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// CheckMembers reloads MembersFile if it changed, drops registered members
+// whose heartbeats stopped, health checks the others, puts the healthy ones
+// on the hash ring and fails over the partitions led by unhealthy ones.
+func (s *Service) CheckMembers(ctx context.Context, now time.Time) {
+	if MembersFile != "" {
+		if err := s.loadMembersFile(MembersFile); err != nil {
+			fmt.Println("[INGEST/MEMBERS]", "file=", MembersFile, "error=", err)
+		}
+	}
+
+	s.members.mu.Lock()
+	var urls, removed []string
+	for url, member := range s.members.members {
+		if member.Source == MemberHeartbeat && member.LastHeartbeat != nil && now.Sub(*member.LastHeartbeat) > MemberTimeout {
+			fmt.Println("[INGEST/MEMBERS]", "storage node=", url, "stopped sending heartbeats")
+			delete(s.members.members, url)
+			removed = append(removed, url)
+			continue
+		}
+		urls = append(urls, url)
+	}
+	s.members.mu.Unlock()
+
+	for _, url := range removed {
+		s.takeOffRing(url, true)
+	}
+
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.checkMember(ctx, url, now)
+		}()
+	}
+	wg.Wait()
+
+	s.updateRing()
+
+	if len(MetadataNodes) == 0 {
+		s.failOverUnhealthy(ctx)
+	}
+}
+
+// checkMember health checks url and marks it unhealthy after
+// HealthCheckFailures failed checks in a row.
+func (s *Service) checkMember(ctx context.Context, url string, now time.Time) {
+	err := s.storage.Health(ctx, url)
+
+	s.members.mu.Lock()
+	defer s.members.mu.Unlock()
+
+	member, ok := s.members.members[url]
+	if !ok {
+		return
+	}
+	member.LastCheck = &now
+
+	if err == nil {
+		if !member.Healthy {
+			fmt.Println("[INGEST/MEMBERS]", "storage node=", url, "is healthy again")
+		}
+		member.Healthy, member.Failures, member.Error = true, 0, ""
+		return
+	}
+
+	member.Failures++
+	member.Error = err.Error()
+	if member.Healthy && member.Failures >= HealthCheckFailures {
+		member.Healthy = false
+		fmt.Println("[INGEST/MEMBERS]", "storage node=", url, "is unhealthy after", member.Failures, "failed checks error=", err)
+	}
+}
+
+// updateRing puts healthy members on the hash ring and takes the unhealthy
+// ones off it.
+func (s *Service) updateRing() {
+	s.members.mu.Lock()
+	healthy := make(map[string]bool, len(s.members.members))
+	for url, member := range s.members.members {
+		healthy[url] = member.Healthy
+	}
+	s.members.mu.Unlock()
+
+	nodes := Routing.Nodes()
+	for url, ok := range healthy {
+		if !ok {
+			s.takeOffRing(url, false)
+			continue
+		}
+		if !slices.Contains(nodes, url) {
+			s.addToRing(url)
+		}
+	}
+}
+
+// addToRing puts url on the hash ring and moves the partitions the ring now
+// places on it there. They stay pinned to their nodes until then.
+func (s *Service) addToRing(url string) {
+	kept := Routing.AddNodeKeepingPlacement(url)
+	fmt.Println("[INGEST/MEMBERS]", "storage node=", url, "added to the ring")
+
+	for _, assignment := range kept {
+		s.moveToRing(assignment, Routing.Placement(assignment.Partition)[0])
+	}
+}
+
+// takeOffRing removes url from the hash ring unless it is the last node, so
+// partitions placed later always have somewhere to go. The partitions it
+// leads are moved to the nodes the ring places them on now when it can
+// still be reached; otherwise they stay on it until failOverUnhealthy takes
+// them over.
+func (s *Service) takeOffRing(url string, reachable bool) {
+	nodes := Routing.Nodes()
+	if !slices.Contains(nodes, url) || len(nodes) <= 1 {
+		return
+	}
+
+	before := Routing.Assignments()
+	Routing.RemoveNodeKeepingPlacement(url)
+	fmt.Println("[INGEST/MEMBERS]", "storage node=", url, "taken off the ring")
+
+	for _, assignment := range before {
+		if len(assignment.Nodes) == 0 || assignment.Nodes[0] != url {
+			continue
+		}
+
+		if reachable {
+			s.moveToRing(assignment, Routing.Placement(assignment.Partition)[0])
+		} else if !assignment.Pinned {
+			s.keepPlacement(assignment)
+		}
+	}
+}
+
+// moveToRing moves a partition from the nodes of assignment to target. It
+// is pinned to those nodes until its data has been moved, so it is never
+// routed to a node without its records.
+func (s *Service) moveToRing(assignment PartitionAssignment, target string) {
+	if !assignment.Pinned && !s.keepPlacement(assignment) {
+		return
+	}
+
+	if _, err := s.StartMove(assignment.Partition, target); err != nil {
+		fmt.Println("[INGEST/MEMBERS]", "partition=", assignment.Partition, "target=", target, "move error=", err)
+	}
+}
+
+// keepPlacement pins a partition to the nodes of assignment and reports
+// whether the pin was saved.
+func (s *Service) keepPlacement(assignment PartitionAssignment) bool {
+	if err := s.pin(context.Background(), assignment.Partition, assignment.Nodes); err != nil {
+		fmt.Println("[INGEST/MEMBERS]", "partition=", assignment.Partition, "failed to keep its placement error=", err)
+		return false
+	}
+
+	return true
+}
+
+// failOverUnhealthy moves every partition led by an unhealthy member off
+// it. A partition with followers fails over to one that has its records;
+// without one it stays on its leader and its writes wait in the WAL until
+// it is back. A partition without followers has its records on no other
+// node, so it is pinned to the nodes the hash ring places it on now and
+// takes new writes there, while the records the unhealthy member holds stay
+// on it.
+func (s *Service) failOverUnhealthy(ctx context.Context) {
+	s.members.mu.Lock()
+	unhealthy := make(map[string]bool)
+	for url, member := range s.members.members {
+		if !member.Healthy {
+			unhealthy[url] = true
+		}
+	}
+	s.members.mu.Unlock()
+
+	if len(unhealthy) == 0 {
+		return
+	}
+
+	for partition := 0; partition < Routing.Partitions(); partition++ {
+		replicas := Routing.Replicas(partition)
+		if len(replicas) == 0 || !unhealthy[replicas[0]] || s.moves.copying(partition) {
+			continue
+		}
+
+		if len(replicas) > 1 {
+			if _, err := s.Failover(ctx, partition, ""); err != nil {
+				fmt.Println("[INGEST/MEMBERS]", "partition=", partition, "leader=", replicas[0], "is unhealthy, failover error=", err)
+			}
+			continue
+		}
+
+		placement := Routing.Placement(partition)
+		if len(placement) == 0 || unhealthy[placement[0]] {
+			continue
+		}
+		if err := s.pin(ctx, partition, placement); err != nil {
+			fmt.Println("[INGEST/MEMBERS]", "partition=", partition, "failed to reroute to", placement[0], "error=", err)
+			continue
+		}
+		fmt.Println("[INGEST/MEMBERS]", "partition=", partition, "leader=", replicas[0], "is unhealthy, rerouted to", placement[0])
+	}
+}
+
+// loadMembersFile makes the storage nodes listed in path members and drops
+// the members it listed before but no longer does.
+func (s *Service) loadMembersFile(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.members.mu.Lock()
+	unchanged := info.ModTime().Equal(s.members.fileModTime) && info.Size() == s.members.fileSize
+	s.members.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		listed[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for url := range listed {
+		if s.members.add(url, MemberFile) {
+			fmt.Println("[INGEST/MEMBERS]", "storage node=", url, "listed in", path)
+		}
+	}
+
+	s.members.mu.Lock()
+	s.members.fileModTime, s.members.fileSize = info.ModTime(), info.Size()
+	var removed []string
+	for url, member := range s.members.members {
+		if member.Source == MemberFile && !listed[url] {
+			fmt.Println("[INGEST/MEMBERS]", "storage node=", url, "no longer listed in", path)
+			delete(s.members.members, url)
+			removed = append(removed, url)
+		}
+	}
+	s.members.mu.Unlock()
+
+	// Moving their partitions off them saves pins and calls storage nodes
+	for _, url := range removed {
+		s.takeOffRing(url, true)
+	}
+
+	return nil
+}
+
+// Health checks that the storage node at nodeURL answers.
+func (node *StorageClient) Health(ctx context.Context, nodeURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultRetryPolicy.AttemptTimeout)
+	defer cancel()
+
+	_, err := send(ctx, node.client, http.MethodGet, nodeURL+"/v1/health", nil)
+
+	return err
+}
@@ -0,0 +1,287 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupMembership makes a failed health check take a node off the ring and
+// stops the background checks, tests run them with CheckMembers
+func setupMembership(t *testing.T) {
+	originalInterval, originalFailures := HealthCheckInterval, HealthCheckFailures
+	originalTimeout, originalFile := MemberTimeout, MembersFile
+	HealthCheckInterval, HealthCheckFailures = 0, 1
+	MemberTimeout, MembersFile = time.Minute, ""
+
+	t.Cleanup(func() {
+		HealthCheckInterval, HealthCheckFailures = originalInterval, originalFailures
+		MemberTimeout, MembersFile = originalTimeout, originalFile
+	})
+}
+
+// waitForMoves waits until no partition is being moved anymore
+func waitForMoves(t *testing.T, service *Service) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		copying := false
+		for _, move := range service.Moves() {
+			copying = copying || move.State == MoveCopying
+		}
+		if !copying {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("moves did not finish: %+v", service.Moves())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegister_AddsNodeUntilHeartbeatsStop(t *testing.T) {
+	setupMembership(t)
+	setupRetryPolicy(t, fastRetryPolicy())
+	_, first := newMemStorage(t)
+	second, secondServer := newMemStorage(t)
+	setupRouting(t, 32, first.URL)
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	for partition := 0; partition < 8; partition++ {
+		ingestService(t, service, fmt.Sprintf("service-%d", partition), 2)
+	}
+
+	service.Register(secondServer.URL)
+	waitForMoves(t, service)
+
+	if nodes := Routing.Nodes(); !slices.Contains(nodes, secondServer.URL) {
+		t.Fatalf("expected the registered node on the ring, got %v", nodes)
+	}
+
+	// The partitions the ring places on the new node are moved there with
+	// their records, the others stay put
+	moved := 0
+	for partition := 0; partition < Routing.Partitions(); partition++ {
+		placement := Routing.Placement(partition)[0]
+		if primary := Routing.Primary(partition); primary != placement {
+			t.Errorf("expected partition %d on %s, got %s", partition, placement, primary)
+		}
+		if placement == secondServer.URL {
+			moved++
+		}
+	}
+	if moved == 0 || moved == Routing.Partitions() {
+		t.Fatalf("expected some partitions to move to the new node, %d did", moved)
+	}
+	for _, move := range service.Moves() {
+		if move.State != MoveCompleted || move.Target != secondServer.URL || len(second.logs(move.Partition)) != move.Copied {
+			t.Errorf("unexpected move %+v", move)
+		}
+	}
+
+	service.CheckMembers(context.Background(), time.Now().Add(2*MemberTimeout))
+	waitForMoves(t, service)
+
+	if nodes := Routing.Nodes(); !slices.Equal(nodes, []string{first.URL}) {
+		t.Errorf("expected the node to be dropped once its heartbeats stopped, got %v", nodes)
+	}
+	if members := service.Members(); len(members) != 1 || members[0].Source != MemberStatic {
+		t.Errorf("expected only the static member to be left, got %+v", members)
+	}
+
+	// Its partitions are moved back
+	for partition := 0; partition < Routing.Partitions(); partition++ {
+		if primary := Routing.Primary(partition); primary != first.URL {
+			t.Errorf("expected partition %d back on %s, got %s", partition, first.URL, primary)
+		}
+	}
+}
+
+func TestCheckMembers_ReroutesPartitionsOfUnhealthyNode(t *testing.T) {
+	setupMembership(t)
+	setupRetryPolicy(t, fastRetryPolicy())
+	_, first := newMemStorage(t)
+	second, secondServer := newMemStorage(t)
+	setupRouting(t, 32, first.URL, secondServer.URL)
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	before := Routing.Assignments()
+
+	second.fail = func(r *http.Request) bool { return true }
+	service.CheckMembers(context.Background(), time.Now())
+
+	// Without followers no other node has the records of its partitions, new
+	// writes go to the healthy node
+	rerouted := 0
+	for _, assignment := range Routing.Assignments() {
+		previous := before[assignment.Partition].Nodes[0]
+		switch {
+		case previous == secondServer.URL && (assignment.Nodes[0] != first.URL || !assignment.Pinned):
+			t.Errorf("expected partition %d to be pinned to %s, got %+v", assignment.Partition, first.URL, assignment)
+		case previous == secondServer.URL:
+			rerouted++
+		case assignment.Nodes[0] != previous || assignment.Pinned:
+			t.Errorf("expected partition %d to stay on %s, got %+v", assignment.Partition, previous, assignment)
+		}
+	}
+	if rerouted == 0 {
+		t.Fatalf("expected some partitions of the unhealthy node to be rerouted")
+	}
+
+	members := service.Members()
+	unhealthy := members[slices.IndexFunc(members, func(m MemberStatus) bool { return m.URL == secondServer.URL })]
+	if unhealthy.Healthy || unhealthy.Failures != 1 || unhealthy.Error == "" {
+		t.Errorf("expected the failed node to be reported unhealthy, got %+v", unhealthy)
+	}
+
+	second.fail = nil
+	service.CheckMembers(context.Background(), time.Now())
+	waitForMoves(t, service)
+
+	if nodes := Routing.Nodes(); len(nodes) != 2 {
+		t.Errorf("expected the recovered node back on the ring, got %v", nodes)
+	}
+
+	// The rerouted partitions keep their new writes where they are
+	for _, assignment := range Routing.Assignments() {
+		if before[assignment.Partition].Nodes[0] == secondServer.URL && assignment.Nodes[0] != first.URL {
+			t.Errorf("expected partition %d to stay on %s, got %+v", assignment.Partition, first.URL, assignment)
+		}
+	}
+}
+
+func TestCheckMembers_FailsOverToInSyncFollower(t *testing.T) {
+	setupMembership(t)
+	setupRetryPolicy(t, fastRetryPolicy())
+	nodes := setupReplicas(t, 1)
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	ingestService(t, service, "test-service", 3)
+	catchUp(nodes, 0)
+	leader, follower := Routing.Replicas(0)[0], Routing.Replicas(0)[1]
+	nodes[leader].fail = func(r *http.Request) bool { return true }
+
+	// A follower missing records is not promoted
+	nodes[follower].lag[0] = 2
+	service.CheckMembers(context.Background(), time.Now())
+	if Routing.Primary(0) != leader {
+		t.Fatalf("expected %s to stay the leader, got %s", leader, Routing.Primary(0))
+	}
+
+	nodes[follower].lag[0] = 0
+	service.CheckMembers(context.Background(), time.Now())
+	if Routing.Primary(0) != follower {
+		t.Errorf("expected the in-sync follower %s to lead, got %s", follower, Routing.Primary(0))
+	}
+}
+
+func TestCheckMembers_KeepsLastNode(t *testing.T) {
+	setupMembership(t)
+	only, server := newMemStorage(t)
+	setupRouting(t, 4, server.URL)
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	only.fail = func(r *http.Request) bool { return true }
+	service.CheckMembers(context.Background(), time.Now())
+
+	if nodes := Routing.Nodes(); !slices.Equal(nodes, []string{server.URL}) {
+		t.Errorf("expected the last node to stay on the ring, got %v", nodes)
+	}
+}
+
+func TestCheckMembers_ReloadsMembersFile(t *testing.T) {
+	setupMembership(t)
+	_, first := newMemStorage(t)
+	_, second := newMemStorage(t)
+	_, third := newMemStorage(t)
+	setupRouting(t, 8, first.URL)
+
+	MembersFile = filepath.Join(t.TempDir(), "members")
+	writeMembers(t, "# storage nodes", second.URL)
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	if nodes := Routing.Nodes(); len(nodes) != 2 || !slices.Contains(nodes, second.URL) {
+		t.Fatalf("expected the listed node on the ring, got %v", nodes)
+	}
+
+	writeMembers(t, third.URL)
+	service.CheckMembers(context.Background(), time.Now())
+
+	nodes := Routing.Nodes()
+	if len(nodes) != 2 || !slices.Contains(nodes, third.URL) || slices.Contains(nodes, second.URL) {
+		t.Errorf("expected the ring to follow the file, got %v", nodes)
+	}
+}
+
+func writeMembers(t *testing.T, lines ...string) {
+	t.Helper()
+
+	if err := os.WriteFile(MembersFile, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestHandleMembers(t *testing.T) {
+	setupMembership(t)
+	setupRouting(t, 4, "http://first:8081")
+
+	service := NewService(NewStorageClient())
+	handler := NewHandler(service)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/members", strings.NewReader(`{"url":"http://second:8081"}`))
+	w := httptest.NewRecorder()
+	handler.HandleMembers(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/members", nil)
+	w = httptest.NewRecorder()
+	handler.HandleMembers(w, req)
+
+	if !strings.Contains(w.Body.String(), `"url":"http://second:8081","source":"heartbeat"`) {
+		t.Errorf("expected the registered node to be listed, got %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/members", strings.NewReader(`{"url":"second:8081"}`))
+	w = httptest.NewRecorder()
+	handler.HandleMembers(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid URL, got %d", http.StatusBadRequest, w.Code)
+	}
+}
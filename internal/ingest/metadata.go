@@ -0,0 +1,197 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// MetadataNodes are the storage nodes serving the cluster metadata. When set,
+// partitions are routed to the leaders and replicas the metadata names
+// instead of the hash ring, and partition moves and failovers are recorded
+// there.
+// This can be overridden for testing or configuration.
+var MetadataNodes []string
+
+// MetadataWatchWait is how long a storage node holds a watch of the cluster
+// metadata while nothing changes.
+// This can be overridden for testing or configuration.
+var MetadataWatchWait = 30 * time.Second
+
+// metadataRetryInterval is how long the watch waits before asking the next
+// metadata node once one failed.
+const metadataRetryInterval = time.Second
+
+// PartitionMetadata is where the cluster metadata places a partition.
+type PartitionMetadata struct {
+	Partition int      `json:"partition"`
+	Leader    string   `json:"leader"`
+	Replicas  []string `json:"replicas"`
+	Epoch     uint64   `json:"epoch"`
+}
+
+// ClusterMetadata is the storage nodes of the cluster and the placement of
+// its partitions. Version grows with every change.
+type ClusterMetadata struct {
+	Version    uint64              `json:"version"`
+	Members    []string            `json:"members"`
+	Partitions []PartitionMetadata `json:"partitions"`
+}
+
+// Metadata returns the cluster metadata served by nodeURL once it is newer
+// than version, or after wait.
+func (node *StorageClient) Metadata(ctx context.Context, nodeURL string, version uint64, wait time.Duration) (ClusterMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait+DefaultRetryPolicy.AttemptTimeout)
+	defer cancel()
+
+	path := "/v1/metadata?version=" + strconv.FormatUint(version, 10) + "&wait=" + wait.String()
+	body, err := send(ctx, node.client, http.MethodGet, nodeURL+path, nil)
+	if err != nil {
+		return ClusterMetadata{}, err
+	}
+
+	var metadata ClusterMetadata
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return ClusterMetadata{}, fmt.Errorf("invalid storage response: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// AssignPartition records on the metadata leader nodeURL that partition is
+// placed on replicas, leader first.
+func (node *StorageClient) AssignPartition(ctx context.Context, nodeURL string, partition int, replicas []string) error {
+	payload, err := json.Marshal(map[string]any{"partition": partition, "replicas": replicas})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultRetryPolicy.Deadline)
+	defer cancel()
+
+	_, err = send(ctx, node.client, http.MethodPost, nodeURL+"/v1/metadata/partitions", payload)
+
+	return err
+}
+
+// runMetadataWatch routes partitions according to the cluster metadata,
+// watching one metadata node after the other until one answers.
+func (s *Service) runMetadataWatch(stop chan struct{}) {
+	defer s.background.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var version uint64
+	for node := 0; ctx.Err() == nil; {
+		metadata, err := s.storage.Metadata(ctx, MetadataNodes[node], version, MetadataWatchWait)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("[INGEST/METADATA]", "node=", MetadataNodes[node], "watch error=", err)
+			}
+			node = (node + 1) % len(MetadataNodes)
+
+			select {
+			case <-time.After(metadataRetryInterval):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if metadata.Version > version || version == 0 {
+			s.applyMetadata(ctx, metadata)
+			version = metadata.Version
+		}
+	}
+}
+
+// applyMetadata routes every partition to the replicas the metadata names.
+// Partitions the metadata has not placed yet are recorded there on the nodes
+// the hash ring picks.
+func (s *Service) applyMetadata(ctx context.Context, metadata ClusterMetadata) {
+	nodes := Routing.Nodes()
+	for _, member := range metadata.Members {
+		s.members.add(member, MemberMetadata)
+		if !slices.Contains(nodes, member) {
+			Routing.AddNode(member)
+			fmt.Println("[INGEST/METADATA]", "added storage node=", member)
+		}
+	}
+
+	assigned := make(map[int]bool)
+	for _, partition := range metadata.Partitions {
+		if partition.Partition >= Routing.Partitions() || len(partition.Replicas) == 0 {
+			continue
+		}
+		assigned[partition.Partition] = true
+
+		if slices.Equal(Routing.Replicas(partition.Partition), partition.Replicas) {
+			continue
+		}
+		Routing.Pin(partition.Partition, partition.Replicas)
+
+		fmt.Println("[INGEST/METADATA]", "partition=", partition.Partition, "leader=", partition.Leader, "replicas=", partition.Replicas, "epoch=", partition.Epoch)
+	}
+
+	for partition := 0; partition < Routing.Partitions(); partition++ {
+		if assigned[partition] {
+			continue
+		}
+
+		replicas := Routing.Replicas(partition)
+		if len(replicas) == 0 {
+			continue
+		}
+		if err := s.publishAssignment(ctx, partition, replicas); err != nil {
+			fmt.Println("[INGEST/METADATA]", "partition=", partition, "assign error=", err)
+		}
+	}
+}
+
+// publishAssignment records the placement of partition on whichever metadata
+// node leads.
+func (s *Service) publishAssignment(ctx context.Context, partition int, replicas []string) error {
+	var errs []error
+	for _, node := range MetadataNodes {
+		err := s.storage.AssignPartition(ctx, node, partition, replicas)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", node, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// pin routes partition to replicas, leader first, saves the pins to
+// RoutingPinsFile and records the placement in the cluster metadata.
+func (s *Service) pin(ctx context.Context, partition int, replicas []string) error {
+	Routing.Pin(partition, replicas)
+
+	var errs []error
+	if RoutingPinsFile != "" {
+		if err := Routing.SavePins(RoutingPinsFile); err != nil {
+			errs = append(errs, fmt.Errorf("failed to save routing pins: %w", err))
+		}
+	}
+
+	if len(MetadataNodes) > 0 {
+		if err := s.publishAssignment(ctx, partition, replicas); err != nil {
+			errs = append(errs, fmt.Errorf("failed to record the placement in the cluster metadata: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,188 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memMetadata is a metadata node keeping the cluster metadata in memory
+type memMetadata struct {
+	mu       sync.Mutex
+	metadata ClusterMetadata
+	changed  chan struct{}
+}
+
+func newMemMetadata(t *testing.T) (*memMetadata, *httptest.Server) {
+	m := &memMetadata{
+		metadata: ClusterMetadata{Members: []string{}, Partitions: []PartitionMetadata{}},
+		changed:  make(chan struct{}),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(m.handle))
+	t.Cleanup(server.Close)
+
+	original := MetadataNodes
+	MetadataNodes = []string{server.URL}
+	t.Cleanup(func() { MetadataNodes = original })
+
+	return m, server
+}
+
+// assign places partition on replicas, leader first
+func (m *memMetadata) assign(partition int, replicas []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.metadata.Version++
+	m.metadata.Partitions = slices.DeleteFunc(m.metadata.Partitions, func(p PartitionMetadata) bool {
+		return p.Partition == partition
+	})
+	m.metadata.Partitions = append(m.metadata.Partitions, PartitionMetadata{
+		Partition: partition,
+		Leader:    replicas[0],
+		Replicas:  replicas,
+		Epoch:     m.metadata.Version,
+	})
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *memMetadata) partition(partition int) (PartitionMetadata, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.metadata.Partitions {
+		if p.Partition == partition {
+			return p, true
+		}
+	}
+	return PartitionMetadata{}, false
+}
+
+func (m *memMetadata) handle(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/metadata":
+		version, _ := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+
+		m.mu.Lock()
+		changed := m.changed
+		newer := m.metadata.Version > version
+		m.mu.Unlock()
+
+		if !newer {
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			case <-r.Context().Done():
+			}
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		json.NewEncoder(w).Encode(m.metadata)
+
+	case "/v1/metadata/partitions":
+		var req struct {
+			Partition int      `json:"partition"`
+			Replicas  []string `json:"replicas"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		m.assign(req.Partition, req.Replicas)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestApplyMetadata(t *testing.T) {
+	metadata, _ := newMemMetadata(t)
+	setupRouting(t, 4, "http://first:8081", "http://second:8081")
+	service := NewService(NewStorageClient())
+
+	// Partition 2 was elected a new leader, the others are not placed yet
+	replicas := []string{"http://third:8081", "http://first:8081"}
+	metadata.assign(2, replicas)
+
+	service.applyMetadata(context.Background(), ClusterMetadata{
+		Version:    1,
+		Members:    []string{"http://first:8081", "http://second:8081", "http://third:8081"},
+		Partitions: []PartitionMetadata{{Partition: 2, Leader: replicas[0], Replicas: replicas, Epoch: 3}},
+	})
+
+	if got := Routing.Replicas(2); !slices.Equal(got, replicas) {
+		t.Errorf("expected partition 2 on %v, got %v", replicas, got)
+	}
+	if nodes := Routing.Nodes(); len(nodes) != 3 {
+		t.Errorf("expected the new member to be added, got %v", nodes)
+	}
+
+	for _, partition := range []int{0, 1, 3} {
+		placed, ok := metadata.partition(partition)
+		if !ok {
+			t.Errorf("expected partition %d to be recorded in the metadata", partition)
+			continue
+		}
+		if !slices.Equal(placed.Replicas, Routing.Replicas(partition)) {
+			t.Errorf("partition %d recorded on %v but routed to %v", partition, placed.Replicas, Routing.Replicas(partition))
+		}
+	}
+}
+
+func TestMetadataWatch_FollowsElections(t *testing.T) {
+	metadata, _ := newMemMetadata(t)
+	nodes := setupReplicas(t, 1)
+
+	// Storage nodes apply elections themselves, the followers are not synced
+	// here
+	originalWait, originalSync := MetadataWatchWait, ReplicationSyncInterval
+	MetadataWatchWait, ReplicationSyncInterval = 50*time.Millisecond, 0
+	t.Cleanup(func() { MetadataWatchWait, ReplicationSyncInterval = originalWait, originalSync })
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	leader, follower := Routing.Replicas(0)[0], Routing.Replicas(0)[1]
+
+	// The watch records the placement of the hash ring first
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if placed, ok := metadata.partition(0); ok && placed.Leader == leader {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("partition 0 was not recorded in the metadata")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	metadata.assign(0, []string{follower})
+
+	for Routing.Primary(0) != follower {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected writes to go to the elected leader %s, got %v", follower, Routing.Replicas(0))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	results, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "elected"}}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || len(nodes[follower].logs(0)) != 1 || len(nodes[leader].logs(0)) != 0 {
+		t.Errorf("expected the write to land on %s, got %+v", follower, results)
+	}
+}
@@ -0,0 +1,160 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// QueueCapacity is how many batches can wait to be forwarded in asynchronous
+// mode. Zero disables the queue and /v1/logs forwards synchronously.
+// This can be overridden for testing or configuration.
+var QueueCapacity = 0
+
+// QueueWorkers is how many batches are forwarded concurrently in
+// asynchronous mode.
+// This can be overridden for testing or configuration.
+var QueueWorkers = 4
+
+// QueueWaitTimeout is how long a request waits for room in a full queue
+// before it is rejected. Zero rejects immediately.
+// This can be overridden for testing or configuration.
+var QueueWaitTimeout time.Duration
+
+// QueueRetryAfter is what rejected clients are told to wait before retrying.
+// This can be overridden for testing or configuration.
+var QueueRetryAfter = time.Second
+
+// ErrQueueFull is returned when a batch is shed because the queue is full.
+var ErrQueueFull = apierror.New(http.StatusTooManyRequests, "ingest queue is full")
+
+// QueueStats describes the asynchronous ingest queue.
+type QueueStats struct {
+	Enabled   bool  `json:"enabled"`
+	Capacity  int   `json:"capacity"`
+	Workers   int   `json:"workers"`
+	Depth     int   `json:"depth"`
+	Enqueued  int64 `json:"enqueued"`
+	Forwarded int64 `json:"forwarded"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+// queuedBatch is a partitioned batch waiting in the ingest queue and the
+// idempotency key it is forwarded with.
+type queuedBatch struct {
+	key        string
+	partitions map[int][]LogEntry
+}
+
+// ingestQueue buffers partitioned batches in memory for a fixed pool of
+// workers that forward them to storage.
+type ingestQueue struct {
+	batches chan queuedBatch
+	workers int
+
+	// closed is guarded by mu so no batch is sent after batches is closed.
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+
+	enqueued  atomic.Int64
+	forwarded atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+}
+
+func newIngestQueue(capacity int, workers int, forward func(queuedBatch) error) *ingestQueue {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	q := &ingestQueue{batches: make(chan queuedBatch, capacity), workers: workers}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+
+			for batch := range q.batches {
+				if err := forward(batch); err != nil {
+					q.failed.Add(1)
+					fmt.Println("[INGEST/QUEUE]", "error=", err)
+					continue
+				}
+				q.forwarded.Add(1)
+			}
+		}()
+	}
+
+	return q
+}
+
+// enqueue adds a batch to the queue, waiting up to QueueWaitTimeout for room
+// when it is full, or until ctx is done.
+func (q *ingestQueue) enqueue(ctx context.Context, batch queuedBatch) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return errors.New("ingest queue is closed")
+	}
+
+	select {
+	case q.batches <- batch:
+		q.enqueued.Add(1)
+		return nil
+	default:
+	}
+
+	if QueueWaitTimeout > 0 {
+		timer := time.NewTimer(QueueWaitTimeout)
+		defer timer.Stop()
+
+		select {
+		case q.batches <- batch:
+			q.enqueued.Add(1)
+			return nil
+		case <-timer.C:
+		case <-ctx.Done():
+			// The client gave up, the queue did not shed the batch.
+			return ctx.Err()
+		}
+	}
+
+	q.dropped.Add(1)
+
+	return ErrQueueFull
+}
+
+// close stops accepting batches and waits until the queued ones have been
+// forwarded.
+func (q *ingestQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.batches)
+	}
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+func (q *ingestQueue) stats() QueueStats {
+	return QueueStats{
+		Enabled:   true,
+		Capacity:  cap(q.batches),
+		Workers:   q.workers,
+		Depth:     len(q.batches),
+		Enqueued:  q.enqueued.Load(),
+		Forwarded: q.forwarded.Load(),
+		Failed:    q.failed.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+}
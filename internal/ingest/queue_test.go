@@ -0,0 +1,155 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupQueue enables the ingest queue for a single test
+func setupQueue(t *testing.T, capacity int, workers int, wait time.Duration) {
+	originalCapacity, originalWorkers, originalWait := QueueCapacity, QueueWorkers, QueueWaitTimeout
+	QueueCapacity, QueueWorkers, QueueWaitTimeout = capacity, workers, wait
+
+	t.Cleanup(func() {
+		QueueCapacity, QueueWorkers, QueueWaitTimeout = originalCapacity, originalWorkers, originalWait
+	})
+}
+
+// blockingStorage is a mock storage node that holds every request until
+// release is closed and signals arrivals on received.
+type blockingStorage struct {
+	received chan struct{}
+	release  chan struct{}
+}
+
+func newBlockingStorage() *blockingStorage {
+	return &blockingStorage{received: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (b *blockingStorage) handle(w http.ResponseWriter, r *http.Request) {
+	b.received <- struct{}{}
+	<-b.release
+
+	mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
+		return AppendResult{}
+	})(w, r)
+}
+
+func submitOne(service *Service) error {
+	_, err := service.Submit(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "queued"}}, "10.0.0.1", AcksLeader)
+	return err
+}
+
+func TestSubmit_QueuesAndForwards(t *testing.T) {
+	setupQueue(t, 10, 2, 0)
+
+	var mu sync.Mutex
+	var receivedLogs []LogEntry
+	_, cleanup := setupMockStorage(mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
+		mu.Lock()
+		receivedLogs = append(receivedLogs, logs...)
+		mu.Unlock()
+		return AppendResult{}
+	}))
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+
+	results, err := service.Submit(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "async"}}, "10.0.0.1", AcksLeader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || !results[0].Queued {
+		t.Errorf("expected a queued result, got %+v", results)
+	}
+
+	service.Close()
+
+	if len(receivedLogs) != 1 || receivedLogs[0].Message != "async" {
+		t.Errorf("expected the queued batch to be forwarded before close returned, got %+v", receivedLogs)
+	}
+	if stats := service.QueueStats(); stats.Enqueued != 1 || stats.Forwarded != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSubmit_ShedsWhenFull(t *testing.T) {
+	setupQueue(t, 1, 1, 0)
+	storage := newBlockingStorage()
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+	defer close(storage.release)
+
+	// The worker picks up the first batch and the second one fills the queue
+	submitOne(service)
+	<-storage.received
+	if err := submitOne(service); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := submitOne(service); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	stats := service.QueueStats()
+	if stats.Depth != 1 || stats.Dropped != 1 || stats.Capacity != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSubmit_WaitsForRoom(t *testing.T) {
+	setupQueue(t, 1, 1, time.Second)
+	storage := newBlockingStorage()
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+
+	submitOne(service)
+	<-storage.received
+	submitOne(service)
+
+	time.AfterFunc(50*time.Millisecond, func() { close(storage.release) })
+
+	if err := submitOne(service); err != nil {
+		t.Errorf("expected the batch to wait for room, got %v", err)
+	}
+}
+
+func TestSubmit_CancelledWhileWaitingIsNotDropped(t *testing.T) {
+	setupQueue(t, 1, 1, time.Second)
+	storage := newBlockingStorage()
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+	defer close(storage.release)
+
+	submitOne(service)
+	<-storage.received
+	submitOne(service)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := service.Submit(ctx, []IncomingLogBody{{Service: "test-service", Message: "queued"}}, "10.0.0.1", AcksLeader)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+
+	if stats := service.QueueStats(); stats.Dropped != 0 {
+		t.Errorf("expected a cancelled batch not to count as dropped, got %+v", stats)
+	}
+}
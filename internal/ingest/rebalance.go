@@ -0,0 +1,341 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// MovePageBytes caps every page of records copied while a partition is
+// moved.
+// This can be overridden for testing or configuration.
+var MovePageBytes int64 = 1024 * 1024
+
+// movePageLimit bounds the number of records of every copied page.
+const movePageLimit = 1000
+
+// ErrMoveInProgress is returned when a partition is already being moved.
+var ErrMoveInProgress = apierror.New(http.StatusConflict, "partition is already being moved")
+
+// ErrAlreadyOnTarget is returned when moving a partition to the storage node
+// it is on.
+var ErrAlreadyOnTarget = apierror.New(http.StatusConflict, "partition is already on the target")
+
+type MoveState string
+
+const (
+	MoveCopying   MoveState = "copying"
+	MoveCompleted MoveState = "completed"
+	MoveFailed    MoveState = "failed"
+)
+
+// MoveStatus describes the move of a partition to another storage node.
+type MoveStatus struct {
+	Partition  int        `json:"partition"`
+	Source     string     `json:"source"`
+	Target     string     `json:"target"`
+	State      MoveState  `json:"state"`
+	Copied     int        `json:"copied"`      // records copied so far
+	NextOffset uint64     `json:"next_offset"` // next offset on the target
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// moves keeps the latest move of every partition.
+type moves struct {
+	mu          sync.Mutex
+	byPartition map[int]*MoveStatus
+}
+
+func (m *moves) start(partition int, source string, target string) (*MoveStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if current, ok := m.byPartition[partition]; ok && current.State == MoveCopying {
+		return nil, fmt.Errorf("partition %d: %w", partition, ErrMoveInProgress)
+	}
+	if m.byPartition == nil {
+		m.byPartition = make(map[int]*MoveStatus)
+	}
+
+	status := &MoveStatus{Partition: partition, Source: source, Target: target, State: MoveCopying, StartedAt: time.Now()}
+	m.byPartition[partition] = status
+
+	return status, nil
+}
+
+// update changes the status of a move under the lock.
+func (m *moves) update(status *MoveStatus, change func(status *MoveStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	change(status)
+}
+
+// copying reports whether partition is being moved.
+func (m *moves) copying(partition int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.byPartition[partition]
+
+	return ok && current.State == MoveCopying
+}
+
+func (m *moves) list() []MoveStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := []MoveStatus{}
+	for _, status := range m.byPartition {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Partition < statuses[j].Partition
+	})
+
+	return statuses
+}
+
+// partitionGates pause the writes of this ingest node to a partition while
+// its ownership changes. Writes hold the gates of their partitions shared,
+// a move holds the gate of its partition exclusively.
+type partitionGates struct {
+	mu    sync.Mutex
+	gates map[int]*sync.RWMutex
+}
+
+func (g *partitionGates) get(partition int) *sync.RWMutex {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.gates == nil {
+		g.gates = make(map[int]*sync.RWMutex)
+	}
+	gate, ok := g.gates[partition]
+	if !ok {
+		gate = &sync.RWMutex{}
+		g.gates[partition] = gate
+	}
+
+	return gate
+}
+
+// enter holds the gates of partitions for a write and returns a function
+// releasing them. Gates are taken in partition order so writes spanning
+// several partitions never deadlock with each other.
+func (g *partitionGates) enter(partitions []int) func() {
+	sorted := append([]int(nil), partitions...)
+	sort.Ints(sorted)
+
+	gates := make([]*sync.RWMutex, len(sorted))
+	for i, partition := range sorted {
+		gates[i] = g.get(partition)
+		gates[i].RLock()
+	}
+
+	return func() {
+		for _, gate := range gates {
+			gate.RUnlock()
+		}
+	}
+}
+
+// MovePartition moves partition from its current primary to target: the
+// records are copied while writes keep going to the source, then writes are
+// paused and the source is fenced while the last records are copied, the
+// partition is pinned to target and finally deleted from the source. The
+// move is aborted and the source left in charge when anything fails before
+// the partition is pinned to target.
+func (s *Service) MovePartition(ctx context.Context, partition int, target string) (MoveStatus, error) {
+	status, err := s.startMove(partition, target)
+	if err != nil {
+		return MoveStatus{}, err
+	}
+
+	return s.runMove(ctx, status)
+}
+
+// StartMove validates a move of partition to target and runs it in the
+// background. The returned status is the move as it started, Moves reports
+// its progress.
+func (s *Service) StartMove(partition int, target string) (MoveStatus, error) {
+	status, err := s.startMove(partition, target)
+	if err != nil {
+		return MoveStatus{}, err
+	}
+
+	started := *status
+	go s.runMove(context.Background(), status)
+
+	return started, nil
+}
+
+// startMove validates a move and records it as copying.
+func (s *Service) startMove(partition int, target string) (*MoveStatus, error) {
+	if partition < 0 || partition >= Routing.Partitions() {
+		return nil, fmt.Errorf("partition %d: %w", partition, ErrPartitionNotFound)
+	}
+
+	source := Routing.Primary(partition)
+	if source == "" || source == target {
+		return nil, fmt.Errorf("partition %d on %s: %w", partition, target, ErrAlreadyOnTarget)
+	}
+
+	return s.moves.start(partition, source, target)
+}
+
+func (s *Service) runMove(ctx context.Context, status *MoveStatus) (MoveStatus, error) {
+	err := s.move(ctx, status)
+
+	var result MoveStatus
+	s.moves.update(status, func(status *MoveStatus) {
+		finishedAt := time.Now()
+		status.FinishedAt = &finishedAt
+		status.State = MoveCompleted
+
+		if err != nil {
+			status.Error = err.Error()
+			if Routing.Primary(status.Partition) != status.Target {
+				status.State = MoveFailed
+			}
+		}
+
+		result = *status
+	})
+
+	fmt.Println(
+		"[INGEST/MOVE]",
+		"partition=", result.Partition,
+		"source=", result.Source,
+		"target=", result.Target,
+		"state=", result.State,
+		"copied=", result.Copied,
+		"error=", err,
+	)
+
+	return result, err
+}
+
+func (s *Service) move(ctx context.Context, status *MoveStatus) error {
+	partition, source, target := status.Partition, status.Source, status.Target
+
+	// Writes keep going to the source while most of the partition is copied.
+	if err := s.copyPartition(ctx, status, false); err != nil {
+		return err
+	}
+
+	if err := s.flip(ctx, status); err != nil {
+		return err
+	}
+
+	if err := s.storage.DeletePartition(ctx, source, partition); err != nil {
+		return fmt.Errorf("partition %d moved to %s but was not deleted from %s: %w", partition, target, source, err)
+	}
+
+	return nil
+}
+
+// flip copies the records written during the copy while writes to the
+// partition are paused and the source is fenced, then pins the partition to
+// the target.
+func (s *Service) flip(ctx context.Context, status *MoveStatus) error {
+	partition, source, target := status.Partition, status.Source, status.Target
+
+	gate := s.gates.get(partition)
+	gate.Lock()
+	defer gate.Unlock()
+
+	if err := s.storage.Fence(ctx, source, partition, true); err != nil {
+		return fmt.Errorf("failed to fence partition %d on %s: %w", partition, source, err)
+	}
+
+	err := s.copyPartition(ctx, status, true)
+	if err == nil {
+		// The target may have been fenced when the partition was moved away
+		// from it before.
+		err = s.storage.Fence(ctx, target, partition, false)
+	}
+	if err != nil {
+		if unfenceErr := s.storage.Fence(context.Background(), source, partition, false); unfenceErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to lift the fence of partition %d on %s: %w", partition, source, unfenceErr))
+		}
+		return err
+	}
+
+	previous := Routing.Replicas(partition)
+	replicas := []string{target}
+	for _, node := range previous {
+		if node != source && node != target && len(replicas) < Routing.ReplicationFactor() {
+			replicas = append(replicas, node)
+		}
+	}
+
+	// The source keeps the partition unless the new placement is recorded,
+	// otherwise the next restart would route it to a deleted copy.
+	if err := s.pin(ctx, partition, replicas); err != nil {
+		err = fmt.Errorf("failed to pin partition %d to %s: %w", partition, target, err)
+		if restoreErr := s.pin(context.Background(), partition, previous); restoreErr != nil {
+			fmt.Println("[INGEST/MOVE]", "partition=", partition, "error=", restoreErr)
+		}
+		if unfenceErr := s.storage.Fence(context.Background(), source, partition, false); unfenceErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to lift the fence of partition %d on %s: %w", partition, source, unfenceErr))
+		}
+		return err
+	}
+
+	return nil
+}
+
+// copyPartition copies the records of the partition the target does not have
+// yet. While writes are still going to the source, copying stops after the
+// first page that is not full so a busy partition cannot keep the move from
+// finishing; otherwise it stops once the target has caught up.
+func (s *Service) copyPartition(ctx context.Context, status *MoveStatus, fenced bool) error {
+	partition, source, target := status.Partition, status.Source, status.Target
+
+	next, err := s.storage.Replicate(ctx, target, partition, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", target, err)
+	}
+
+	for {
+		page, err := s.storage.ReadNode(ctx, source, partition, ReadRequest{
+			FromOffset: &next,
+			Limit:      movePageLimit,
+			MaxBytes:   MovePageBytes,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read partition %d from %s: %w", partition, source, err)
+		}
+		if len(page.Logs) == 0 {
+			return nil
+		}
+
+		next, err = s.storage.Replicate(ctx, target, partition, page.Logs)
+		if err != nil {
+			return fmt.Errorf("failed to copy partition %d to %s: %w", partition, target, err)
+		}
+
+		s.moves.update(status, func(status *MoveStatus) {
+			status.Copied += len(page.Logs)
+			status.NextOffset = next
+		})
+
+		if !fenced && len(page.Logs) < movePageLimit {
+			return nil
+		}
+	}
+}
+
+// Moves returns the latest move of every partition.
+func (s *Service) Moves() []MoveStatus {
+	return s.moves.list()
+}
@@ -0,0 +1,440 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStorage is an in-memory storage node serving the endpoints used by
+// ingest and partition moves
+type memStorage struct {
+	mu         sync.Mutex
+	partitions map[int][]LogEntry
+	fenced     map[int]bool
+	deleted    map[int]bool
+	following  map[int]string // leader of the partitions this node follows
+	lag        map[int]uint64 // lag reported for followed partitions
+
+	// fail answers matching requests with a 500
+	fail func(r *http.Request) bool
+}
+
+func newMemStorage(t *testing.T) (*memStorage, *httptest.Server) {
+	m := &memStorage{
+		partitions: make(map[int][]LogEntry),
+		fenced:     make(map[int]bool),
+		deleted:    make(map[int]bool),
+		following:  make(map[int]string),
+		lag:        make(map[int]uint64),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(m.handle))
+	t.Cleanup(server.Close)
+
+	return m, server
+}
+
+// setupRouting routes every partition to nodes for a single test
+func setupRouting(t *testing.T, partitions int, nodes ...string) {
+	original := Routing
+	Routing = NewRoutingTable(partitions, 1, nodes...)
+
+	t.Cleanup(func() {
+		Routing = original
+	})
+}
+
+func (m *memStorage) next(partition int) uint64 {
+	logs := m.partitions[partition]
+	if len(logs) == 0 {
+		return 0
+	}
+	return logs[len(logs)-1].Offset + 1
+}
+
+func (m *memStorage) logs(partition int) []LogEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]LogEntry(nil), m.partitions[partition]...)
+}
+
+func (m *memStorage) handle(w http.ResponseWriter, r *http.Request) {
+	if m.fail != nil && m.fail(r) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	partition, _ := strconv.Atoi(r.URL.Query().Get("partition"))
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/v1/storage/batch":
+		var batch batchRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+
+		var response struct {
+			Results []map[string]any `json:"results"`
+		}
+		for _, batch := range batch.Partitions {
+			if m.fenced[batch.Partition] {
+				response.Results = append(response.Results, map[string]any{
+					"partition": batch.Partition,
+					"status":    http.StatusServiceUnavailable,
+					"error":     "partition is fenced",
+				})
+				continue
+			}
+
+			base := m.next(batch.Partition)
+			for i, log := range batch.Logs {
+				log.Offset = base + uint64(i)
+				m.partitions[batch.Partition] = append(m.partitions[batch.Partition], log)
+			}
+			response.Results = append(response.Results, map[string]any{
+				"partition":   batch.Partition,
+				"base_offset": base,
+				"last_offset": m.next(batch.Partition) - 1,
+				"status":      http.StatusOK,
+			})
+		}
+		json.NewEncoder(w).Encode(response)
+
+	case "/v1/read":
+		from, _ := strconv.ParseUint(r.URL.Query().Get("from_offset"), 10, 64)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+		result := ReadResult{Logs: []LogEntry{}, NextOffset: m.next(partition), EndOffset: m.next(partition)}
+		for _, log := range m.partitions[partition] {
+			if log.Offset >= from && len(result.Logs) < limit {
+				result.Logs = append(result.Logs, log)
+			}
+		}
+		if len(result.Logs) > 0 {
+			result.NextOffset = result.Logs[len(result.Logs)-1].Offset + 1
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case "/v1/replicate":
+		var logs []LogEntry
+		json.NewDecoder(r.Body).Decode(&logs)
+
+		for _, log := range logs {
+			if log.Offset >= m.next(partition) {
+				m.partitions[partition] = append(m.partitions[partition], log)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"partition": partition, "next_offset": m.next(partition)})
+
+	case "/v1/fence":
+		m.fenced[partition] = r.Method == http.MethodPost
+		w.WriteHeader(http.StatusNoContent)
+
+	case "/v1/partition":
+		delete(m.partitions, partition)
+		m.deleted[partition] = true
+		w.WriteHeader(http.StatusNoContent)
+
+	case "/v1/follow":
+		if r.Method == http.MethodPost {
+			var req struct {
+				Partition int    `json:"partition"`
+				Leader    string `json:"leader"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			m.following[req.Partition] = req.Leader
+			m.fenced[req.Partition] = true
+		} else {
+			if _, ok := m.following[partition]; !ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			delete(m.following, partition)
+			m.fenced[partition] = false
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "/v1/replication":
+		statuses := []ReplicaStatus{}
+		for partition, leader := range m.following {
+			statuses = append(statuses, ReplicaStatus{
+				Partition:  partition,
+				Leader:     leader,
+				NextOffset: m.next(partition),
+				Lag:        m.lag[partition],
+			})
+		}
+		json.NewEncoder(w).Encode(statuses)
+
+	case "/v1/health":
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func ingestService(t *testing.T, service *Service, name string, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		_, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: name, Message: fmt.Sprintf("message %d", i)}}, "127.0.0.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestMovePartition(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	source, sourceServer := newMemStorage(t)
+	target, targetServer := newMemStorage(t)
+	setupRouting(t, 4, sourceServer.URL)
+
+	service := NewService(NewStorageClient())
+	ingestService(t, service, "moved-service", 5)
+	partition := partitionForKey("moved-service")
+
+	status, err := service.MovePartition(context.Background(), partition, targetServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if status.State != MoveCompleted || status.Copied != 5 || status.NextOffset != 5 || status.FinishedAt == nil {
+		t.Errorf("unexpected move status: %+v", status)
+	}
+	if Routing.Primary(partition) != targetServer.URL {
+		t.Errorf("expected partition %d to be routed to the target, got %s", partition, Routing.Primary(partition))
+	}
+	if !source.deleted[partition] {
+		t.Errorf("expected partition %d to be deleted from the source", partition)
+	}
+
+	logs := target.logs(partition)
+	if len(logs) != 5 {
+		t.Fatalf("expected 5 logs on the target, got %d", len(logs))
+	}
+	for i, log := range logs {
+		if log.Offset != uint64(i) || log.Message != fmt.Sprintf("message %d", i) {
+			t.Errorf("log %d was not copied as is: %+v", i, log)
+		}
+	}
+
+	// New writes continue at the next offset on the target
+	results, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "moved-service", Message: "after move"}}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || results[0].BaseOffset != 5 {
+		t.Errorf("expected the next write at offset 5, got %+v", results)
+	}
+
+	if moves := service.Moves(); len(moves) != 1 || moves[0].Partition != partition {
+		t.Errorf("unexpected moves: %+v", moves)
+	}
+}
+
+func TestMovePartition_CatchesUpWithConcurrentWrites(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	_, sourceServer := newMemStorage(t)
+	target, targetServer := newMemStorage(t)
+	setupRouting(t, 1, sourceServer.URL)
+
+	service := NewService(NewStorageClient())
+	ingestService(t, service, "busy-service", 50)
+
+	var wg sync.WaitGroup
+	var acknowledged sync.Map
+	stop := make(chan struct{})
+
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				message := fmt.Sprintf("writer %d message %d", writer, i)
+				_, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "busy-service", Message: message}}, "127.0.0.1")
+				if err == nil {
+					acknowledged.Store(message, true)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := service.MovePartition(context.Background(), 0, targetServer.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	stored := make(map[string]bool)
+	for i, log := range target.logs(0) {
+		if log.Offset != uint64(i) {
+			t.Fatalf("gap in offsets on the target at %d: %d", i, log.Offset)
+		}
+		stored[log.Message] = true
+	}
+
+	acknowledged.Range(func(message, _ any) bool {
+		if !stored[message.(string)] {
+			t.Errorf("acknowledged log %q is missing on the target", message)
+		}
+		return true
+	})
+}
+
+func TestMovePartition_AbortsWhenTargetFails(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	source, sourceServer := newMemStorage(t)
+	target, targetServer := newMemStorage(t)
+	setupRouting(t, 1, sourceServer.URL)
+
+	// The target stops answering once the source has been fenced
+	target.fail = func(r *http.Request) bool {
+		return r.URL.Path == "/v1/fence"
+	}
+
+	service := NewService(NewStorageClient())
+	ingestService(t, service, "test-service", 3)
+
+	status, err := service.MovePartition(context.Background(), 0, targetServer.URL)
+	if err == nil {
+		t.Fatal("expected the move to fail")
+	}
+	if status.State != MoveFailed || status.Error == "" {
+		t.Errorf("unexpected move status: %+v", status)
+	}
+
+	// The source is still in charge and accepts writes again
+	if Routing.Primary(0) != sourceServer.URL {
+		t.Errorf("expected partition to stay on the source, got %s", Routing.Primary(0))
+	}
+	if source.deleted[0] {
+		t.Errorf("source partition should not be deleted")
+	}
+	ingestService(t, service, "test-service", 1)
+	if logs := source.logs(0); len(logs) != 4 {
+		t.Errorf("expected 4 logs on the source, got %d", len(logs))
+	}
+}
+
+func TestMovePartition_KeepsSourceWhenPinIsNotSaved(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	source, sourceServer := newMemStorage(t)
+	_, targetServer := newMemStorage(t)
+	setupRouting(t, 1, sourceServer.URL)
+
+	// The pins cannot be saved under a regular file
+	notADir := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(notADir, nil, 0644)
+	original := RoutingPinsFile
+	RoutingPinsFile = filepath.Join(notADir, "routing.json")
+	t.Cleanup(func() { RoutingPinsFile = original })
+
+	service := NewService(NewStorageClient())
+	ingestService(t, service, "test-service", 3)
+
+	if _, err := service.MovePartition(context.Background(), 0, targetServer.URL); err == nil {
+		t.Fatal("expected the move to fail")
+	}
+
+	if Routing.Primary(0) != sourceServer.URL {
+		t.Errorf("expected partition to stay on the source, got %s", Routing.Primary(0))
+	}
+	if source.deleted[0] || source.fenced[0] {
+		t.Errorf("expected the source partition to be kept and unfenced")
+	}
+}
+
+func TestMovePartition_RejectsMoveToCurrentNode(t *testing.T) {
+	_, sourceServer := newMemStorage(t)
+	setupRouting(t, 4, sourceServer.URL)
+
+	service := NewService(NewStorageClient())
+
+	if _, err := service.MovePartition(context.Background(), 0, sourceServer.URL); err == nil {
+		t.Error("expected error moving a partition to the node it is on")
+	}
+	if _, err := service.MovePartition(context.Background(), 4, "http://other:8081"); err == nil {
+		t.Error("expected error moving a partition that does not exist")
+	}
+}
+
+func TestHandleMoves(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	_, sourceServer := newMemStorage(t)
+	target, targetServer := newMemStorage(t)
+	setupRouting(t, 1, sourceServer.URL)
+
+	handler := setupHandler()
+	ingestService(t, handler.service, "test-service", 2)
+
+	body, _ := json.Marshal(MoveRequest{Partition: 0, Target: "not a url"})
+	req := httptest.NewRequest(http.MethodPost, "/v1/admin/moves", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleMoves(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid target, got %d", w.Code)
+	}
+
+	body, _ = json.Marshal(MoveRequest{Partition: 0, Target: targetServer.URL})
+	req = httptest.NewRequest(http.MethodPost, "/v1/admin/moves", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+
+	handler.HandleMoves(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	var started MoveStatus
+	json.NewDecoder(w.Body).Decode(&started)
+	if started.Partition != 0 || started.Source != sourceServer.URL || started.Target != targetServer.URL {
+		t.Errorf("unexpected move status: %+v", started)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		req = httptest.NewRequest(http.MethodGet, "/v1/admin/moves", nil)
+		w = httptest.NewRecorder()
+
+		handler.HandleMoves(w, req)
+
+		var moves []MoveStatus
+		json.NewDecoder(w.Body).Decode(&moves)
+		if len(moves) == 1 && moves[0].State == MoveCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("move did not complete: %+v", moves)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if logs := target.logs(0); len(logs) != 2 {
+		t.Errorf("expected 2 logs on the target, got %d", len(logs))
+	}
+}
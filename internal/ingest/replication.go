@@ -0,0 +1,369 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// ReplicationSyncInterval is how often the storage nodes are told which
+// leader to follow for every partition they replicate.
+// This can be overridden for testing or configuration.
+var ReplicationSyncInterval = 5 * time.Second
+
+// MaxFailoverLag is how many records a follower may be missing to still be
+// promoted when the leader of its partition cannot be reached.
+// This can be overridden for testing or configuration.
+var MaxFailoverLag uint64 = 0
+
+// FailoverCatchUpTimeout bounds how long a failover waits for the follower
+// to fetch the last records of a reachable leader.
+// This can be overridden for testing or configuration.
+var FailoverCatchUpTimeout = 10 * time.Second
+
+// failoverPollInterval is how often a failover checks whether the follower
+// has caught up.
+const failoverPollInterval = 20 * time.Millisecond
+
+var (
+	// ErrNoFollower is returned when a partition has no follower to promote.
+	ErrNoFollower = apierror.New(http.StatusBadRequest, "partition has no follower")
+	// ErrFollowerBehind is returned when the follower is missing records of
+	// the leader.
+	ErrFollowerBehind = apierror.New(http.StatusConflict, "follower has not caught up with the leader")
+)
+
+// ReplicaStatus describes a follower of a partition. Lag is how many offsets
+// it was behind its leader after its last fetch.
+type ReplicaStatus struct {
+	Node            string     `json:"node"`
+	Partition       int        `json:"partition"`
+	Leader          string     `json:"leader"`
+	NextOffset      uint64     `json:"next_offset"`
+	LeaderEndOffset uint64     `json:"leader_end_offset"`
+	Lag             uint64     `json:"lag"`
+	LastFetch       *time.Time `json:"last_fetch,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// PartitionReplication is the leader of a partition and the state of each of
+// its followers.
+type PartitionReplication struct {
+	Partition int             `json:"partition"`
+	Leader    string          `json:"leader"`
+	Followers []ReplicaStatus `json:"followers"`
+}
+
+// FailoverResult describes a follower promoted to leader of a partition.
+type FailoverResult struct {
+	Partition  int    `json:"partition"`
+	OldLeader  string `json:"old_leader"`
+	NewLeader  string `json:"new_leader"`
+	NextOffset uint64 `json:"next_offset"` // next offset on the new leader
+	Fenced     bool   `json:"fenced"`      // whether the old leader was reachable and fenced
+}
+
+// runReplicationSync keeps the followers of every partition on its current
+// leader every ReplicationSyncInterval.
+func (s *Service) runReplicationSync(stop chan struct{}) {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(ReplicationSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.SyncReplication(context.Background()); err != nil {
+			fmt.Println("[INGEST/REPLICATION]", "sync error=", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// SyncReplication makes every replica of a partition but the first follow
+// the first one, its leader, and promotes leaders that still follow the
+// partition from an earlier assignment once they are at most MaxFailoverLag
+// records behind.
+func (s *Service) SyncReplication(ctx context.Context) error {
+	following := make(map[string]map[int]ReplicaStatus)
+	var errs []error
+
+	for _, node := range Routing.Nodes() {
+		statuses, err := s.storage.ReplicationStatus(ctx, node)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get replication status of %s: %w", node, err))
+			continue
+		}
+
+		following[node] = make(map[int]ReplicaStatus)
+		for _, status := range statuses {
+			following[node][status.Partition] = status
+		}
+	}
+
+	for partition := 0; partition < Routing.Partitions(); partition++ {
+		replicas := Routing.Replicas(partition)
+		if len(replicas) == 0 {
+			continue
+		}
+
+		leader := replicas[0]
+		if status, ok := following[leader][partition]; ok {
+			if status.Lag > MaxFailoverLag {
+				errs = append(errs, fmt.Errorf("%s is %d records behind on partition %d: %w", leader, status.Lag, partition, ErrFollowerBehind))
+			} else if err := s.storage.Promote(ctx, leader, partition); err != nil {
+				errs = append(errs, fmt.Errorf("failed to promote partition %d on %s: %w", partition, leader, err))
+			}
+		}
+
+		for _, node := range replicas[1:] {
+			statuses, reachable := following[node]
+			if !reachable || statuses[partition].Leader == leader {
+				continue
+			}
+
+			if err := s.storage.Follow(ctx, node, partition, leader); err != nil {
+				errs = append(errs, fmt.Errorf("failed to make %s follow partition %d: %w", node, partition, err))
+				continue
+			}
+
+			fmt.Println("[INGEST/REPLICATION]", "partition=", partition, "follower=", node, "leader=", leader)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Replication reports the leader and followers of every partition. A
+// follower that cannot be reached or does not follow its partition yet is
+// reported with an error.
+func (s *Service) Replication(ctx context.Context) []PartitionReplication {
+	statuses := make(map[string]map[int]ReplicaStatus)
+	failures := make(map[string]error)
+
+	for _, node := range Routing.Nodes() {
+		list, err := s.storage.ReplicationStatus(ctx, node)
+		if err != nil {
+			failures[node] = err
+			continue
+		}
+
+		statuses[node] = make(map[int]ReplicaStatus)
+		for _, status := range list {
+			statuses[node][status.Partition] = status
+		}
+	}
+
+	partitions := make([]PartitionReplication, 0, Routing.Partitions())
+	for partition := 0; partition < Routing.Partitions(); partition++ {
+		replicas := Routing.Replicas(partition)
+		if len(replicas) == 0 {
+			continue
+		}
+
+		replication := PartitionReplication{Partition: partition, Leader: replicas[0], Followers: []ReplicaStatus{}}
+		for _, node := range replicas[1:] {
+			status, ok := statuses[node][partition]
+			switch {
+			case failures[node] != nil:
+				status = ReplicaStatus{Node: node, Partition: partition, Error: failures[node].Error()}
+			case !ok:
+				status = ReplicaStatus{Node: node, Partition: partition, Error: "not following the partition yet"}
+			case status.Leader != replicas[0]:
+				status.Error = "following " + status.Leader + " instead of the leader"
+			}
+			replication.Followers = append(replication.Followers, status)
+		}
+
+		partitions = append(partitions, replication)
+	}
+
+	return partitions
+}
+
+// Failover promotes a follower of partition to leader, the given one or the
+// most caught-up one when follower is empty. Writes to the partition are
+// paused and the old leader is fenced while the follower fetches its last
+// records. When the old leader cannot be reached, the follower is promoted
+// only if it was at most MaxFailoverLag records behind, and the old leader is
+// dropped from the replicas of the partition since it may hold records the
+// new leader never got.
+func (s *Service) Failover(ctx context.Context, partition int, follower string) (FailoverResult, error) {
+	if partition < 0 || partition >= Routing.Partitions() {
+		return FailoverResult{}, fmt.Errorf("partition %d: %w", partition, ErrPartitionNotFound)
+	}
+
+	replicas := Routing.Replicas(partition)
+	if len(replicas) < 2 {
+		return FailoverResult{}, fmt.Errorf("partition %d: %w", partition, ErrNoFollower)
+	}
+	leader := replicas[0]
+
+	candidate, err := s.failoverCandidate(ctx, partition, replicas, follower)
+	if err != nil {
+		return FailoverResult{}, err
+	}
+
+	gate := s.gates.get(partition)
+	gate.Lock()
+
+	result, err := s.promote(ctx, partition, leader, candidate)
+	gate.Unlock()
+
+	if err != nil {
+		fmt.Println("[INGEST/FAILOVER]", "partition=", partition, "follower=", candidate.Node, "error=", err)
+		return FailoverResult{}, err
+	}
+
+	fmt.Println(
+		"[INGEST/FAILOVER]",
+		"partition=", partition,
+		"old_leader=", result.OldLeader,
+		"new_leader=", result.NewLeader,
+		"next_offset=", result.NextOffset,
+		"fenced=", result.Fenced,
+	)
+
+	// The remaining followers switch to the new leader now rather than on
+	// the next sync.
+	for _, node := range Routing.Replicas(partition)[1:] {
+		if err := s.storage.Follow(ctx, node, partition, result.NewLeader); err != nil {
+			fmt.Println("[INGEST/FAILOVER]", "partition=", partition, "follower=", node, "error=", err)
+		}
+	}
+
+	return result, nil
+}
+
+// failoverCandidate returns the status of the follower to promote.
+func (s *Service) failoverCandidate(ctx context.Context, partition int, replicas []string, follower string) (ReplicaStatus, error) {
+	var candidate *ReplicaStatus
+
+	for _, node := range replicas[1:] {
+		if follower != "" && node != follower {
+			continue
+		}
+
+		statuses, err := s.storage.ReplicationStatus(ctx, node)
+		if err != nil {
+			if follower != "" {
+				return ReplicaStatus{}, fmt.Errorf("failed to reach follower %s: %w", node, err)
+			}
+			continue
+		}
+
+		for _, status := range statuses {
+			if status.Partition != partition || status.Leader != replicas[0] {
+				continue
+			}
+			if candidate == nil || status.NextOffset > candidate.NextOffset {
+				candidate = &status
+			}
+		}
+	}
+
+	if candidate == nil && follower != "" {
+		return ReplicaStatus{}, fmt.Errorf("%s does not follow partition %d: %w", follower, partition, ErrNoFollower)
+	}
+	if candidate == nil {
+		return ReplicaStatus{}, fmt.Errorf("partition %d: %w", partition, ErrNoFollower)
+	}
+
+	return *candidate, nil
+}
+
+// promote fences the old leader, waits for the candidate to catch up and
+// pins the partition to it. Writes to the partition must be paused.
+func (s *Service) promote(ctx context.Context, partition int, leader string, candidate ReplicaStatus) (FailoverResult, error) {
+	result := FailoverResult{Partition: partition, OldLeader: leader, NewLeader: candidate.Node}
+
+	fenceCtx, cancel := context.WithTimeout(ctx, FailoverCatchUpTimeout)
+	defer cancel()
+
+	if err := s.storage.Fence(fenceCtx, leader, partition, true); err == nil {
+		result.Fenced = true
+	} else {
+		fmt.Println("[INGEST/FAILOVER]", "partition=", partition, "old leader unreachable error=", err)
+	}
+
+	var err error
+	if result.Fenced {
+		err = s.awaitCatchUp(fenceCtx, partition, leader, candidate.Node)
+	} else if candidate.Lag > MaxFailoverLag {
+		err = fmt.Errorf("%s is %d records behind on partition %d: %w", candidate.Node, candidate.Lag, partition, ErrFollowerBehind)
+	}
+
+	if err == nil {
+		err = s.storage.Promote(ctx, candidate.Node, partition)
+	}
+	if err != nil {
+		if result.Fenced {
+			if unfenceErr := s.storage.Fence(context.Background(), leader, partition, false); unfenceErr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to lift the fence of partition %d on %s: %w", partition, leader, unfenceErr))
+			}
+		}
+		return FailoverResult{}, err
+	}
+
+	replicas := []string{candidate.Node}
+	for _, node := range Routing.Replicas(partition)[1:] {
+		if node != candidate.Node && len(replicas) < Routing.ReplicationFactor() {
+			replicas = append(replicas, node)
+		}
+	}
+	// A fenced old leader has no records the new leader is missing and
+	// becomes one of its followers.
+	if result.Fenced && len(replicas) < Routing.ReplicationFactor() {
+		replicas = append(replicas, leader)
+	}
+	if err := s.pin(ctx, partition, replicas); err != nil {
+		fmt.Println("[INGEST/FAILOVER]", "partition=", partition, "error=", err)
+	}
+
+	result.NextOffset = candidate.NextOffset
+	if statuses, err := s.storage.ReplicationStatus(ctx, candidate.Node); err == nil {
+		for _, status := range statuses {
+			if status.Partition == partition {
+				result.NextOffset = status.NextOffset
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// awaitCatchUp waits until follower has fetched every record of the fenced
+// leader.
+func (s *Service) awaitCatchUp(ctx context.Context, partition int, leader string, follower string) error {
+	page, err := s.storage.ReadNode(ctx, leader, partition, ReadRequest{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("failed to read partition %d from %s: %w", partition, leader, err)
+	}
+
+	for {
+		statuses, err := s.storage.ReplicationStatus(ctx, follower)
+		if err != nil {
+			return fmt.Errorf("failed to reach follower %s: %w", follower, err)
+		}
+
+		for _, status := range statuses {
+			if status.Partition == partition && status.NextOffset >= page.EndOffset {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not reach offset %d of partition %d: %w", follower, page.EndOffset, partition, ErrFollowerBehind)
+		case <-time.After(failoverPollInterval):
+		}
+	}
+}
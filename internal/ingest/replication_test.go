@@ -0,0 +1,243 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setupReplicas routes every partition to a leader and a follower among
+// two in-memory storage nodes, keyed by their URL
+func setupReplicas(t *testing.T, partitions int) map[string]*memStorage {
+	first, firstServer := newMemStorage(t)
+	second, secondServer := newMemStorage(t)
+
+	original := Routing
+	Routing = NewRoutingTable(partitions, 2, firstServer.URL, secondServer.URL)
+
+	t.Cleanup(func() {
+		Routing = original
+	})
+
+	return map[string]*memStorage{firstServer.URL: first, secondServer.URL: second}
+}
+
+// catchUp copies the logs of partition from its leader to its follower
+func catchUp(nodes map[string]*memStorage, partition int) {
+	replicas := Routing.Replicas(partition)
+	leader, follower := nodes[replicas[0]], nodes[replicas[1]]
+
+	logs := leader.logs(partition)
+
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+
+	follower.partitions[partition] = logs
+	follower.following[partition] = replicas[0]
+	follower.fenced[partition] = true
+}
+
+func TestSyncReplication(t *testing.T) {
+	nodes := setupReplicas(t, 8)
+	service := NewService(NewStorageClient())
+
+	// A leader that still follows its partition from an earlier assignment
+	leader := Routing.Replicas(3)[0]
+	nodes[leader].following[3] = Routing.Replicas(3)[1]
+	nodes[leader].fenced[3] = true
+
+	if err := service.SyncReplication(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for partition := 0; partition < 8; partition++ {
+		replicas := Routing.Replicas(partition)
+		if following := nodes[replicas[1]].following[partition]; following != replicas[0] {
+			t.Errorf("follower of partition %d follows %q instead of %s", partition, following, replicas[0])
+		}
+		if _, ok := nodes[replicas[0]].following[partition]; ok {
+			t.Errorf("leader of partition %d should not follow it", partition)
+		}
+	}
+	if nodes[leader].fenced[3] {
+		t.Errorf("promoted leader of partition 3 should accept writes")
+	}
+
+	replication := service.Replication(context.Background())
+	if len(replication) != 8 {
+		t.Fatalf("expected 8 partitions, got %d", len(replication))
+	}
+	for _, partition := range replication {
+		if len(partition.Followers) != 1 || partition.Followers[0].Error != "" || partition.Followers[0].Node == partition.Leader {
+			t.Errorf("unexpected replication of partition %d: %+v", partition.Partition, partition)
+		}
+	}
+}
+
+func TestSyncReplication_KeepsLaggingLeaderFenced(t *testing.T) {
+	nodes := setupReplicas(t, 1)
+	service := NewService(NewStorageClient())
+
+	// The leader still follows the partition and is missing records
+	leader, follower := Routing.Replicas(0)[0], Routing.Replicas(0)[1]
+	nodes[leader].following[0] = follower
+	nodes[leader].fenced[0] = true
+	nodes[leader].lag[0] = 3
+
+	if err := service.SyncReplication(context.Background()); !errors.Is(err, ErrFollowerBehind) {
+		t.Fatalf("expected ErrFollowerBehind, got %v", err)
+	}
+	if !nodes[leader].fenced[0] {
+		t.Errorf("expected the lagging leader not to be promoted")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	nodes := setupReplicas(t, 4)
+	service := NewService(NewStorageClient())
+
+	ingestService(t, service, "failover-service", 5)
+	partition := partitionForKey("failover-service")
+	catchUp(nodes, partition)
+
+	oldLeader, follower := Routing.Replicas(partition)[0], Routing.Replicas(partition)[1]
+
+	result, err := service.Failover(context.Background(), partition, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.OldLeader != oldLeader || result.NewLeader != follower || !result.Fenced || result.NextOffset != 5 {
+		t.Errorf("unexpected failover result: %+v", result)
+	}
+	if replicas := Routing.Replicas(partition); replicas[0] != follower || replicas[1] != oldLeader {
+		t.Errorf("expected replicas [%s %s], got %v", follower, oldLeader, replicas)
+	}
+
+	// The old leader follows the new one and only the new leader takes writes
+	if nodes[oldLeader].following[partition] != follower || !nodes[oldLeader].fenced[partition] {
+		t.Errorf("old leader should follow the new leader")
+	}
+
+	results, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "failover-service", Message: "after failover"}}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || results[0].BaseOffset != 5 {
+		t.Errorf("expected the next write at offset 5, got %+v", results)
+	}
+	if logs := nodes[follower].logs(partition); len(logs) != 6 {
+		t.Errorf("expected 6 logs on the new leader, got %d", len(logs))
+	}
+}
+
+func TestFailover_WaitsForFollowerToCatchUp(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	nodes := setupReplicas(t, 1)
+	service := NewService(NewStorageClient())
+
+	original := FailoverCatchUpTimeout
+	FailoverCatchUpTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { FailoverCatchUpTimeout = original })
+
+	ingestService(t, service, "test-service", 3)
+	catchUp(nodes, 0)
+	ingestService(t, service, "test-service", 2)
+
+	leader := Routing.Replicas(0)[0]
+
+	if _, err := service.Failover(context.Background(), 0, ""); !errors.Is(err, ErrFollowerBehind) {
+		t.Fatalf("expected ErrFollowerBehind, got %v", err)
+	}
+
+	// The old leader stays in charge and accepts writes again
+	if Routing.Primary(0) != leader || nodes[leader].fenced[0] {
+		t.Errorf("expected %s to stay the unfenced leader", leader)
+	}
+	ingestService(t, service, "test-service", 1)
+}
+
+func TestFailover_LeaderUnreachable(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	nodes := setupReplicas(t, 1)
+	service := NewService(NewStorageClient())
+
+	ingestService(t, service, "test-service", 3)
+	catchUp(nodes, 0)
+
+	leader, follower := Routing.Replicas(0)[0], Routing.Replicas(0)[1]
+	nodes[leader].fail = func(r *http.Request) bool { return true }
+
+	nodes[follower].lag[0] = 2
+	if _, err := service.Failover(context.Background(), 0, follower); !errors.Is(err, ErrFollowerBehind) {
+		t.Fatalf("expected ErrFollowerBehind for a follower missing records, got %v", err)
+	}
+
+	nodes[follower].lag[0] = 0
+	result, err := service.Failover(context.Background(), 0, follower)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Fenced || result.NewLeader != follower {
+		t.Errorf("unexpected failover result: %+v", result)
+	}
+
+	// The unreachable leader may hold records the follower never got
+	if replicas := Routing.Replicas(0); len(replicas) != 1 || replicas[0] != follower {
+		t.Errorf("expected only %s to replicate the partition, got %v", follower, replicas)
+	}
+}
+
+func TestHandleFailover(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+	nodes := setupReplicas(t, 1)
+
+	handler := setupHandler()
+	ingestService(t, handler.service, "test-service", 2)
+	catchUp(nodes, 0)
+
+	follower := Routing.Replicas(0)[1]
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/admin/replication", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleReplication(w, req)
+
+	var replication []PartitionReplication
+	json.NewDecoder(w.Body).Decode(&replication)
+	if len(replication) != 1 || len(replication[0].Followers) != 1 || replication[0].Followers[0].NextOffset != 2 {
+		t.Fatalf("unexpected replication status: %+v", replication)
+	}
+
+	body, _ := json.Marshal(FailoverRequest{Partition: 0, Follower: "http://not-a-follower:8081"})
+	req = httptest.NewRequest(http.MethodPost, "/v1/admin/failover", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+
+	handler.HandleFailover(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a node that does not follow the partition, got %d", w.Code)
+	}
+
+	body, _ = json.Marshal(FailoverRequest{Partition: 0, Follower: follower})
+	req = httptest.NewRequest(http.MethodPost, "/v1/admin/failover", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+
+	handler.HandleFailover(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var result FailoverResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if result.NewLeader != follower || Routing.Primary(0) != follower {
+		t.Errorf("unexpected failover result: %+v", result)
+	}
+}
@@ -0,0 +1,121 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how StorageClient retries requests that failed with a
+// transient error.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one.
+	MaxAttempts int
+	// BaseBackoff is the wait before the first retry, doubled for every
+	// further retry up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Jitter is the fraction of every backoff that is randomized, between 0
+	// and 1, so clients that failed together do not retry together.
+	Jitter float64
+	// AttemptTimeout bounds a single attempt, Deadline all attempts and the
+	// backoffs between them. Zero means no bound.
+	AttemptTimeout time.Duration
+	Deadline       time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of clients created by
+// NewStorageClient. Storage nodes are told how long an attempt may take, so
+// they answer acks=all writes before it is given up.
+// This can be overridden for testing or configuration.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	BaseBackoff:    50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Jitter:         0.5,
+	AttemptTimeout: 2 * time.Second,
+	Deadline:       5 * time.Second,
+}
+
+// backoff returns how long to wait before retry number retry, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 && backoff > 0 {
+		backoff -= time.Duration(p.Jitter * rand.Float64() * float64(backoff))
+	}
+
+	return backoff
+}
+
+// retry calls attempt until it succeeds, fails with an error shouldRetry
+// rejects, or the policy runs out of attempts or time.
+func (p RetryPolicy) retry(ctx context.Context, idempotent bool, attempt func(ctx context.Context) error) error {
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+
+	var err error
+	for n := 1; ; n++ {
+		err = p.attempt(ctx, attempt)
+		if err == nil || n >= p.MaxAttempts || ctx.Err() != nil || !shouldRetry(err, idempotent) {
+			return err
+		}
+
+		timer := time.NewTimer(p.backoff(n))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (p RetryPolicy) attempt(ctx context.Context, attempt func(ctx context.Context) error) error {
+	if p.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.AttemptTimeout)
+		defer cancel()
+	}
+
+	return attempt(ctx)
+}
+
+// shouldRetry reports whether a failed attempt is worth repeating.
+// Idempotent requests are retried on every 5xx response and transport error.
+// Other requests may have been stored by a failed attempt, so they are only
+// retried when they provably were not: on 503s, which storage nodes answer
+// before storing anything (a fenced partition, too few in-sync replicas),
+// and when the storage node could not be dialed.
+func shouldRetry(err error, idempotent bool) bool {
+	if errors.Is(err, ErrBreakerOpen) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode == http.StatusServiceUnavailable {
+			return true
+		}
+		return idempotent && statusErr.StatusCode >= 500
+	}
+
+	if idempotent {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,201 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupRetryPolicy overrides DefaultRetryPolicy for a single test
+func setupRetryPolicy(t *testing.T, policy RetryPolicy) {
+	original := DefaultRetryPolicy
+	DefaultRetryPolicy = policy
+
+	t.Cleanup(func() {
+		DefaultRetryPolicy = original
+	})
+}
+
+func fastRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		BaseBackoff:    time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		AttemptTimeout: 100 * time.Millisecond,
+		Deadline:       time.Second,
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, want := range expected {
+		if got := policy.backoff(i + 1); got != want*time.Millisecond {
+			t.Errorf("retry %d: expected %v, got %v", i+1, want*time.Millisecond, got)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.backoff(1); got < 5*time.Millisecond || got > 10*time.Millisecond {
+			t.Fatalf("expected a jittered backoff between 5ms and 10ms, got %v", got)
+		}
+	}
+}
+
+func TestStorageClientAppend_RetriesServerErrors(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	var attempts atomic.Int32
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(AppendResult{BaseOffset: 7, LastOffset: 7})
+	})
+	defer cleanup()
+
+	result, err := NewStorageClient().Append(context.Background(), 0, []LogEntry{{}}, AcksLeader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts.Load() != 3 || result.BaseOffset != 7 {
+		t.Errorf("expected success on the third attempt, got %d attempts and %+v", attempts.Load(), result)
+	}
+}
+
+func TestStorageClientAppend_RetriesUnkeyedAppendsOnlyOn503(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	var attempts atomic.Int32
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer cleanup()
+
+	// The storage node may have stored the logs before failing
+	client := NewStorageClient()
+	if _, err := client.Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected a single attempt without an idempotency key, got %d", attempts.Load())
+	}
+
+	attempts.Store(0)
+	ctx := withDedupKey(context.Background(), "key")
+	if outcome := client.AppendBatch(ctx, map[int][]LogEntry{0: {{}}}, AcksLeader)[0]; outcome.Err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("expected every attempt with an idempotency key, got %d", attempts.Load())
+	}
+}
+
+func TestStorageClientAppend_DoesNotRetryClientErrors(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	var attempts atomic.Int32
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	defer cleanup()
+
+	if _, err := NewStorageClient().Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected a single attempt, got %d", attempts.Load())
+	}
+}
+
+func TestStorageClientAppend_DoesNotRetryTimeouts(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	var attempts atomic.Int32
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		time.Sleep(200 * time.Millisecond)
+	})
+	defer cleanup()
+
+	if _, err := NewStorageClient().Append(context.Background(), 0, []LogEntry{{}}, AcksLeader); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected an append that may have been stored not to be retried, got %d attempts", attempts.Load())
+	}
+}
+
+func TestStorageClientRead_RetriesTimeouts(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	var attempts atomic.Int32
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+		json.NewEncoder(w).Encode(ReadResult{NextOffset: 3})
+	})
+	defer cleanup()
+
+	result, err := NewStorageClient().Read(context.Background(), 0, ReadRequest{Limit: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts.Load() != 2 || result.NextOffset != 3 {
+		t.Errorf("expected success on the second attempt, got %d attempts and %+v", attempts.Load(), result)
+	}
+}
+
+func TestStorageClient_SendsAttemptTimeout(t *testing.T) {
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	var timeout atomic.Int64
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.ParseInt(r.Header.Get("X-Request-Timeout"), 10, 64)
+		timeout.Store(ms)
+		json.NewEncoder(w).Encode(AppendResult{})
+	})
+	defer cleanup()
+
+	if _, err := NewStorageClient().Append(context.Background(), 0, []LogEntry{{}}, AcksAll); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ms := timeout.Load(); ms <= 0 || ms > fastRetryPolicy().AttemptTimeout.Milliseconds() {
+		t.Errorf("expected the attempt timeout sent with the request, got %dms", ms)
+	}
+}
+
+func TestStorageClient_RespectsContext(t *testing.T) {
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 100
+	policy.BaseBackoff = 50 * time.Millisecond
+	policy.MaxBackoff = 50 * time.Millisecond
+	setupRetryPolicy(t, policy)
+
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := NewStorageClient().Read(ctx, 0, ReadRequest{Limit: 10}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected retries to stop with the context, took %v", elapsed)
+	}
+}
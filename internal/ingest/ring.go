@@ -0,0 +1,150 @@
+package ingest
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// VirtualNodes is how many points every member of a hash ring is given. More
+// points spread keys more evenly over the members at the cost of a larger
+// ring.
+// This can be overridden for testing or configuration.
+var VirtualNodes = 128
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// Ring is a consistent hash ring. Every member is hashed onto the ring at
+// VirtualNodes points and a key belongs to the members owning the first
+// points clockwise from its hash, so adding or removing a member only moves
+// the keys next to that member's points. A Ring is not safe for concurrent
+// use.
+type Ring struct {
+	vnodes  int
+	members map[string]bool
+	points  []ringPoint // sorted by hash
+}
+
+func NewRing(vnodes int, members ...string) *Ring {
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+
+	r := &Ring{vnodes: vnodes, members: make(map[string]bool)}
+	for _, member := range members {
+		r.place(member)
+	}
+	r.sort()
+
+	return r
+}
+
+// Add places member on the ring. Adding a member twice has no effect.
+func (r *Ring) Add(member string) {
+	r.place(member)
+	r.sort()
+}
+
+func (r *Ring) place(member string) {
+	if r.members[member] {
+		return
+	}
+	r.members[member] = true
+
+	for i := 0; i < r.vnodes; i++ {
+		r.points = append(r.points, ringPoint{hash: ringHash(member + "#" + strconv.Itoa(i)), member: member})
+	}
+}
+
+func (r *Ring) sort() {
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].member < r.points[j].member
+	})
+}
+
+// Remove takes member off the ring.
+func (r *Ring) Remove(member string) {
+	if !r.members[member] {
+		return
+	}
+	delete(r.members, member)
+
+	points := r.points[:0]
+	for _, point := range r.points {
+		if point.member != member {
+			points = append(points, point)
+		}
+	}
+	r.points = points
+}
+
+// Members returns the members of the ring in sorted order.
+func (r *Ring) Members() []string {
+	members := make([]string, 0, len(r.members))
+	for member := range r.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	return members
+}
+
+// Get returns the member owning key, or "" when the ring is empty.
+func (r *Ring) Get(key string) string {
+	members := r.Lookup(key, 1)
+	if len(members) == 0 {
+		return ""
+	}
+
+	return members[0]
+}
+
+// Lookup returns up to n distinct members for key, walking the ring
+// clockwise from its hash. The first member is the owner of the key and the
+// others are where its replicas belong.
+func (r *Ring) Lookup(key string, n int) []string {
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+
+	members := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(members) < n; i++ {
+		point := r.points[(start+i)%len(r.points)]
+		if !seen[point.member] {
+			seen[point.member] = true
+			members = append(members, point.member)
+		}
+	}
+
+	return members
+}
+
+// ringHash places a key on the ring. FNV-1a alone leaves keys that only
+// differ in their last bytes close together, so its result is mixed with the
+// splitmix64 finalizer to spread virtual nodes evenly.
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
@@ -0,0 +1,140 @@
+package ingest
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ringKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("service-%d", i)
+	}
+	return keys
+}
+
+func ringMembers(n int) []string {
+	members := make([]string, n)
+	for i := range members {
+		members[i] = fmt.Sprintf("http://storage-%d:8081", i)
+	}
+	return members
+}
+
+func TestRing_Lookup(t *testing.T) {
+	ring := NewRing(VirtualNodes, ringMembers(5)...)
+
+	// Same key should always return the same members
+	first := ring.Lookup("my-service", 3)
+	second := ring.Lookup("my-service", 3)
+
+	if len(first) != 3 {
+		t.Fatalf("expected 3 members, got %v", first)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("lookups differ: %v vs %v", first, second)
+		}
+	}
+
+	// Replicas are distinct members
+	seen := make(map[string]bool)
+	for _, member := range first {
+		if seen[member] {
+			t.Errorf("member %s returned twice in %v", member, first)
+		}
+		seen[member] = true
+	}
+
+	if ring.Get("my-service") != first[0] {
+		t.Errorf("Get should return the first member of Lookup")
+	}
+
+	// Asking for more members than the ring has returns all of them
+	if all := ring.Lookup("my-service", 10); len(all) != 5 {
+		t.Errorf("expected all 5 members, got %v", all)
+	}
+
+	if empty := NewRing(VirtualNodes); empty.Get("my-service") != "" {
+		t.Errorf("empty ring should not return a member")
+	}
+}
+
+func TestRing_Balance(t *testing.T) {
+	members := ringMembers(5)
+	ring := NewRing(VirtualNodes, members...)
+	keys := ringKeys(20000)
+
+	counts := make(map[string]int)
+	for _, key := range keys {
+		counts[ring.Get(key)]++
+	}
+
+	expected := len(keys) / len(members)
+	for _, member := range members {
+		if counts[member] < expected/2 || counts[member] > expected*3/2 {
+			t.Errorf("member %s owns %d keys, expected about %d", member, counts[member], expected)
+		}
+	}
+}
+
+func TestRing_AddMoveKeysOnlyToNewMember(t *testing.T) {
+	members := ringMembers(5)
+	ring := NewRing(VirtualNodes, members[:4]...)
+	keys := ringKeys(20000)
+
+	before := make(map[string]string)
+	for _, key := range keys {
+		before[key] = ring.Get(key)
+	}
+
+	ring.Add(members[4])
+
+	moved := 0
+	for _, key := range keys {
+		owner := ring.Get(key)
+		if owner == before[key] {
+			continue
+		}
+		moved++
+		if owner != members[4] {
+			t.Fatalf("key %s moved from %s to %s instead of the new member", key, before[key], owner)
+		}
+	}
+
+	// Ideally 1/5 of the keys move to the new member
+	if moved == 0 || moved > 2*len(keys)/5 {
+		t.Errorf("%d of %d keys moved, expected about %d", moved, len(keys), len(keys)/5)
+	}
+}
+
+func TestRing_RemoveMovesOnlyKeysOfRemovedMember(t *testing.T) {
+	members := ringMembers(5)
+	ring := NewRing(VirtualNodes, members...)
+	keys := ringKeys(20000)
+
+	before := make(map[string]string)
+	for _, key := range keys {
+		before[key] = ring.Get(key)
+	}
+
+	ring.Remove(members[2])
+
+	for _, key := range keys {
+		owner := ring.Get(key)
+		if owner == members[2] {
+			t.Fatalf("key %s still owned by removed member", key)
+		}
+		if before[key] != members[2] && owner != before[key] {
+			t.Fatalf("key %s moved from %s to %s although its member was not removed", key, before[key], owner)
+		}
+	}
+
+	// Adding the member back restores the original placement
+	ring.Add(members[2])
+	for _, key := range keys {
+		if owner := ring.Get(key); owner != before[key] {
+			t.Fatalf("key %s owned by %s after re-adding, expected %s", key, owner, before[key])
+		}
+	}
+}
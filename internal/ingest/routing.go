@@ -0,0 +1,381 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// Routing places keys on partitions and partitions on storage nodes.
+// This can be overridden for testing or configuration.
+var Routing = NewRoutingTable(4, 1, "http://localhost:8081", "http://localhost:8082")
+
+// RoutingPinsFile is where partitions pinned to storage nodes by a partition
+// move are kept, so an ingest node keeps routing them to where their data is
+// after a restart. Empty keeps pins in memory only.
+// This can be overridden for testing or configuration.
+var RoutingPinsFile = ""
+
+// LegacyPlacement is where partitions were stored before they were placed on
+// the hash ring. An ingest node starting without pins keeps these partitions
+// on their legacy node when it is still a storage node.
+// This can be overridden for testing or configuration.
+var LegacyPlacement = map[int]string{
+	0: "http://localhost:8081",
+	1: "http://localhost:8081",
+	2: "http://localhost:8082",
+	3: "http://localhost:8082",
+}
+
+// ErrPartitionNotFound is returned for partitions the routing table does not
+// have.
+var ErrPartitionNotFound = apierror.New(http.StatusNotFound, "partition not found")
+
+// PartitionAssignment is the storage nodes a partition is placed on, primary
+// first. Pinned partitions were moved and no longer follow the hash ring.
+type PartitionAssignment struct {
+	Partition int      `json:"partition"`
+	Nodes     []string `json:"nodes"`
+	Pinned    bool     `json:"pinned,omitempty"`
+}
+
+// RoutingStatus describes the routing table.
+type RoutingStatus struct {
+	ReplicationFactor int                   `json:"replication_factor"`
+	VirtualNodes      int                   `json:"virtual_nodes"`
+	Nodes             []string              `json:"nodes"`
+	Partitions        []PartitionAssignment `json:"partitions"`
+}
+
+// RoutingTable maps keys to partitions with jump consistent hashing and
+// partitions to storage nodes with a consistent hash ring. Adding a
+// partition only moves the keys it takes over, adding or removing a storage
+// node only the partitions that node takes over or gives up. Partitions
+// pinned after a move stay on their nodes regardless of the ring.
+type RoutingTable struct {
+	mu                sync.RWMutex
+	partitionCount    int
+	replicationFactor int
+	nodes             *Ring
+	pinned            map[int][]string // placements set by Pin, by partition
+}
+
+// NewRoutingTable creates a routing table for partitionCount partitions, each
+// placed on replicationFactor of nodes.
+func NewRoutingTable(partitionCount int, replicationFactor int, nodes ...string) *RoutingTable {
+	if partitionCount <= 0 {
+		partitionCount = 1
+	}
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+
+	return &RoutingTable{
+		partitionCount:    partitionCount,
+		replicationFactor: replicationFactor,
+		nodes:             NewRing(VirtualNodes, nodes...),
+		pinned:            make(map[int][]string),
+	}
+}
+
+func partitionName(partition int) string {
+	return fmt.Sprintf("partition-%d", partition)
+}
+
+// legacyPartitions is how many partitions keys were hashed to, by their
+// FNV-1a hash modulo, before the number of partitions could be changed.
+const legacyPartitions = 4
+
+// PartitionForKey returns the partition key belongs to. Keys start on the
+// partition of their FNV-1a hash modulo four, where ingest nodes always put
+// them, and jump consistent hashing moves them on from there when there are
+// more partitions: growing from n to n+1 partitions moves 1/(n+1) of the
+// keys, all of them to the new partition. Records of a moved key written
+// before and after the change are not ordered with each other. With fewer
+// than four partitions, keys are hashed modulo their number.
+func (t *RoutingTable) PartitionForKey(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	partition := int(h.Sum32() % uint32(min(t.partitionCount, legacyPartitions)))
+	if t.partitionCount <= legacyPartitions {
+		return partition
+	}
+
+	// Jump consistent hashing (Lamping and Veach) walks the partitions a
+	// key jumps to as their number grows. A key stays on one of the first
+	// four with probability 4/n, so the first jump is at 4/r.
+	seed := ringHash(key)
+	next := float64(legacyPartitions) / jumpFraction(&seed)
+	for next < float64(t.partitionCount) {
+		partition = int(next)
+		next = float64(partition+1) / jumpFraction(&seed)
+	}
+
+	return partition
+}
+
+// jumpFraction advances the random sequence of a key and returns its next
+// value in (0, 1].
+func jumpFraction(seed *uint64) float64 {
+	*seed = *seed*2862933555777941757 + 1
+
+	return float64((*seed>>33)+1) / (1 << 31)
+}
+
+// Partitions returns the number of partitions.
+func (t *RoutingTable) Partitions() int {
+	return t.partitionCount
+}
+
+// ReplicationFactor returns how many storage nodes every partition is placed
+// on while there are enough nodes.
+func (t *RoutingTable) ReplicationFactor() int {
+	return t.replicationFactor
+}
+
+// Replicas returns the storage nodes of partition, primary first.
+func (t *RoutingTable) Replicas(partition int) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	nodes, _ := t.replicas(partition)
+
+	return nodes
+}
+
+// Primary returns the storage node that takes the writes of partition, or ""
+// when there are no storage nodes.
+func (t *RoutingTable) Primary(partition int) string {
+	nodes := t.Replicas(partition)
+	if len(nodes) == 0 {
+		return ""
+	}
+
+	return nodes[0]
+}
+
+func (t *RoutingTable) replicas(partition int) ([]string, bool) {
+	if nodes, ok := t.pinned[partition]; ok {
+		return append([]string(nil), nodes...), true
+	}
+
+	return t.nodes.Lookup(partitionName(partition), t.replicationFactor), false
+}
+
+// Pin places partition on nodes, primary first, regardless of the hash ring.
+// Partitions are pinned once their data has been moved to another node.
+func (t *RoutingTable) Pin(partition int, nodes []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pinned[partition] = append([]string(nil), nodes...)
+}
+
+// SavePins writes the pinned partitions to path.
+func (t *RoutingTable) SavePins(path string) error {
+	t.mu.RLock()
+	pins := make(map[string][]string, len(t.pinned))
+	for partition, nodes := range t.pinned {
+		pins[strconv.Itoa(partition)] = nodes
+	}
+	t.mu.RUnlock()
+
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadPins pins the partitions saved to path by SavePins. Without a file,
+// the legacy placement is pinned and saved to path, and every other
+// partition follows the hash ring.
+func (t *RoutingTable) LoadPins(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if t.PinLegacyPlacement() == 0 {
+			return nil
+		}
+		return t.SavePins(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	var pins map[string][]string
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return fmt.Errorf("invalid routing pins in %s: %w", path, err)
+	}
+
+	for key, nodes := range pins {
+		partition, err := strconv.Atoi(key)
+		if err != nil || partition < 0 || partition >= t.partitionCount || len(nodes) == 0 {
+			return fmt.Errorf("invalid routing pin %q in %s", key, path)
+		}
+		t.Pin(partition, nodes)
+	}
+
+	return nil
+}
+
+// PinLegacyPlacement pins the partitions of LegacyPlacement the hash ring
+// would move away from their legacy node, when that node is still a storage
+// node. Their other replicas follow the ring. It returns how many partitions
+// were pinned.
+func (t *RoutingTable) PinLegacyPlacement() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pinned := 0
+	for partition, legacy := range LegacyPlacement {
+		if partition >= t.partitionCount || !slices.Contains(t.nodes.Members(), legacy) {
+			continue
+		}
+		if _, ok := t.pinned[partition]; ok {
+			continue
+		}
+
+		placement := t.nodes.Lookup(partitionName(partition), t.replicationFactor)
+		if len(placement) > 0 && placement[0] == legacy {
+			continue
+		}
+
+		nodes := []string{legacy}
+		for _, node := range t.nodes.Lookup(partitionName(partition), t.replicationFactor+1) {
+			if node != legacy && len(nodes) < t.replicationFactor {
+				nodes = append(nodes, node)
+			}
+		}
+		t.pinned[partition] = nodes
+		pinned++
+	}
+
+	return pinned
+}
+
+// Placement returns the storage nodes the hash ring places partition on,
+// primary first, whether it is pinned or not.
+func (t *RoutingTable) Placement(partition int) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.nodes.Lookup(partitionName(partition), t.replicationFactor)
+}
+
+// Nodes returns the storage nodes in sorted order.
+func (t *RoutingTable) Nodes() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.nodes.Members()
+}
+
+// AddNode adds a storage node, which takes over some partitions from the
+// others.
+func (t *RoutingTable) AddNode(node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nodes.Add(node)
+}
+
+// RemoveNode removes a storage node, its partitions move to the others.
+func (t *RoutingTable) RemoveNode(node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nodes.Remove(node)
+}
+
+// AddNodeKeepingPlacement adds a storage node like AddNode, but pins every
+// partition whose primary the node takes over to the nodes it is on now in
+// the same step, so no write is routed to the new node before the data of
+// the partition has been moved there. It returns the pinned partitions with
+// their nodes.
+func (t *RoutingTable) AddNodeKeepingPlacement(node string) []PartitionAssignment {
+	return t.keepPlacement(func() { t.nodes.Add(node) })
+}
+
+// RemoveNodeKeepingPlacement removes a storage node like RemoveNode, but
+// pins the partitions it leads to the nodes they are on now in the same
+// step. It returns the pinned partitions with their nodes.
+func (t *RoutingTable) RemoveNodeKeepingPlacement(node string) []PartitionAssignment {
+	return t.keepPlacement(func() { t.nodes.Remove(node) })
+}
+
+// keepPlacement changes the ring and pins the partitions that were not
+// pinned and whose primary the change moves to their previous nodes.
+func (t *RoutingTable) keepPlacement(change func()) []PartitionAssignment {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	before := make(map[int][]string, t.partitionCount)
+	for partition := 0; partition < t.partitionCount; partition++ {
+		if _, ok := t.pinned[partition]; !ok {
+			before[partition] = t.nodes.Lookup(partitionName(partition), t.replicationFactor)
+		}
+	}
+
+	change()
+
+	var kept []PartitionAssignment
+	for partition := 0; partition < t.partitionCount; partition++ {
+		nodes := before[partition]
+		if len(nodes) == 0 {
+			continue
+		}
+		if placement := t.nodes.Lookup(partitionName(partition), 1); len(placement) > 0 && placement[0] == nodes[0] {
+			continue
+		}
+
+		t.pinned[partition] = nodes
+		kept = append(kept, PartitionAssignment{Partition: partition, Nodes: nodes})
+	}
+
+	return kept
+}
+
+// Assignments returns the storage nodes of every partition.
+func (t *RoutingTable) Assignments() []PartitionAssignment {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	assignments := make([]PartitionAssignment, 0, t.partitionCount)
+	for partition := 0; partition < t.partitionCount; partition++ {
+		nodes, pinned := t.replicas(partition)
+		if nodes == nil {
+			nodes = []string{}
+		}
+		assignments = append(assignments, PartitionAssignment{Partition: partition, Nodes: nodes, Pinned: pinned})
+	}
+
+	return assignments
+}
+
+// Status returns the storage nodes and the placement of every partition.
+func (t *RoutingTable) Status() RoutingStatus {
+	return RoutingStatus{
+		ReplicationFactor: t.replicationFactor,
+		VirtualNodes:      t.nodes.vnodes,
+		Nodes:             t.Nodes(),
+		Partitions:        t.Assignments(),
+	}
+}
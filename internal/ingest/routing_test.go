@@ -0,0 +1,356 @@
+package ingest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRoutingTable_PartitionForKey(t *testing.T) {
+	routing := NewRoutingTable(8, 1, ringMembers(2)...)
+
+	for _, key := range ringKeys(1000) {
+		partition := routing.PartitionForKey(key)
+		if partition < 0 || partition >= 8 {
+			t.Fatalf("partition %d out of range [0, 8) for key %s", partition, key)
+		}
+		if partition != routing.PartitionForKey(key) {
+			t.Fatalf("same key should produce same partition")
+		}
+	}
+}
+
+func TestRoutingTable_PartitionForKeyIsHashModulo(t *testing.T) {
+	routing := NewRoutingTable(4, 1, ringMembers(2)...)
+
+	// Partitions earlier versions hashed these keys to with FNV-1a % 4
+	for key, partition := range map[string]int{"service-a": 2, "service-b": 3, "service-c": 0, "service-d": 1} {
+		if got := routing.PartitionForKey(key); got != partition {
+			t.Errorf("expected %s on partition %d, got %d", key, partition, got)
+		}
+	}
+}
+
+func TestRoutingTable_AddPartitionMovesMinimalKeys(t *testing.T) {
+	keys := ringKeys(20000)
+
+	for partitions := legacyPartitions; partitions < 16; partitions++ {
+		before := NewRoutingTable(partitions, 1, ringMembers(2)...)
+		after := NewRoutingTable(partitions+1, 1, ringMembers(2)...)
+
+		moved := 0
+		for _, key := range keys {
+			from, to := before.PartitionForKey(key), after.PartitionForKey(key)
+			if from == to {
+				continue
+			}
+			moved++
+			if to != partitions {
+				t.Fatalf("%s moved from partition %d to %d growing to %d partitions", key, from, to, partitions+1)
+			}
+		}
+
+		// Ideally 1/(n+1) of the keys move to the new partition
+		expected := len(keys) / (partitions + 1)
+		if moved < expected/2 || moved > 3*expected/2 {
+			t.Errorf("%d of %d keys moved growing to %d partitions, expected about %d", moved, len(keys), partitions+1, expected)
+		}
+	}
+}
+
+func TestRoutingTable_PartitionForKeyIsBalanced(t *testing.T) {
+	routing := NewRoutingTable(10, 1, ringMembers(2)...)
+	keys := ringKeys(20000)
+
+	counts := make([]int, routing.Partitions())
+	for _, key := range keys {
+		counts[routing.PartitionForKey(key)]++
+	}
+
+	expected := len(keys) / routing.Partitions()
+	for partition, count := range counts {
+		if count < expected*3/4 || count > expected*5/4 {
+			t.Errorf("partition %d got %d keys, expected about %d", partition, count, expected)
+		}
+	}
+}
+
+func TestRoutingTable_LoadPinsKeepsRingPlacement(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.json")
+	nodes := ringMembers(5)
+
+	// An ingest node starting without pins places every partition on the ring
+	routing := NewRoutingTable(256, 1, nodes[:4]...)
+	if err := routing.LoadPins(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, assignment := range routing.Assignments() {
+		if assignment.Pinned {
+			t.Fatalf("expected partition %d to follow the ring, got %+v", assignment.Partition, assignment)
+		}
+	}
+
+	// Only a moved partition is pinned
+	moved := routing.Primary(7)
+	for _, node := range nodes[:4] {
+		if node != moved {
+			moved = node
+			break
+		}
+	}
+	routing.Pin(7, []string{moved})
+
+	before := make(map[int]string)
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		before[partition] = routing.Primary(partition)
+	}
+
+	routing.AddNode(nodes[4])
+
+	changed := 0
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		primary := routing.Primary(partition)
+		if primary == before[partition] {
+			continue
+		}
+		changed++
+		if partition == 7 || primary != nodes[4] {
+			t.Fatalf("partition %d moved from %s to %s", partition, before[partition], primary)
+		}
+	}
+
+	// Ideally 1/5 of the partitions move to the new node, the rest stay put
+	if changed == 0 || changed > 2*routing.Partitions()/5 {
+		t.Errorf("%d of %d partitions moved, expected about %d", changed, routing.Partitions(), routing.Partitions()/5)
+	}
+}
+
+func TestRoutingTable_AddNodeMovesMinimalPartitions(t *testing.T) {
+	nodes := ringMembers(5)
+	routing := NewRoutingTable(256, 1, nodes[:4]...)
+
+	before := make(map[int]string)
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		before[partition] = routing.Primary(partition)
+	}
+
+	routing.AddNode(nodes[4])
+
+	moved := 0
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		primary := routing.Primary(partition)
+		if primary == before[partition] {
+			continue
+		}
+		moved++
+		if primary != nodes[4] {
+			t.Fatalf("partition %d moved from %s to %s instead of the new node", partition, before[partition], primary)
+		}
+	}
+
+	// Ideally 1/5 of the partitions move to the new node
+	if moved == 0 || moved > 2*routing.Partitions()/5 {
+		t.Errorf("%d of %d partitions moved, expected about %d", moved, routing.Partitions(), routing.Partitions()/5)
+	}
+}
+
+func TestRoutingTable_AddNodeKeepingPlacementPinsMovedPartitions(t *testing.T) {
+	nodes := ringMembers(5)
+	routing := NewRoutingTable(64, 2, nodes[:4]...)
+
+	before := make(map[int][]string)
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		before[partition] = routing.Replicas(partition)
+	}
+
+	kept := routing.AddNodeKeepingPlacement(nodes[4])
+	if len(kept) == 0 {
+		t.Fatal("expected the new node to take over some partitions")
+	}
+
+	// Writes keep going to where the data is until it has been moved
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		if replicas := routing.Replicas(partition); replicas[0] != before[partition][0] {
+			t.Errorf("partition %d routed to %v before its data was moved", partition, replicas)
+		}
+	}
+	for _, assignment := range kept {
+		if !slices.Equal(assignment.Nodes, before[assignment.Partition]) {
+			t.Errorf("expected partition %d pinned to %v, got %v", assignment.Partition, before[assignment.Partition], assignment.Nodes)
+		}
+		if placement := routing.Placement(assignment.Partition); placement[0] != nodes[4] {
+			t.Errorf("expected partition %d placed on the new node, got %v", assignment.Partition, placement)
+		}
+	}
+}
+
+func TestRoutingTable_RemoveNodeMovesOnlyItsPartitions(t *testing.T) {
+	nodes := ringMembers(5)
+	routing := NewRoutingTable(256, 3, nodes...)
+
+	before := make(map[int][]string)
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		before[partition] = routing.Replicas(partition)
+	}
+
+	routing.RemoveNode(nodes[1])
+
+	for partition := 0; partition < routing.Partitions(); partition++ {
+		replicas := routing.Replicas(partition)
+
+		// Replicas that stay keep their order, the removed node is replaced
+		// by the next node on the ring
+		var kept []string
+		for _, node := range before[partition] {
+			if node != nodes[1] {
+				kept = append(kept, node)
+			}
+		}
+		for i, node := range kept {
+			if replicas[i] != node {
+				t.Fatalf("partition %d replicas changed from %v to %v", partition, before[partition], replicas)
+			}
+		}
+		if len(replicas) != 3 {
+			t.Fatalf("partition %d has %d replicas, expected 3", partition, len(replicas))
+		}
+	}
+}
+
+func TestRoutingTable_Replicas(t *testing.T) {
+	routing := NewRoutingTable(16, 3, ringMembers(2)...)
+
+	// Replication factor is capped by the number of nodes
+	for _, assignment := range routing.Assignments() {
+		if len(assignment.Nodes) != 2 {
+			t.Fatalf("partition %d has nodes %v, expected 2", assignment.Partition, assignment.Nodes)
+		}
+		if assignment.Nodes[0] != routing.Primary(assignment.Partition) {
+			t.Errorf("first node of partition %d should be its primary", assignment.Partition)
+		}
+	}
+
+	routing.AddNode("http://storage-2:8081")
+	for _, assignment := range routing.Assignments() {
+		if len(assignment.Nodes) != 3 {
+			t.Fatalf("partition %d has nodes %v, expected 3", assignment.Partition, assignment.Nodes)
+		}
+	}
+}
+
+func TestHandleRouting(t *testing.T) {
+	originalRouting := Routing
+	Routing = NewRoutingTable(4, 2, ringMembers(3)...)
+	defer func() { Routing = originalRouting }()
+
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/admin/routing", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleRouting(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var response RoutingStatus
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if response.ReplicationFactor != 2 || len(response.Nodes) != 3 || len(response.Partitions) != 4 {
+		t.Errorf("unexpected routing status: %+v", response)
+	}
+	for _, assignment := range response.Partitions {
+		if len(assignment.Nodes) != 2 {
+			t.Errorf("partition %d has nodes %v, expected 2", assignment.Partition, assignment.Nodes)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/admin/routing", nil)
+	w = httptest.NewRecorder()
+
+	handler.HandleRouting(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", w.Code)
+	}
+}
+
+func TestRoutingTable_PinsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.json")
+
+	routing := NewRoutingTable(4, 1, ringMembers(2)...)
+	moved := "http://storage-9:8081"
+	routing.Pin(2, []string{moved})
+
+	if routing.Primary(2) != moved {
+		t.Fatalf("expected pinned partition on %s, got %s", moved, routing.Primary(2))
+	}
+	if err := routing.SavePins(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restarted := NewRoutingTable(4, 1, ringMembers(2)...)
+	if err := restarted.LoadPins(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, assignment := range restarted.Assignments() {
+		if assignment.Partition == 2 {
+			if !assignment.Pinned || assignment.Nodes[0] != moved {
+				t.Errorf("expected partition 2 pinned to %s, got %+v", moved, assignment)
+			}
+			continue
+		}
+		if assignment.Pinned || assignment.Nodes[0] != routing.Primary(assignment.Partition) {
+			t.Errorf("unexpected assignment %+v", assignment)
+		}
+	}
+
+	// Adding nodes does not move pinned partitions
+	restarted.AddNode("http://storage-3:8081")
+	if restarted.Primary(2) != moved {
+		t.Errorf("pinned partition moved to %s", restarted.Primary(2))
+	}
+
+	if err := NewRoutingTable(4, 1).LoadPins(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("missing pins file should not fail, got %v", err)
+	}
+}
+
+func TestRoutingTable_LoadPinsSeedsLegacyPlacement(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.json")
+
+	routing := NewRoutingTable(8, 2, "http://localhost:8081", "http://localhost:8082", "http://localhost:8083")
+	if err := routing.LoadPins(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for partition, legacy := range LegacyPlacement {
+		nodes := routing.Replicas(partition)
+		if len(nodes) != 2 || nodes[0] != legacy || nodes[1] == legacy {
+			t.Errorf("expected partition %d on %s and another replica, got %v", partition, legacy, nodes)
+		}
+	}
+	for partition := len(LegacyPlacement); partition < routing.Partitions(); partition++ {
+		if !slices.Equal(routing.Replicas(partition), routing.Placement(partition)) {
+			t.Errorf("expected partition %d to follow the ring, got %v", partition, routing.Replicas(partition))
+		}
+	}
+
+	// The seeded pins are saved and loaded again after a restart
+	restarted := NewRoutingTable(8, 2, "http://localhost:8081", "http://localhost:8082", "http://localhost:8083")
+	if err := restarted.LoadPins(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for partition := range LegacyPlacement {
+		if !slices.Equal(restarted.Replicas(partition), routing.Replicas(partition)) {
+			t.Errorf("partition %d moved to %v after restart", partition, restarted.Replicas(partition))
+		}
+	}
+}
@@ -1,21 +1,171 @@
 package ingest
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
 type Service struct {
 	storage *StorageClient
+	queue   *ingestQueue
+
+	// Partition moves pause writes to their partition with its gate.
+	gates partitionGates
+	moves moves
+
+	wal *wal
+
+	members membership
+	dedup   dedupCache
+
+	// Background jobs run until stop is closed.
+	stop       chan struct{}
+	background sync.WaitGroup
 }
 
 func NewService(storage *StorageClient) *Service {
 	return &Service{storage: storage}
 }
 
-func (s *Service) Ingest(logs []IncomingLogBody, clientIP string) error {
+// Open loads the WAL under WALDir, if configured, and starts replaying the
+// batches waiting in it. With a QueueCapacity, it also starts the workers of
+// the asynchronous ingest queue. When partitions are replicated, it keeps
+// their followers on their leaders every ReplicationSyncInterval. With
+// MetadataNodes, it routes partitions according to the cluster metadata.
+// Every HealthCheckInterval, it health checks the storage nodes, keeps the
+// unhealthy ones off the hash ring and moves partitions as the ring changes.
+func (s *Service) Open() error {
+	s.stop = make(chan struct{})
+
+	if WALDir != "" {
+		wal, err := openWAL(WALDir)
+		if err != nil {
+			return err
+		}
+
+		s.wal = wal
+
+		s.background.Add(1)
+		go s.runReplay(s.stop)
+	}
+
+	if len(MetadataNodes) > 0 {
+		s.background.Add(1)
+		go s.runMetadataWatch(s.stop)
+	}
+
+	for _, node := range Routing.Nodes() {
+		s.members.add(node, MemberStatic)
+	}
+	if MembersFile != "" {
+		if err := s.loadMembersFile(MembersFile); err != nil {
+			return err
+		}
+		s.updateRing()
+	}
+	if HealthCheckInterval > 0 {
+		s.background.Add(1)
+		go s.runMembership(s.stop)
+	}
+
+	if Routing.ReplicationFactor() > 1 && ReplicationSyncInterval > 0 {
+		s.background.Add(1)
+		go s.runReplicationSync(s.stop)
+	}
+
+	if QueueCapacity > 0 {
+		s.queue = newIngestQueue(QueueCapacity, QueueWorkers, func(batch queuedBatch) error {
+			_, err := s.forward(withDedupKey(context.Background(), batch.key), batch.partitions, AcksLeader)
+			return err
+		})
+	}
+
+	return nil
+}
+
+// Close forwards the batches left in the ingest queue, waits for writes with
+// AcksNone still being forwarded and stops the background jobs. Batches
+// still waiting in the WAL are replayed after the next Open.
+func (s *Service) Close() {
+	if s.queue != nil {
+		s.queue.close()
+	}
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.background.Wait()
+}
+
+// Submit ingests logs according to acks. With AcksAll they are forwarded
+// synchronously, with AcksLeader too unless the ingest queue is enabled, and
+// with AcksNone they are forwarded in the background or through the ingest
+// queue. Queued batches are forwarded with AcksLeader. Partitions that are
+// not stored yet are reported as queued without offsets, and ErrQueueFull is
+// returned when the queue has no room for them.
+func (s *Service) Submit(ctx context.Context, logs []IncomingLogBody, clientIP string, acks Acks) ([]AppendResult, error) {
+	return s.submit(ctx, partitionLogs(logs, clientIP), acks)
+}
+
+func (s *Service) submit(ctx context.Context, partitionedLogs map[int][]LogEntry, acks Acks) ([]AppendResult, error) {
+	if acks == AcksAll || (acks == AcksLeader && s.queue == nil) {
+		return s.forward(ctx, partitionedLogs, acks)
+	}
+
+	if s.queue != nil {
+		if err := s.queue.enqueue(ctx, queuedBatch{key: dedupKey(ctx), partitions: partitionedLogs}); err != nil {
+			return nil, err
+		}
+	} else {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			if _, err := s.forward(withDedupKey(context.Background(), dedupKey(ctx)), partitionedLogs, AcksNone); err != nil {
+				fmt.Println("[INGEST/ACKS]", "acks=", AcksNone, "error=", err)
+			}
+		}()
+	}
+
+	return queued(partitionedLogs), nil
+}
+
+// queued reports every partition of a batch as queued.
+func queued(partitionedLogs map[int][]LogEntry) []AppendResult {
+	results := make([]AppendResult, 0, len(partitionedLogs))
+	for partition := range partitionedLogs {
+		results = append(results, AppendResult{Partition: partition, Queued: true})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Partition < results[j].Partition
+	})
+
+	return results
+}
+
+// QueueStats describes the ingest queue.
+func (s *Service) QueueStats() QueueStats {
+	if s.queue == nil {
+		return QueueStats{}
+	}
+
+	return s.queue.stats()
+}
+
+// Ingest enriches and partitions logs, forwards the partitions to their
+// storage nodes with one request per node and returns the offsets each batch
+// landed at, ordered by partition, once their leaders stored them.
+func (s *Service) Ingest(ctx context.Context, logs []IncomingLogBody, clientIP string) ([]AppendResult, error) {
+	return s.forward(ctx, partitionLogs(logs, clientIP), AcksLeader)
+}
+
+// partitionLogs enriches logs and groups them by partition.
+func partitionLogs(logs []IncomingLogBody, clientIP string) map[int][]LogEntry {
 	partitionedLogs := make(map[int][]LogEntry)
 
 	for _, incomingLog := range logs {
@@ -25,43 +175,213 @@ func (s *Service) Ingest(logs []IncomingLogBody, clientIP string) error {
 		partitionedLogs[partition] = append(partitionedLogs[partition], enriched)
 	}
 
-	// IMPROVEMENT: Use errgroup instead of using waitgroup and channels
-	var wg sync.WaitGroup
-	errChannel := make(chan error, len(partitionedLogs))
+	return partitionedLogs
+}
+
+// forward sends partitioned logs to their storage nodes, which answer once
+// acks is met. Writes with AcksAll are never written to the WAL instead.
+func (s *Service) forward(ctx context.Context, partitionedLogs map[int][]LogEntry, acks Acks) ([]AppendResult, error) {
+	var results []AppendResult
+	var errs []error
 
+	// Batches must not overtake batches of the same partition still waiting
+	// in the WAL.
+	direct := make(map[int][]LogEntry)
 	for partition, logs := range partitionedLogs {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+		logsPrint(partition, logs)
 
-			err := s.storage.Append(partition, logs)
-			if err != nil {
-				errChannel <- fmt.Errorf("failed to append to partition %d: %w", partition, err)
+		if s.wal != nil && s.wal.hasPending(partition) {
+			if acks == AcksAll {
+				err := fmt.Errorf("earlier batches are waiting in the WAL: %w", ErrNotEnoughReplicas)
+				results, errs = collect(results, errs, partition, AppendResult{}, err)
+				continue
 			}
-		}()
+			result, err := s.writeToWAL(partition, dedupKey(ctx), logs)
+			results, errs = collect(results, errs, partition, result, err)
+			continue
+		}
+		direct[partition] = logs
+	}
 
-		logsPrint(partition, logs)
+	partitions := make([]int, 0, len(direct))
+	for partition := range direct {
+		partitions = append(partitions, partition)
 	}
+	release := s.gates.enter(partitions)
+	defer release()
 
-	wg.Wait()
-	close(errChannel)
+	for partition, outcome := range s.storage.AppendBatch(ctx, direct, acks) {
+		result, err := outcome.Result, outcome.Err
+		if err != nil && acks == AcksAll {
+			err = quorumError(err)
+		} else if err != nil && s.wal != nil && retryable(err, dedupKey(ctx) != "") {
+			fmt.Println("[INGEST/WAL]", "partition=", partition, "queueing after error=", err)
+			result, err = s.writeToWAL(partition, dedupKey(ctx), direct[partition])
+		}
+		results, errs = collect(results, errs, partition, result, err)
+	}
 
-	var errs []error
-	for err := range errChannel {
-		errs = append(errs, err)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Partition < results[j].Partition
+	})
+
+	return results, errors.Join(errs...)
+}
+
+func collect(results []AppendResult, errs []error, partition int, result AppendResult, err error) ([]AppendResult, []error) {
+	if err != nil {
+		return results, append(errs, &PartitionError{Partition: partition, Err: err})
+	}
+
+	return append(results, result), errs
+}
+
+// PartitionError is returned, joined with the others, for every partition of
+// a batch that could not be stored or queued.
+type PartitionError struct {
+	Partition int
+	Err       error
+}
+
+func (e *PartitionError) Error() string {
+	return fmt.Sprintf("failed to append to partition %d: %v", e.Partition, e.Err)
+}
+
+func (e *PartitionError) Unwrap() error {
+	return e.Err
+}
+
+// partitionErrors returns the errors of the partitions that failed, by
+// partition.
+func partitionErrors(err error) map[int]error {
+	failures := make(map[int]error)
+	addPartitionErrors(failures, err)
+
+	return failures
+}
+
+func addPartitionErrors(failures map[int]error, err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			addPartitionErrors(failures, err)
+		}
+		return
+	}
+
+	var partitionErr *PartitionError
+	if errors.As(err, &partitionErr) {
+		failures[partitionErr.Partition] = partitionErr.Err
+	}
+}
+
+// writeToWAL writes a batch to the WAL, with the idempotency key it was
+// accepted with, or a new one, and the storage node it is routed to, to be
+// delivered later and reports it as queued.
+func (s *Service) writeToWAL(partition int, key string, logs []LogEntry) (AppendResult, error) {
+	if key == "" {
+		// Replays of a batch that timed out must not store it twice
+		key = "wal-" + rand.Text()
+	}
+	if err := s.wal.write(partition, Routing.Primary(partition), key, logs); err != nil {
+		return AppendResult{}, fmt.Errorf("failed to write to the WAL: %w", err)
+	}
+
+	return AppendResult{Partition: partition, Queued: true}, nil
+}
+
+// runReplay retries the batches waiting in the WAL every WALReplayInterval.
+func (s *Service) runReplay(stop chan struct{}) {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(WALReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.replay()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// replay delivers the batches waiting in the WAL oldest first, stopping at
+// the first batch of a partition that still cannot be delivered. Batches
+// older than HintMaxAge are dropped instead. Batches are sent with the
+// idempotency key the WAL keeps for them, so a batch the storage node
+// already stored before its attempt timed out is not stored again.
+func (s *Service) replay() {
+	for _, partition := range s.wal.partitions() {
+		if dropped, err := s.wal.expire(partition, time.Now()); err != nil {
+			fmt.Println("[INGEST/WAL]", "partition=", partition, "error=", err)
+		} else if dropped > 0 {
+			fmt.Println("[INGEST/WAL]", "partition=", partition, "dropped expired batches=", dropped)
+		}
+
+		for {
+			seq, entry, ok, err := s.wal.oldest(partition)
+			if err != nil {
+				fmt.Println("[INGEST/WAL]", "partition=", partition, "error=", err)
+				break
+			}
+			if !ok {
+				break
+			}
+
+			ctx := withDedupKey(context.Background(), entry.Key)
+			release := s.gates.enter([]int{partition})
+			outcome := s.storage.AppendBatch(ctx, map[int][]LogEntry{partition: entry.Logs}, AcksLeader)[partition]
+			release()
+			result, err := outcome.Result, outcome.Err
+			if err != nil && retryable(err, true) {
+				fmt.Println("[INGEST/WAL]", "partition=", partition, "replay error=", err)
+				break
+			}
+			if err != nil {
+				// Retrying a rejected batch would block the partition forever.
+				fmt.Println("[INGEST/WAL]", "partition=", partition, "dropping rejected batch", seq, "error=", err)
+			} else {
+				fmt.Println(
+					"[INGEST/WAL]",
+					"partition=", partition,
+					"replayed=", len(entry.Logs),
+					"base_offset=", result.BaseOffset,
+					"last_offset=", result.LastOffset,
+				)
+			}
+
+			if err := s.wal.remove(partition, seq); err != nil {
+				fmt.Println("[INGEST/WAL]", "partition=", partition, "error=", err)
+				break
+			}
+		}
+	}
+}
+
+// Hints returns the batches waiting in the WAL for their storage nodes.
+func (s *Service) Hints() HintStats {
+	if s.wal == nil {
+		return HintStats{Partitions: []HintStatus{}}
 	}
 
-	return errors.Join(errs...)
+	return s.wal.stats()
 }
 
-func (s *Service) Query(service string, limit int) ([]LogEntry, error) {
+// Query reads a page of the partition the service is stored in.
+func (s *Service) Query(ctx context.Context, service string, req ReadRequest) (ReadResult, error) {
 	partition := partitionForKey(service)
-	logs, err := s.storage.Read(partition, limit)
+	result, err := s.storage.Read(ctx, partition, req)
 	if err != nil {
-		return nil, err
+		return ReadResult{}, err
 	}
 
-	return logs, nil
+	return result, nil
+}
+
+// Breakers returns the circuit breaker state of every storage node.
+func (s *Service) Breakers() []BreakerStatus {
+	return s.storage.Breakers()
 }
 
 func enrich(incomingLog IncomingLogBody, clientIP string) LogEntry {
@@ -1,6 +1,7 @@
 package ingest
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -18,8 +19,8 @@ func TestPartitionForKey(t *testing.T) {
 	}
 
 	// Partition should be within range
-	if p1 < 0 || p1 >= partitionCount {
-		t.Errorf("partition %d out of range [0, %d)", p1, partitionCount)
+	if p1 < 0 || p1 >= Routing.Partitions() {
+		t.Errorf("partition %d out of range [0, %d)", p1, Routing.Partitions())
 	}
 }
 
@@ -32,8 +33,8 @@ func TestPartitionForKey_DifferentKeys(t *testing.T) {
 		p := partitionForKey(key)
 		partitions[p] = true
 
-		if p < 0 || p >= partitionCount {
-			t.Errorf("partition %d out of range [0, %d) for key %s", p, partitionCount, key)
+		if p < 0 || p >= Routing.Partitions() {
+			t.Errorf("partition %d out of range [0, %d) for key %s", p, Routing.Partitions(), key)
 		}
 	}
 }
@@ -81,28 +82,18 @@ func TestEnrich(t *testing.T) {
 func TestServiceIngest(t *testing.T) {
 	var receivedLogs []LogEntry
 	var mu sync.Mutex
-	mockStorage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var logs []LogEntry
-		json.NewDecoder(r.Body).Decode(&logs)
+	mockStorage := httptest.NewServer(mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
 		mu.Lock()
 		receivedLogs = append(receivedLogs, logs...)
 		mu.Unlock()
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
+		return AppendResult{LastOffset: uint64(len(logs) - 1)}
 	}))
 	defer mockStorage.Close()
 
-	// Point all partitions to mock server
-	originalURLs := make(map[int]string)
-	for k, v := range StorageNodeURLs {
-		originalURLs[k] = v
-		StorageNodeURLs[k] = mockStorage.URL
-	}
-	defer func() {
-		for k, v := range originalURLs {
-			StorageNodeURLs[k] = v
-		}
-	}()
+	// Route all partitions to mock server
+	originalRouting := Routing
+	Routing = NewRoutingTable(originalRouting.Partitions(), 1, mockStorage.URL)
+	defer func() { Routing = originalRouting }()
 
 	storage := NewStorageClient()
 	service := NewService(storage)
@@ -122,7 +113,7 @@ func TestServiceIngest(t *testing.T) {
 		},
 	}
 
-	err := service.Ingest(incomingLogs, "10.0.0.1")
+	_, err := service.Ingest(context.Background(), incomingLogs, "10.0.0.1")
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -137,23 +128,60 @@ func TestServiceIngest(t *testing.T) {
 	}
 }
 
+func TestServiceIngest_ReturnsOffsets(t *testing.T) {
+	mockStorage := httptest.NewServer(mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
+		return AppendResult{
+			Partition:  partition,
+			BaseOffset: 100,
+			LastOffset: 100 + uint64(len(logs)) - 1,
+		}
+	}))
+	defer mockStorage.Close()
+
+	// Route all partitions to mock server
+	originalRouting := Routing
+	Routing = NewRoutingTable(originalRouting.Partitions(), 1, mockStorage.URL)
+	defer func() { Routing = originalRouting }()
+
+	service := NewService(NewStorageClient())
+
+	services := []string{"service-a", "service-b", "service-c", "service-d", "service-e"}
+	var incomingLogs []IncomingLogBody
+	expected := make(map[int]uint64)
+	for _, name := range services {
+		incomingLogs = append(incomingLogs, IncomingLogBody{Service: name, Message: "test"})
+		expected[partitionForKey(name)]++
+	}
+
+	results, err := service.Ingest(context.Background(), incomingLogs, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d partition results, got %d", len(expected), len(results))
+	}
+
+	for i, result := range results {
+		if i > 0 && results[i-1].Partition >= result.Partition {
+			t.Errorf("expected results ordered by partition, got %+v", results)
+		}
+		if result.BaseOffset != 100 || result.LastOffset != 100+expected[result.Partition]-1 {
+			t.Errorf("unexpected offsets for partition %d: %+v", result.Partition, result)
+		}
+	}
+}
+
 func TestServiceIngest_StorageError(t *testing.T) {
 	mockStorage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 	}))
 	defer mockStorage.Close()
 
-	// Point all partitions to mock server
-	originalURLs := make(map[int]string)
-	for k, v := range StorageNodeURLs {
-		originalURLs[k] = v
-		StorageNodeURLs[k] = mockStorage.URL
-	}
-	defer func() {
-		for k, v := range originalURLs {
-			StorageNodeURLs[k] = v
-		}
-	}()
+	// Route all partitions to mock server
+	originalRouting := Routing
+	Routing = NewRoutingTable(originalRouting.Partitions(), 1, mockStorage.URL)
+	defer func() { Routing = originalRouting }()
 
 	storage := NewStorageClient()
 	service := NewService(storage)
@@ -166,7 +194,7 @@ func TestServiceIngest_StorageError(t *testing.T) {
 		},
 	}
 
-	err := service.Ingest(incomingLogs, "10.0.0.1")
+	_, err := service.Ingest(context.Background(), incomingLogs, "10.0.0.1")
 
 	if err == nil {
 		t.Error("expected error when storage fails, got nil")
@@ -191,31 +219,26 @@ func TestServiceQuery(t *testing.T) {
 	mockStorage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(mockLogs)
+		json.NewEncoder(w).Encode(ReadResult{Logs: mockLogs, NextOffset: 1})
 	}))
 	defer mockStorage.Close()
 
-	// Point all partitions to mock server
-	originalURLs := make(map[int]string)
-	for k, v := range StorageNodeURLs {
-		originalURLs[k] = v
-		StorageNodeURLs[k] = mockStorage.URL
-	}
-	defer func() {
-		for k, v := range originalURLs {
-			StorageNodeURLs[k] = v
-		}
-	}()
+	// Route all partitions to mock server
+	originalRouting := Routing
+	Routing = NewRoutingTable(originalRouting.Partitions(), 1, mockStorage.URL)
+	defer func() { Routing = originalRouting }()
 
 	storage := &StorageClient{}
 	service := NewService(storage)
 
-	logs, err := service.Query("test-service", 10)
+	result, err := service.Query(context.Background(), "test-service", ReadRequest{Limit: 10})
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
+	logs := result.Logs
+
 	if len(logs) != 1 {
 		t.Fatalf("expected 1 log, got %d", len(logs))
 	}
@@ -231,22 +254,15 @@ func TestServiceQuery_StorageError(t *testing.T) {
 	}))
 	defer mockStorage.Close()
 
-	// Point all partitions to mock server
-	originalURLs := make(map[int]string)
-	for k, v := range StorageNodeURLs {
-		originalURLs[k] = v
-		StorageNodeURLs[k] = mockStorage.URL
-	}
-	defer func() {
-		for k, v := range originalURLs {
-			StorageNodeURLs[k] = v
-		}
-	}()
+	// Route all partitions to mock server
+	originalRouting := Routing
+	Routing = NewRoutingTable(originalRouting.Partitions(), 1, mockStorage.URL)
+	defer func() { Routing = originalRouting }()
 
 	storage := &StorageClient{}
 	service := NewService(storage)
 
-	_, err := service.Query("test-service", 10)
+	_, err := service.Query(context.Background(), "test-service", ReadRequest{Limit: 10})
 
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -2,87 +2,404 @@ package ingest
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
 )
 
-// StorageNodeURLs maps partition numbers to storage node URLs.
-// This can be overridden for testing or configuration.
-var StorageNodeURLs = map[int]string{
-	0: "http://localhost:8081",
-	1: "http://localhost:8081",
-	2: "http://localhost:8082",
-	3: "http://localhost:8082",
+// AppendResult is the range of offsets a storage node assigned to a batch.
+// Queued batches were written to the WAL instead and have no offsets yet.
+type AppendResult struct {
+	Partition  int    `json:"partition"`
+	BaseOffset uint64 `json:"base_offset"`
+	LastOffset uint64 `json:"last_offset"`
+	Queued     bool   `json:"queued,omitempty"`
+	Duplicate  bool   `json:"duplicate,omitempty"`
+}
+
+// StatusError is returned when a storage node answers with an unexpected
+// status code. Code and Message are taken from the error body of the
+// response, if any.
+type StatusError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("storage returned %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("storage returned %d", e.StatusCode)
+}
+
+// retryable reports whether a failed append may be sent again later without
+// storing it twice, which only idempotent appends may after an ambiguous
+// failure. Requests the storage node rejected as invalid never succeed.
+func retryable(err error, idempotent bool) bool {
+	return errors.Is(err, ErrBreakerOpen) || shouldRetry(err, idempotent)
+}
+
+// BatchResult is the outcome of appending one partition of a batch.
+type BatchResult struct {
+	Result AppendResult
+	Err    error
+}
+
+type partitionBatch struct {
+	Partition int        `json:"partition"`
+	Key       string     `json:"key,omitempty"`
+	Logs      []LogEntry `json:"logs"`
+}
+
+type batchRequest struct {
+	Partitions []partitionBatch `json:"partitions"`
+}
+
+type batchResponse struct {
+	Results []struct {
+		AppendResult
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
+
+// ReadRequest selects a page of a partition. Without FromOffset the last
+// Limit entries are returned.
+type ReadRequest struct {
+	FromOffset *uint64
+	Limit      int
+	MaxBytes   int64
+}
+
+// ReadResult is a page of a partition and the offset the next page starts at.
+// EndOffset is the offset the next record appended to the partition gets.
+type ReadResult struct {
+	Partition  int        `json:"partition"`
+	Logs       []LogEntry `json:"logs"`
+	NextOffset uint64     `json:"next_offset"`
+	EndOffset  uint64     `json:"end_offset"`
 }
 
 type StorageClient struct {
-	client *http.Client
+	client   *http.Client
+	retry    RetryPolicy
+	breakers breakers
 }
 
 func NewStorageClient() *StorageClient {
 	return &StorageClient{
 		client: &http.Client{},
+		retry:  DefaultRetryPolicy,
 	}
 }
 
-func (node *StorageClient) Append(partition int, logs []LogEntry) error {
+// Append stores logs on the storage node of the partition, which answers
+// once acks is met. Appends are only retried when the storage node cannot
+// have stored them.
+func (node *StorageClient) Append(ctx context.Context, partition int, logs []LogEntry, acks Acks) (AppendResult, error) {
 	payload, err := json.Marshal(logs)
 	if err != nil {
-		return err
+		return AppendResult{}, err
 	}
 
-	url := node.URL(partition) + "/v1/storage?partition=" + strconv.Itoa(partition)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	path := "/v1/storage?partition=" + strconv.Itoa(partition) + "&acks=" + string(acks)
+
+	body, err := node.do(ctx, false, http.MethodPost, node.URL(partition), path, payload)
 	if err != nil {
-		return err
+		return AppendResult{}, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	var result AppendResult
 
-	response, err := node.client.Do(req)
+	err = json.Unmarshal(body, &result)
 	if err != nil {
-		return err
+		return AppendResult{}, fmt.Errorf("invalid storage response: %w", err)
 	}
 
-	defer response.Body.Close()
+	return result, nil
+}
 
-	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		return fmt.Errorf("storage returned %d", response.StatusCode)
+// AppendBatch stores the logs of several partitions with one request per
+// storage node, answered once acks is met, and returns the outcome of every
+// partition. The idempotency key ctx carries is sent with every partition,
+// so storage nodes store each of them once per key.
+func (node *StorageClient) AppendBatch(ctx context.Context, batches map[int][]LogEntry, acks Acks) map[int]BatchResult {
+	key := dedupKey(ctx)
+
+	byNode := make(map[string][]partitionBatch)
+	for partition, logs := range batches {
+		url := node.URL(partition)
+		byNode[url] = append(byNode[url], partitionBatch{Partition: partition, Key: key, Logs: logs})
+	}
+
+	var mu sync.Mutex
+	results := make(map[int]BatchResult, len(batches))
+
+	var wg sync.WaitGroup
+	for url, partitions := range byNode {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			nodeResults := node.appendNode(ctx, url, partitions, acks)
+
+			mu.Lock()
+			for partition, result := range nodeResults {
+				results[partition] = result
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// appendNode sends the batches of the partitions owned by one storage node.
+// When the request itself fails, every partition in it fails with the same
+// error. Batches sent with a key are retried like reads, as the storage
+// node does not store them twice.
+func (node *StorageClient) appendNode(ctx context.Context, url string, partitions []partitionBatch, acks Acks) map[int]BatchResult {
+	results := make(map[int]BatchResult, len(partitions))
+
+	failAll := func(err error) map[int]BatchResult {
+		for _, batch := range partitions {
+			results[batch.Partition] = BatchResult{Err: err}
+		}
+		return results
+	}
+
+	payload, err := json.Marshal(batchRequest{Partitions: partitions})
+	if err != nil {
+		return failAll(err)
+	}
+
+	idempotent := partitions[0].Key != ""
+
+	body, err := node.do(ctx, idempotent, http.MethodPost, url, "/v1/storage/batch?acks="+string(acks), payload)
+	if err != nil {
+		return failAll(err)
 	}
 
-	return nil
+	var response batchResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return failAll(fmt.Errorf("invalid storage response: %w", err))
+	}
+
+	for _, result := range response.Results {
+		if _, ok := results[result.Partition]; ok || !requested(partitions, result.Partition) {
+			continue
+		}
+		if result.Status < 200 || result.Status >= 300 {
+			results[result.Partition] = BatchResult{Err: fmt.Errorf("%s: %w", result.Error, &StatusError{StatusCode: result.Status})}
+			continue
+		}
+		results[result.Partition] = BatchResult{Result: result.AppendResult}
+	}
+
+	for _, batch := range partitions {
+		if _, ok := results[batch.Partition]; !ok {
+			results[batch.Partition] = BatchResult{Err: fmt.Errorf("storage returned no result for partition %d", batch.Partition)}
+		}
+	}
+
+	return results
 }
 
-func (node *StorageClient) Read(partition int, limit int) ([]LogEntry, error) {
-	if limit < 0 {
-		return nil, fmt.Errorf("invalid value for limit query param")
+func requested(partitions []partitionBatch, partition int) bool {
+	for _, batch := range partitions {
+		if batch.Partition == partition {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (node *StorageClient) Read(ctx context.Context, partition int, req ReadRequest) (ReadResult, error) {
+	return node.ReadNode(ctx, node.URL(partition), partition, req)
+}
+
+// ReadNode reads a page of partition from a given storage node instead of
+// the one it is routed to.
+func (node *StorageClient) ReadNode(ctx context.Context, nodeURL string, partition int, req ReadRequest) (ReadResult, error) {
+	if req.Limit < 0 {
+		return ReadResult{}, fmt.Errorf("invalid value for limit query param")
+	}
+
+	query := url.Values{}
+	query.Set("partition", strconv.Itoa(partition))
+	query.Set("limit", strconv.Itoa(req.Limit))
+	if req.FromOffset != nil {
+		query.Set("from_offset", strconv.FormatUint(*req.FromOffset, 10))
+	}
+	if req.MaxBytes > 0 {
+		query.Set("max_bytes", strconv.FormatInt(req.MaxBytes, 10))
 	}
 
-	url := node.URL(partition) + "/v1/read?partition=" + strconv.Itoa(partition) + "&limit=" + strconv.Itoa(limit)
-	response, err := http.Get(url)
+	body, err := node.do(ctx, true, http.MethodGet, nodeURL, "/v1/read?"+query.Encode(), nil)
+	if err != nil {
+		return ReadResult{}, err
+	}
+
+	var result ReadResult
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return ReadResult{}, err
+	}
+	result.Partition = partition
+
+	return result, nil
+}
+
+// Replicate stores logs copied from another storage node on nodeURL with
+// the offsets they already have and returns the next offset of the partition
+// there. Logs the node already has are skipped, so it is safe to retry.
+func (node *StorageClient) Replicate(ctx context.Context, nodeURL string, partition int, logs []LogEntry) (uint64, error) {
+	if logs == nil {
+		logs = []LogEntry{}
+	}
+
+	payload, err := json.Marshal(logs)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := node.do(ctx, true, http.MethodPost, nodeURL, "/v1/replicate?partition="+strconv.Itoa(partition), payload)
+	if err != nil {
+		return 0, err
+	}
+
+	var response struct {
+		NextOffset uint64 `json:"next_offset"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, fmt.Errorf("invalid storage response: %w", err)
+	}
+
+	return response.NextOffset, nil
+}
+
+// Fence stops partition on nodeURL from accepting writes, or lets it accept
+// them again when fenced is false.
+func (node *StorageClient) Fence(ctx context.Context, nodeURL string, partition int, fenced bool) error {
+	method := http.MethodPost
+	if !fenced {
+		method = http.MethodDelete
+	}
+
+	_, err := node.do(ctx, true, method, nodeURL, "/v1/fence?partition="+strconv.Itoa(partition), nil)
+
+	return err
+}
+
+// DeletePartition removes partition from nodeURL.
+func (node *StorageClient) DeletePartition(ctx context.Context, nodeURL string, partition int) error {
+	_, err := node.do(ctx, false, http.MethodDelete, nodeURL, "/v1/partition?partition="+strconv.Itoa(partition), nil)
+
+	return err
+}
+
+// Follow makes nodeURL a follower of partition on leader.
+func (node *StorageClient) Follow(ctx context.Context, nodeURL string, partition int, leader string) error {
+	payload, err := json.Marshal(map[string]any{"partition": partition, "leader": leader})
+	if err != nil {
+		return err
+	}
+
+	_, err = node.do(ctx, true, http.MethodPost, nodeURL, "/v1/follow", payload)
+
+	return err
+}
+
+// Promote makes the follower of partition on nodeURL its leader.
+func (node *StorageClient) Promote(ctx context.Context, nodeURL string, partition int) error {
+	_, err := node.do(ctx, false, http.MethodDelete, nodeURL, "/v1/follow?partition="+strconv.Itoa(partition), nil)
+
+	return err
+}
+
+// ReplicationStatus returns the partitions nodeURL follows.
+func (node *StorageClient) ReplicationStatus(ctx context.Context, nodeURL string) ([]ReplicaStatus, error) {
+	body, err := node.do(ctx, true, http.MethodGet, nodeURL, "/v1/replication", nil)
 	if err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("storage returned %d", response.StatusCode)
+	var statuses []ReplicaStatus
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		return nil, fmt.Errorf("invalid storage response: %w", err)
+	}
+	for i := range statuses {
+		statuses[i].Node = nodeURL
 	}
 
-	var logs []LogEntry
+	return statuses, nil
+}
 
-	err = json.NewDecoder(response.Body).Decode(&logs)
+// do sends a request to a storage node according to the retry policy of the
+// client and returns the body of the first successful response. Attempts fail
+// fast while the circuit breaker of the node is open.
+func (node *StorageClient) do(ctx context.Context, idempotent bool, method string, nodeURL string, path string, payload []byte) ([]byte, error) {
+	client := node.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var body []byte
+	err := node.retry.retry(ctx, idempotent, func(attemptCtx context.Context) error {
+		return node.breakers.guard(ctx, nodeURL, func() error {
+			var err error
+			body, err = send(attemptCtx, client, method, nodeURL+path, payload)
+			return err
+		})
+	})
+
+	return body, err
+}
+
+func send(ctx context.Context, client *http.Client, method string, url string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Storage nodes answer acks=all writes before the attempt times out
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("X-Request-Timeout", strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+
+	response, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		apiErr := apierror.Parse(body)
+		return nil, &StatusError{StatusCode: response.StatusCode, Code: apiErr.Code, Message: apiErr.Message}
+	}
 
-	return logs, nil
+	return io.ReadAll(response.Body)
 }
 
-func (node StorageClient) URL(partition int) string {
-	if url, ok := StorageNodeURLs[partition]; ok {
+// URL returns the storage node that takes the writes of partition.
+func (node *StorageClient) URL(partition int) string {
+	if url := Routing.Primary(partition); url != "" {
 		return url
 	}
 	return "http://localhost:8081"
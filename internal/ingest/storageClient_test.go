@@ -0,0 +1,70 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStorageClientAppendBatch_OneRequestPerNode(t *testing.T) {
+	var requests atomic.Int32
+	store := mockBatchStorage(func(partition int, logs []LogEntry) AppendResult {
+		return AppendResult{BaseOffset: uint64(partition * 10)}
+	})
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		store(w, r)
+	})
+	defer cleanup()
+
+	batches := map[int][]LogEntry{0: {{}}, 1: {{}}, 2: {{}}, 3: {{}}}
+	results := NewStorageClient().AppendBatch(context.Background(), batches, AcksLeader)
+
+	if requests.Load() != 1 {
+		t.Errorf("expected partitions on the same node to share a request, got %d requests", requests.Load())
+	}
+	for partition := range batches {
+		result := results[partition]
+		if result.Err != nil || result.Result.Partition != partition || result.Result.BaseOffset != uint64(partition*10) {
+			t.Errorf("unexpected result for partition %d: %+v", partition, result)
+		}
+	}
+}
+
+func TestStorageClientAppendBatch_ReportsPartialFailure(t *testing.T) {
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"results": []map[string]any{
+			{"partition": 0, "base_offset": 5, "last_offset": 5, "status": http.StatusOK},
+			{"partition": 1, "status": http.StatusBadRequest, "error": "storing logs failed"},
+		}})
+	})
+	defer cleanup()
+
+	results := NewStorageClient().AppendBatch(context.Background(), map[int][]LogEntry{0: {{}}, 1: {{}}}, AcksLeader)
+
+	if results[0].Err != nil || results[0].Result.BaseOffset != 5 {
+		t.Errorf("expected partition 0 to succeed, got %+v", results[0])
+	}
+
+	var statusErr *StatusError
+	if !errors.As(results[1].Err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected partition 1 to fail with its status, got %v", results[1].Err)
+	}
+}
+
+func TestStorageClientAppendBatch_NodeFailureFailsItsPartitions(t *testing.T) {
+	setupRetryPolicy(t, singleAttemptPolicy())
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer cleanup()
+
+	results := NewStorageClient().AppendBatch(context.Background(), map[int][]LogEntry{0: {{}}, 2: {{}}}, AcksLeader)
+
+	if len(results) != 2 || results[0].Err == nil || results[2].Err == nil {
+		t.Errorf("expected both partitions to fail, got %+v", results)
+	}
+}
@@ -0,0 +1,429 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// WALDir is where batches that could not be delivered to their storage node
+// are kept until it is back. Empty disables the WAL and failed appends are
+// returned to the client instead.
+// This can be overridden for testing or configuration.
+var WALDir = ""
+
+// WALReplayInterval is how often batches waiting in the WAL are retried.
+// This can be overridden for testing or configuration.
+var WALReplayInterval = time.Second
+
+// HintMaxAge is how long a batch waits in the WAL for its storage node before
+// it is dropped. Dropped batches were answered as accepted but are never
+// stored, so zero, the default, keeps batches until they are delivered and
+// HintMaxBytes bounds the WAL instead.
+// This can be overridden for testing or configuration.
+var HintMaxAge time.Duration
+
+// HintMaxBytes caps the size of all batches waiting in the WAL. Once it is
+// reached, partitions whose storage node is unreachable fail again. Zero
+// means no limit.
+// This can be overridden for testing or configuration.
+var HintMaxBytes int64 = 256 * 1024 * 1024
+
+// ErrWALFull is returned when a batch would take the WAL over HintMaxBytes.
+var ErrWALFull = apierror.New(http.StatusServiceUnavailable, "WAL is full")
+
+const walSuffix = ".json"
+
+// HintStatus describes the batches of a partition waiting in the WAL. Node
+// is the storage node the oldest of them was written for; they are delivered
+// to the current leader of the partition, which differs from it once the
+// partition was moved or failed over.
+type HintStatus struct {
+	Partition int        `json:"partition"`
+	Node      string     `json:"node"`
+	Batches   int        `json:"batches"`
+	Bytes     int64      `json:"bytes"`
+	Oldest    *time.Time `json:"oldest,omitempty"`
+	Expired   int64      `json:"expired"`
+}
+
+// HintStats describes the WAL. Rejected counts the batches that failed
+// because the WAL was full, Expired the accepted batches dropped after
+// HintMaxAge without being delivered.
+type HintStats struct {
+	Enabled    bool         `json:"enabled"`
+	MaxAge     string       `json:"max_age"`
+	MaxBytes   int64        `json:"max_bytes"`
+	Bytes      int64        `json:"bytes"`
+	Rejected   int64        `json:"rejected"`
+	Expired    int64        `json:"expired"`
+	Partitions []HintStatus `json:"partitions"`
+}
+
+// walEntry is the content of a batch file: the logs of the batch, the
+// storage node it was written for and the idempotency key it was accepted
+// with, so its replay is not stored twice when an earlier attempt reached
+// the storage node after all.
+type walEntry struct {
+	Node string     `json:"node,omitempty"`
+	Key  string     `json:"key,omitempty"`
+	Logs []LogEntry `json:"logs"`
+}
+
+// walBatch is a batch waiting for delivery.
+type walBatch struct {
+	seq     uint64
+	bytes   int64
+	written time.Time
+	node    string
+}
+
+// wal stores undelivered batches as one file per batch under
+// WALDir/partition-N/, named by a sequence number that keeps them in the
+// order they were accepted.
+type wal struct {
+	dir string
+
+	mu       sync.Mutex
+	pending  map[int][]walBatch // waiting for delivery, oldest first
+	next     map[int]uint64
+	bytes    int64
+	expired  map[int]int64
+	rejected int64
+}
+
+func openWAL(dir string) (*wal, error) {
+	w := &wal{
+		dir:     dir,
+		pending: make(map[int][]walBatch),
+		next:    make(map[int]uint64),
+		expired: make(map[int]int64),
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		partition, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "partition-"))
+		if !entry.IsDir() || err != nil || partition < 0 {
+			continue
+		}
+
+		if err := w.load(partition); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// load picks up the batches a previous run left in the WAL of partition.
+func (w *wal) load(partition int) error {
+	dir := w.partitionDir(partition)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var pending []walBatch
+	for _, entry := range entries {
+		name := entry.Name()
+
+		// Left behind by a write that did not finish, it was never
+		// acknowledged.
+		if strings.HasSuffix(name, ".tmp") {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		node, err := walNode(filepath.Join(dir, name))
+		if err != nil {
+			// Replaying the batch reports it
+			fmt.Println("[INGEST/WAL]", "partition=", partition, "batch=", seq, "error=", err)
+		}
+		pending = append(pending, walBatch{seq: seq, bytes: info.Size(), written: info.ModTime(), node: node})
+		w.bytes += info.Size()
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+
+	w.pending[partition] = pending
+	if len(pending) > 0 {
+		w.next[partition] = pending[len(pending)-1].seq + 1
+		fmt.Println("[INGEST/WAL]", "partition=", partition, "pending_batches=", len(pending))
+	}
+
+	return nil
+}
+
+// walNode reads the storage node a batch was written for from the start of
+// its file, where walEntry puts it, without decoding its logs.
+func walNode(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return "", fmt.Errorf("invalid WAL batch %s", path)
+	}
+	if key, err := decoder.Token(); err != nil || key != "node" {
+		return "", err
+	}
+
+	var node string
+	if err := decoder.Decode(&node); err != nil {
+		return "", fmt.Errorf("invalid WAL batch %s: %w", path, err)
+	}
+
+	return node, nil
+}
+
+func (w *wal) partitionDir(partition int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("partition-%d", partition))
+}
+
+func (w *wal) batchPath(partition int, seq uint64) string {
+	return filepath.Join(w.partitionDir(partition), fmt.Sprintf("%020d%s", seq, walSuffix))
+}
+
+// hasPending reports whether batches of partition are waiting for delivery.
+func (w *wal) hasPending(partition int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.pending[partition]) > 0
+}
+
+// partitions returns the partitions with batches waiting for delivery.
+func (w *wal) partitions() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var partitions []int
+	for partition, pending := range w.pending {
+		if len(pending) > 0 {
+			partitions = append(partitions, partition)
+		}
+	}
+	sort.Ints(partitions)
+
+	return partitions
+}
+
+// write appends a batch for node, accepted with the idempotency key, to the
+// WAL of partition and returns once it is durable, or fails with ErrWALFull
+// when it does not fit under HintMaxBytes.
+func (w *wal) write(partition int, node string, key string, logs []LogEntry) error {
+	payload, err := json.Marshal(walEntry{Node: node, Key: key, Logs: logs})
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if HintMaxBytes > 0 && w.bytes+int64(len(payload)) > HintMaxBytes {
+		w.rejected++
+		return ErrWALFull
+	}
+
+	dir := w.partitionDir(partition)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	seq := w.next[partition]
+	path := w.batchPath(partition, seq)
+
+	if err := writeFileSync(path+".tmp", payload); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	w.next[partition] = seq + 1
+	w.pending[partition] = append(w.pending[partition], walBatch{seq: seq, bytes: int64(len(payload)), written: time.Now(), node: node})
+	w.bytes += int64(len(payload))
+
+	return nil
+}
+
+// expire drops the batches of partition older than HintMaxAge and returns
+// how many it dropped.
+func (w *wal) expire(partition int, now time.Time) (int, error) {
+	if HintMaxAge <= 0 {
+		return 0, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dropped := 0
+	for _, batch := range w.pending[partition] {
+		if now.Sub(batch.written) <= HintMaxAge {
+			break
+		}
+		if err := w.removeLocked(partition, batch.seq); err != nil {
+			return dropped, err
+		}
+		w.expired[partition]++
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// oldest returns the oldest batch of partition waiting for delivery.
+func (w *wal) oldest(partition int) (uint64, walEntry, bool, error) {
+	w.mu.Lock()
+	pending := w.pending[partition]
+	w.mu.Unlock()
+
+	if len(pending) == 0 {
+		return 0, walEntry{}, false, nil
+	}
+
+	data, err := os.ReadFile(w.batchPath(partition, pending[0].seq))
+	if err != nil {
+		return 0, walEntry{}, false, err
+	}
+
+	var entry walEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return 0, walEntry{}, false, err
+	}
+
+	return pending[0].seq, entry, true, nil
+}
+
+// remove drops a delivered batch from the WAL.
+func (w *wal) remove(partition int, seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.removeLocked(partition, seq)
+}
+
+func (w *wal) removeLocked(partition int, seq uint64) error {
+	pending := w.pending[partition]
+	if len(pending) == 0 || pending[0].seq != seq {
+		return fmt.Errorf("batch %d is not the oldest of partition %d", seq, partition)
+	}
+
+	if err := os.Remove(w.batchPath(partition, seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	w.pending[partition] = pending[1:]
+	w.bytes -= pending[0].bytes
+
+	return nil
+}
+
+// stats describes the batches waiting in the WAL.
+func (w *wal) stats() HintStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := HintStats{
+		Enabled:    true,
+		MaxAge:     HintMaxAge.String(),
+		MaxBytes:   HintMaxBytes,
+		Bytes:      w.bytes,
+		Rejected:   w.rejected,
+		Partitions: []HintStatus{},
+	}
+
+	for _, expired := range w.expired {
+		stats.Expired += expired
+	}
+
+	for partition, pending := range w.pending {
+		if len(pending) == 0 && w.expired[partition] == 0 {
+			continue
+		}
+
+		status := HintStatus{
+			Partition: partition,
+			Batches:   len(pending),
+			Expired:   w.expired[partition],
+		}
+		for _, batch := range pending {
+			status.Bytes += batch.bytes
+		}
+		if len(pending) > 0 {
+			oldest := pending[0].written
+			status.Oldest = &oldest
+			status.Node = pending[0].node
+		}
+
+		stats.Partitions = append(stats.Partitions, status)
+	}
+	sort.Slice(stats.Partitions, func(i, j int) bool {
+		return stats.Partitions[i].Partition < stats.Partitions[j].Partition
+	})
+
+	return stats
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
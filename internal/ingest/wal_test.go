@@ -0,0 +1,370 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupWAL points WALDir at a temp directory for a single test
+func setupWAL(t *testing.T) string {
+	dir := t.TempDir()
+	original := WALDir
+	WALDir = dir
+
+	t.Cleanup(func() {
+		WALDir = original
+	})
+
+	return dir
+}
+
+// setupHints bounds the batches waiting in the WAL for a single test
+func setupHints(t *testing.T, maxAge time.Duration, maxBytes int64) {
+	originalAge, originalBytes := HintMaxAge, HintMaxBytes
+	HintMaxAge, HintMaxBytes = maxAge, maxBytes
+
+	t.Cleanup(func() {
+		HintMaxAge, HintMaxBytes = originalAge, originalBytes
+	})
+}
+
+// flakyStorage is a mock storage node that fails appends while down is set
+// and records the messages it stored in order.
+type flakyStorage struct {
+	down   atomic.Bool
+	status int
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func (f *flakyStorage) handle(w http.ResponseWriter, r *http.Request) {
+	if f.down.Load() {
+		w.WriteHeader(f.status)
+		return
+	}
+
+	store := func(partition int, logs []LogEntry) AppendResult {
+		f.mu.Lock()
+		for _, log := range logs {
+			f.messages = append(f.messages, log.Message)
+		}
+		f.mu.Unlock()
+
+		return AppendResult{LastOffset: uint64(len(logs) - 1)}
+	}
+
+	mockBatchStorage(store)(w, r)
+}
+
+func TestServiceIngest_QueuesInWALWhileStorageIsDown(t *testing.T) {
+	setupWAL(t)
+	storage := &flakyStorage{status: http.StatusServiceUnavailable}
+	storage.down.Store(true)
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	results, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "first"}}, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("expected the batch to be queued, got error: %v", err)
+	}
+	if len(results) != 1 || !results[0].Queued {
+		t.Fatalf("expected a queued result, got %+v", results)
+	}
+
+	// Once storage is back, later batches still wait behind the queued one
+	storage.down.Store(false)
+	results, _ = service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "second"}}, "10.0.0.1")
+	if !results[0].Queued {
+		t.Errorf("expected the second batch to queue behind the first, got %+v", results)
+	}
+
+	service.replay()
+
+	if len(storage.messages) != 2 || storage.messages[0] != "first" || storage.messages[1] != "second" {
+		t.Errorf("expected both batches replayed in order, got %v", storage.messages)
+	}
+	if service.wal.hasPending(partitionForKey("test-service")) {
+		t.Error("expected the WAL to be empty after replay")
+	}
+
+	results, _ = service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "third"}}, "10.0.0.1")
+	if results[0].Queued {
+		t.Error("expected batches to go straight to storage once the WAL is drained")
+	}
+}
+
+func TestServiceIngest_RejectedBatchIsNotQueued(t *testing.T) {
+	setupWAL(t)
+	storage := &flakyStorage{status: http.StatusBadRequest}
+	storage.down.Store(true)
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+
+	_, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "invalid"}}, "10.0.0.1")
+	if err == nil {
+		t.Fatal("expected error for a batch storage rejected, got nil")
+	}
+	if service.wal.hasPending(partitionForKey("test-service")) {
+		t.Error("expected a rejected batch not to be queued")
+	}
+}
+
+func TestServiceIngest_AmbiguousFailureIsNotQueued(t *testing.T) {
+	setupWAL(t)
+	storage := &flakyStorage{status: http.StatusInternalServerError}
+	storage.down.Store(true)
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+
+	// Without an idempotency key, a replay could store the batch twice
+	if _, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "first"}}, "10.0.0.1"); err == nil {
+		t.Fatal("expected error for a batch storage may have stored, got nil")
+	}
+	if service.wal.hasPending(partitionForKey("test-service")) {
+		t.Error("expected a batch without an idempotency key not to be queued")
+	}
+
+	ctx := withDedupKey(context.Background(), "key/1")
+	results, err := service.Ingest(ctx, []IncomingLogBody{{Service: "test-service", Message: "second"}}, "10.0.0.1")
+	if err != nil || !results[0].Queued {
+		t.Fatalf("expected a batch with an idempotency key to be queued, got %+v %v", results, err)
+	}
+}
+
+func TestServiceIngest_QueuedBatchGetsIdempotencyKey(t *testing.T) {
+	setupWAL(t)
+	storage := &flakyStorage{status: http.StatusServiceUnavailable}
+	storage.down.Store(true)
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	service.Open()
+	defer service.Close()
+
+	if _, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "first"}}, "10.0.0.1"); err != nil {
+		t.Fatalf("expected the batch to be queued, got error: %v", err)
+	}
+
+	_, entry, ok, err := service.wal.oldest(partitionForKey("test-service"))
+	if err != nil || !ok || entry.Key == "" {
+		t.Errorf("expected the queued batch to be replayed with a key, got %+v %v %v", entry, ok, err)
+	}
+}
+
+func TestWAL_SurvivesRestart(t *testing.T) {
+	dir := setupWAL(t)
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.write(2, "http://storage-a", "key/a", []LogEntry{{IncomingLogBody: IncomingLogBody{Message: "a"}}})
+	w.write(2, "http://storage-a", "", []LogEntry{{IncomingLogBody: IncomingLogBody{Message: "b"}}})
+
+	// A batch that was being written during a crash
+	os.WriteFile(filepath.Join(dir, "partition-2", "00000000000000000002.json.tmp"), []byte("[{"), 0644)
+
+	reopened, err := openWAL(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if partitions := reopened.partitions(); len(partitions) != 1 || partitions[0] != 2 {
+		t.Fatalf("expected partition 2 to have pending batches, got %v", partitions)
+	}
+
+	if stats := reopened.stats(); stats.Partitions[0].Node != "http://storage-a" {
+		t.Errorf("expected the node of the oldest batch to be reported after a restart, got %q", stats.Partitions[0].Node)
+	}
+
+	seq, entry, ok, err := reopened.oldest(2)
+	if err != nil || !ok || entry.Logs[0].Message != "a" || entry.Key != "key/a" || entry.Node != "http://storage-a" {
+		t.Fatalf("expected batch a with its key and node first, got %v %+v %v", ok, entry, err)
+	}
+	reopened.remove(2, seq)
+
+	reopened.write(2, "http://storage-b", "", []LogEntry{{IncomingLogBody: IncomingLogBody{Message: "c"}}})
+
+	var messages []string
+	for {
+		seq, entry, ok, _ := reopened.oldest(2)
+		if !ok {
+			break
+		}
+		messages = append(messages, entry.Logs[0].Message)
+		reopened.remove(2, seq)
+	}
+
+	if len(messages) != 2 || messages[0] != "b" || messages[1] != "c" {
+		t.Errorf("expected b then c, got %v", messages)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition-2", "00000000000000000002.json.tmp")); !os.IsNotExist(err) {
+		t.Error("expected the unfinished batch to be removed")
+	}
+}
+
+func TestServiceIngest_FailsOnceWALIsFull(t *testing.T) {
+	setupWAL(t)
+	setupHints(t, time.Hour, 300)
+	storage := &flakyStorage{status: http.StatusServiceUnavailable}
+	storage.down.Store(true)
+	server, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	if _, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "first"}}, "10.0.0.1"); err != nil {
+		t.Fatalf("expected the batch to be queued, got error: %v", err)
+	}
+
+	// The partition is routed elsewhere after the batch was written
+	Routing.Pin(partitionForKey("test-service"), []string{"http://elsewhere"})
+
+	_, err := service.Ingest(context.Background(), []IncomingLogBody{{Service: "test-service", Message: "second"}}, "10.0.0.1")
+	if !errors.Is(err, ErrWALFull) {
+		t.Fatalf("expected ErrWALFull, got %v", err)
+	}
+
+	hints := service.Hints()
+	if hints.Rejected != 1 || len(hints.Partitions) != 1 || hints.Partitions[0].Batches != 1 || hints.Bytes == 0 {
+		t.Errorf("unexpected hints %+v", hints)
+	}
+	if hints.Partitions[0].Node != server.URL {
+		t.Errorf("expected the batch to wait for the node it was written for, got %s", hints.Partitions[0].Node)
+	}
+}
+
+func TestReplay_DropsExpiredBatches(t *testing.T) {
+	dir := setupWAL(t)
+	setupHints(t, time.Hour, 0)
+	storage := &flakyStorage{status: http.StatusServiceUnavailable}
+	_, cleanup := setupMockStorage(storage.handle)
+	defer cleanup()
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.write(1, "", "", []LogEntry{{IncomingLogBody: IncomingLogBody{Message: "stale"}}})
+	w.write(1, "", "", []LogEntry{{IncomingLogBody: IncomingLogBody{Message: "fresh"}}})
+
+	// The first batch was accepted before the node went down two hours ago
+	stale := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "partition-1", "00000000000000000000.json"), stale, stale)
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	service.replay()
+
+	if len(storage.messages) != 1 || storage.messages[0] != "fresh" {
+		t.Errorf("expected only the fresh batch to be delivered, got %v", storage.messages)
+	}
+
+	hints := service.Hints()
+	if hints.Bytes != 0 || hints.Expired != 1 || len(hints.Partitions) != 1 || hints.Partitions[0].Expired != 1 {
+		t.Errorf("unexpected hints %+v", hints)
+	}
+}
+
+func TestReplay_SendsKeySoTimedOutBatchIsStoredOnce(t *testing.T) {
+	setupWAL(t)
+	setupRetryPolicy(t, fastRetryPolicy())
+
+	// The storage node stores every batch but answers too late while slow,
+	// and stores each key once
+	var slow atomic.Bool
+	slow.Store(true)
+	var mu sync.Mutex
+	keys := make(map[string]AppendResult)
+	var stored []string
+	_, cleanup := setupMockStorage(func(w http.ResponseWriter, r *http.Request) {
+		var batch batchRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+
+		var response struct {
+			Results []map[string]any `json:"results"`
+		}
+		mu.Lock()
+		for _, partition := range batch.Partitions {
+			result, duplicate := keys[partition.Key]
+			if !duplicate {
+				result = AppendResult{BaseOffset: uint64(len(stored)), LastOffset: uint64(len(stored) + len(partition.Logs) - 1)}
+				for _, log := range partition.Logs {
+					stored = append(stored, log.Message)
+				}
+				if partition.Key != "" {
+					keys[partition.Key] = result
+				}
+			}
+			response.Results = append(response.Results, map[string]any{
+				"partition":   partition.Partition,
+				"base_offset": result.BaseOffset,
+				"last_offset": result.LastOffset,
+				"status":      http.StatusOK,
+			})
+		}
+		mu.Unlock()
+
+		if slow.Load() {
+			time.Sleep(2 * DefaultRetryPolicy.AttemptTimeout)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	defer cleanup()
+
+	service := NewService(NewStorageClient())
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer service.Close()
+
+	logs := []IncomingLogBody{{Service: "test-service", Message: "once"}}
+	results, _, err := service.SubmitOnce(context.Background(), "key/timeout", logs, "10.0.0.1", AcksLeader)
+	if err != nil || len(results) != 1 || !results[0].Queued {
+		t.Fatalf("expected the timed out batch to wait in the WAL, got %+v %v", results, err)
+	}
+
+	slow.Store(false)
+	service.replay()
+
+	if service.wal.hasPending(partitionForKey("test-service")) {
+		t.Error("expected the WAL to be empty after replay")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stored) != 1 {
+		t.Errorf("expected the batch to be stored once, got %v", stored)
+	}
+}
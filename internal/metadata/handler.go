@@ -0,0 +1,118 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+	"github.com/bonniesimon/log-go/internal/raft"
+)
+
+// MaxWatchWait caps how long a watch of the cluster state is held.
+const MaxWatchWait = time.Minute
+
+// MaxRequestBytes caps the body of assignments.
+const MaxRequestBytes = 1024 * 1024
+
+// AssignRequest places a partition on storage nodes, leader first.
+type AssignRequest struct {
+	Partition int      `json:"partition"`
+	Replicas  []string `json:"replicas"`
+}
+
+type Handler struct {
+	server *Server
+}
+
+func NewHandler(server *Server) *Handler {
+	return &Handler{server: server}
+}
+
+// HandleState returns the cluster state. With version and wait, the request
+// is held until the state is newer than version or for wait, so ingest nodes
+// can watch it.
+func (h *Handler) HandleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+
+	var version uint64
+	if versionQuery := query.Get("version"); versionQuery != "" {
+		var err error
+		version, err = strconv.ParseUint(versionQuery, 10, 64)
+		if err != nil {
+			apierror.BadRequest(w, "invalid version query param value")
+			return
+		}
+	}
+
+	var wait time.Duration
+	if waitQuery := query.Get("wait"); waitQuery != "" {
+		var err error
+		wait, err = time.ParseDuration(waitQuery)
+		if err != nil || wait < 0 {
+			apierror.BadRequest(w, "invalid wait query param value")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), min(wait, MaxWatchWait))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.server.Wait(ctx, version))
+}
+
+// HandlePartitions assigns a partition to storage nodes. Only the metadata
+// leader accepts assignments, other servers answer 503 naming the leader.
+func (h *Handler) HandlePartitions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.MethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req AssignRequest
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &req); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	if req.Partition < 0 || len(req.Replicas) == 0 {
+		apierror.BadRequest(w, "partition and replicas are required")
+		return
+	}
+
+	err := h.server.Assign(r.Context(), req.Partition, req.Replicas)
+	if errors.Is(err, raft.ErrNotLeader) {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "not the metadata leader, the leader is "+strconv.Quote(h.server.Leader()))
+		return
+	}
+	if err != nil {
+		fmt.Println("[METADATA]", "partition=", req.Partition, "assign error=", err)
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRaft reports the raft state of the server.
+func (h *Handler) HandleRaft(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.server.Status())
+}
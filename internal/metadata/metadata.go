@@ -0,0 +1,179 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/bonniesimon/log-go/internal/raft"
+)
+
+// PartitionState is where a partition is placed. Leader takes its writes and
+// the other replicas follow it. Epoch grows with every change, so elections
+// decided on an older state are not applied.
+type PartitionState struct {
+	Partition int      `json:"partition"`
+	Leader    string   `json:"leader"`
+	Replicas  []string `json:"replicas"` // leader first
+	Epoch     uint64   `json:"epoch"`
+}
+
+// ClusterState is the storage nodes of the cluster and the placement of
+// every assigned partition. Version is the raft index of the last change.
+type ClusterState struct {
+	Version    uint64           `json:"version"`
+	Members    []string         `json:"members"`
+	Partitions []PartitionState `json:"partitions"`
+}
+
+// Partition returns the state of partition and whether it is assigned.
+func (c ClusterState) Partition(partition int) (PartitionState, bool) {
+	for _, state := range c.Partitions {
+		if state.Partition == partition {
+			return state, true
+		}
+	}
+
+	return PartitionState{}, false
+}
+
+const (
+	commandJoin   = "join"
+	commandAssign = "assign"
+	commandElect  = "elect"
+)
+
+// command is a change of the cluster state replicated through raft.
+type command struct {
+	Type      string   `json:"type"`
+	Member    string   `json:"member,omitempty"`
+	Partition int      `json:"partition"`
+	Replicas  []string `json:"replicas,omitempty"`
+	Epoch     uint64   `json:"epoch,omitempty"` // elect only applies at this epoch
+}
+
+// FSM is the cluster state every metadata server builds from the raft log.
+type FSM struct {
+	mu         sync.Mutex
+	version    uint64
+	members    map[string]bool
+	partitions map[int]*PartitionState
+	changed    chan struct{} // closed on the next change
+}
+
+func NewFSM() *FSM {
+	return &FSM{
+		members:    make(map[string]bool),
+		partitions: make(map[int]*PartitionState),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Apply applies a committed command to the cluster state.
+func (f *FSM) Apply(entry raft.Entry) {
+	var cmd command
+	if err := json.Unmarshal(entry.Command, &cmd); err != nil {
+		fmt.Println("[METADATA]", "index=", entry.Index, "invalid command error=", err)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Type {
+	case commandJoin:
+		f.members[cmd.Member] = true
+
+	case commandAssign:
+		f.assign(cmd.Partition, cmd.Replicas)
+
+	case commandElect:
+		current, ok := f.partitions[cmd.Partition]
+		if !ok || current.Epoch != cmd.Epoch {
+			fmt.Println("[METADATA]", "partition=", cmd.Partition, "ignoring stale election at epoch", cmd.Epoch)
+			return
+		}
+		f.assign(cmd.Partition, cmd.Replicas)
+
+	default:
+		fmt.Println("[METADATA]", "index=", entry.Index, "unknown command", cmd.Type)
+		return
+	}
+
+	f.version = entry.Index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// assign places partition on replicas, leader first. f.mu must be held.
+func (f *FSM) assign(partition int, replicas []string) {
+	if len(replicas) == 0 {
+		return
+	}
+
+	state, ok := f.partitions[partition]
+	if !ok {
+		state = &PartitionState{Partition: partition}
+		f.partitions[partition] = state
+	}
+
+	state.Leader = replicas[0]
+	state.Replicas = slices.Clone(replicas)
+	state.Epoch++
+
+	for _, replica := range replicas {
+		f.members[replica] = true
+	}
+}
+
+// State returns a copy of the cluster state.
+func (f *FSM) State() ClusterState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.state()
+}
+
+func (f *FSM) state() ClusterState {
+	state := ClusterState{Version: f.version, Members: []string{}, Partitions: []PartitionState{}}
+
+	for member := range f.members {
+		state.Members = append(state.Members, member)
+	}
+	sort.Strings(state.Members)
+
+	for _, partition := range f.partitions {
+		copied := *partition
+		copied.Replicas = slices.Clone(partition.Replicas)
+		state.Partitions = append(state.Partitions, copied)
+	}
+	sort.Slice(state.Partitions, func(i, j int) bool {
+		return state.Partitions[i].Partition < state.Partitions[j].Partition
+	})
+
+	return state
+}
+
+// Wait returns the cluster state once its version is past version, or the
+// current state once ctx is done.
+func (f *FSM) Wait(ctx context.Context, version uint64) ClusterState {
+	for {
+		f.mu.Lock()
+		if f.version > version {
+			state := f.state()
+			f.mu.Unlock()
+			return state
+		}
+		changed := f.changed
+		f.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return f.State()
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/raft"
+)
+
+// NodeFailureTimeout is how long the metadata leader goes without hearing
+// from a storage node before it elects new leaders for the partitions that
+// node leads.
+// This can be overridden for testing or configuration.
+var NodeFailureTimeout = 5 * time.Second
+
+// ProposeTimeout bounds how long a change of the cluster state waits to be
+// committed.
+// This can be overridden for testing or configuration.
+var ProposeTimeout = 5 * time.Second
+
+// ErrNoReplicaAlive is returned when no replica of a partition can take over
+// from its failed leader: none is alive and reports how far it got.
+var ErrNoReplicaAlive = errors.New("no replica of the partition is alive")
+
+// Server keeps the cluster state replicated with raft among the storage nodes
+// and, while it is the raft leader, elects new partition leaders when storage
+// nodes fail. Every server is a storage node, identified by its URL.
+type Server struct {
+	id   string
+	node *raft.Node
+	fsm  *FSM
+
+	// nextOffset returns how far node has replicated partition, to elect
+	// the most caught-up replica.
+	nextOffset func(ctx context.Context, node string, partition int) (uint64, error)
+
+	stop       chan struct{}
+	background sync.WaitGroup
+}
+
+// NewServer creates the metadata server of storage node id, replicating the
+// cluster state with peers through transport and keeping its raft state
+// under dir.
+func NewServer(id string, peers []string, dir string, transport raft.Transport) (*Server, error) {
+	fsm := NewFSM()
+
+	node, err := raft.NewNode(raft.Config{ID: id, Peers: peers, Dir: dir, Transport: transport, FSM: fsm})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{id: id, node: node, fsm: fsm, stop: make(chan struct{})}
+	s.nextOffset = s.replicationOffset
+
+	return s, nil
+}
+
+// Node returns the raft node of the server, to be reached by its peers.
+func (s *Server) Node() *raft.Node {
+	return s.node
+}
+
+// ID returns the URL of the storage node the server runs on.
+func (s *Server) ID() string {
+	return s.id
+}
+
+// Start joins the raft group and starts watching storage nodes for failures.
+func (s *Server) Start() {
+	s.node.Start()
+
+	s.background.Add(1)
+	go s.runElections()
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	close(s.stop)
+	s.background.Wait()
+	s.node.Close()
+}
+
+// State returns the cluster state as applied on this server.
+func (s *Server) State() ClusterState {
+	return s.fsm.State()
+}
+
+// Wait returns the cluster state once it is newer than version, or the
+// current state once ctx is done.
+func (s *Server) Wait(ctx context.Context, version uint64) ClusterState {
+	return s.fsm.Wait(ctx, version)
+}
+
+// Leader returns the metadata server leading the raft group, if any.
+func (s *Server) Leader() string {
+	return s.node.Leader()
+}
+
+// Status describes the raft node of the server.
+func (s *Server) Status() raft.Status {
+	return s.node.Status()
+}
+
+// Assign places partition on replicas, leader first. Only the raft leader
+// accepts changes, others return raft.ErrNotLeader.
+func (s *Server) Assign(ctx context.Context, partition int, replicas []string) error {
+	if partition < 0 || len(replicas) == 0 {
+		return fmt.Errorf("partition %d needs at least one replica", partition)
+	}
+
+	return s.propose(ctx, command{Type: commandAssign, Partition: partition, Replicas: replicas})
+}
+
+func (s *Server) propose(ctx context.Context, cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ProposeTimeout)
+	defer cancel()
+
+	_, err = s.node.Propose(ctx, data)
+
+	return err
+}
+
+// runElections checks for failed partition leaders while this server leads
+// the raft group.
+func (s *Server) runElections() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(NodeFailureTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if s.node.IsLeader() {
+				s.checkNodes(now)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// checkNodes adds the raft members missing from the cluster and elects a new
+// leader for every partition whose leader was not heard from within
+// NodeFailureTimeout.
+func (s *Server) checkNodes(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), ProposeTimeout)
+	defer cancel()
+
+	status := s.node.Status()
+	if status.State != raft.Leader.String() {
+		return
+	}
+
+	alive := map[string]bool{s.id: true}
+	for _, peer := range status.Peers {
+		alive[peer.ID] = peer.LastContact != nil && now.Sub(*peer.LastContact) < NodeFailureTimeout
+	}
+
+	state := s.fsm.State()
+	for member := range alive {
+		if !slices.Contains(state.Members, member) {
+			if err := s.propose(ctx, command{Type: commandJoin, Member: member}); err != nil {
+				fmt.Println("[METADATA]", "member=", member, "join error=", err)
+			}
+		}
+	}
+
+	for _, partition := range state.Partitions {
+		// Leaders that are not raft members cannot be checked.
+		isAlive, known := alive[partition.Leader]
+		if isAlive || !known {
+			continue
+		}
+
+		if err := s.elect(ctx, partition, alive); err != nil {
+			fmt.Println("[METADATA]", "partition=", partition.Partition, "failed leader=", partition.Leader, "error=", err)
+		}
+	}
+}
+
+// elect makes the most caught-up live replica the leader of partition, among
+// those that report their offset. The failed leader is dropped from the
+// replicas since it may hold records the new leader never got.
+func (s *Server) elect(ctx context.Context, partition PartitionState, alive map[string]bool) error {
+	var leader string
+	var leaderOffset uint64
+	for _, replica := range partition.Replicas[1:] {
+		if !alive[replica] {
+			continue
+		}
+
+		// A replica that cannot say how far it got may be missing any
+		// number of records.
+		offset, err := s.nextOffset(ctx, replica, partition.Partition)
+		if err != nil {
+			fmt.Println("[METADATA]", "partition=", partition.Partition, "replica=", replica, "error=", err)
+			continue
+		}
+		if leader == "" || offset > leaderOffset {
+			leader, leaderOffset = replica, offset
+		}
+	}
+	if leader == "" {
+		return ErrNoReplicaAlive
+	}
+
+	replicas := []string{leader}
+	for _, replica := range partition.Replicas[1:] {
+		if replica != leader {
+			replicas = append(replicas, replica)
+		}
+	}
+
+	err := s.propose(ctx, command{Type: commandElect, Partition: partition.Partition, Replicas: replicas, Epoch: partition.Epoch})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(
+		"[METADATA]",
+		"partition=", partition.Partition,
+		"failed leader=", partition.Leader,
+		"new leader=", leader,
+		"next_offset=", leaderOffset,
+	)
+
+	return nil
+}
+
+// replicationOffset asks node how far it has fetched partition from its
+// leader.
+func (s *Server) replicationOffset(ctx context.Context, node string, partition int) (uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, node+"/v1/replication", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return 0, fmt.Errorf("storage returned %d", response.StatusCode)
+	}
+
+	var statuses []struct {
+		Partition  int    `json:"partition"`
+		NextOffset uint64 `json:"next_offset"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&statuses); err != nil {
+		return 0, fmt.Errorf("invalid storage response: %w", err)
+	}
+
+	for _, status := range statuses {
+		if status.Partition == partition {
+			return status.NextOffset, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s does not follow partition %d", node, partition)
+}
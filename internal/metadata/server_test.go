@@ -0,0 +1,257 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/raft"
+)
+
+func setupTimeouts(t *testing.T) {
+	t.Cleanup(raft.MemTimeouts())
+
+	originalFailure := NodeFailureTimeout
+	NodeFailureTimeout = 100 * time.Millisecond
+
+	t.Cleanup(func() {
+		NodeFailureTimeout = originalFailure
+	})
+}
+
+// offsets fakes how far every storage node replicated its partitions
+type offsets struct {
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+func (o *offsets) nextOffset(ctx context.Context, node string, partition int) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	offset, ok := o.offsets[node]
+	if !ok {
+		return 0, errors.New("unreachable")
+	}
+	return offset, nil
+}
+
+// newCluster starts size metadata servers connected in memory
+func newCluster(t *testing.T, transport *raft.MemTransport, size int, fake *offsets) []*Server {
+	peers := raft.MemPeers("http://node-", size)
+
+	servers := make([]*Server, size)
+	for i := range servers {
+		id := "http://node-" + strconv.Itoa(i)
+		server, err := NewServer(id, peers[id], "", transport)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fake != nil {
+			server.nextOffset = fake.nextOffset
+		}
+		transport.Register(server.Node())
+		servers[i] = server
+	}
+
+	for _, server := range servers {
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+
+	return servers
+}
+
+func waitForLeader(t *testing.T, servers []*Server) *Server {
+	t.Helper()
+
+	nodes := make([]*raft.Node, len(servers))
+	for i, server := range servers {
+		nodes[i] = server.Node()
+	}
+
+	leader := raft.WaitForLeader(nodes, 2*time.Second)
+	for _, server := range servers {
+		if leader != nil && server.Node() == leader {
+			return server
+		}
+	}
+
+	t.Fatalf("no metadata leader was elected")
+	return nil
+}
+
+// waitForState waits until done holds for the state of server
+func waitForState(t *testing.T, server *Server, done func(state ClusterState) bool) ClusterState {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		state := server.State()
+		if done(state) {
+			return state
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state of %s did not get there: %+v", server.ID(), state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAssign_ReplicatedToEveryServer(t *testing.T) {
+	setupTimeouts(t)
+	servers := newCluster(t, raft.NewMemTransport(), 3, nil)
+
+	leader := waitForLeader(t, servers)
+	replicas := []string{servers[1].ID(), servers[2].ID()}
+	if err := leader.Assign(context.Background(), 0, replicas); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, server := range servers {
+		state := waitForState(t, server, func(state ClusterState) bool {
+			_, ok := state.Partition(0)
+			return ok && len(state.Members) == 3
+		})
+
+		partition, _ := state.Partition(0)
+		if partition.Leader != replicas[0] || len(partition.Replicas) != 2 || partition.Epoch != 1 {
+			t.Errorf("unexpected partition on %s: %+v", server.ID(), partition)
+		}
+	}
+
+	for _, server := range servers {
+		if server == leader {
+			continue
+		}
+		if err := server.Assign(context.Background(), 1, replicas); !errors.Is(err, raft.ErrNotLeader) {
+			t.Errorf("expected ErrNotLeader from %s, got %v", server.ID(), err)
+		}
+	}
+}
+
+func TestFailedLeader_MostCaughtUpReplicaElected(t *testing.T) {
+	setupTimeouts(t)
+	transport := raft.NewMemTransport()
+	fake := &offsets{offsets: make(map[string]uint64)}
+	servers := newCluster(t, transport, 3, fake)
+
+	leader := waitForLeader(t, servers)
+
+	var others []*Server
+	for _, server := range servers {
+		if server != leader {
+			others = append(others, server)
+		}
+	}
+	failed, behind := others[0].ID(), others[1].ID()
+	fake.mu.Lock()
+	fake.offsets[behind] = 3
+	fake.offsets[leader.ID()] = 5
+	fake.mu.Unlock()
+
+	if err := leader.Assign(context.Background(), 0, []string{failed, behind, leader.ID()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	transport.Disconnect(failed)
+
+	state := waitForState(t, leader, func(state ClusterState) bool {
+		partition, _ := state.Partition(0)
+		return partition.Leader != failed
+	})
+
+	partition, _ := state.Partition(0)
+	if partition.Leader != leader.ID() || partition.Epoch != 2 {
+		t.Errorf("expected %s to lead partition 0 at epoch 2, got %+v", leader.ID(), partition)
+	}
+	if len(partition.Replicas) != 2 || partition.Replicas[1] != behind {
+		t.Errorf("expected the failed leader to be dropped from the replicas, got %v", partition.Replicas)
+	}
+}
+
+func TestElect_SkipsReplicasWithoutOffset(t *testing.T) {
+	setupTimeouts(t)
+	fake := &offsets{offsets: make(map[string]uint64)}
+	leader := waitForLeader(t, newCluster(t, raft.NewMemTransport(), 1, fake))
+
+	partition := PartitionState{Partition: 0, Leader: "http://failed", Replicas: []string{"http://failed", "http://silent"}, Epoch: 1}
+	alive := map[string]bool{"http://silent": true}
+
+	// The replica is alive but cannot say how far it replicated the partition
+	if err := leader.elect(context.Background(), partition, alive); !errors.Is(err, ErrNoReplicaAlive) {
+		t.Fatalf("expected ErrNoReplicaAlive, got %v", err)
+	}
+	if _, ok := leader.State().Partition(0); ok {
+		t.Errorf("expected no leader to be elected")
+	}
+}
+
+func TestFSM_StaleElectionIgnored(t *testing.T) {
+	fsm := NewFSM()
+
+	apply := func(index uint64, cmd command) {
+		data, _ := json.Marshal(cmd)
+		fsm.Apply(raft.Entry{Index: index, Command: data})
+	}
+
+	apply(1, command{Type: commandAssign, Partition: 0, Replicas: []string{"a", "b", "c"}})
+	apply(2, command{Type: commandElect, Partition: 0, Replicas: []string{"b", "c"}, Epoch: 1})
+	apply(3, command{Type: commandElect, Partition: 0, Replicas: []string{"c"}, Epoch: 1})
+
+	state := fsm.State()
+	partition, _ := state.Partition(0)
+	if partition.Leader != "b" || partition.Epoch != 2 || state.Version != 2 {
+		t.Errorf("expected the stale election to be ignored, got %+v at version %d", partition, state.Version)
+	}
+	if len(state.Members) != 3 {
+		t.Errorf("expected every replica to be a member, got %v", state.Members)
+	}
+}
+
+func TestHandleState_Watch(t *testing.T) {
+	setupTimeouts(t)
+	servers := newCluster(t, raft.NewMemTransport(), 1, nil)
+	server := waitForLeader(t, servers)
+	handler := NewHandler(server)
+
+	version := waitForState(t, server, func(state ClusterState) bool { return len(state.Members) == 1 }).Version
+
+	watched := make(chan ClusterState)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/v1/metadata?version="+strconv.FormatUint(version, 10)+"&wait=2s", nil)
+		w := httptest.NewRecorder()
+
+		handler.HandleState(w, req)
+
+		var state ClusterState
+		json.NewDecoder(w.Body).Decode(&state)
+		watched <- state
+	}()
+
+	body, _ := json.Marshal(AssignRequest{Partition: 3, Replicas: []string{server.ID()}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/metadata/partitions", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandlePartitions(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+
+	select {
+	case state := <-watched:
+		if _, ok := state.Partition(3); !ok || state.Version <= version {
+			t.Errorf("expected the watch to return the assignment, got %+v", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watch did not return after the assignment")
+	}
+}
@@ -0,0 +1,847 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ElectionTimeout is how long a follower waits to hear from a leader before
+// it starts an election. Every node waits a random duration between one and
+// two ElectionTimeouts so they rarely campaign at the same time. A leader
+// that has not heard from a majority for an ElectionTimeout steps down.
+// This can be overridden for testing or configuration.
+var ElectionTimeout = time.Second
+
+// HeartbeatInterval is how often a leader sends entries, or empty heartbeats,
+// to its followers.
+// This can be overridden for testing or configuration.
+var HeartbeatInterval = 100 * time.Millisecond
+
+// maxAppendEntries bounds the entries sent to a follower in one request.
+const maxAppendEntries = 256
+
+var (
+	// ErrNotLeader is returned when proposing a command to a node that is not
+	// the leader. Leader tells which node is, if any.
+	ErrNotLeader = errors.New("not the raft leader")
+	// ErrLeadershipLost is returned when the leader stepped down before a
+	// proposed command was committed. The command may still be committed by
+	// the next leader.
+	ErrLeadershipLost = errors.New("raft leadership lost before the command was committed")
+	// ErrStopped is returned when proposing a command to a closed node.
+	ErrStopped = errors.New("raft node is stopped")
+)
+
+// State is the role a node plays in its group.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// Entry is a command in the replicated log. Entries without a command are
+// appended by new leaders to commit the entries of earlier terms and are not
+// applied.
+type Entry struct {
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+// FSM is the state machine the committed entries of the log are applied to.
+type FSM interface {
+	// Apply is called with every committed entry, in log order, from a
+	// single goroutine.
+	Apply(entry Entry)
+}
+
+// Config configures a node of a raft group.
+type Config struct {
+	ID        string   // how the other nodes reach this one through Transport
+	Peers     []string // the other nodes of the group
+	Dir       string   // where the term, vote and log are kept, empty keeps them in memory
+	Transport Transport
+	FSM       FSM
+}
+
+// PeerStatus is how far a peer has replicated the log of the leader.
+type PeerStatus struct {
+	ID          string     `json:"id"`
+	MatchIndex  uint64     `json:"match_index"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+// Status describes a node. Peers are only reported by the leader.
+type Status struct {
+	ID           string       `json:"id"`
+	State        string       `json:"state"`
+	Term         uint64       `json:"term"`
+	Leader       string       `json:"leader,omitempty"`
+	LastIndex    uint64       `json:"last_index"`
+	CommitIndex  uint64       `json:"commit_index"`
+	AppliedIndex uint64       `json:"applied_index"`
+	Peers        []PeerStatus `json:"peers,omitempty"`
+}
+
+// Node is a member of a raft group. The leader appends proposed commands to
+// its log and replicates them to the followers, and every node applies the
+// entries a majority has to its FSM. The whole log is kept and replayed into
+// the FSM on start, which suits the small, rarely changing state it is used
+// for: the log file is only appended to, but it is never compacted.
+type Node struct {
+	id        string
+	peers     []string
+	transport Transport
+	fsm       FSM
+	path      string   // term and vote
+	logFile   *os.File // one entry per line, appended to as the log grows
+
+	mu          sync.Mutex
+	state       State
+	term        uint64
+	votedFor    string
+	leader      string
+	log         []Entry // log[0] is a sentinel at index 0
+	logEnds     []int64 // size of the log file up to every entry
+	commitIndex uint64
+	lastApplied uint64
+	deadline    time.Time // an election starts when no leader was heard of by then
+
+	// Leader state, reset on every election won.
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	contact    map[string]time.Time // last response of every peer
+	sending    map[string]bool      // peers with an AppendEntries request in flight
+
+	waiters map[uint64]waiter // proposals waiting to be applied, by index
+
+	closed     bool
+	applyCh    chan struct{}
+	stop       chan struct{}
+	background sync.WaitGroup
+}
+
+// waiter is a proposal waiting for its entry to be applied.
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// persistentState is the term and vote a node must remember across restarts
+// to keep the promises it made to the other nodes. The log is kept in a file
+// of its own.
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// NewNode creates a node of a raft group, loading its term, vote and log from
+// Config.Dir. The node does nothing until Start is called.
+func NewNode(config Config) (*Node, error) {
+	n := &Node{
+		id:         config.ID,
+		peers:      append([]string(nil), config.Peers...),
+		transport:  config.Transport,
+		fsm:        config.FSM,
+		log:        []Entry{{}},
+		logEnds:    []int64{0},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		contact:    make(map[string]time.Time),
+		sending:    make(map[string]bool),
+		waiters:    make(map[uint64]waiter),
+		applyCh:    make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+
+	if config.Dir != "" {
+		n.path = filepath.Join(config.Dir, "raft.json")
+		if err := n.load(config.Dir); err != nil {
+			if n.logFile != nil {
+				n.logFile.Close()
+			}
+			return nil, err
+		}
+	}
+	n.resetDeadline(time.Now())
+
+	return n, nil
+}
+
+// Start starts the election timer and the applier of committed entries.
+func (n *Node) Start() {
+	n.background.Add(2)
+	go n.run()
+	go n.runApplier()
+}
+
+// Close stops the node. Proposals still waiting fail with ErrStopped.
+func (n *Node) Close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	n.failWaiters(ErrStopped)
+	n.mu.Unlock()
+
+	close(n.stop)
+	n.background.Wait()
+
+	n.mu.Lock()
+	if n.logFile != nil {
+		n.logFile.Close()
+	}
+	n.mu.Unlock()
+}
+
+// ID returns the ID of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the leader this node knows of, or "" during elections.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.leader
+}
+
+// IsLeader reports whether this node is the leader of its group.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.state == Leader
+}
+
+// Status describes the node and, on the leader, its peers.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{
+		ID:           n.id,
+		State:        n.state.String(),
+		Term:         n.term,
+		Leader:       n.leader,
+		LastIndex:    n.lastIndex(),
+		CommitIndex:  n.commitIndex,
+		AppliedIndex: n.lastApplied,
+	}
+
+	if n.state == Leader {
+		for _, peer := range n.peers {
+			peerStatus := PeerStatus{ID: peer, MatchIndex: n.matchIndex[peer]}
+			if contact, ok := n.contact[peer]; ok {
+				peerStatus.LastContact = &contact
+			}
+			status.Peers = append(status.Peers, peerStatus)
+		}
+		sort.Slice(status.Peers, func(i, j int) bool {
+			return status.Peers[i].ID < status.Peers[j].ID
+		})
+	}
+
+	return status
+}
+
+// Propose appends command to the log of the leader and returns its index once
+// it has been committed and applied to the FSM of the leader.
+func (n *Node) Propose(ctx context.Context, command []byte) (uint64, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return 0, ErrStopped
+	}
+	if n.state != Leader {
+		leader := n.leader
+		n.mu.Unlock()
+		return 0, fmt.Errorf("%w, the leader is %q", ErrNotLeader, leader)
+	}
+
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: command}
+	n.log = append(n.log, entry)
+	if err := n.saveLog(entry.Index); err != nil {
+		n.log = n.log[:entry.Index]
+		n.mu.Unlock()
+		return 0, err
+	}
+
+	done := make(chan error, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, done: done}
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	n.broadcast()
+
+	select {
+	case err := <-done:
+		return entry.Index, err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// RequestVote answers a candidate asking for the vote of this node.
+func (n *Node) RequestVote(req VoteRequest) VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return VoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+	}
+
+	lastTerm, lastIndex := n.log[n.lastIndex()].Term, n.lastIndex()
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= lastIndex)
+	if !upToDate || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return VoteResponse{Term: n.term}
+	}
+
+	n.votedFor = req.Candidate
+	if err := n.saveState(); err != nil {
+		fmt.Println("[RAFT]", "node=", n.id, "failed to save vote error=", err)
+		n.votedFor = ""
+		return VoteResponse{Term: n.term}
+	}
+	n.resetDeadline(time.Now())
+
+	return VoteResponse{Term: n.term, Granted: true}
+}
+
+// AppendEntries answers the leader replicating its log to this node.
+func (n *Node) AppendEntries(req AppendRequest) AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	}
+	if req.Term > n.term || n.state != Follower {
+		n.becomeFollower(req.Term, req.Leader)
+	}
+	n.leader = req.Leader
+	n.resetDeadline(time.Now())
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	}
+	if term := n.log[req.PrevLogIndex].Term; term != req.PrevLogTerm {
+		// Skip the whole conflicting term rather than one entry at a time.
+		index := req.PrevLogIndex
+		for index > 1 && n.log[index-1].Term == term {
+			index--
+		}
+		return AppendResponse{Term: n.term, LastIndex: index - 1}
+	}
+
+	for i, entry := range req.Entries {
+		if entry.Index <= n.lastIndex() {
+			if n.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			n.log = n.log[:entry.Index]
+		}
+
+		n.log = append(n.log, req.Entries[i:]...)
+		if err := n.saveLog(entry.Index); err != nil {
+			fmt.Println("[RAFT]", "node=", n.id, "failed to save log error=", err)
+			n.log = n.log[:entry.Index]
+			return AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+		}
+		break
+	}
+
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	// A stale request may vouch for fewer entries than are known to be
+	// committed already.
+	if commit := min(req.LeaderCommit, match); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.notifyApplier()
+	}
+
+	return AppendResponse{Term: n.term, Success: true, LastIndex: match}
+}
+
+// run starts elections when no leader is heard of and sends heartbeats while
+// this node leads.
+func (n *Node) run() {
+	defer n.background.Done()
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			n.tick(now)
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *Node) tick(now time.Time) {
+	n.mu.Lock()
+
+	switch {
+	case n.state == Leader && !n.heardFromMajority(now):
+		fmt.Println("[RAFT]", "node=", n.id, "term=", n.term, "lost contact with the majority, stepping down")
+		n.becomeFollower(n.term, "")
+		n.mu.Unlock()
+	case n.state == Leader:
+		n.mu.Unlock()
+		n.broadcast()
+	case now.After(n.deadline):
+		n.campaign(now)
+		n.mu.Unlock()
+	default:
+		n.mu.Unlock()
+	}
+}
+
+// campaign starts an election for the next term. n.mu must be held.
+func (n *Node) campaign(now time.Time) {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	n.resetDeadline(now)
+	if err := n.saveState(); err != nil {
+		fmt.Println("[RAFT]", "node=", n.id, "failed to save vote error=", err)
+		return
+	}
+
+	fmt.Println("[RAFT]", "node=", n.id, "campaign term=", n.term)
+
+	req := VoteRequest{
+		Term:         n.term,
+		Candidate:    n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.log[n.lastIndex()].Term,
+	}
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader(now)
+		return
+	}
+
+	for _, peer := range n.peers {
+		n.background.Add(1)
+		go func() {
+			defer n.background.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), ElectionTimeout)
+			defer cancel()
+
+			resp, err := n.transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term, "")
+				return
+			}
+			if !resp.Granted || n.state != Candidate || n.term != req.Term {
+				return
+			}
+
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader(time.Now())
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over the group after winning an election. n.mu must be
+// held.
+func (n *Node) becomeLeader(now time.Time) {
+	n.state = Leader
+	n.leader = n.id
+
+	last := n.lastIndex()
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = last + 1
+		n.matchIndex[peer] = 0
+		n.contact[peer] = now
+	}
+
+	// Entries of earlier terms are only committed along with an entry of the
+	// current term.
+	n.log = append(n.log, Entry{Index: last + 1, Term: n.term})
+	if err := n.saveLog(last + 1); err != nil {
+		fmt.Println("[RAFT]", "node=", n.id, "failed to save log error=", err)
+	}
+	n.advanceCommit()
+
+	fmt.Println("[RAFT]", "node=", n.id, "leader term=", n.term)
+
+	for _, peer := range n.peers {
+		n.replicate(peer)
+	}
+}
+
+// becomeFollower follows leader in term, forgetting the vote of an earlier
+// term. n.mu must be held.
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.saveState(); err != nil {
+			fmt.Println("[RAFT]", "node=", n.id, "failed to save term error=", err)
+		}
+	}
+
+	if n.state == Leader {
+		n.failWaiters(ErrLeadershipLost)
+	}
+	n.state = Follower
+	n.leader = leader
+	n.resetDeadline(time.Now())
+}
+
+// broadcast replicates the log to every peer that has no request in flight.
+func (n *Node) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, peer := range n.peers {
+		n.replicate(peer)
+	}
+}
+
+// replicate sends the entries peer is missing, or an empty heartbeat, unless
+// a request to peer is already in flight. It sends again right away while
+// peer is behind. n.mu must be held.
+func (n *Node) replicate(peer string) {
+	if n.closed || n.state != Leader || n.sending[peer] {
+		return
+	}
+	n.sending[peer] = true
+
+	next := n.nextIndex[peer]
+	end := min(n.lastIndex()+1, next+maxAppendEntries)
+	req := AppendRequest{
+		Term:         n.term,
+		Leader:       n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.log[next-1].Term,
+		Entries:      append([]Entry(nil), n.log[next:end]...),
+		LeaderCommit: n.commitIndex,
+	}
+
+	n.background.Add(1)
+	go func() {
+		defer n.background.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), ElectionTimeout)
+		defer cancel()
+
+		resp, err := n.transport.AppendEntries(ctx, peer, req)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		n.sending[peer] = false
+		if err != nil {
+			return
+		}
+		n.contact[peer] = time.Now()
+
+		if resp.Term > n.term {
+			n.becomeFollower(resp.Term, "")
+			return
+		}
+		if n.state != Leader || n.term != req.Term {
+			return
+		}
+
+		if resp.Success {
+			n.matchIndex[peer] = max(n.matchIndex[peer], resp.LastIndex)
+			n.nextIndex[peer] = n.matchIndex[peer] + 1
+			n.advanceCommit()
+		} else {
+			n.nextIndex[peer] = max(1, min(req.PrevLogIndex, resp.LastIndex+1))
+		}
+
+		if !resp.Success || n.nextIndex[peer] <= n.lastIndex() {
+			n.replicate(peer)
+		}
+	}()
+}
+
+// advanceCommit commits the entries of the current term a majority has.
+// n.mu must be held.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.log[index].Term == n.term; index-- {
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.notifyApplier()
+			return
+		}
+	}
+}
+
+// heardFromMajority reports whether a majority of the group answered the
+// leader within the last ElectionTimeout. n.mu must be held.
+func (n *Node) heardFromMajority(now time.Time) bool {
+	count := 1
+	for _, peer := range n.peers {
+		if now.Sub(n.contact[peer]) < ElectionTimeout {
+			count++
+		}
+	}
+
+	return count >= n.quorum()
+}
+
+// runApplier applies committed entries to the FSM and completes the
+// proposals waiting for them.
+func (n *Node) runApplier() {
+	defer n.background.Done()
+
+	for {
+		select {
+		case <-n.applyCh:
+		case <-n.stop:
+			return
+		}
+
+		for {
+			n.mu.Lock()
+			if n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			entries := append([]Entry(nil), n.log[n.lastApplied+1:n.commitIndex+1]...)
+			n.mu.Unlock()
+
+			for _, entry := range entries {
+				if entry.Command != nil {
+					n.fsm.Apply(entry)
+				}
+			}
+
+			n.mu.Lock()
+			n.lastApplied = entries[len(entries)-1].Index
+			for _, entry := range entries {
+				w, ok := n.waiters[entry.Index]
+				if !ok {
+					continue
+				}
+				delete(n.waiters, entry.Index)
+
+				// Another leader overwrote the proposed entry.
+				if w.term != entry.Term {
+					w.done <- ErrLeadershipLost
+				} else {
+					w.done <- nil
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *Node) notifyApplier() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// failWaiters fails every proposal still waiting. n.mu must be held.
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.done <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// resetDeadline sets when the next election starts if no leader is heard of,
+// a random duration between one and two ElectionTimeouts from now.
+func (n *Node) resetDeadline(now time.Time) {
+	n.deadline = now.Add(ElectionTimeout + rand.N(ElectionTimeout))
+}
+
+// saveState saves the term and vote before the node answers or acts on
+// them. n.mu must be held.
+func (n *Node) saveState() error {
+	if n.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(persistentState{Term: n.term, VotedFor: n.votedFor})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(n.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(n.path+".tmp", n.path)
+}
+
+// saveLog saves the entries of the log from index on, dropping those the
+// log file has from there. Only the new entries are written, so appending
+// costs the same however long the log is. n.mu must be held.
+func (n *Node) saveLog(from uint64) error {
+	if n.logFile == nil {
+		return nil
+	}
+
+	// Entries a failed save left out are written along.
+	from = min(from, uint64(len(n.logEnds)))
+	n.logEnds = n.logEnds[:from]
+	offset := n.logEnds[from-1]
+	if err := n.logFile.Truncate(offset); err != nil {
+		return err
+	}
+
+	var data []byte
+	var ends []int64
+	for _, entry := range n.log[from:] {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+		ends = append(ends, offset+int64(len(data)))
+	}
+
+	if _, err := n.logFile.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if err := n.logFile.Sync(); err != nil {
+		return err
+	}
+	n.logEnds = append(n.logEnds, ends...)
+
+	return nil
+}
+
+// load restores the term and vote saved by saveState and the log saved by
+// saveLog, starting an empty node when there are none. A torn last entry
+// left by a crash was never acknowledged and is cut off.
+func (n *Node) load(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var state persistentState
+	data, err := os.ReadFile(n.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("invalid raft state in %s: %w", n.path, err)
+		}
+	}
+	n.term = state.Term
+	n.votedFor = state.VotedFor
+
+	path := filepath.Join(dir, "raft.log")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	n.logFile = file
+
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				fmt.Println("[RAFT]", "node=", n.id, "dropping torn log entry bytes=", len(line))
+				if err := file.Truncate(size); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("invalid raft log in %s: %w", path, err)
+		}
+		if entry.Index != uint64(len(n.log)) {
+			return fmt.Errorf("invalid raft log in %s: entry %d has index %d", path, len(n.log), entry.Index)
+		}
+
+		size += int64(len(line))
+		n.log = append(n.log, entry)
+		n.logEnds = append(n.logEnds, size)
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupTimeouts(t *testing.T) {
+	t.Cleanup(MemTimeouts())
+}
+
+// memFSM records the commands applied to it
+type memFSM struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (f *memFSM) Apply(entry Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commands = append(f.commands, string(entry.Command))
+}
+
+func (f *memFSM) applied() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.commands...)
+}
+
+type testNode struct {
+	node *Node
+	fsm  *memFSM
+}
+
+// newCluster starts a group of size nodes connected by transport, keeping
+// their state under dirs when given
+func newCluster(t *testing.T, transport *MemTransport, size int, dirs ...string) []testNode {
+	peers := MemPeers("node-", size)
+
+	nodes := make([]testNode, size)
+	for i := range nodes {
+		id := "node-" + strconv.Itoa(i)
+		config := Config{ID: id, Peers: peers[id], Transport: transport, FSM: &memFSM{}}
+		if len(dirs) > i {
+			config.Dir = dirs[i]
+		}
+
+		node, err := NewNode(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		transport.Register(node)
+		nodes[i] = testNode{node: node, fsm: config.FSM.(*memFSM)}
+	}
+
+	for _, n := range nodes {
+		n.node.Start()
+		t.Cleanup(n.node.Close)
+	}
+
+	return nodes
+}
+
+// waitForLeader waits until exactly one of the connected nodes leads and the
+// others know it.
+func waitForLeader(t *testing.T, nodes []testNode, disconnected ...string) *Node {
+	t.Helper()
+
+	var connected []*Node
+	for _, n := range nodes {
+		if !contains(disconnected, n.node.ID()) {
+			connected = append(connected, n.node)
+		}
+	}
+
+	leader := WaitForLeader(connected, 2*time.Second)
+	if leader == nil {
+		t.Fatalf("no single leader was elected")
+	}
+
+	return leader
+}
+
+// waitForApplied waits until every node applied expected
+func waitForApplied(t *testing.T, nodes []testNode, expected ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, n := range nodes {
+		for {
+			applied := n.fsm.applied()
+			if equal(applied, expected) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s applied %v, expected %v", n.node.ID(), applied, expected)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func propose(t *testing.T, node *Node, command string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := node.Propose(ctx, []byte(command)); err != nil {
+		t.Fatalf("unexpected error proposing %q: %v", command, err)
+	}
+}
+
+func TestPropose_AppliedOnEveryNode(t *testing.T) {
+	setupTimeouts(t)
+	nodes := newCluster(t, NewMemTransport(), 3)
+
+	leader := waitForLeader(t, nodes)
+	propose(t, leader, "first")
+	propose(t, leader, "second")
+
+	waitForApplied(t, nodes, "first", "second")
+
+	status := leader.Status()
+	if status.State != "leader" || len(status.Peers) != 2 || status.CommitIndex != status.LastIndex {
+		t.Errorf("unexpected leader status: %+v", status)
+	}
+}
+
+func TestPropose_NotLeader(t *testing.T) {
+	setupTimeouts(t)
+	nodes := newCluster(t, NewMemTransport(), 3)
+
+	leader := waitForLeader(t, nodes)
+	for _, n := range nodes {
+		if n.node == leader {
+			continue
+		}
+		if _, err := n.node.Propose(context.Background(), []byte("follower")); !errors.Is(err, ErrNotLeader) {
+			t.Errorf("expected ErrNotLeader from %s, got %v", n.node.ID(), err)
+		}
+	}
+}
+
+func TestLeaderFailure_ElectsNewLeader(t *testing.T) {
+	setupTimeouts(t)
+	transport := NewMemTransport()
+	nodes := newCluster(t, transport, 3)
+
+	oldLeader := waitForLeader(t, nodes)
+	propose(t, oldLeader, "before")
+	waitForApplied(t, nodes, "before")
+
+	transport.Disconnect(oldLeader.ID())
+
+	newLeader := waitForLeader(t, nodes, oldLeader.ID())
+	if newLeader == oldLeader {
+		t.Fatalf("expected a new leader")
+	}
+	propose(t, newLeader, "after")
+
+	// The old leader cannot commit anything without a majority
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := oldLeader.Propose(ctx, []byte("lost")); err == nil {
+		t.Errorf("expected the disconnected leader to fail proposals")
+	}
+
+	// Once back, it follows the new leader and drops its uncommitted entry
+	transport.Connect(oldLeader.ID())
+	waitForLeader(t, nodes)
+	waitForApplied(t, nodes, "before", "after")
+}
+
+func TestRestart_ReplaysLog(t *testing.T) {
+	setupTimeouts(t)
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+
+	transport := NewMemTransport()
+	nodes := newCluster(t, transport, 3, dirs...)
+	propose(t, waitForLeader(t, nodes), "persisted")
+	waitForApplied(t, nodes, "persisted")
+
+	for _, n := range nodes {
+		n.node.Close()
+	}
+
+	// Committed entries are applied again once a new leader is elected
+	nodes = newCluster(t, NewMemTransport(), 3, dirs...)
+	propose(t, waitForLeader(t, nodes), "after restart")
+	waitForApplied(t, nodes, "persisted", "after restart")
+}
+
+func TestSingleNode(t *testing.T) {
+	setupTimeouts(t)
+	nodes := newCluster(t, NewMemTransport(), 1)
+
+	propose(t, waitForLeader(t, nodes), "alone")
+	waitForApplied(t, nodes, "alone")
+}
+
+// newFollower creates a node that is not started, so it only changes when
+// it is sent requests
+func newFollower(t *testing.T, dir string) *Node {
+	t.Helper()
+
+	node, err := NewNode(Config{ID: "follower", Peers: []string{"leader"}, Dir: dir, Transport: NewMemTransport(), FSM: &memFSM{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(node.Close)
+
+	return node
+}
+
+func entries(term uint64, from uint64, to uint64) []Entry {
+	var entries []Entry
+	for index := from; index <= to; index++ {
+		entries = append(entries, Entry{Index: index, Term: term, Command: []byte(strconv.FormatUint(index, 10))})
+	}
+	return entries
+}
+
+func TestAppendEntries_StaleRequestKeepsCommitIndex(t *testing.T) {
+	node := newFollower(t, "")
+
+	node.AppendEntries(AppendRequest{Term: 1, Leader: "leader", Entries: entries(1, 1, 3), LeaderCommit: 2})
+
+	// Sent before the first one but delivered after it
+	resp := node.AppendEntries(AppendRequest{Term: 1, Leader: "leader", Entries: entries(1, 1, 1), LeaderCommit: 3})
+	if !resp.Success {
+		t.Fatalf("expected the stale request to succeed")
+	}
+
+	if status := node.Status(); status.CommitIndex != 2 || status.LastIndex != 3 {
+		t.Errorf("expected commit index 2 and last index 3, got %d and %d", status.CommitIndex, status.LastIndex)
+	}
+}
+
+func TestRestart_KeepsLogAfterConflict(t *testing.T) {
+	dir := t.TempDir()
+	node := newFollower(t, dir)
+
+	node.AppendEntries(AppendRequest{Term: 1, Leader: "leader", Entries: entries(1, 1, 5)})
+	// A new leader overwrites the entries from 3 on
+	node.AppendEntries(AppendRequest{Term: 2, Leader: "leader", PrevLogIndex: 2, PrevLogTerm: 1, Entries: entries(2, 3, 4)})
+	node.Close()
+
+	node = newFollower(t, dir)
+	expected := append(entries(1, 1, 2), entries(2, 3, 4)...)
+	if status := node.Status(); status.LastIndex != 4 || status.Term != 2 {
+		t.Fatalf("expected last index 4 in term 2, got %d in term %d", status.LastIndex, status.Term)
+	}
+	for _, entry := range expected {
+		if node.log[entry.Index].Term != entry.Term {
+			t.Errorf("expected entry %d of term %d, got term %d", entry.Index, entry.Term, node.log[entry.Index].Term)
+		}
+	}
+}
+
+func TestRestart_DropsTornLogEntry(t *testing.T) {
+	dir := t.TempDir()
+	node := newFollower(t, dir)
+	node.AppendEntries(AppendRequest{Term: 1, Leader: "leader", Entries: entries(1, 1, 2)})
+	node.Close()
+
+	// A crash in the middle of writing the third entry
+	file, err := os.OpenFile(filepath.Join(dir, "raft.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file.WriteString(`{"index":3,"te`)
+	file.Close()
+
+	node = newFollower(t, dir)
+	if status := node.Status(); status.LastIndex != 2 {
+		t.Fatalf("expected last index 2, got %d", status.LastIndex)
+	}
+
+	// The next entry is not appended to the torn one
+	node.AppendEntries(AppendRequest{Term: 1, Leader: "leader", PrevLogIndex: 2, PrevLogTerm: 1, Entries: entries(1, 3, 3)})
+	node.Close()
+
+	node = newFollower(t, dir)
+	if status := node.Status(); status.LastIndex != 3 {
+		t.Errorf("expected last index 3, got %d", status.LastIndex)
+	}
+}
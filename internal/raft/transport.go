@@ -0,0 +1,280 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable is returned by MemTransport for nodes that are not
+// registered or are disconnected.
+var ErrUnreachable = errors.New("raft node unreachable")
+
+// VoteRequest asks a node for its vote in an election.
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest replicates the entries following PrevLogIndex to a follower.
+// Without entries it is a heartbeat.
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendResponse tells the leader how far the log of the follower matches
+// its own. When Success is false, LastIndex is where the leader should try
+// again from.
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// Transport carries the requests of a node to its peers.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, req AppendRequest) (AppendResponse, error)
+}
+
+// MemTransport connects the nodes of a group running in one process, as in
+// tests. Disconnected nodes can neither send nor receive requests.
+type MemTransport struct {
+	mu           sync.RWMutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{nodes: make(map[string]*Node), disconnected: make(map[string]bool)}
+}
+
+// Register makes node reachable by its ID.
+func (t *MemTransport) Register(node *Node) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nodes[node.ID()] = node
+}
+
+// Disconnect cuts node off from the other nodes until Connect is called.
+func (t *MemTransport) Disconnect(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.disconnected[id] = true
+}
+
+// Connect reconnects a disconnected node.
+func (t *MemTransport) Connect(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.disconnected, id)
+}
+
+func (t *MemTransport) node(from string, to string) (*Node, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	node, ok := t.nodes[to]
+	if !ok || t.disconnected[from] || t.disconnected[to] {
+		return nil, fmt.Errorf("%s: %w", to, ErrUnreachable)
+	}
+
+	return node, nil
+}
+
+func (t *MemTransport) RequestVote(ctx context.Context, peer string, req VoteRequest) (VoteResponse, error) {
+	node, err := t.node(req.Candidate, peer)
+	if err != nil {
+		return VoteResponse{}, err
+	}
+
+	return node.RequestVote(req), nil
+}
+
+func (t *MemTransport) AppendEntries(ctx context.Context, peer string, req AppendRequest) (AppendResponse, error) {
+	node, err := t.node(req.Leader, peer)
+	if err != nil {
+		return AppendResponse{}, err
+	}
+
+	return node.AppendEntries(req), nil
+}
+
+// MemTimeouts shortens ElectionTimeout and HeartbeatInterval so groups
+// connected by a MemTransport elect a leader within milliseconds. It returns
+// a function restoring them.
+func MemTimeouts() (restore func()) {
+	election, heartbeat := ElectionTimeout, HeartbeatInterval
+	ElectionTimeout, HeartbeatInterval = 50*time.Millisecond, 10*time.Millisecond
+
+	return func() {
+		ElectionTimeout, HeartbeatInterval = election, heartbeat
+	}
+}
+
+// MemPeers returns the peers of every member of a group of size nodes named
+// prefix followed by their number, as they are passed to Config.
+func MemPeers(prefix string, size int) map[string][]string {
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = prefix + strconv.Itoa(i)
+	}
+
+	peers := make(map[string][]string, size)
+	for _, id := range ids {
+		for _, peer := range ids {
+			if peer != id {
+				peers[id] = append(peers[id], peer)
+			}
+		}
+	}
+
+	return peers
+}
+
+// WaitForLeader waits until exactly one of nodes leads and the others know
+// it, and returns that node. It returns nil when they do not agree within
+// timeout.
+func WaitForLeader(nodes []*Node, timeout time.Duration) *Node {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		for _, node := range nodes {
+			if node.IsLeader() {
+				leaders = append(leaders, node)
+			}
+		}
+
+		if len(leaders) == 1 {
+			agreed := true
+			for _, node := range nodes {
+				agreed = agreed && node.Leader() == leaders[0].ID()
+			}
+			if agreed {
+				return leaders[0]
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// HTTPTransport sends requests as JSON to the /v1/raft/vote and
+// /v1/raft/append endpoints of peers, which are identified by their base
+// URL.
+type HTTPTransport struct {
+	client *http.Client
+}
+
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{client: &http.Client{}}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, peer string, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	err := t.post(ctx, peer+"/v1/raft/vote", req, &resp)
+
+	return resp, err
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, peer string, req AppendRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	err := t.post(ctx, peer+"/v1/raft/append", req, &resp)
+
+	return resp, err
+}
+
+func (t *HTTPTransport) post(ctx context.Context, url string, req any, resp any) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("raft peer returned %d: %s", response.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return json.NewDecoder(response.Body).Decode(resp)
+}
+
+// Handler serves the requests HTTPTransport sends to a node.
+type Handler struct {
+	node *Node
+}
+
+func NewHandler(node *Node) *Handler {
+	return &Handler{node: node}
+}
+
+// HandleVote answers a candidate asking for the vote of the node.
+func (h *Handler) HandleVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req VoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.node.RequestVote(req))
+}
+
+// HandleAppend answers the leader replicating its log to the node.
+func (h *Handler) HandleAppend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AppendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.node.AppendEntries(req))
+}
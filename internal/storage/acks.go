@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// Acks is how many replicas must have a write before it is acknowledged.
+type Acks string
+
+const (
+	// AcksNone acknowledges writes once they are appended, without waiting
+	// for them to be durable.
+	AcksNone Acks = "0"
+	// AcksLeader acknowledges writes once they are durable on the leader
+	// according to Durability.
+	AcksLeader Acks = "1"
+	// AcksAll acknowledges writes once every in-sync follower has them too.
+	AcksAll Acks = "all"
+)
+
+// ParseAcks parses the acks of a write, AcksLeader when empty.
+func ParseAcks(value string) (Acks, error) {
+	switch Acks(value) {
+	case "", AcksLeader:
+		return AcksLeader, nil
+	case AcksNone, AcksAll:
+		return Acks(value), nil
+	default:
+		return "", fmt.Errorf("invalid acks %q, expected 0, 1 or all", value)
+	}
+}
+
+// MinInSyncReplicas is how many replicas of a partition, the leader
+// included, must be in sync for writes with AcksAll to be accepted.
+// This can be overridden for testing or configuration.
+var MinInSyncReplicas = 1
+
+// ReplicaLagTimeout is how long a follower stays in sync after it last
+// fetched up to the end of the partition.
+// This can be overridden for testing or configuration.
+var ReplicaLagTimeout = 10 * time.Second
+
+// AcksTimeout bounds how long a write with AcksAll waits for its in-sync
+// followers before it is answered with ErrReplicationIncomplete. Writes
+// carrying RequestTimeoutHeader stop waiting earlier when their sender would
+// give up first. Zero waits as long as the request does.
+// This can be overridden for testing or configuration.
+var AcksTimeout = 1500 * time.Millisecond
+
+// inSyncCheckInterval is how often a write with AcksAll checks whether
+// followers dropped out of sync while it waits for them.
+const inSyncCheckInterval = 50 * time.Millisecond
+
+var (
+	// ErrNotEnoughReplicas is returned for writes with AcksAll to partitions
+	// with fewer than MinInSyncReplicas in-sync replicas. Nothing is stored.
+	ErrNotEnoughReplicas = apierror.New(http.StatusServiceUnavailable, "not enough in-sync replicas")
+	// ErrReplicationIncomplete is returned when a write with AcksAll was
+	// stored on the leader but fewer than MinInSyncReplicas replicas have it.
+	ErrReplicationIncomplete = apierror.New(http.StatusGatewayTimeout, "stored on the leader but not on enough in-sync replicas")
+)
+
+// followerProgress is how far a follower has fetched a partition from this
+// node.
+type followerProgress struct {
+	next       uint64    // the follower has every record below next
+	caughtUpAt time.Time // last fetch starting at the end of the partition
+}
+
+// signal wakes up the requests waiting for something to happen to a
+// partition.
+type signal struct {
+	mu    sync.Mutex
+	chans map[int]chan struct{}
+}
+
+// wait returns a channel closed on the next notify of partition.
+func (sig *signal) wait(partition int) <-chan struct{} {
+	sig.mu.Lock()
+	defer sig.mu.Unlock()
+
+	if sig.chans == nil {
+		sig.chans = make(map[int]chan struct{})
+	}
+	ch, ok := sig.chans[partition]
+	if !ok {
+		ch = make(chan struct{})
+		sig.chans[partition] = ch
+	}
+
+	return ch
+}
+
+func (sig *signal) notify(partition int) {
+	sig.mu.Lock()
+	defer sig.mu.Unlock()
+
+	if ch, ok := sig.chans[partition]; ok {
+		close(ch)
+		delete(sig.chans, partition)
+	}
+}
+
+// replicaTracker tracks the followers of the partitions this node leads.
+// Fetches of caught-up followers wait for appended, writes with AcksAll wait
+// for progressed.
+type replicaTracker struct {
+	mu        sync.Mutex
+	followers map[int]map[string]*followerProgress
+
+	appended   signal
+	progressed signal
+}
+
+// fetched records that replica fetched partition from offset next while the
+// partition ended at end.
+func (t *replicaTracker) fetched(partition int, replica string, next uint64, end uint64, now time.Time) {
+	t.mu.Lock()
+
+	if t.followers == nil {
+		t.followers = make(map[int]map[string]*followerProgress)
+	}
+	if t.followers[partition] == nil {
+		t.followers[partition] = make(map[string]*followerProgress)
+	}
+	progress, ok := t.followers[partition][replica]
+	if !ok {
+		progress = &followerProgress{}
+		t.followers[partition][replica] = progress
+	}
+
+	progress.next = next
+	if next >= end {
+		progress.caughtUpAt = now
+	}
+	t.mu.Unlock()
+
+	t.progressed.notify(partition)
+}
+
+// inSync returns the followers of partition that are in sync at now and how
+// many of them have every record below target.
+func (t *replicaTracker) inSync(partition int, target uint64, now time.Time) (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inSync, acknowledged := 0, 0
+	for _, progress := range t.followers[partition] {
+		if now.Sub(progress.caughtUpAt) >= ReplicaLagTimeout {
+			continue
+		}
+		inSync++
+		if progress.next >= target {
+			acknowledged++
+		}
+	}
+
+	return inSync, acknowledged
+}
+
+// forget drops the followers of a partition that was deleted.
+func (t *replicaTracker) forget(partition int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.followers, partition)
+}
+
+// InSyncReplicas is how many replicas of a partition, the leader included,
+// are in sync.
+func (s *Service) InSyncReplicas(partition int) int {
+	inSync, _ := s.replicas.inSync(partition, 0, time.Now())
+	return inSync + 1
+}
+
+// awaitReplicas waits until every in-sync follower of partition has the
+// records below target, for at most AcksTimeout or until ctx is done.
+// Followers that fall out of sync meanwhile are no longer waited for, as long
+// as MinInSyncReplicas replicas remain.
+func (s *Service) awaitReplicas(ctx context.Context, partition int, target uint64) error {
+	if AcksTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, AcksTimeout)
+		defer cancel()
+	}
+
+	for {
+		progressed := s.replicas.progressed.wait(partition)
+
+		inSync, acknowledged := s.replicas.inSync(partition, target, time.Now())
+		if inSync+1 < MinInSyncReplicas {
+			return fmt.Errorf("partition %d has %d of %d in-sync replicas: %w", partition, inSync+1, MinInSyncReplicas, ErrReplicationIncomplete)
+		}
+		if acknowledged == inSync {
+			return nil
+		}
+
+		timer := time.NewTimer(inSyncCheckInterval)
+		select {
+		case <-progressed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("partition %d: %d of %d in-sync followers have offset %d: %w", partition, acknowledged, inSync, target-1, ErrReplicationIncomplete)
+		}
+		timer.Stop()
+	}
+}
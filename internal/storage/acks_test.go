@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func setupAcks(t *testing.T, minInSync int, lagTimeout time.Duration) {
+	originalMin, originalTimeout := MinInSyncReplicas, ReplicaLagTimeout
+	MinInSyncReplicas, ReplicaLagTimeout = minInSync, lagTimeout
+
+	t.Cleanup(func() {
+		MinInSyncReplicas, ReplicaLagTimeout = originalMin, originalTimeout
+	})
+}
+
+func TestParseAcks(t *testing.T) {
+	tests := map[string]Acks{"": AcksLeader, "0": AcksNone, "1": AcksLeader, "all": AcksAll}
+	for value, expected := range tests {
+		acks, err := ParseAcks(value)
+		if err != nil || acks != expected {
+			t.Errorf("ParseAcks(%q) = %q, %v; expected %q", value, acks, err, expected)
+		}
+	}
+
+	if _, err := ParseAcks("2"); err == nil {
+		t.Error("expected error for acks=2")
+	}
+}
+
+func TestStoreAcks_AllWaitsForInSyncFollowers(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupAcks(t, 2, time.Second)
+
+	service := &Service{}
+	defer service.Close()
+
+	// Without a follower in sync nothing is stored
+	if _, err := service.StoreAcks(context.Background(), 0, []LogEntry{{Message: "alone"}}, AcksAll); !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("expected ErrNotEnoughReplicas, got %v", err)
+	}
+	if _, err := service.Read(0, 10); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected nothing stored, got %v", err)
+	}
+
+	// The follower catches up with the empty partition
+	if _, err := service.Fetch(0, "follower-1", 0, 0, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if inSync := service.InSyncReplicas(0); inSync != 2 {
+		t.Fatalf("expected 2 in-sync replicas, got %d", inSync)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := service.StoreAcks(context.Background(), 0, []LogEntry{{Message: "replicated"}}, AcksAll)
+		done <- err
+	}()
+
+	page, err := service.Fetch(0, "follower-1", 0, 0, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Logs) != 1 {
+		t.Fatalf("expected the follower to fetch 1 log, got %d", len(page.Logs))
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("write acknowledged before the follower had it: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Fetching from the next offset tells the leader the follower has it
+	if _, err := service.Fetch(0, "follower-1", page.NextOffset, 0, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write was not acknowledged after the follower fetched it")
+	}
+}
+
+func TestStoreAcks_FollowerFallsOutOfSync(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupAcks(t, 1, 50*time.Millisecond)
+
+	service := &Service{}
+	defer service.Close()
+
+	service.Fetch(0, "follower-1", 0, 0, 0)
+
+	// The follower stops fetching, the write only waits until it is out of
+	// sync
+	start := time.Now()
+	if _, err := service.StoreAcks(context.Background(), 0, []LogEntry{{Message: "first"}}, AcksAll); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write waited %v for a follower out of sync", elapsed)
+	}
+
+	// With two replicas required the write is stored but reported as not
+	// replicated
+	MinInSyncReplicas = 2
+	service.Fetch(0, "follower-1", 1, 0, 0)
+
+	result, err := service.StoreAcks(context.Background(), 0, []LogEntry{{Message: "second"}}, AcksAll)
+	if !errors.Is(err, ErrReplicationIncomplete) {
+		t.Fatalf("expected ErrReplicationIncomplete, got %v", err)
+	}
+	if result.BaseOffset != 1 {
+		t.Errorf("expected the write at offset 1, got %+v", result)
+	}
+	if logs, _ := service.Read(0, 10); len(logs) != 2 {
+		t.Errorf("expected 2 logs on the leader, got %d", len(logs))
+	}
+}
+
+func TestStoreAcks_AllStopsWaitingAtTimeout(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupAcks(t, 1, 10*time.Second)
+	originalTimeout := AcksTimeout
+	AcksTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { AcksTimeout = originalTimeout })
+
+	service := &Service{}
+	defer service.Close()
+
+	// The follower stays in sync but never fetches the write
+	service.Fetch(0, "follower-1", 0, 0, 0)
+
+	start := time.Now()
+	if _, err := service.StoreAcks(context.Background(), 0, []LogEntry{{Message: "first"}}, AcksAll); !errors.Is(err, ErrReplicationIncomplete) {
+		t.Fatalf("expected ErrReplicationIncomplete, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write waited %v instead of AcksTimeout", elapsed)
+	}
+
+	// Without AcksTimeout the request bounds the wait
+	AcksTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := service.StoreAcks(ctx, 0, []LogEntry{{Message: "second"}}, AcksAll); !errors.Is(err, ErrReplicationIncomplete) {
+		t.Fatalf("expected ErrReplicationIncomplete, got %v", err)
+	}
+}
+
+func TestFetch_WaitsForNewRecords(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	defer service.Close()
+
+	storeMessages(t, service, 0, 2)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		service.Store(0, []LogEntry{{Message: "new"}})
+	}()
+
+	start := time.Now()
+	page, err := service.Fetch(0, "follower-1", 2, 0, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Logs) != 1 || page.Logs[0].Offset != 2 || page.EndOffset != 3 {
+		t.Errorf("unexpected page: %+v", page)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fetch returned after %v instead of on the append", elapsed)
+	}
+
+	// Without new records the fetch returns an empty page after the wait
+	page, err = service.Fetch(0, "follower-1", 3, 0, 10*time.Millisecond)
+	if err != nil || len(page.Logs) != 0 || page.NextOffset != 3 {
+		t.Errorf("unexpected page: %+v (%v)", page, err)
+	}
+}
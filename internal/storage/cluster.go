@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/bonniesimon/log-go/internal/metadata"
+)
+
+// WatchCluster keeps the partitions this node replicates on the leaders the
+// cluster metadata names, following them or taking over as leader when it
+// is elected. self is the URL of this node in the metadata.
+func (s *Service) WatchCluster(cluster *metadata.Server, self string) {
+	stop := s.stopChan()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer cancel()
+
+		var version uint64
+		for ctx.Err() == nil {
+			state := cluster.Wait(ctx, version)
+			if state.Version > version {
+				s.applyCluster(state, self)
+				version = state.Version
+			}
+		}
+	}()
+}
+
+// applyCluster follows the leader of every partition placed on self and
+// promotes the partitions self was elected leader of.
+func (s *Service) applyCluster(state metadata.ClusterState, self string) {
+	for _, partition := range state.Partitions {
+		if !slices.Contains(partition.Replicas, self) {
+			continue
+		}
+
+		var err error
+		if partition.Leader == self {
+			if s.isFollowing(partition.Partition) {
+				err = s.Promote(partition.Partition)
+			}
+		} else {
+			err = s.Follow(partition.Partition, partition.Leader)
+		}
+
+		if err != nil {
+			fmt.Println("[STORAGE/CLUSTER]", "partition=", partition.Partition, "leader=", partition.Leader, "epoch=", partition.Epoch, "error=", err)
+		}
+	}
+}
+
+func (s *Service) isFollowing(partition int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.followers[partition]
+
+	return ok
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/metadata"
+	"github.com/bonniesimon/log-go/internal/raft"
+)
+
+// setupCluster starts a single metadata server run by self
+func setupCluster(t *testing.T, self string) *metadata.Server {
+	originalElection, originalHeartbeat := raft.ElectionTimeout, raft.HeartbeatInterval
+	raft.ElectionTimeout, raft.HeartbeatInterval = 20*time.Millisecond, 5*time.Millisecond
+	t.Cleanup(func() {
+		raft.ElectionTimeout, raft.HeartbeatInterval = originalElection, originalHeartbeat
+	})
+
+	transport := raft.NewMemTransport()
+	cluster, err := metadata.NewServer(self, nil, "", transport)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	transport.Register(cluster.Node())
+	cluster.Start()
+	t.Cleanup(cluster.Close)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cluster.Node().IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("metadata server was not elected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return cluster
+}
+
+func TestWatchCluster_FollowsElectedLeader(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupReplication(t, 5*time.Millisecond)
+
+	self := "http://self:8081"
+	cluster := setupCluster(t, self)
+
+	leader, server := newMemLeader(t)
+	leader.append(4)
+
+	service := &Service{}
+	defer service.Close()
+	service.WatchCluster(cluster, self)
+
+	if err := cluster.Assign(context.Background(), 0, []string{server.URL, self}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForReplica(t, service, 0, func(status ReplicaStatus) bool {
+		return status.Leader == server.URL && status.NextOffset == 4
+	})
+
+	// Partitions placed on other nodes only are left alone
+	if err := cluster.Assign(context.Background(), 1, []string{server.URL}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Once elected, this node takes the writes of the partition
+	if err := cluster.Assign(context.Background(), 0, []string{self, server.URL}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(service.ReplicationStatus()) != 0 || service.isFenced(0) {
+		if time.Now().After(deadline) {
+			t.Fatalf("partition was not promoted: %+v", service.ReplicationStatus())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	result, err := service.Store(0, []LogEntry{{Message: "elected"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 4 {
+		t.Errorf("expected offset 4, got %d", result.BaseOffset)
+	}
+}
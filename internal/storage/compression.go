@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CompressSegments enables gzip compression of sealed segments.
+// This can be overridden for testing or configuration.
+var CompressSegments = true
+
+// CompressionCheckInterval is how often sealed segments are looked for and
+// compressed.
+// This can be overridden for testing or configuration.
+var CompressionCheckInterval = time.Minute
+
+const compressedSuffix = ".gz"
+
+// PartitionStats is the size of a partition before and after compression of
+// its sealed segments. The active segment is never compressed and counts
+// fully towards both sizes.
+type PartitionStats struct {
+	Partition          int    `json:"partition"`
+	Segments           int    `json:"segments"`
+	CompressedSegments int    `json:"compressed_segments"`
+	FirstOffset        uint64 `json:"first_offset"`
+	NextOffset         uint64 `json:"next_offset"`
+	RawBytes           int64  `json:"raw_bytes"`
+	CompressedBytes    int64  `json:"compressed_bytes"`
+}
+
+// filePath is where the records of the segment are stored on disk.
+func (seg segment) filePath() string {
+	if seg.compressed {
+		return seg.path + compressedSuffix
+	}
+
+	return seg.path
+}
+
+// diskSize is the number of bytes the segment takes up on disk.
+func (seg segment) diskSize() int64 {
+	if seg.compressed {
+		return seg.compressedSize
+	}
+
+	return seg.size
+}
+
+// StartCompression compresses sealed segments every CompressionCheckInterval
+// until the service is closed.
+func (s *Service) StartCompression() {
+	if !CompressSegments {
+		return
+	}
+
+	stop := s.stopChan()
+	s.background.Add(1)
+
+	go func() {
+		defer s.background.Done()
+
+		ticker := time.NewTicker(CompressionCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.CompressSealedSegments(); err != nil {
+					fmt.Println("[STORAGE/COMPRESS]", "error=", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// CompressSealedSegments compresses every sealed segment that is still stored
+// uncompressed.
+func (s *Service) CompressSealedSegments() error {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	var errs []error
+	for _, p := range s.openPartitions() {
+		errs = append(errs, p.compressSealed())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Stats returns the raw and compressed size of every partition.
+func (s *Service) Stats() []PartitionStats {
+	stats := []PartitionStats{}
+
+	for _, p := range s.openPartitions() {
+		segments, next := p.snapshot()
+
+		partitionStats := PartitionStats{
+			Partition:   p.id,
+			Segments:    len(segments),
+			FirstOffset: segments[0].baseOffset,
+			NextOffset:  next,
+		}
+		for _, seg := range segments {
+			if seg.compressed {
+				partitionStats.CompressedSegments++
+			}
+			partitionStats.RawBytes += seg.size
+			partitionStats.CompressedBytes += seg.diskSize()
+		}
+
+		stats = append(stats, partitionStats)
+	}
+
+	return stats
+}
+
+// openPartitions returns the partitions opened so far ordered by id.
+func (s *Service) openPartitions() []*partition {
+	s.mu.Lock()
+	partitions := make([]*partition, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		partitions = append(partitions, p)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].id < partitions[j].id
+	})
+
+	return partitions
+}
+
+func (p *partition) compressSealed() error {
+	segments, _ := p.snapshot()
+
+	for _, seg := range segments[:len(segments)-1] {
+		if seg.compressed || seg.size == 0 {
+			continue
+		}
+		if err := p.compress(seg); err != nil {
+			return fmt.Errorf("failed to compress %s: %w", seg.path, err)
+		}
+	}
+
+	return nil
+}
+
+// compress writes a gzip copy of a sealed segment next to it and swaps the
+// segment over to it. The uncompressed file is removed only once the copy is
+// durable, readers that still have it open keep reading it.
+func (p *partition) compress(seg segment) error {
+	compressedPath := seg.path + compressedSuffix
+	tmpPath := compressedPath + ".tmp"
+
+	compressedSize, err := writeCompressed(seg, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, compressedPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := syncDir(p.dir); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	var current *segment
+	for _, s := range p.segments[:len(p.segments)-1] {
+		if s.id == seg.id {
+			current = s
+		}
+	}
+	if current != nil {
+		current.compressed = true
+		current.compressedSize = compressedSize
+	}
+	p.mu.Unlock()
+
+	if current == nil {
+		// Deleted while it was being compressed.
+		return removeIfExists(compressedPath)
+	}
+
+	fmt.Println(
+		"[STORAGE/COMPRESS]",
+		"partition=", p.id,
+		"segment=", filepath.Base(seg.path),
+		"raw_bytes=", seg.size,
+		"compressed_bytes=", compressedSize,
+	)
+
+	return removeIfExists(seg.path)
+}
+
+func writeCompressed(seg segment, path string) (int64, error) {
+	r, err := seg.open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	if _, err := io.Copy(zw, r); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	if Durability != DurabilityNone {
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), f.Close()
+}
+
+// compressedRawSize reads the uncompressed size of a gzip file from its
+// trailer. The trailer holds the size modulo 2^32, which is plenty for
+// segments bounded by MaxSegmentBytes.
+func compressedRawSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	trailer := make([]byte, 4)
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
+
+// openCompressedAt returns a reader over the decompressed segment starting at
+// position. gzip streams cannot seek, so everything before position is
+// decompressed and skipped.
+func (seg segment) openCompressedAt(position int64) (io.ReadCloser, error) {
+	f, err := os.Open(seg.path + compressedSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := io.CopyN(io.Discard, zr, position); err != nil {
+		zr.Close()
+		f.Close()
+		return nil, err
+	}
+
+	return &compressedReader{Reader: io.LimitReader(zr, seg.size-position), zr: zr, f: f}, nil
+}
+
+// compressedReader reads a compressed segment and closes the gzip reader
+// along with the file.
+type compressedReader struct {
+	io.Reader
+	zr *gzip.Reader
+	f  *os.File
+}
+
+func (r *compressedReader) Close() error {
+	return errors.Join(r.zr.Close(), r.f.Close())
+}
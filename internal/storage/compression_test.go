@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupCompression overrides whether sealed segments are compressed for a
+// single test
+func setupCompression(t *testing.T, enabled bool) {
+	original := CompressSegments
+	CompressSegments = enabled
+
+	t.Cleanup(func() {
+		CompressSegments = original
+	})
+}
+
+func compressedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read partition dir: %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), compressedSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
+
+func TestCompressSealedSegments(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 1024, 0)
+	setupIndexInterval(t, 200)
+
+	service := &Service{}
+	defer service.Close()
+
+	storeMessages(t, service, 0, 40)
+
+	if err := service.CompressSealedSegments(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dir := filepath.Join(tmpDir, "partition-0")
+	files := segmentFiles(t, dir)
+	compressed := compressedFiles(t, dir)
+	if len(files) != 1 || len(compressed) == 0 {
+		t.Fatalf("expected only the active segment to stay uncompressed, got %v and %v", files, compressed)
+	}
+
+	logs, err := service.Read(0, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) != 40 {
+		t.Fatalf("expected 40 logs, got %d", len(logs))
+	}
+	for i, log := range logs {
+		if log.Offset != uint64(i) {
+			t.Fatalf("expected offset %d, got %d", i, log.Offset)
+		}
+	}
+
+	read, err := service.ReadFrom(0, 17, 3, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(read.Logs) != 3 || read.Logs[0].Offset != 17 || read.Logs[0].Message != "message 17" {
+		t.Errorf("expected offsets 17 to 19 from a compressed segment, got %+v", read.Logs)
+	}
+}
+
+func TestCompressSealedSegments_SurvivesRestart(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 1024, 0)
+
+	service := &Service{}
+	storeMessages(t, service, 0, 30)
+	service.CompressSealedSegments()
+	before := service.Stats()
+	service.Close()
+
+	restarted := &Service{}
+	defer restarted.Close()
+	if err := restarted.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	after := restarted.Stats()
+	if len(after) != 1 || after[0] != before[0] {
+		t.Errorf("expected the same stats after restart, got %+v and %+v", before, after)
+	}
+
+	result, err := restarted.Store(0, []LogEntry{{Message: "after restart"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 30 {
+		t.Errorf("expected offset 30, got %d", result.BaseOffset)
+	}
+
+	logs, _ := restarted.Read(0, 100)
+	if len(logs) != 31 {
+		t.Errorf("expected 31 logs, got %d", len(logs))
+	}
+}
+
+func TestOpen_PrefersUncompressedSegment(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 1024, 0)
+
+	service := &Service{}
+	storeMessages(t, service, 0, 30)
+
+	original := filepath.Join(tmpDir, "partition-0", segmentFileName(1))
+	data, _ := os.ReadFile(original)
+
+	service.CompressSealedSegments()
+	service.Close()
+
+	// Simulate a crash after compressing but before removing the original
+	os.WriteFile(original, data, 0644)
+
+	restarted := &Service{}
+	defer restarted.Close()
+	if err := restarted.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(original + compressedSuffix); !os.IsNotExist(err) {
+		t.Error("expected the leftover compressed copy to be removed")
+	}
+
+	logs, _ := restarted.Read(0, 100)
+	if len(logs) != 30 {
+		t.Errorf("expected 30 logs, got %d", len(logs))
+	}
+}
+
+func TestStats_ReportsRawAndCompressedSize(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 4096, 0)
+
+	service := &Service{}
+	defer service.Close()
+
+	storeMessages(t, service, 0, 100)
+
+	stats := service.Stats()
+	if len(stats) != 1 || stats[0].RawBytes != stats[0].CompressedBytes {
+		t.Fatalf("expected equal sizes before compression, got %+v", stats)
+	}
+
+	service.CompressSealedSegments()
+
+	stats = service.Stats()
+	if stats[0].CompressedSegments != stats[0].Segments-1 {
+		t.Errorf("expected all sealed segments to be compressed, got %+v", stats[0])
+	}
+	if stats[0].CompressedBytes*2 > stats[0].RawBytes {
+		t.Errorf("expected repetitive logs to compress well, got %+v", stats[0])
+	}
+	if stats[0].NextOffset != 100 {
+		t.Errorf("expected next offset 100, got %d", stats[0].NextOffset)
+	}
+}
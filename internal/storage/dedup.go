@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DedupWindow is how long the offsets of a batch stored with an idempotency
+// key are remembered by its partition, so a retry of it is answered with
+// them instead of being stored twice, whichever ingest node it comes
+// through and also after a restart. Zero disables deduplication.
+// This can be overridden for testing or configuration.
+var DedupWindow = 5 * time.Minute
+
+// DedupMaxKeys caps how many idempotency keys each partition remembers. The
+// oldest are forgotten first.
+// This can be overridden for testing or configuration.
+var DedupMaxKeys = 10000
+
+// dedupFileName is the journal of the keys stored in a partition, kept in
+// its directory as one JSON line per key.
+const dedupFileName = "idempotency.log"
+
+// dedupRecord is the outcome of a batch stored with an idempotency key.
+type dedupRecord struct {
+	Key        string    `json:"key"`
+	BaseOffset uint64    `json:"base_offset"`
+	LastOffset uint64    `json:"last_offset"`
+	At         time.Time `json:"at"`
+}
+
+// partitionDedup remembers the batches stored in a partition with an
+// idempotency key within DedupWindow, in memory and in its journal.
+type partitionDedup struct {
+	mu       sync.Mutex
+	path     string
+	records  map[string]dedupRecord
+	order    []dedupRecord // oldest first
+	inFlight map[string]chan struct{}
+	lines    int // records in the journal, forgotten ones included
+}
+
+// dedupFor returns the keys remembered by partition, loading its journal on
+// first use.
+func (s *Service) dedupFor(partition int) (*partitionDedup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.dedup[partition]; ok {
+		return d, nil
+	}
+
+	d := &partitionDedup{
+		path:     filepath.Join(partitionDir(partition), dedupFileName),
+		records:  make(map[string]dedupRecord),
+		inFlight: make(map[string]chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	if s.dedup == nil {
+		s.dedup = make(map[int]*partitionDedup)
+	}
+	s.dedup[partition] = d
+
+	return d, nil
+}
+
+// load reads the journal. A torn last line left by a crash is skipped and
+// cut off, so the next key is not appended to it.
+func (d *partitionDedup) load() error {
+	f, err := os.OpenFile(d.path, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var size int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				if err := f.Truncate(size); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size += int64(len(line))
+
+		var record dedupRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.Key == "" {
+			continue
+		}
+		d.remember(record)
+		d.lines++
+	}
+	d.prune(time.Now())
+
+	return nil
+}
+
+// claim returns the record of key when it was stored within DedupWindow.
+// Otherwise the caller owns key, and has to finish it, unless another batch
+// with key is in flight, in which case the caller waits on the returned
+// channel and claims again.
+func (d *partitionDedup) claim(key string, now time.Time) (dedupRecord, <-chan struct{}, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.prune(now)
+
+	if record, ok := d.records[key]; ok {
+		return record, nil, true
+	}
+	if done, ok := d.inFlight[key]; ok {
+		return dedupRecord{}, done, false
+	}
+
+	d.inFlight[key] = make(chan struct{})
+
+	return dedupRecord{}, nil, false
+}
+
+// finish records the offsets key was stored at, unless the batch was not
+// stored, and lets the batches waiting for key claim it again.
+func (d *partitionDedup) finish(key string, result AppendResult, stored bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	done := d.inFlight[key]
+	delete(d.inFlight, key)
+	defer close(done)
+
+	if !stored {
+		return nil
+	}
+
+	record := dedupRecord{Key: key, BaseOffset: result.BaseOffset, LastOffset: result.LastOffset, At: time.Now()}
+	d.remember(record)
+
+	return d.append(record)
+}
+
+func (d *partitionDedup) remember(record dedupRecord) {
+	if _, ok := d.records[record.Key]; ok {
+		return
+	}
+
+	d.records[record.Key] = record
+	d.order = append(d.order, record)
+}
+
+// prune forgets keys older than DedupWindow and the oldest keys beyond
+// DedupMaxKeys.
+func (d *partitionDedup) prune(now time.Time) {
+	for len(d.order) > 0 {
+		oldest := d.order[0]
+		if now.Sub(oldest.At) <= DedupWindow && len(d.order) <= DedupMaxKeys {
+			break
+		}
+
+		d.order = d.order[1:]
+		delete(d.records, oldest.Key)
+	}
+}
+
+// append adds record to the journal and fsyncs it unless Durability is
+// DurabilityNone. Once most of the journal is forgotten keys it is rewritten
+// with the remembered ones.
+func (d *partitionDedup) append(record dedupRecord) error {
+	if d.lines > 2*len(d.order)+DedupMaxKeys {
+		return d.rewrite()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	d.lines++
+
+	if Durability == DurabilityNone {
+		return nil
+	}
+
+	return f.Sync()
+}
+
+// rewrite replaces the journal with the remembered keys.
+func (d *partitionDedup) rewrite() error {
+	tmpPath := d.path + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, record := range d.order {
+		line, err := json.Marshal(record)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+
+	err = w.Flush()
+	if err == nil && Durability != DurabilityNone {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		return err
+	}
+	d.lines = len(d.order)
+
+	return syncDir(filepath.Dir(d.path))
+}
+
+// StoreOnce stores logs like StoreAcks, at most once per key within
+// DedupWindow. A retry of a batch that was stored is answered with the
+// original offsets and reported as a duplicate; a retry that arrives while
+// the batch is in flight waits for it. With AcksAll a duplicate is only
+// answered once the followers have fetched the original batch. Keys are kept
+// by the partition on this node, so a follower promoted in its place does
+// not know them.
+func (s *Service) StoreOnce(ctx context.Context, partition int, key string, logs []LogEntry, acks Acks) (AppendResult, bool, error) {
+	if DedupWindow <= 0 || key == "" {
+		result, err := s.StoreAcks(ctx, partition, logs, acks)
+		return result, false, err
+	}
+
+	d, err := s.dedupFor(partition)
+	if err != nil {
+		return AppendResult{}, false, err
+	}
+
+	for {
+		record, done, found := d.claim(key, time.Now())
+		if found {
+			result := AppendResult{BaseOffset: record.BaseOffset, LastOffset: record.LastOffset}
+			if acks == AcksAll {
+				if err := s.awaitReplicas(ctx, partition, result.LastOffset+1); err != nil {
+					return result, true, err
+				}
+			}
+			return result, true, nil
+		}
+		if done == nil {
+			break
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return AppendResult{}, false, ctx.Err()
+		}
+	}
+
+	result, err := s.StoreAcks(ctx, partition, logs, acks)
+
+	// Batches stored on this node but not yet on enough followers are
+	// remembered too, so their retry waits for the followers instead of
+	// storing them again.
+	stored := err == nil || errors.Is(err, ErrReplicationIncomplete)
+	if recordErr := d.finish(key, result, stored); recordErr != nil {
+		// The batch is stored, only a retry after a restart is not
+		// recognized.
+		fmt.Println("[STORAGE/DEDUP]", "partition=", partition, "error=", recordErr)
+	}
+
+	return result, false, err
+}
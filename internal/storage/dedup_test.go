@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStoreOnce_AnswersRetryAfterRestartWithOriginalOffsets(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	logs := []LogEntry{{Service: "api", Message: "first"}, {Service: "api", Message: "second"}}
+
+	first, duplicate, err := service.StoreOnce(context.Background(), 0, "key/a", logs, AcksLeader)
+	if err != nil || duplicate {
+		t.Fatalf("unexpected first attempt: %v %v", duplicate, err)
+	}
+	service.Close()
+
+	restarted := &Service{}
+	defer restarted.Close()
+	if err := restarted.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	retry, duplicate, err := restarted.StoreOnce(context.Background(), 0, "key/a", logs, AcksLeader)
+	if err != nil || !duplicate || retry != first {
+		t.Fatalf("expected the retry to get %+v back, got %+v %v %v", first, retry, duplicate, err)
+	}
+
+	other, duplicate, err := restarted.StoreOnce(context.Background(), 0, "key/b", logs, AcksLeader)
+	if err != nil || duplicate || other.BaseOffset != first.LastOffset+1 {
+		t.Fatalf("expected another key to be stored after the first batch, got %+v %v %v", other, duplicate, err)
+	}
+
+	stored, err := restarted.ReadFrom(0, 0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Logs) != 4 {
+		t.Errorf("expected 4 stored logs, got %d", len(stored.Logs))
+	}
+}
+
+func TestStoreOnce_ConcurrentRetriesStoreOnce(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	defer service.Close()
+
+	logs := []LogEntry{{Service: "api", Message: "once"}}
+
+	var wg sync.WaitGroup
+	results := make([]AppendResult, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, _, err := service.StoreOnce(context.Background(), 1, "producer/p/1", logs, AcksLeader)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result != results[0] {
+			t.Errorf("expected every attempt to get %+v, got %+v", results[0], result)
+		}
+	}
+
+	stored, err := service.ReadFrom(1, 0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Logs) != 1 {
+		t.Errorf("expected the batch to be stored once, got %d logs", len(stored.Logs))
+	}
+}
+
+func TestStoreOnce_RecoversJournalWithTornTail(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	logs := []LogEntry{{Service: "api", Message: "first"}}
+
+	first, _, err := service.StoreOnce(context.Background(), 0, "key/a", logs, AcksLeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Close()
+
+	// A crash while the next key was journaled leaves half a line behind
+	journal := filepath.Join(partitionDir(0), dedupFileName)
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"key":"key/b","base_of`)
+	f.Close()
+
+	restarted := &Service{}
+	defer restarted.Close()
+	if err := restarted.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	retry, duplicate, err := restarted.StoreOnce(context.Background(), 0, "key/a", logs, AcksLeader)
+	if err != nil || !duplicate || retry != first {
+		t.Fatalf("expected the journaled key to survive the torn tail, got %+v %v %v", retry, duplicate, err)
+	}
+
+	second, duplicate, err := restarted.StoreOnce(context.Background(), 0, "key/b", logs, AcksLeader)
+	if err != nil || duplicate {
+		t.Fatalf("expected the torn key to be stored, got %v %v", duplicate, err)
+	}
+	restarted.Close()
+
+	// The key journaled after the torn tail is not lost with it
+	again := &Service{}
+	defer again.Close()
+	if err := again.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	retry, duplicate, err = again.StoreOnce(context.Background(), 0, "key/b", logs, AcksLeader)
+	if err != nil || !duplicate || retry != second {
+		t.Errorf("expected the retry to get %+v back, got %+v %v %v", second, retry, duplicate, err)
+	}
+}
+
+func TestStoreOnce_RewritesJournalOfForgottenKeys(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	originalMaxKeys := DedupMaxKeys
+	DedupMaxKeys = 2
+	defer func() { DedupMaxKeys = originalMaxKeys }()
+
+	service := &Service{}
+	defer service.Close()
+
+	logs := []LogEntry{{Service: "api", Message: "batch"}}
+	for i := 0; i < 20; i++ {
+		if _, _, err := service.StoreOnce(context.Background(), 0, fmt.Sprintf("key/%d", i), logs, AcksLeader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(partitionDir(0), dedupFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > 3*DedupMaxKeys+1 {
+		t.Errorf("expected the journal to be rewritten with the remembered keys, got %d lines", lines)
+	}
+
+	// Only the latest keys are remembered
+	if _, duplicate, _ := service.StoreOnce(context.Background(), 0, "key/19", logs, AcksLeader); !duplicate {
+		t.Errorf("expected the latest key to be remembered")
+	}
+	if _, duplicate, _ := service.StoreOnce(context.Background(), 0, "key/0", logs, AcksLeader); duplicate {
+		t.Errorf("expected the oldest key to be forgotten")
+	}
+}
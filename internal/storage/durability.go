@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DurabilityMode selects what has to happen before an appended batch is
+// acknowledged.
+type DurabilityMode int
+
+const (
+	// DurabilityRequest fsyncs the segment before every batch is acknowledged.
+	DurabilityRequest DurabilityMode = iota
+	// DurabilityInterval fsyncs every SyncInterval and holds a batch until the
+	// next fsync covering it, so concurrent writes share a single fsync.
+	DurabilityInterval
+	// DurabilityNone acknowledges as soon as the batch was handed to the OS.
+	DurabilityNone
+)
+
+// Durability is the durability mode used for appends.
+// This can be overridden for testing or configuration.
+var Durability = DurabilityRequest
+
+// SyncInterval is how often segments are fsynced with DurabilityInterval.
+// This can be overridden for testing or configuration.
+var SyncInterval = 50 * time.Millisecond
+
+func ParseDurabilityMode(mode string) (DurabilityMode, error) {
+	switch mode {
+	case "request":
+		return DurabilityRequest, nil
+	case "interval":
+		return DurabilityInterval, nil
+	case "none":
+		return DurabilityNone, nil
+	}
+
+	return 0, fmt.Errorf("unknown durability mode %q, expected request, interval or none", mode)
+}
+
+func (m DurabilityMode) String() string {
+	switch m {
+	case DurabilityRequest:
+		return "request"
+	case DurabilityInterval:
+		return "interval"
+	case DurabilityNone:
+		return "none"
+	}
+
+	return fmt.Sprintf("DurabilityMode(%d)", int(m))
+}
+
+// groupSyncer periodically fsyncs the segments of a partition written since
+// its last run and releases the appends waiting for that fsync.
+type groupSyncer struct {
+	p *partition
+
+	mu      sync.Mutex
+	waiters []chan error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newGroupSyncer(p *partition) *groupSyncer {
+	g := &groupSyncer{
+		p:    p,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go g.run()
+
+	return g
+}
+
+func (g *groupSyncer) run() {
+	defer close(g.done)
+
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.flush()
+		case <-g.stop:
+			g.flush()
+			return
+		}
+	}
+}
+
+// wait blocks until the next fsync of the partition has completed.
+func (g *groupSyncer) wait() error {
+	ch := make(chan error, 1)
+
+	g.mu.Lock()
+	select {
+	case <-g.stop:
+		g.mu.Unlock()
+		return errors.New("partition is closed")
+	default:
+	}
+	g.waiters = append(g.waiters, ch)
+	g.mu.Unlock()
+
+	return <-ch
+}
+
+func (g *groupSyncer) flush() {
+	g.mu.Lock()
+	waiters := g.waiters
+	g.waiters = nil
+	g.mu.Unlock()
+
+	if len(waiters) == 0 {
+		return
+	}
+
+	err := g.p.syncDirty()
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+// close fsyncs outstanding writes one last time and stops the syncer.
+func (g *groupSyncer) close() {
+	g.mu.Lock()
+	close(g.stop)
+	g.mu.Unlock()
+
+	<-g.done
+}
+
+// syncDirty fsyncs every segment written to since the last call.
+func (p *partition) syncDirty() error {
+	p.mu.Lock()
+	dirty := p.dirty
+	p.dirty = nil
+	p.mu.Unlock()
+
+	var errs []error
+	for path := range dirty {
+		errs = append(errs, syncFile(path))
+	}
+
+	return errors.Join(errs...)
+}
+
+// waitForSync blocks until writes appended so far are durable according to
+// the configured durability mode.
+func (p *partition) waitForSync() error {
+	if Durability != DurabilityInterval {
+		return nil
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return p.syncDirty()
+	}
+	if p.syncer == nil {
+		p.syncer = newGroupSyncer(p)
+	}
+	syncer := p.syncer
+	p.mu.Unlock()
+
+	return syncer.wait()
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// Sealed and replaced by its compressed copy, which was fsynced.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir makes the creation of files in dir durable.
+func syncDir(dir string) error {
+	if Durability == DurabilityNone {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupDurability overrides the durability settings for a single test
+func setupDurability(t *testing.T, mode DurabilityMode, interval time.Duration) {
+	originalMode, originalInterval := Durability, SyncInterval
+	Durability, SyncInterval = mode, interval
+
+	t.Cleanup(func() {
+		Durability, SyncInterval = originalMode, originalInterval
+	})
+}
+
+func TestParseDurabilityMode(t *testing.T) {
+	for _, mode := range []DurabilityMode{DurabilityRequest, DurabilityInterval, DurabilityNone} {
+		parsed, err := ParseDurabilityMode(mode.String())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if parsed != mode {
+			t.Errorf("expected %s, got %s", mode, parsed)
+		}
+	}
+
+	if _, err := ParseDurabilityMode("sometimes"); err == nil {
+		t.Error("expected error for unknown mode, got nil")
+	}
+}
+
+func TestStore_IntervalDurabilityWaitsForSync(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupDurability(t, DurabilityInterval, 50*time.Millisecond)
+
+	service := &Service{}
+	defer service.Close()
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := service.Store(0, []LogEntry{{Message: "grouped"}})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected writes to wait for the group fsync, returned after %s", elapsed)
+	}
+
+	p, _ := service.partition(0, false)
+	p.mu.Lock()
+	dirty := len(p.dirty)
+	p.mu.Unlock()
+	if dirty != 0 {
+		t.Errorf("expected no dirty segments after acknowledged writes, got %d", dirty)
+	}
+
+	logs, _ := service.Read(0, 100)
+	if len(logs) != 10 {
+		t.Errorf("expected 10 logs, got %d", len(logs))
+	}
+}
+
+func TestStore_RequestDurabilityDoesNotDeferSync(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupDurability(t, DurabilityRequest, time.Hour)
+
+	service := &Service{}
+	defer service.Close()
+
+	if _, err := service.Store(0, []LogEntry{{Message: "synced"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p, _ := service.partition(0, false)
+	if p.syncer != nil || len(p.dirty) != 0 {
+		t.Error("expected request durability to sync inline")
+	}
+}
+
+func TestClose_FlushesPendingSyncs(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupDurability(t, DurabilityInterval, time.Hour)
+
+	service := &Service{}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := service.Store(0, []LogEntry{{Message: "pending"}})
+		done <- err
+	}()
+
+	// Wait for the write to be parked on the syncer
+	for i := 0; i < 100; i++ {
+		p, err := service.partition(0, false)
+		if err == nil {
+			p.mu.Lock()
+			syncer := p.syncer
+			p.mu.Unlock()
+			if syncer != nil {
+				syncer.mu.Lock()
+				waiting := len(syncer.waiters)
+				syncer.mu.Unlock()
+				if waiting > 0 {
+					break
+				}
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	service.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to release the pending write")
+	}
+}
@@ -1,12 +1,23 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
 )
 
+// MaxRequestBytes caps the body of every request a storage node decodes.
+// Larger requests are answered with 413. Zero removes the limit.
+// This can be overridden for testing or configuration.
+var MaxRequestBytes int64 = 32 * 1024 * 1024
+
 type Handler struct {
 	service *Service
 }
@@ -15,7 +26,27 @@ func NewHandler(s *Service) *Handler {
 	return &Handler{service: s}
 }
 
+// RequestTimeoutHeader is how long, in milliseconds, the sender of a write
+// waits for its answer. Writes with AcksAll stop waiting for followers in
+// time to answer with ErrReplicationIncomplete before the sender gives up on
+// a write the leader stored and sends it again.
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// requestContext bounds the context of r by the timeout it carries, keeping
+// a tenth of it to answer in.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ms, err := strconv.ParseInt(r.Header.Get(RequestTimeoutHeader), 10, 64)
+	if err != nil || ms <= 0 {
+		return context.WithCancel(r.Context())
+	}
+
+	timeout := time.Duration(ms) * time.Millisecond
+
+	return context.WithTimeout(r.Context(), timeout-timeout/10)
+}
+
 type LogEntry struct {
+	Offset         uint64            `json:"offset"`
 	Timestamp      uint64            `json:"timestamp"`
 	Service        string            `json:"service"`
 	Level          string            `json:"level,omitempty"`
@@ -26,83 +57,562 @@ type LogEntry struct {
 	ClientIP       string            `json:"client_ip"`
 }
 
+type StoreResponse struct {
+	Partition int `json:"partition"`
+	AppendResult
+}
+
+// PartitionBatch is the logs of one partition in a batch request. Logs
+// sent with a key are stored once per key, see StoreOnce.
+type PartitionBatch struct {
+	Partition int        `json:"partition"`
+	Key       string     `json:"key,omitempty"`
+	Logs      []LogEntry `json:"logs"`
+}
+
+type BatchRequest struct {
+	Partitions []PartitionBatch `json:"partitions"`
+}
+
+// PartitionResult is the outcome of storing one partition of a batch. Status
+// is the status code a single partition request would have been answered
+// with.
+type PartitionResult struct {
+	StoreResponse
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []PartitionResult `json:"results"`
+}
+
+// ReplicateResponse is the next offset of a partition after a replicated
+// batch, where the following batch has to start.
+type ReplicateResponse struct {
+	Partition  int    `json:"partition"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+// FollowRequest makes a storage node follow the leader of a partition.
+type FollowRequest struct {
+	Partition int    `json:"partition"`
+	Leader    string `json:"leader"`
+}
+
+// HandleRead returns a page of a partition. Without from_offset the last
+// limit entries are returned, otherwise up to limit entries starting at
+// from_offset. max_bytes caps the size of the page and next_offset in the
+// response is where the following page starts.
 func (h *Handler) HandleRead(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusBadRequest)
+		apierror.MethodNotAllowed(w, http.MethodGet)
 		return
 	}
 
 	partitionQuery := r.URL.Query().Get("partition")
 	limitQuery := r.URL.Query().Get("limit")
+	fromOffsetQuery := r.URL.Query().Get("from_offset")
+	maxBytesQuery := r.URL.Query().Get("max_bytes")
 
 	partition, err := strconv.Atoi(partitionQuery)
 	if err != nil || partition < 0 {
-		http.Error(w, "invalid partition query param value", http.StatusBadRequest)
+		apierror.BadRequest(w, "invalid partition query param value")
 		return
 	}
 	limit, err := strconv.Atoi(limitQuery)
 	if err != nil || limit < 0 {
-		http.Error(w, "invalid limit query param value", http.StatusBadRequest)
+		apierror.BadRequest(w, "invalid limit query param value")
 		return
 	}
 
-	logs, err := h.service.Read(partition, limit)
+	var maxBytes int64
+	if maxBytesQuery != "" {
+		maxBytes, err = strconv.ParseInt(maxBytesQuery, 10, 64)
+		if err != nil || maxBytes < 0 {
+			apierror.BadRequest(w, "invalid max_bytes query param value")
+			return
+		}
+	}
+
+	var result ReadResult
+	var fromOffset uint64
+	if fromOffsetQuery == "" {
+		result, err = h.service.ReadLast(partition, limit, maxBytes)
+	} else {
+		fromOffset, err = strconv.ParseUint(fromOffsetQuery, 10, 64)
+		if err != nil {
+			apierror.BadRequest(w, "invalid from_offset query param value")
+			return
+		}
+		result, err = h.service.ReadFrom(partition, fromOffset, limit, maxBytes)
+	}
+	if errors.Is(err, ErrPartitionNotFound) {
+		// Nothing was written to the partition yet.
+		result, err = ReadResult{Logs: []LogEntry{}, NextOffset: fromOffset}, nil
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprint("error reading from storage file", err), http.StatusBadRequest)
+		fmt.Println("[STORAGE/READ]", "partition=", partition, "error=", err)
+		apierror.WriteError(w, err)
 		return
 	}
 
 	fmt.Println(
 		"[STORAGE/READ]",
 		"partition=", partition,
+		"from_offset=", fromOffsetQuery,
 		"limit=", limit,
+		"next_offset=", result.NextOffset,
 	)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(logs); err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
-		return
-	}
+	json.NewEncoder(w).Encode(result)
 }
 
 func (h *Handler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		apierror.MethodNotAllowed(w, http.MethodPost)
 		return
 	}
 
 	partitionStr := r.URL.Query().Get("partition")
 	if partitionStr == "" {
-		http.Error(w, "Partition query param not found", http.StatusBadRequest)
+		apierror.BadRequest(w, "Partition query param not found")
 		return
 	}
 
 	partition, err := strconv.Atoi(partitionStr)
 	if err != nil || partition < 0 {
-		http.Error(w, "invalid partition query param value", http.StatusBadRequest)
+		apierror.BadRequest(w, "invalid partition query param value")
 		return
 	}
 
 	var logs []LogEntry
 
-	err = json.NewDecoder(r.Body).Decode(&logs)
-	if err != nil {
-		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &logs); err != nil {
+		apierror.WriteError(w, err)
 		return
 	}
 
 	if len(logs) == 0 {
-		http.Error(w, "empty array", http.StatusBadRequest)
+		apierror.BadRequest(w, "empty array")
+		return
+	}
+
+	acks, err := ParseAcks(r.URL.Query().Get("acks"))
+	if err != nil {
+		apierror.BadRequest(w, err.Error())
+		return
+	}
+
+	ctx, cancel := requestContext(r)
+	defer cancel()
+
+	result, err := h.service.StoreAcks(ctx, partition, logs, acks)
+	if err != nil {
+		fmt.Println("[STORAGE/CREATE]", "partition=", partition, "error=", err)
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(StoreResponse{Partition: partition, AppendResult: result})
+}
+
+// HandleRetention reports the retention policy of the node and the segments
+// it has deleted.
+func (h *Handler) HandleRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.service.RetentionStats())
+}
+
+// HandleStats reports the raw and compressed size of every partition.
+func (h *Handler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.service.Stats())
+}
+
+// HandleHealth answers the health checks of the ingest nodes.
+func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleBatch stores the logs of several partitions in one request and
+// reports the outcome of every partition separately, so the failure of one
+// partition does not hide that the others were stored.
+func (h *Handler) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.MethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	acks, err := ParseAcks(r.URL.Query().Get("acks"))
+	if err != nil {
+		apierror.BadRequest(w, err.Error())
+		return
+	}
+
+	var batch BatchRequest
+
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &batch); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	if len(batch.Partitions) == 0 {
+		apierror.BadRequest(w, "empty batch")
+		return
+	}
+
+	seen := make(map[int]bool)
+	for _, partitionBatch := range batch.Partitions {
+		if partitionBatch.Partition < 0 || seen[partitionBatch.Partition] {
+			apierror.BadRequest(w, fmt.Sprintf("invalid or duplicate partition %d", partitionBatch.Partition))
+			return
+		}
+		if len(partitionBatch.Logs) == 0 {
+			apierror.BadRequest(w, fmt.Sprintf("empty array for partition %d", partitionBatch.Partition))
+			return
+		}
+		seen[partitionBatch.Partition] = true
+	}
+
+	ctx, cancel := requestContext(r)
+	defer cancel()
+
+	results, duplicates, errs := h.service.StoreBatch(ctx, batch.Partitions, acks)
+
+	response := BatchResponse{Results: make([]PartitionResult, len(results))}
+	for i, result := range results {
+		partitionResult := PartitionResult{
+			StoreResponse: StoreResponse{Partition: batch.Partitions[i].Partition, AppendResult: result},
+			Duplicate:     duplicates[i],
+			Status:        http.StatusOK,
+		}
+		if errs[i] != nil {
+			fmt.Println("[STORAGE/BATCH]", "partition=", batch.Partitions[i].Partition, "error=", errs[i])
+			partitionResult.Status = http.StatusInternalServerError
+			partitionResult.Error = errs[i].Error()
+		}
+		var apiErr *apierror.Error
+		if errors.As(errs[i], &apiErr) {
+			partitionResult.Status = apiErr.Status
+		}
+		response.Results[i] = partitionResult
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleReplicate stores logs copied from another storage node with the
+// offsets they already have. It is used to move partitions between nodes.
+func (h *Handler) HandleReplicate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.MethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	partition, err := strconv.Atoi(r.URL.Query().Get("partition"))
+	if err != nil || partition < 0 {
+		apierror.BadRequest(w, "invalid partition query param value")
+		return
+	}
+
+	var logs []LogEntry
+
+	if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &logs); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	next, err := h.service.Replicate(partition, logs)
+	if err != nil {
+		fmt.Println("[STORAGE/MIGRATION]", "partition=", partition, "error=", err)
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ReplicateResponse{Partition: partition, NextOffset: next})
+}
+
+// HandleFence fences a partition with POST, so it stops accepting writes
+// while it is moved to another node, and lifts the fence with DELETE.
+func (h *Handler) HandleFence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		apierror.MethodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return
+	}
+
+	partition, err := strconv.Atoi(r.URL.Query().Get("partition"))
+	if err != nil || partition < 0 {
+		apierror.BadRequest(w, "invalid partition query param value")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err = h.service.Fence(partition)
+	} else {
+		err = h.service.Unfence(partition)
+	}
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	fmt.Println("[STORAGE/MIGRATION]", "partition=", partition, "fenced=", r.Method == http.MethodPost)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePartition deletes a partition that was moved to another node.
+func (h *Handler) HandlePartition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		apierror.MethodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	partition, err := strconv.Atoi(r.URL.Query().Get("partition"))
+	if err != nil || partition < 0 {
+		apierror.BadRequest(w, "invalid partition query param value")
+		return
+	}
+
+	if err := h.service.DeletePartition(partition); err != nil {
+		fmt.Println("[STORAGE/MIGRATION]", "partition=", partition, "error=", err)
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleFollow makes this node a follower of a partition with POST and
+// promotes it to leader of the partition with DELETE.
+func (h *Handler) HandleFollow(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req FollowRequest
+
+		if err := apierror.DecodeJSON(w, r, MaxRequestBytes, &req); err != nil {
+			apierror.WriteError(w, err)
+			return
+		}
+
+		if req.Partition < 0 || req.Leader == "" {
+			apierror.BadRequest(w, "partition and leader are required")
+			return
+		}
+
+		if err := h.service.Follow(req.Partition, req.Leader); err != nil {
+			fmt.Println("[STORAGE/REPLICATION]", "partition=", req.Partition, "error=", err)
+			apierror.WriteError(w, err)
+			return
+		}
+
+	case http.MethodDelete:
+		partition, err := strconv.Atoi(r.URL.Query().Get("partition"))
+		if err != nil || partition < 0 {
+			apierror.BadRequest(w, "invalid partition query param value")
+			return
+		}
+
+		if err := h.service.Promote(partition); err != nil {
+			apierror.WriteError(w, err)
+			return
+		}
+
+	default:
+		apierror.MethodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleReplication reports the partitions this node follows and how far
+// behind their leaders they are.
+func (h *Handler) HandleReplication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.service.ReplicationStatus())
+}
+
+// HandleFetch serves the pages followers replicate from this node. The
+// follower sends its NodeID as replica and from_offset tells how far it has
+// got, which decides whether it is in sync. A follower that has caught up is
+// answered once new records arrive or after max_wait.
+func (h *Handler) HandleFetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+
+	partition, err := strconv.Atoi(query.Get("partition"))
+	if err != nil || partition < 0 {
+		apierror.BadRequest(w, "invalid partition query param value")
+		return
+	}
+
+	replica := query.Get("replica")
+	if replica == "" {
+		apierror.BadRequest(w, "replica query param not found")
+		return
+	}
+
+	fromOffset, err := strconv.ParseUint(query.Get("from_offset"), 10, 64)
+	if err != nil {
+		apierror.BadRequest(w, "invalid from_offset query param value")
 		return
 	}
 
-	err = h.service.Store(partition, logs)
+	var maxBytes int64
+	if maxBytesQuery := query.Get("max_bytes"); maxBytesQuery != "" {
+		maxBytes, err = strconv.ParseInt(maxBytesQuery, 10, 64)
+		if err != nil || maxBytes < 0 {
+			apierror.BadRequest(w, "invalid max_bytes query param value")
+			return
+		}
+	}
+
+	var maxWait time.Duration
+	if maxWaitQuery := query.Get("max_wait"); maxWaitQuery != "" {
+		maxWait, err = time.ParseDuration(maxWaitQuery)
+		if err != nil || maxWait < 0 {
+			apierror.BadRequest(w, "invalid max_wait query param value")
+			return
+		}
+	}
+	// A held fetch must not outlive the time the follower stays in sync.
+	maxWait = min(maxWait, ReplicaLagTimeout/2)
+
+	result, err := h.service.Fetch(partition, replica, fromOffset, maxBytes, maxWait)
 	if err != nil {
-		http.Error(w, "storing logs failed", http.StatusBadRequest)
+		fmt.Println("[STORAGE/REPLICATION]", "partition=", partition, "replica=", replica, "error=", err)
+		apierror.WriteError(w, err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleDigest returns the digest of every range of a partition between
+// from_offset and until_offset, the whole partition by default, for a
+// replica to compare its copy with.
+func (h *Handler) HandleDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+
+	partition, err := strconv.Atoi(query.Get("partition"))
+	if err != nil || partition < 0 {
+		apierror.BadRequest(w, "invalid partition query param value")
+		return
+	}
+
+	var from uint64
+	if fromQuery := query.Get("from_offset"); fromQuery != "" {
+		from, err = strconv.ParseUint(fromQuery, 10, 64)
+		if err != nil {
+			apierror.BadRequest(w, "invalid from_offset query param value")
+			return
+		}
+	}
+
+	until := uint64(math.MaxUint64)
+	if untilQuery := query.Get("until_offset"); untilQuery != "" {
+		until, err = strconv.ParseUint(untilQuery, 10, 64)
+		if err != nil {
+			apierror.BadRequest(w, "invalid until_offset query param value")
+			return
+		}
+	}
+
+	digest, err := h.service.Digest(partition, from, until)
+	if err != nil {
+		fmt.Println("[STORAGE/REPAIR]", "partition=", partition, "digest error=", err)
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(digest)
+}
+
+// HandleRepair repairs a partition from peer, the leader it follows by
+// default, with POST and reports the latest repair of every partition with
+// GET.
+func (h *Handler) HandleRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(h.service.RepairReports())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		apierror.MethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	partition, err := strconv.Atoi(r.URL.Query().Get("partition"))
+	if err != nil || partition < 0 {
+		apierror.BadRequest(w, "invalid partition query param value")
+		return
+	}
+
+	report, err := h.service.Repair(r.Context(), partition, r.URL.Query().Get("peer"))
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	// A failed repair is still reported, with its error.
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
 }
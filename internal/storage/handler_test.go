@@ -7,7 +7,12 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
 )
 
 // setupHandler creates the handler with all dependencies for testing
@@ -55,10 +60,17 @@ func TestHandleCreate(t *testing.T) {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
 
-	// Verify file was created
-	filePath := filepath.Join(tmpDir, "partition-0.log")
+	var response StoreResponse
+	json.NewDecoder(w.Body).Decode(&response)
+
+	if response.Partition != 0 || response.BaseOffset != 0 || response.LastOffset != 0 {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	// Verify segment was created
+	filePath := filepath.Join(tmpDir, "partition-0", "segment-00001.log")
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		t.Error("expected partition file to be created")
+		t.Error("expected partition segment to be created")
 	}
 }
 
@@ -138,8 +150,9 @@ func TestHandleRead(t *testing.T) {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
 
-	var logs []LogEntry
-	json.NewDecoder(w.Body).Decode(&logs)
+	var result ReadResult
+	json.NewDecoder(w.Body).Decode(&result)
+	logs := result.Logs
 
 	if len(logs) != 1 {
 		t.Errorf("expected 1 log, got %d", len(logs))
@@ -149,6 +162,37 @@ func TestHandleRead(t *testing.T) {
 	}
 }
 
+func TestHandleRead_ReturnsOffsets(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+
+	for i := 0; i < 2; i++ {
+		body, _ := json.Marshal([]LogEntry{{Message: "first"}, {Message: "second"}})
+		req := httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0", bytes.NewReader(body))
+		handler.HandleCreate(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/read?partition=0&limit=3", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleRead(w, req)
+
+	var result ReadResult
+	json.NewDecoder(w.Body).Decode(&result)
+	logs := result.Logs
+
+	if len(logs) != 3 {
+		t.Fatalf("expected 3 logs, got %d", len(logs))
+	}
+	for i, log := range logs {
+		if log.Offset != uint64(i+1) {
+			t.Errorf("expected offset %d, got %d", i+1, log.Offset)
+		}
+	}
+}
+
 func TestHandleRead_InvalidPartition(t *testing.T) {
 	_, cleanup := setupTempDir(t)
 	defer cleanup()
@@ -176,8 +220,57 @@ func TestHandleRead_InvalidMethod(t *testing.T) {
 
 	handler.HandleRead(w, req)
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected status 400, got %d", w.Code)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", w.Code)
+	}
+}
+
+func TestHandleRead_NeverWrittenPartition(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/read?partition=7&limit=10&from_offset=3", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleRead(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result ReadResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if result.Logs == nil || len(result.Logs) != 0 || result.NextOffset != 3 {
+		t.Errorf("expected an empty page resuming at offset 3, got %+v", result)
+	}
+}
+
+func TestHandleCreate_PayloadTooLarge(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	original := MaxRequestBytes
+	MaxRequestBytes = 64
+	t.Cleanup(func() { MaxRequestBytes = original })
+
+	handler := setupHandler()
+
+	body, _ := json.Marshal([]LogEntry{{Message: strings.Repeat("x", 100)}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413, got %d", w.Code)
+	}
+
+	var response apierror.Response
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Code != apierror.CodePayloadTooLarge || response.Message == "" {
+		t.Errorf("expected a payload_too_large error body, got %+v", response)
 	}
 }
 
@@ -228,3 +321,548 @@ func TestHandleRead_NegativeLimit(t *testing.T) {
 		t.Errorf("expected status 400, got %d", w.Code)
 	}
 }
+
+func TestHandleRead_PagesFromOffset(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 500, 0)
+
+	handler := setupHandler()
+
+	var batch []LogEntry
+	for i := 0; i < 25; i++ {
+		batch = append(batch, LogEntry{Message: "paged message"})
+	}
+	body, _ := json.Marshal(batch)
+	handler.HandleCreate(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0", bytes.NewReader(body)))
+
+	var seen []uint64
+	next := uint64(0)
+	for page := 0; page < 10; page++ {
+		req := httptest.NewRequest(http.MethodGet, "/v1/read?partition=0&limit=7&from_offset="+strconv.FormatUint(next, 10), nil)
+		w := httptest.NewRecorder()
+
+		handler.HandleRead(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var result ReadResult
+		json.NewDecoder(w.Body).Decode(&result)
+
+		if len(result.Logs) == 0 {
+			if result.NextOffset != next {
+				t.Errorf("expected next_offset to stay at %d at the end, got %d", next, result.NextOffset)
+			}
+			break
+		}
+
+		for _, log := range result.Logs {
+			seen = append(seen, log.Offset)
+		}
+		next = result.NextOffset
+	}
+
+	if len(seen) != 25 {
+		t.Fatalf("expected 25 logs across pages, got %d", len(seen))
+	}
+	for i, offset := range seen {
+		if offset != uint64(i) {
+			t.Fatalf("expected contiguous offsets, got %v", seen)
+		}
+	}
+}
+
+func TestHandleRead_MaxBytes(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+
+	body, _ := json.Marshal([]LogEntry{{Message: "one"}, {Message: "two"}, {Message: "three"}})
+	handler.HandleCreate(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0", bytes.NewReader(body)))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/read?partition=0&limit=10&from_offset=0&max_bytes=1", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleRead(w, req)
+
+	var result ReadResult
+	json.NewDecoder(w.Body).Decode(&result)
+
+	// A page always holds at least one entry so the reader makes progress
+	if len(result.Logs) != 1 || result.NextOffset != 1 {
+		t.Errorf("expected a single entry and next_offset 1, got %d entries and %d", len(result.Logs), result.NextOffset)
+	}
+}
+
+func TestHandleRead_InvalidFromOffset(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+
+	for _, query := range []string{"from_offset=abc", "from_offset=-1", "from_offset=0&max_bytes=-1"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/read?partition=0&limit=10&"+query, nil)
+		w := httptest.NewRecorder()
+
+		handler.HandleRead(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %s, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestHandleRetention(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+	handler.service.Store(0, []LogEntry{{Message: "kept"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/retention", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleRetention(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var stats RetentionStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(stats.Partitions) != 1 || stats.SegmentsDeleted != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+	handler.service.Store(2, []LogEntry{{Message: "counted"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/stats", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleStats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var stats []PartitionStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Partition != 2 || stats[0].RawBytes == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/health", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleHealth(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestHandleRepair_NotFollowed(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+	handler.service.Store(0, []LogEntry{{Message: "led here"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/repair?partition=0", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleRepair(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without a peer, got %d", w.Code)
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+	handler.service.Store(1, []LogEntry{{Message: "existing"}})
+
+	batch := BatchRequest{Partitions: []PartitionBatch{
+		{Partition: 0, Logs: []LogEntry{{Message: "a"}, {Message: "b"}}},
+		{Partition: 1, Logs: []LogEntry{{Message: "c"}}},
+	}}
+	body, _ := json.Marshal(batch)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/storage/batch", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleBatch(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var response BatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(response.Results) != 2 {
+		t.Fatalf("expected a result per partition, got %+v", response.Results)
+	}
+
+	first, second := response.Results[0], response.Results[1]
+	if first.Partition != 0 || first.Status != http.StatusOK || first.LastOffset != 1 {
+		t.Errorf("unexpected result for partition 0: %+v", first)
+	}
+	if second.Partition != 1 || second.Status != http.StatusOK || second.BaseOffset != 1 {
+		t.Errorf("unexpected result for partition 1: %+v", second)
+	}
+}
+
+func TestHandleBatch_ReportsPartialFailure(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	// A file where the partition directory should be makes the store fail
+	os.WriteFile(filepath.Join(tmpDir, "partition-3"), []byte("not a directory"), 0644)
+
+	handler := setupHandler()
+
+	batch := BatchRequest{Partitions: []PartitionBatch{
+		{Partition: 2, Logs: []LogEntry{{Message: "stored"}}},
+		{Partition: 3, Logs: []LogEntry{{Message: "failed"}}},
+	}}
+	body, _ := json.Marshal(batch)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/storage/batch", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleBatch(w, req)
+
+	var response BatchResponse
+	json.NewDecoder(w.Body).Decode(&response)
+
+	if len(response.Results) != 2 {
+		t.Fatalf("expected a result per partition, got %+v", response.Results)
+	}
+	if response.Results[0].Status != http.StatusOK || response.Results[0].Error != "" {
+		t.Errorf("expected partition 2 to be stored, got %+v", response.Results[0])
+	}
+	if response.Results[1].Status != http.StatusInternalServerError || response.Results[1].Error == "" {
+		t.Errorf("expected partition 3 to fail, got %+v", response.Results[1])
+	}
+
+	logs, _ := handler.service.Read(2, 10)
+	if len(logs) != 1 {
+		t.Errorf("expected partition 2 to keep its log, got %d", len(logs))
+	}
+}
+
+func TestHandleBatch_DuplicatePartition(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+
+	batch := BatchRequest{Partitions: []PartitionBatch{
+		{Partition: 0, Logs: []LogEntry{{Message: "a"}}},
+		{Partition: 0, Logs: []LogEntry{{Message: "b"}}},
+	}}
+	body, _ := json.Marshal(batch)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/storage/batch", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleBatch(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
+
+func TestHandleReplicate(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+
+	body, _ := json.Marshal([]LogEntry{{Offset: 4, Message: "a"}, {Offset: 5, Message: "b"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/replicate?partition=2", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleReplicate(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var response ReplicateResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.Partition != 2 || response.NextOffset != 6 {
+		t.Errorf("unexpected response: %+v", response)
+	}
+
+	body, _ = json.Marshal([]LogEntry{{Offset: 7}, {Offset: 7}})
+	req = httptest.NewRequest(http.MethodPost, "/v1/replicate?partition=2", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+
+	handler.HandleReplicate(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for repeated offsets, got %d", w.Code)
+	}
+}
+
+func TestHandleFence(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/fence?partition=0", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleFence(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+
+	body, _ := json.Marshal([]LogEntry{{Message: "fenced"}})
+	req = httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 for fenced partition, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/fence?partition=0", nil)
+	w = httptest.NewRecorder()
+
+	handler.HandleFence(w, req)
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+
+	handler.HandleCreate(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 once the fence is lifted, got %d", w.Code)
+	}
+}
+
+func TestHandlePartition(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+	handler.service.Store(1, []LogEntry{{Message: "moved away"}})
+
+	req := httptest.NewRequest(http.MethodDelete, "/v1/partition?partition=1", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandlePartition(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "partition-1")); !os.IsNotExist(err) {
+		t.Errorf("expected partition-1 to be removed, got %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/partition?partition=1", nil)
+	w = httptest.NewRecorder()
+
+	handler.HandlePartition(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+	var response apierror.Response
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Code != apierror.CodeNotFound {
+		t.Errorf("expected code %q, got %+v", apierror.CodeNotFound, response)
+	}
+}
+
+func TestHandleFollow(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupReplication(t, 5*time.Millisecond)
+
+	leader, server := newMemLeader(t)
+	leader.append(2)
+
+	handler := setupHandler()
+	defer handler.service.Close()
+
+	body, _ := json.Marshal(FollowRequest{Partition: 0, Leader: server.URL})
+	req := httptest.NewRequest(http.MethodPost, "/v1/follow", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.HandleFollow(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+
+	waitForReplica(t, handler.service, 0, func(status ReplicaStatus) bool { return status.NextOffset == 2 })
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/replication", nil)
+	w = httptest.NewRecorder()
+
+	handler.HandleReplication(w, req)
+
+	var statuses []ReplicaStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].Leader != server.URL || statuses[0].Lag != 0 {
+		t.Errorf("unexpected replication status: %+v", statuses)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/follow?partition=0", nil)
+	w = httptest.NewRecorder()
+
+	handler.HandleFollow(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/follow?partition=0", nil)
+	w = httptest.NewRecorder()
+
+	handler.HandleFollow(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 promoting a partition that is not followed, got %d", w.Code)
+	}
+}
+
+func TestHandleCreate_Acks(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupAcks(t, 2, time.Second)
+
+	handler := setupHandler()
+	defer handler.service.Close()
+
+	body, _ := json.Marshal([]LogEntry{{Message: "acks"}})
+
+	tests := []struct {
+		acks     string
+		expected int
+	}{
+		{"2", http.StatusBadRequest},
+		{"all", http.StatusServiceUnavailable},
+		{"1", http.StatusOK},
+		{"0", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0&acks="+test.acks, bytes.NewReader(body))
+		w := httptest.NewRecorder()
+
+		handler.HandleCreate(w, req)
+
+		if w.Code != test.expected {
+			t.Errorf("acks=%s: expected status %d, got %d", test.acks, test.expected, w.Code)
+		}
+	}
+
+	batch, _ := json.Marshal(BatchRequest{Partitions: []PartitionBatch{{Partition: 1, Logs: []LogEntry{{Message: "acks"}}}}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/storage/batch?acks=all", bytes.NewReader(batch))
+	w := httptest.NewRecorder()
+
+	handler.HandleBatch(w, req)
+
+	var response BatchResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Results) != 1 || response.Results[0].Status != http.StatusServiceUnavailable {
+		t.Errorf("expected partition status 503, got %+v", response.Results)
+	}
+}
+
+func TestHandleCreate_AcksAllAnswersBeforeRequestTimeout(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupAcks(t, 1, 10*time.Second)
+	originalTimeout := AcksTimeout
+	AcksTimeout = 10 * time.Second
+	t.Cleanup(func() { AcksTimeout = originalTimeout })
+
+	handler := setupHandler()
+	defer handler.service.Close()
+
+	// The follower stays in sync but never fetches the write
+	handler.service.Fetch(0, "follower-1", 0, 0, 0)
+
+	body, _ := json.Marshal([]LogEntry{{Message: "acks"}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/storage?partition=0&acks=all", bytes.NewReader(body))
+	req.Header.Set(RequestTimeoutHeader, "200")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	handler.HandleCreate(w, req)
+
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("answered after %v, when the sender already gave up", elapsed)
+	}
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", w.Code)
+	}
+}
+
+func TestHandleFetch(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	handler := setupHandler()
+	defer handler.service.Close()
+	storeMessages(t, handler.service, 0, 3)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/fetch?partition=0&from_offset=1&replica=follower-1&max_wait=10ms", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleFetch(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var result ReadResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if len(result.Logs) != 2 || result.NextOffset != 3 || result.EndOffset != 3 {
+		t.Errorf("unexpected page: %+v", result)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/fetch?partition=0&from_offset=1", nil)
+	w = httptest.NewRecorder()
+
+	handler.HandleFetch(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without replica, got %d", w.Code)
+	}
+}
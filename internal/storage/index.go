@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IndexIntervalBytes is roughly how many bytes of records sit between two
+// entries of a segment index. Smaller values mean faster seeks and bigger
+// indexes.
+// This can be overridden for testing or configuration.
+var IndexIntervalBytes int64 = 4096
+
+const (
+	indexSuffix    = ".index"
+	indexEntrySize = 16
+)
+
+// indexEntry maps the offset of a record to its byte position in the segment.
+type indexEntry struct {
+	offset   uint64
+	position int64
+}
+
+func indexPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, segmentSuffix) + indexSuffix
+}
+
+func (e indexEntry) marshal() []byte {
+	buf := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(buf[:8], e.offset)
+	binary.BigEndian.PutUint64(buf[8:], uint64(e.position))
+
+	return buf
+}
+
+// loadIndex reads the index of the segment from disk and checks it against
+// the segment. A missing or inconsistent index is rebuilt from the log.
+func (seg *segment) loadIndex() error {
+	entries, err := readIndexFile(indexPath(seg.path))
+	if err == nil {
+		err = seg.validateIndex(entries)
+	}
+	if err == nil {
+		seg.index = entries
+		if len(entries) > 0 {
+			seg.lastIndexed = entries[len(entries)-1].position
+		}
+		return nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) || seg.size > 0 {
+		fmt.Println("[STORAGE/INDEX]", "rebuilding", indexPath(seg.path), "reason=", err)
+	}
+
+	return seg.rebuildIndex()
+}
+
+func readIndexFile(path string) ([]indexEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%indexEntrySize != 0 {
+		return nil, fmt.Errorf("index size %d is not a multiple of %d", len(data), indexEntrySize)
+	}
+
+	entries := make([]indexEntry, 0, len(data)/indexEntrySize)
+	for i := 0; i < len(data); i += indexEntrySize {
+		entries = append(entries, indexEntry{
+			offset:   binary.BigEndian.Uint64(data[i : i+8]),
+			position: int64(binary.BigEndian.Uint64(data[i+8 : i+16])),
+		})
+	}
+
+	return entries, nil
+}
+
+// validateIndex checks that entries are ordered, start at the beginning of
+// the segment and that the last one points at the record it claims to.
+func (seg *segment) validateIndex(entries []indexEntry) error {
+	if len(entries) == 0 {
+		if seg.size == 0 {
+			return nil
+		}
+		return errors.New("index is empty")
+	}
+
+	if entries[0].position != 0 {
+		return errors.New("first index entry does not point at the start of the segment")
+	}
+
+	for i := 1; i < len(entries); i++ {
+		if entries[i].offset <= entries[i-1].offset || entries[i].position <= entries[i-1].position {
+			return fmt.Errorf("index entry %d is out of order", i)
+		}
+	}
+
+	last := entries[len(entries)-1]
+	if last.position >= seg.size {
+		return fmt.Errorf("index entry points past the end of the segment")
+	}
+
+	records, closer, err := seg.records(last.position)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	log, _, err := records.next()
+	if err != nil {
+		return fmt.Errorf("index entry does not point at a record: %w", err)
+	}
+	if log.Offset != last.offset {
+		return fmt.Errorf("index entry points at offset %d instead of %d", log.Offset, last.offset)
+	}
+
+	return nil
+}
+
+// rebuildIndex scans the whole segment and rewrites its index. Corrupt
+// records are left out of the index.
+func (seg *segment) rebuildIndex() error {
+	seg.index = nil
+	seg.lastIndexed = 0
+
+	records, closer, err := seg.records(0)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	var buf []byte
+	for {
+		log, position, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := asCorruptRecord(err); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if seg.needsIndexEntry(position) {
+			entry := indexEntry{offset: log.Offset, position: position}
+			seg.addIndexEntry(entry)
+			buf = append(buf, entry.marshal()...)
+		}
+	}
+
+	return os.WriteFile(indexPath(seg.path), buf, 0644)
+}
+
+// needsIndexEntry reports whether a record written at position should be
+// added to the index.
+func (seg *segment) needsIndexEntry(position int64) bool {
+	return len(seg.index) == 0 || position-seg.lastIndexed >= IndexIntervalBytes
+}
+
+func (seg *segment) addIndexEntry(entry indexEntry) {
+	seg.index = append(seg.index, entry)
+	seg.lastIndexed = entry.position
+}
+
+// lookup returns the position of the closest indexed record at or before
+// offset.
+func (seg segment) lookup(offset uint64) int64 {
+	i := sort.Search(len(seg.index), func(i int) bool {
+		return seg.index[i].offset > offset
+	})
+	if i == 0 {
+		return 0
+	}
+
+	return seg.index[i-1].position
+}
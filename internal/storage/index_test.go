@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupIndexInterval overrides IndexIntervalBytes for a single test
+func setupIndexInterval(t *testing.T, interval int64) {
+	original := IndexIntervalBytes
+	IndexIntervalBytes = interval
+
+	t.Cleanup(func() {
+		IndexIntervalBytes = original
+	})
+}
+
+func storeMessages(t *testing.T, service *Service, partition int, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		_, err := service.Store(partition, []LogEntry{{Service: "test-service", Message: fmt.Sprintf("message %d", i)}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestIndex_IsSparse(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupIndexInterval(t, 300)
+
+	service := &Service{}
+	storeMessages(t, service, 0, 50)
+
+	entries, err := readIndexFile(filepath.Join(tmpDir, "partition-0", "segment-00001.index"))
+	if err != nil {
+		t.Fatalf("failed to read index: %v", err)
+	}
+
+	if len(entries) < 2 || len(entries) >= 50 {
+		t.Fatalf("expected a sparse index, got %d entries for 50 records", len(entries))
+	}
+	if entries[0].offset != 0 || entries[0].position != 0 {
+		t.Errorf("expected first entry to point at the start, got %+v", entries[0])
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].position-entries[i-1].position < 300 {
+			t.Errorf("entries %d and %d are closer than the interval", i-1, i)
+		}
+	}
+}
+
+func TestIndex_LookupSeeksToRecord(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupIndexInterval(t, 300)
+	setupSegmentLimits(t, 2000, 0)
+
+	service := &Service{}
+	storeMessages(t, service, 0, 100)
+
+	p, _ := service.partition(0, false)
+	segments, _ := p.snapshot()
+	if len(segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+
+	for _, from := range []uint64{0, 1, 37, 64, 99} {
+		pg, err := readLogFromPartition(segments, from, 3, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		logs := pg.logs
+		if len(logs) == 0 || logs[0].Offset != from {
+			t.Fatalf("expected read from %d to start at %d, got %+v", from, from, logs)
+		}
+		if logs[0].Message != fmt.Sprintf("message %d", from) {
+			t.Errorf("expected message %d, got %q", from, logs[0].Message)
+		}
+	}
+
+	pg, _ := readLogFromPartition(segments, 98, 10, 0)
+	if len(pg.logs) != 2 {
+		t.Errorf("expected read at the tail to return 2 logs, got %d", len(pg.logs))
+	}
+}
+
+func TestIndex_RebuiltWhenMissing(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupIndexInterval(t, 300)
+
+	storeMessages(t, &Service{}, 0, 30)
+
+	path := filepath.Join(tmpDir, "partition-0", "segment-00001.index")
+	original, _ := os.ReadFile(path)
+	os.Remove(path)
+
+	service := &Service{}
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rebuilt, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected index to be rebuilt: %v", err)
+	}
+	if string(rebuilt) != string(original) {
+		t.Error("expected the rebuilt index to match the original")
+	}
+
+	logs, _ := service.Read(0, 5)
+	if len(logs) != 5 || logs[0].Offset != 25 {
+		t.Errorf("unexpected logs after rebuilding the index: %+v", logs)
+	}
+}
+
+func TestIndex_RebuiltWhenCorrupt(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupIndexInterval(t, 300)
+
+	storeMessages(t, &Service{}, 0, 30)
+
+	path := filepath.Join(tmpDir, "partition-0", "segment-00001.index")
+	original, _ := os.ReadFile(path)
+
+	corruptions := map[string][]byte{
+		"truncated entry": original[:len(original)-3],
+		"wrong offset":    append(append([]byte{}, original...), indexEntry{offset: 7, position: 20}.marshal()...),
+		"past the end":    append(append([]byte{}, original...), indexEntry{offset: 1000, position: 1 << 20}.marshal()...),
+	}
+
+	for name, data := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			os.WriteFile(path, data, 0644)
+
+			service := &Service{}
+			logs, err := service.Read(0, 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(logs) != 3 || logs[0].Offset != 27 {
+				t.Errorf("unexpected logs with a corrupt index: %+v", logs)
+			}
+
+			rebuilt, _ := os.ReadFile(path)
+			if string(rebuilt) != string(original) {
+				t.Error("expected the corrupt index to be rebuilt")
+			}
+		})
+	}
+}
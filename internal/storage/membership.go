@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AnnounceInterval is how often this node sends its heartbeat to the ingest
+// nodes it announces itself to.
+// This can be overridden for testing or configuration.
+var AnnounceInterval = 5 * time.Second
+
+// Announce registers this node, reachable at self, with every ingest node in
+// targets and keeps sending them heartbeats every AnnounceInterval until the
+// service is closed.
+func (s *Service) Announce(targets []string, self string) {
+	stop := s.stopChan()
+
+	payload, err := json.Marshal(map[string]string{"url": self})
+	if err != nil {
+		fmt.Println("[STORAGE/MEMBERS]", "error=", err)
+		return
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		ticker := time.NewTicker(AnnounceInterval)
+		defer ticker.Stop()
+
+		for {
+			for _, target := range targets {
+				if err := announce(client, target, payload); err != nil {
+					fmt.Println("[STORAGE/MEMBERS]", "ingest node=", target, "error=", err)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// announce sends one heartbeat to the ingest node target.
+func announce(client *http.Client, target string, payload []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, target+"/v1/members", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("ingest node %s answered with status %d", target, response.StatusCode)
+	}
+
+	return nil
+}
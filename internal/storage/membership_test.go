@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnnounce_SendsHeartbeats(t *testing.T) {
+	original := AnnounceInterval
+	AnnounceInterval = 5 * time.Millisecond
+	t.Cleanup(func() { AnnounceInterval = original })
+
+	heartbeats := make(chan string, 16)
+	ingest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			URL string `json:"url"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		select {
+		case heartbeats <- r.URL.Path + " " + req.URL:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ingest.Close()
+
+	service := &Service{}
+	service.Announce([]string{ingest.URL}, "http://self:8081")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case heartbeat := <-heartbeats:
+			if heartbeat != "/v1/members http://self:8081" {
+				t.Errorf("unexpected heartbeat %q", heartbeat)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected heartbeat %d", i+1)
+		}
+	}
+
+	service.Close()
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// ErrPartitionFenced is returned for writes to a partition that is being
+// moved to another storage node.
+var ErrPartitionFenced = apierror.New(http.StatusServiceUnavailable, "partition is fenced")
+
+// fenceSuffix names the file that marks a partition as fenced.
+const fenceSuffix = ".fenced"
+
+// ErrOffsetsNotIncreasing is returned for replicated logs whose offsets are
+// not increasing.
+var ErrOffsetsNotIncreasing = apierror.New(http.StatusBadRequest, "offsets are not increasing")
+
+// Fence stops the partition from accepting writes until Unfence is called,
+// so a partition move can copy the last records before ownership changes.
+// Reads are still served. The fence is kept in partition-N.fenced so it
+// survives a restart, and outlives the partition once it is deleted.
+func (s *Service) Fence(partition int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fenced[partition] {
+		return nil
+	}
+
+	if err := os.MkdirAll(BaseLogDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(fencePath(partition), nil, 0644); err != nil {
+		return err
+	}
+	if err := syncDir(BaseLogDir); err != nil {
+		return err
+	}
+
+	if s.fenced == nil {
+		s.fenced = make(map[int]bool)
+	}
+	s.fenced[partition] = true
+
+	return nil
+}
+
+// Unfence lets a fenced partition accept writes again.
+func (s *Service) Unfence(partition int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := removeIfExists(fencePath(partition)); err != nil {
+		return err
+	}
+	delete(s.fenced, partition)
+
+	return syncDir(BaseLogDir)
+}
+
+func fencePath(partition int) string {
+	return filepath.Join(BaseLogDir, fmt.Sprintf("partition-%d%s", partition, fenceSuffix))
+}
+
+func (s *Service) isFenced(partition int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.fenced[partition]
+}
+
+// Replicate appends logs copied from the same partition on another storage
+// node, keeping their offsets. Offsets must be increasing; logs the partition
+// already has are skipped, so a copy can be resumed or repeated. Fences only
+// stop client writes, a partition can always be moved back. It returns the
+// next offset of the partition.
+func (s *Service) Replicate(partition int, logs []LogEntry) (uint64, error) {
+	for i := 1; i < len(logs); i++ {
+		if logs[i].Offset <= logs[i-1].Offset {
+			return 0, fmt.Errorf("offset %d does not follow offset %d: %w", logs[i].Offset, logs[i-1].Offset, ErrOffsetsNotIncreasing)
+		}
+	}
+
+	p, err := s.partition(partition, true)
+	if err != nil {
+		return 0, err
+	}
+
+	next, err := p.appendReplicated(logs)
+	if err != nil {
+		return 0, err
+	}
+	s.replicas.appended.notify(partition)
+
+	if err := p.waitForSync(); err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+// DeletePartition closes the partition and removes it from disk, once it has
+// been moved to another storage node. The partition stays fenced so late
+// writes are not stored in a new, empty copy.
+func (s *Service) DeletePartition(partition int) error {
+	s.stopFollowing(partition)
+
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	s.mu.Lock()
+	p, ok := s.partitions[partition]
+	delete(s.partitions, partition)
+	delete(s.dedup, partition)
+	s.mu.Unlock()
+
+	if !ok && !partitionExists(partition) {
+		return fmt.Errorf("partition %d: %w", partition, ErrPartitionNotFound)
+	}
+
+	var errs []error
+	if ok {
+		errs = append(errs, p.close())
+	}
+	s.replicas.forget(partition)
+	errs = append(errs,
+		os.RemoveAll(partitionDir(partition)),
+		removeIfExists(legacyPartitionLogFilePath(partition)),
+	)
+
+	fmt.Println("[STORAGE/MIGRATION]", "partition=", partition, "deleted")
+
+	return errors.Join(errs...)
+}
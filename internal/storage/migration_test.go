@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReplicate_KeepsOffsets(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+
+	// Offsets below 5 were deleted by retention on the source and 7 was a
+	// corrupt record
+	logs := []LogEntry{
+		{Offset: 5, Message: "five"},
+		{Offset: 6, Message: "six"},
+		{Offset: 8, Message: "eight"},
+	}
+
+	next, err := service.Replicate(0, logs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next != 9 {
+		t.Errorf("expected next offset 9, got %d", next)
+	}
+
+	// Repeating a copy stores nothing twice
+	next, err = service.Replicate(0, append(logs, LogEntry{Offset: 9, Message: "nine"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next != 10 {
+		t.Errorf("expected next offset 10, got %d", next)
+	}
+	service.Close()
+
+	restarted := &Service{}
+	defer restarted.Close()
+
+	result, err := restarted.ReadFrom(0, 0, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []uint64{5, 6, 8, 9}
+	if len(result.Logs) != len(expected) {
+		t.Fatalf("expected %d logs, got %+v", len(expected), result.Logs)
+	}
+	for i, log := range result.Logs {
+		if log.Offset != expected[i] {
+			t.Errorf("log %d: expected offset %d, got %d", i, expected[i], log.Offset)
+		}
+	}
+
+	stored, err := restarted.Store(0, []LogEntry{{Message: "after move"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.BaseOffset != 10 {
+		t.Errorf("expected offset 10 after replicated logs, got %d", stored.BaseOffset)
+	}
+}
+
+func TestReplicate_RejectsDecreasingOffsets(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	defer service.Close()
+
+	_, err := service.Replicate(0, []LogEntry{{Offset: 3}, {Offset: 2}})
+	if err == nil {
+		t.Fatal("expected error for decreasing offsets")
+	}
+}
+
+func TestFence_RejectsWrites(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	defer service.Close()
+
+	storeMessages(t, service, 0, 2)
+	service.Fence(0)
+
+	if _, err := service.Store(0, []LogEntry{{Message: "fenced"}}); !errors.Is(err, ErrPartitionFenced) {
+		t.Fatalf("expected ErrPartitionFenced, got %v", err)
+	}
+
+	// Reads and other partitions are not affected
+	if logs, err := service.Read(0, 10); err != nil || len(logs) != 2 {
+		t.Errorf("expected 2 logs from fenced partition, got %d (%v)", len(logs), err)
+	}
+	storeMessages(t, service, 1, 1)
+
+	service.Unfence(0)
+	result, err := service.Store(0, []LogEntry{{Message: "unfenced"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 2 {
+		t.Errorf("expected offset 2, got %d", result.BaseOffset)
+	}
+}
+
+func TestFence_SurvivesRestart(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	storeMessages(t, service, 0, 2)
+	if err := service.Fence(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := service.DeletePartition(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service.Close()
+
+	restarted := &Service{}
+	defer restarted.Close()
+	if err := restarted.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The deleted partition is not brought back by late writes
+	if _, err := restarted.Store(0, []LogEntry{{Message: "late"}}); !errors.Is(err, ErrPartitionFenced) {
+		t.Fatalf("expected ErrPartitionFenced after a restart, got %v", err)
+	}
+
+	if err := restarted.Unfence(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(fencePath(0)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the fence to be removed, got %v", err)
+	}
+}
+
+func TestDeletePartition(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	defer service.Close()
+
+	storeMessages(t, service, 0, 3)
+	service.Fence(0)
+
+	if err := service.DeletePartition(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(partitionDir(0)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected partition directory to be removed, got %v", err)
+	}
+	if _, err := service.Read(0, 10); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected deleted partition to be missing, got %v", err)
+	}
+
+	// Late writes do not bring the partition back
+	if _, err := service.Store(0, []LogEntry{{Message: "late"}}); !errors.Is(err, ErrPartitionFenced) {
+		t.Errorf("expected ErrPartitionFenced, got %v", err)
+	}
+
+	if err := service.DeletePartition(0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist deleting a missing partition, got %v", err)
+	}
+}
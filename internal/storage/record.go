@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Every record is framed as
+//
+//	length (4 bytes) | crc32c of payload (4 bytes) | payload (JSON)
+//
+// so a reader can tell a complete record from a torn or corrupted one.
+const (
+	recordHeaderSize = 8
+	maxRecordBytes   = 64 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptRecordError describes a record that failed its length or checksum
+// check.
+type CorruptRecordError struct {
+	Segment  string `json:"segment"`
+	Position int64  `json:"position"`
+	Reason   string `json:"reason"`
+	// Torn is set when the record runs past the end of the segment or its
+	// length cannot be trusted, so nothing after it can be read.
+	Torn bool `json:"torn"`
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record in %s at position %d: %s", e.Segment, e.Position, e.Reason)
+}
+
+func encodeLog(log LogEntry) ([]byte, error) {
+	payload, err := json.Marshal(log)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+
+	return append(record, payload...), nil
+}
+
+// recordReader decodes the records of a segment while keeping track of the
+// position each of them starts at.
+type recordReader struct {
+	r        *bufio.Reader
+	segment  string
+	position int64
+	torn     bool
+}
+
+func newRecordReader(r io.Reader, position int64) *recordReader {
+	return &recordReader{r: bufio.NewReader(r), position: position}
+}
+
+// next returns the next record and its position, or io.EOF once the segment
+// is exhausted. A record failing its checks is returned as a
+// *CorruptRecordError; reading can continue after it unless it is torn.
+func (rr *recordReader) next() (LogEntry, int64, error) {
+	position := rr.position
+	if rr.torn {
+		return LogEntry{}, position, io.EOF
+	}
+
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(rr.r, header)
+	if err == io.EOF {
+		return LogEntry{}, position, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return LogEntry{}, position, rr.tornAt(position, fmt.Sprintf("header cut short after %d bytes", n))
+	}
+	if err != nil {
+		return LogEntry{}, position, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length == 0 || length > maxRecordBytes {
+		return LogEntry{}, position, rr.tornAt(position, fmt.Sprintf("invalid record length %d", length))
+	}
+
+	payload := make([]byte, length)
+	n, err = io.ReadFull(rr.r, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return LogEntry{}, position, rr.tornAt(position, fmt.Sprintf("payload cut short after %d of %d bytes", n, length))
+	}
+	if err != nil {
+		return LogEntry{}, position, err
+	}
+
+	rr.position += recordHeaderSize + int64(length)
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return LogEntry{}, position, &CorruptRecordError{Segment: rr.segment, Position: position, Reason: "checksum mismatch"}
+	}
+
+	var log LogEntry
+
+	if err := json.Unmarshal(payload, &log); err != nil {
+		return LogEntry{}, position, &CorruptRecordError{Segment: rr.segment, Position: position, Reason: err.Error()}
+	}
+
+	return log, position, nil
+}
+
+func (rr *recordReader) tornAt(position int64, reason string) error {
+	rr.torn = true
+
+	return &CorruptRecordError{Segment: rr.segment, Position: position, Reason: reason, Torn: true}
+}
+
+// asCorruptRecord reports whether err describes a corrupt record.
+func asCorruptRecord(err error) (*CorruptRecordError, bool) {
+	var corrupt *CorruptRecordError
+	if errors.As(err, &corrupt) {
+		return corrupt, true
+	}
+
+	return nil, false
+}
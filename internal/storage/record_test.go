@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRecord_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	for _, message := range []string{"first", "second"} {
+		record, err := encodeLog(LogEntry{Message: message})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		buf.Write(record)
+	}
+
+	records := newRecordReader(&buf, 0)
+
+	first, position, err := records.next()
+	if err != nil || first.Message != "first" || position != 0 {
+		t.Fatalf("unexpected first record %+v at %d: %v", first, position, err)
+	}
+
+	second, position, err := records.next()
+	if err != nil || second.Message != "second" || position == 0 {
+		t.Fatalf("unexpected second record %+v at %d: %v", second, position, err)
+	}
+
+	if _, _, err := records.next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestRecord_ChecksumMismatchIsSkippable(t *testing.T) {
+	first, _ := encodeLog(LogEntry{Message: "corrupted"})
+	second, _ := encodeLog(LogEntry{Message: "intact"})
+	first[len(first)-3] ^= 0xff
+
+	records := newRecordReader(bytes.NewReader(append(first, second...)), 0)
+
+	_, _, err := records.next()
+	corrupt, ok := asCorruptRecord(err)
+	if !ok {
+		t.Fatalf("expected a corrupt record error, got %v", err)
+	}
+	if corrupt.Torn || corrupt.Position != 0 {
+		t.Errorf("unexpected corruption details %+v", corrupt)
+	}
+
+	log, _, err := records.next()
+	if err != nil || log.Message != "intact" {
+		t.Errorf("expected to read past the corrupt record, got %+v: %v", log, err)
+	}
+}
+
+func TestRecord_TornRecord(t *testing.T) {
+	record, _ := encodeLog(LogEntry{Message: "torn"})
+
+	for _, cut := range []int{3, recordHeaderSize, len(record) - 1} {
+		records := newRecordReader(bytes.NewReader(record[:cut]), 0)
+
+		_, _, err := records.next()
+		corrupt, ok := asCorruptRecord(err)
+		if !ok || !corrupt.Torn {
+			t.Errorf("expected a torn record when cut at %d, got %v", cut, err)
+		}
+
+		if _, _, err := records.next(); err != io.EOF {
+			t.Errorf("expected io.EOF after a torn record, got %v", err)
+		}
+	}
+}
+
+func TestRecord_ZeroLengthIsTorn(t *testing.T) {
+	records := newRecordReader(bytes.NewReader(make([]byte, 64)), 0)
+
+	_, _, err := records.next()
+	if corrupt, ok := asCorruptRecord(err); !ok || !corrupt.Torn {
+		t.Errorf("expected zeroed bytes to be a torn record, got %v", err)
+	}
+}
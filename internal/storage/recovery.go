@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// rejectedSuffix names the file next to a converted segment that keeps the
+// lines which did not parse, so they can be inspected instead of being lost.
+const rejectedSuffix = ".rejected"
+
+// convertUnframed rewrites a segment written before records were framed as
+// framed records in place. Its JSON lines would otherwise be mistaken for a
+// torn tail and truncated. Each line keeps the offset it was stored with.
+func (seg *segment) convertUnframed() error {
+	if seg.size == 0 || seg.compressed {
+		return nil
+	}
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(f, first); err != nil {
+		return err
+	}
+	if first[0] != '{' {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	fmt.Println("[STORAGE/RECOVERY]", "converting unframed", seg.path)
+
+	tmpPath := seg.path + ".tmp"
+	size, rejected, err := writeFramed(f, tmpPath, func(*LogEntry) {})
+	if err != nil {
+		return err
+	}
+	if err := writeRejected(seg.path+rejectedSuffix, rejected); err != nil {
+		return err
+	}
+
+	// The index points into the JSON lines. Without it the framed segment
+	// gets a fresh one, also when a crash stops us before the rename.
+	if err := os.Remove(indexPath(seg.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmpPath, seg.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(seg.path)); err != nil {
+		return err
+	}
+
+	seg.size = size
+
+	return nil
+}
+
+// writeFramed writes the JSON lines of r as framed records to path, passing
+// each log to assign first, and syncs it. Lines that do not parse are not
+// written and returned instead.
+func writeFramed(r io.Reader, path string, assign func(*LogEntry)) (int64, [][]byte, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	var size int64
+	var rejected [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxRecordBytes)
+	for scanner.Scan() {
+		var log LogEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &log); err != nil {
+			rejected = append(rejected, append([]byte(nil), scanner.Bytes()...))
+			continue
+		}
+
+		assign(&log)
+
+		record, err := encodeLog(log)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := f.Write(record); err != nil {
+			return 0, nil, err
+		}
+		size += int64(len(record))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, nil, err
+	}
+
+	return size, rejected, f.Close()
+}
+
+// writeRejected keeps the lines a conversion could not parse in path.
+func writeRejected(path string, lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	fmt.Println("[STORAGE/RECOVERY]", "rejected", len(lines), "lines that do not parse, kept in", path)
+
+	return os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0644)
+}
+
+// recoverTail checks the records after the last index entry of the active
+// segment and truncates a torn or corrupt tail left behind by a crash.
+// Corrupt records followed by valid ones are kept, reads report them.
+func (seg *segment) recoverTail() error {
+	var position int64
+	if len(seg.index) > 0 {
+		position = seg.index[len(seg.index)-1].position
+	}
+
+	records, closer, err := seg.records(position)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	// Position of the first bad record not followed by a valid one.
+	badTail := int64(-1)
+	var reason string
+	for {
+		_, position, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if corrupt, ok := asCorruptRecord(err); ok {
+			if badTail < 0 {
+				badTail, reason = position, corrupt.Reason
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		badTail = -1
+	}
+
+	if badTail < 0 {
+		return nil
+	}
+
+	fmt.Println("[STORAGE/RECOVERY]", "truncating", seg.path, "at=", badTail, "size=", seg.size, "reason=", reason)
+
+	if err := os.Truncate(seg.path, badTail); err != nil {
+		return err
+	}
+	seg.size = badTail
+
+	return seg.rebuildIndex()
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func segmentPath(partition int, id int) string {
+	return filepath.Join(partitionDir(partition), segmentFileName(id))
+}
+
+func TestRecovery_TruncatesTornTail(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	storeMessages(t, service, 0, 5)
+	service.Close()
+
+	path := segmentPath(0, 1)
+	info, _ := os.Stat(path)
+	intactSize := info.Size()
+
+	// Simulate a crash halfway through writing a record
+	record, _ := encodeLog(LogEntry{Offset: 5, Message: "half written"})
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(record[:len(record)/2])
+	f.Close()
+
+	restarted := &Service{}
+	if err := restarted.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer restarted.Close()
+
+	info, _ = os.Stat(path)
+	if info.Size() != intactSize {
+		t.Errorf("expected the torn tail to be truncated to %d bytes, got %d", intactSize, info.Size())
+	}
+
+	result, err := restarted.Store(0, []LogEntry{{Message: "after recovery"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 5 {
+		t.Errorf("expected offset 5 after recovery, got %d", result.BaseOffset)
+	}
+
+	read, _ := restarted.ReadFrom(0, 0, 10, 0)
+	if len(read.Logs) != 6 || len(read.Corrupt) != 0 {
+		t.Errorf("expected 6 clean logs, got %d logs and %d corrupt", len(read.Logs), len(read.Corrupt))
+	}
+}
+
+func TestRecovery_TruncatesCorruptLastRecord(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	storeMessages(t, service, 0, 3)
+	service.Close()
+
+	path := segmentPath(0, 1)
+	data, _ := os.ReadFile(path)
+	data[len(data)-2] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	restarted := &Service{}
+	defer restarted.Close()
+
+	read, err := restarted.ReadFrom(0, 0, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(read.Logs) != 2 || len(read.Corrupt) != 0 {
+		t.Errorf("expected the corrupt tail to be dropped, got %d logs and %d corrupt", len(read.Logs), len(read.Corrupt))
+	}
+}
+
+func TestRecovery_ReportsCorruptionInTheMiddle(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	storeMessages(t, service, 0, 5)
+
+	p, _ := service.partition(0, false)
+	segments, _ := p.snapshot()
+	service.Close()
+
+	// Find where the third record starts and flip a byte of its payload
+	records, closer, _ := segments[0].records(0)
+	var third int64
+	for i := 0; i < 3; i++ {
+		_, third, _ = records.next()
+	}
+	closer.Close()
+
+	path := segmentPath(0, 1)
+	data, _ := os.ReadFile(path)
+	data[third+recordHeaderSize+2] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	restarted := &Service{}
+	defer restarted.Close()
+
+	read, err := restarted.ReadFrom(0, 0, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(read.Logs) != 4 {
+		t.Fatalf("expected the 4 intact logs, got %d", len(read.Logs))
+	}
+	if len(read.Corrupt) != 1 || read.Corrupt[0].Position != third || read.Corrupt[0].Torn {
+		t.Fatalf("expected the corrupt record to be reported, got %+v", read.Corrupt)
+	}
+	if read.Logs[2].Offset != 3 {
+		t.Errorf("expected offset 2 to be missing, got %d after offset 1", read.Logs[2].Offset)
+	}
+
+	info, _ := os.Stat(path)
+	if info.Size() != int64(len(data)) {
+		t.Error("expected a segment with corruption in the middle not to be truncated")
+	}
+
+	result, _ := restarted.Store(0, []LogEntry{{Message: "after"}})
+	if result.BaseOffset != 5 {
+		t.Errorf("expected offset 5, got %d", result.BaseOffset)
+	}
+}
+
+func TestRecovery_ConvertsUnframedSegments(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	dir := filepath.Join(tmpDir, "partition-0")
+	os.MkdirAll(dir, 0755)
+	lines := `{"offset":4,"message":"json lines"}` + "\n" + `{"offset":5,` + "\n" + `{"offset":6,"message":"more"}` + "\n"
+	os.WriteFile(filepath.Join(dir, "segment-00001.log"), []byte(lines), 0644)
+
+	service := &Service{}
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logs, _ := service.Read(0, 10)
+	if len(logs) != 2 || logs[0].Offset != 4 || logs[1].Offset != 6 || logs[1].Message != "more" {
+		t.Errorf("expected the lines to keep their offsets, got %+v", logs)
+	}
+
+	rejected, _ := os.ReadFile(filepath.Join(dir, "segment-00001.log.rejected"))
+	if string(rejected) != `{"offset":5,`+"\n" {
+		t.Errorf("expected the line that does not parse to be kept, got %q", rejected)
+	}
+
+	result, _ := service.Store(0, []LogEntry{{Message: "after"}})
+	if result.BaseOffset != 7 {
+		t.Errorf("expected offset 7, got %d", result.BaseOffset)
+	}
+}
@@ -0,0 +1,599 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// AntiEntropyInterval is how often every partition this node follows is
+// compared with its leader and repaired. Zero disables it.
+// This can be overridden for testing or configuration.
+var AntiEntropyInterval = 10 * time.Minute
+
+// DigestRangeOffsets is how many offsets every digested range spans. Ranges
+// start at multiples of it, so replicas whose segments are cut at different
+// offsets still compare the same ranges.
+// This can be overridden for testing or configuration.
+var DigestRangeOffsets uint64 = 1024
+
+// repairReadLimit bounds the records of every page read from the peer.
+const repairReadLimit = 1000
+
+// ErrNoRepairPeer is returned when repairing a partition that is not
+// followed without naming the replica to repair it from.
+var ErrNoRepairPeer = apierror.New(http.StatusBadRequest, "partition is not followed and no peer was given")
+
+// RangeDigest is the digest of the records of a partition between
+// FirstOffset and EndOffset, excluded.
+type RangeDigest struct {
+	FirstOffset uint64 `json:"first_offset"`
+	EndOffset   uint64 `json:"end_offset"`
+	Records     int    `json:"records"`
+	Digest      string `json:"digest"`
+}
+
+// PartitionDigest is the digest of every range of a partition between
+// FirstOffset and EndOffset. Root is the digest of the range digests, equal
+// roots mean equal ranges.
+type PartitionDigest struct {
+	Partition   int           `json:"partition"`
+	FirstOffset uint64        `json:"first_offset"`
+	EndOffset   uint64        `json:"end_offset"`
+	Root        string        `json:"root"`
+	Ranges      []RangeDigest `json:"ranges"`
+}
+
+// OffsetRange is the offsets from First up to End, excluded.
+type OffsetRange struct {
+	First uint64 `json:"first"`
+	End   uint64 `json:"end"`
+}
+
+// RepairReport is the outcome of comparing a partition with Peer. The
+// segments holding divergent ranges are rewritten from the peer, the active
+// segment is sealed first. Extra are the records past the end of the peer,
+// which are reported but kept: truncating them is left to the operator.
+type RepairReport struct {
+	Partition        int           `json:"partition"`
+	Peer             string        `json:"peer"`
+	At               time.Time     `json:"at"`
+	FirstOffset      uint64        `json:"first_offset"`
+	EndOffset        uint64        `json:"end_offset"`
+	RangesCompared   int           `json:"ranges_compared"`
+	Divergent        []OffsetRange `json:"divergent"`
+	SegmentsRepaired []string      `json:"segments_repaired"`
+	RecordsRepaired  int           `json:"records_repaired"`
+	Extra            *OffsetRange  `json:"extra,omitempty"`
+	Error            string        `json:"error,omitempty"`
+}
+
+// repairLog keeps the latest repair report of every partition.
+type repairLog struct {
+	mu      sync.Mutex
+	reports map[int]RepairReport
+}
+
+func (l *repairLog) record(report RepairReport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.reports == nil {
+		l.reports = make(map[int]RepairReport)
+	}
+	l.reports[report.Partition] = report
+}
+
+// digester hashes the records of a partition range by range.
+type digester struct {
+	digest PartitionDigest
+	hash   []byte // of the current range
+}
+
+func newDigester(partition int, from uint64, until uint64) *digester {
+	d := &digester{digest: PartitionDigest{Partition: partition, FirstOffset: from, EndOffset: until, Ranges: []RangeDigest{}}}
+
+	for first := from; first < until; {
+		end := min((first/DigestRangeOffsets+1)*DigestRangeOffsets, until)
+		d.digest.Ranges = append(d.digest.Ranges, RangeDigest{FirstOffset: first, EndOffset: end})
+		first = end
+	}
+
+	return d
+}
+
+// add hashes log into its range. Logs must be added in offset order.
+func (d *digester) add(log LogEntry) error {
+	if log.Offset < d.digest.FirstOffset || log.Offset >= d.digest.EndOffset {
+		return nil
+	}
+
+	i := sort.Search(len(d.digest.Ranges), func(i int) bool {
+		return d.digest.Ranges[i].EndOffset > log.Offset
+	})
+
+	payload, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if d.digest.Ranges[i].Records > 0 {
+		h.Write(d.hash)
+	}
+	binary.Write(h, binary.BigEndian, log.Offset)
+	h.Write(payload)
+
+	d.hash = h.Sum(nil)
+	d.digest.Ranges[i].Records++
+	d.digest.Ranges[i].Digest = hex.EncodeToString(d.hash)
+
+	return nil
+}
+
+// result returns the digest of every range and their root.
+func (d *digester) result() PartitionDigest {
+	root := sha256.New()
+	for _, r := range d.digest.Ranges {
+		binary.Write(root, binary.BigEndian, r.FirstOffset)
+		root.Write([]byte(r.Digest))
+	}
+	d.digest.Root = hex.EncodeToString(root.Sum(nil))
+
+	return d.digest
+}
+
+// Digest returns the digest of partition between from and until, clipped to
+// the offsets the partition holds. Corrupt records are left out, so a replica
+// with a corrupt copy digests differently.
+func (s *Service) Digest(partition int, from uint64, until uint64) (PartitionDigest, error) {
+	p, err := s.partition(partition, false)
+	if err != nil {
+		return PartitionDigest{}, err
+	}
+
+	segments, next, release := p.readSnapshot()
+	defer release()
+
+	from = max(from, segments[0].baseOffset)
+	until = min(until, next)
+	if from > until {
+		from = until
+	}
+
+	d := newDigester(partition, from, until)
+	err = scanRecords(segments, from, func(log LogEntry) bool {
+		if log.Offset >= until {
+			return false
+		}
+		if err := d.add(log); err != nil {
+			fmt.Println("[STORAGE/REPAIR]", "partition=", partition, "offset=", log.Offset, "error=", err)
+		}
+		return true
+	})
+	if err != nil {
+		return PartitionDigest{}, err
+	}
+
+	return d.result(), nil
+}
+
+// scanRecords calls fn with every readable record of segments at or after
+// from, in offset order, until fn returns false.
+func scanRecords(segments []segment, from uint64, fn func(LogEntry) bool) error {
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].baseOffset > from
+	})
+	if i > 0 {
+		i--
+	}
+
+	for ; i < len(segments); i++ {
+		done, err := scanSegment(segments[i], from, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanSegment(seg segment, from uint64, fn func(LogEntry) bool) (bool, error) {
+	records, closer, err := seg.records(seg.lookup(from))
+	if errors.Is(err, os.ErrNotExist) {
+		// Deleted by retention after the snapshot was taken.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer closer.Close()
+
+	for {
+		log, _, err := records.next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if _, ok := asCorruptRecord(err); ok {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if log.Offset < from {
+			continue
+		}
+		if !fn(log) {
+			return true, nil
+		}
+	}
+}
+
+// StartAntiEntropy repairs every partition this node follows from its leader
+// every AntiEntropyInterval until the service is closed.
+func (s *Service) StartAntiEntropy() {
+	if AntiEntropyInterval <= 0 {
+		return
+	}
+
+	stop := s.stopChan()
+	s.background.Add(1)
+
+	go func() {
+		defer s.background.Done()
+
+		ticker := time.NewTicker(AntiEntropyInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, status := range s.ReplicationStatus() {
+					s.Repair(context.Background(), status.Partition, "")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Repair compares the digests of partition with the copy on peer, the leader
+// it follows when peer is empty, and rewrites the sealed segments holding
+// divergent ranges with the records of the peer. Records the peer does not
+// have, because retention deleted them or they are newer, are kept.
+func (s *Service) Repair(ctx context.Context, partition int, peer string) (RepairReport, error) {
+	if peer == "" {
+		s.mu.Lock()
+		f, ok := s.followers[partition]
+		s.mu.Unlock()
+		if !ok {
+			return RepairReport{}, ErrNoRepairPeer
+		}
+		peer = f.leader()
+	}
+
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	report := RepairReport{
+		Partition:        partition,
+		Peer:             peer,
+		At:               time.Now(),
+		Divergent:        []OffsetRange{},
+		SegmentsRepaired: []string{},
+	}
+
+	err := s.repair(ctx, &report)
+
+	var extra uint64
+	if report.Extra != nil {
+		extra = report.Extra.End - report.Extra.First
+	}
+	if err != nil {
+		report.Error = err.Error()
+		fmt.Println("[STORAGE/REPAIR]", "partition=", partition, "peer=", peer, "error=", err)
+	} else {
+		fmt.Println(
+			"[STORAGE/REPAIR]",
+			"partition=", partition,
+			"peer=", peer,
+			"ranges=", report.RangesCompared,
+			"divergent=", len(report.Divergent),
+			"segments_repaired=", len(report.SegmentsRepaired),
+			"extra=", extra,
+		)
+	}
+	s.repairs.record(report)
+
+	return report, err
+}
+
+func (s *Service) repair(ctx context.Context, report *RepairReport) error {
+	p, err := s.partition(report.Partition, false)
+	if err != nil {
+		return err
+	}
+	segments, next := p.snapshot()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	remote, err := peerDigest(ctx, client, report.Peer, report.Partition, segments[0].baseOffset, next)
+	if err != nil {
+		return err
+	}
+	local, err := s.Digest(report.Partition, remote.FirstOffset, remote.EndOffset)
+	if err != nil {
+		return err
+	}
+
+	report.FirstOffset, report.EndOffset = local.FirstOffset, local.EndOffset
+	report.RangesCompared = len(local.Ranges)
+	if local.FirstOffset != remote.FirstOffset || local.EndOffset != remote.EndOffset || len(local.Ranges) != len(remote.Ranges) {
+		return fmt.Errorf("peer digested offsets %d to %d instead of %d to %d", remote.FirstOffset, remote.EndOffset, local.FirstOffset, local.EndOffset)
+	}
+	if remote.EndOffset < next {
+		report.Extra = &OffsetRange{First: remote.EndOffset, End: next}
+	}
+	if local.Root == remote.Root {
+		return nil
+	}
+
+	for i, r := range local.Ranges {
+		if r.Digest != remote.Ranges[i].Digest {
+			report.Divergent = append(report.Divergent, OffsetRange{First: r.FirstOffset, End: r.EndOffset})
+		}
+	}
+
+	// Divergent ranges are repaired a sealed segment at a time, so the
+	// active segment is sealed first when it holds one.
+	if err := p.sealBefore(report.Divergent[len(report.Divergent)-1].End); err != nil {
+		return fmt.Errorf("failed to seal the active segment: %w", err)
+	}
+
+	segments, _ = p.snapshot()
+	for i, seg := range segments[:len(segments)-1] {
+		end := segments[i+1].baseOffset
+
+		var overlapping []OffsetRange
+		for _, r := range report.Divergent {
+			if r.First < end && r.End > seg.baseOffset {
+				overlapping = append(overlapping, OffsetRange{First: max(r.First, seg.baseOffset), End: min(r.End, end)})
+			}
+		}
+		if len(overlapping) == 0 {
+			continue
+		}
+
+		lo, hi := overlapping[0].First, overlapping[len(overlapping)-1].End
+		records, err := p.rewriteSegment(ctx, client, report.Peer, seg, lo, hi)
+		if err != nil {
+			return fmt.Errorf("failed to repair %s: %w", filepath.Base(seg.path), err)
+		}
+		report.SegmentsRepaired = append(report.SegmentsRepaired, filepath.Base(seg.path))
+		report.RecordsRepaired += records
+	}
+
+	return nil
+}
+
+// sealBefore seals the active segment when it holds records before until.
+func (p *partition) sealBefore(until uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errPartitionClosed
+	}
+	if active := p.active(); active.size == 0 || active.baseOffset >= until {
+		return nil
+	}
+
+	return p.roll()
+}
+
+// rewriteSegment replaces the records of a sealed segment between lo and hi
+// with the records peer has there and returns how many it wrote. The
+// segment is written next to the old one and swapped in by swapSegment, a
+// compressed segment is stored uncompressed until it is compressed again.
+func (p *partition) rewriteSegment(ctx context.Context, client *http.Client, peer string, seg segment, lo uint64, hi uint64) (int, error) {
+	var before, after []LogEntry
+	_, err := scanSegment(seg, 0, func(log LogEntry) bool {
+		if log.Offset < lo {
+			before = append(before, log)
+		} else if log.Offset >= hi {
+			after = append(after, log)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	repaired, err := peerRecords(ctx, client, peer, p.id, lo, hi)
+	if err != nil {
+		return 0, err
+	}
+
+	tmpPath := seg.path + ".repair"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+
+	// The index is built along with the file rather than read back from it.
+	rewritten := segment{id: seg.id, path: seg.path}
+	var index []byte
+	for _, logs := range [][]LogEntry{before, repaired, after} {
+		for _, log := range logs {
+			record, err := encodeLog(log)
+			if err != nil {
+				f.Close()
+				return 0, err
+			}
+			if _, err := f.Write(record); err != nil {
+				f.Close()
+				return 0, err
+			}
+
+			if rewritten.needsIndexEntry(rewritten.size) {
+				entry := indexEntry{offset: log.Offset, position: rewritten.size}
+				rewritten.addIndexEntry(entry)
+				index = append(index, entry.marshal()...)
+			}
+			rewritten.size += int64(len(record))
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := p.swapSegment(rewritten, tmpPath); err != nil {
+		return 0, err
+	}
+
+	if err := os.WriteFile(indexPath(seg.path), index, 0644); err != nil {
+		return 0, err
+	}
+
+	return len(repaired), nil
+}
+
+// swapSegment renames the file at path over the sealed segment rewritten
+// replaces and takes over its size and index. Readers of earlier snapshots
+// are waited for, so none of them looks up the positions of the old file in
+// the new one. The old index is removed first, a crash before the new one
+// is written has it rebuilt on the next start.
+func (p *partition) swapSegment(rewritten segment, path string) error {
+	p.files.Lock()
+	defer p.files.Unlock()
+
+	if err := removeIfExists(indexPath(rewritten.path)); err != nil {
+		return err
+	}
+	if err := os.Rename(path, rewritten.path); err != nil {
+		return err
+	}
+	if err := syncDir(p.dir); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	for _, current := range p.segments {
+		if current.id == rewritten.id {
+			current.size = rewritten.size
+			current.compressed = false
+			current.compressedSize = 0
+			current.index = rewritten.index
+			current.lastIndexed = rewritten.lastIndexed
+		}
+	}
+	delete(p.newest, rewritten.id)
+	p.mu.Unlock()
+
+	// Left behind, the compressed copy would lose to the rewritten file on
+	// the next start anyway.
+	return removeIfExists(rewritten.path + compressedSuffix)
+}
+
+// peerDigest asks peer for the digest of partition between from and until.
+func peerDigest(ctx context.Context, client *http.Client, peer string, partition int, from uint64, until uint64) (PartitionDigest, error) {
+	query := url.Values{}
+	query.Set("partition", strconv.Itoa(partition))
+	query.Set("from_offset", strconv.FormatUint(from, 10))
+	query.Set("until_offset", strconv.FormatUint(until, 10))
+
+	var digest PartitionDigest
+	err := getJSON(ctx, client, peer+"/v1/digest?"+query.Encode(), &digest)
+
+	return digest, err
+}
+
+// peerRecords reads the records of partition between lo and hi from peer.
+func peerRecords(ctx context.Context, client *http.Client, peer string, partition int, lo uint64, hi uint64) ([]LogEntry, error) {
+	var logs []LogEntry
+	for from := lo; from < hi; {
+		query := url.Values{}
+		query.Set("partition", strconv.Itoa(partition))
+		query.Set("from_offset", strconv.FormatUint(from, 10))
+		query.Set("limit", strconv.Itoa(repairReadLimit))
+		query.Set("max_bytes", strconv.FormatInt(ReplicationFetchBytes, 10))
+
+		var page ReadResult
+		if err := getJSON(ctx, client, peer+"/v1/read?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+
+		for _, log := range page.Logs {
+			if log.Offset >= from && log.Offset < hi {
+				logs = append(logs, log)
+			}
+		}
+		if page.NextOffset <= from {
+			break
+		}
+		from = page.NextOffset
+	}
+
+	return logs, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer answered %s with status %d", req.URL.Path, response.StatusCode)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from peer: %w", err)
+	}
+
+	return nil
+}
+
+// RepairReports returns the latest repair report of every partition.
+func (s *Service) RepairReports() []RepairReport {
+	s.repairs.mu.Lock()
+	defer s.repairs.mu.Unlock()
+
+	reports := make([]RepairReport, 0, len(s.repairs.reports))
+	for _, report := range s.repairs.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Partition < reports[j].Partition
+	})
+
+	return reports
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupRepair digests ranges of rangeOffsets offsets for a single test
+func setupRepair(t *testing.T, rangeOffsets uint64) {
+	original := DigestRangeOffsets
+	DigestRangeOffsets = rangeOffsets
+
+	t.Cleanup(func() {
+		DigestRangeOffsets = original
+	})
+}
+
+// digest answers like the digest endpoint of a storage node
+func (l *memLeader) digest(w http.ResponseWriter, r *http.Request) {
+	from, _ := strconv.ParseUint(r.URL.Query().Get("from_offset"), 10, 64)
+	until, _ := strconv.ParseUint(r.URL.Query().Get("until_offset"), 10, 64)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := newDigester(0, from, min(until, uint64(len(l.logs))))
+	for _, log := range l.logs {
+		d.add(log)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.result())
+}
+
+// replicaOf copies every log of leader to partition 0 of a new service
+func replicaOf(t *testing.T, leader *memLeader) *Service {
+	t.Helper()
+
+	service := &Service{}
+	if _, err := service.Replicate(0, leader.logs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return service
+}
+
+func TestRepair_RewritesDivergentSegments(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 400, 0)
+	setupRepair(t, 4)
+
+	leader, server := newMemLeader(t)
+	leader.append(20)
+
+	service := replicaOf(t, leader)
+	defer service.Close()
+
+	// A bit flips in the first record of the first segment
+	first := filepath.Join(tmpDir, "partition-0", "segment-00001.log")
+	data, _ := os.ReadFile(first)
+	data[recordHeaderSize+4] ^= 0xff
+	os.WriteFile(first, data, 0644)
+
+	report, err := service.Repair(context.Background(), 0, server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !slices.Equal(report.Divergent, []OffsetRange{{First: 0, End: 4}}) {
+		t.Errorf("expected only the first range to diverge, got %+v", report.Divergent)
+	}
+	// The range spans the first two segments
+	if !slices.Equal(report.SegmentsRepaired, []string{"segment-00001.log", "segment-00002.log"}) || report.RecordsRepaired != 4 {
+		t.Errorf("expected the segments holding the range to be repaired, got %+v", report)
+	}
+
+	result, err := service.ReadFrom(0, 0, 100, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 20 || len(result.Corrupt) != 0 || result.Logs[0].Message != "message 0" {
+		t.Errorf("expected every record back without corruption, got %d logs and %v", len(result.Logs), result.Corrupt)
+	}
+
+	if reports := service.RepairReports(); len(reports) != 1 || reports[0].Peer != server.URL {
+		t.Errorf("expected the repair to be reported, got %+v", reports)
+	}
+}
+
+func TestRepair_SealsActiveSegmentToRepairIt(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupRepair(t, 4)
+
+	leader, server := newMemLeader(t)
+	leader.append(8)
+
+	service := replicaOf(t, leader)
+	defer service.Close()
+
+	leader.mu.Lock()
+	leader.logs[5].Message = "rewritten"
+	leader.mu.Unlock()
+
+	report, err := service.Repair(context.Background(), 0, server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(report.SegmentsRepaired, []string{"segment-00001.log"}) || report.RecordsRepaired != 4 {
+		t.Errorf("expected the sealed active segment to be repaired, got %+v", report)
+	}
+
+	// Replicated records go to the new active segment
+	leader.append(1)
+	if _, err := service.Replicate(0, leader.logs[8:]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, _ := service.ReadFrom(0, 0, 100, 0)
+	if len(result.Logs) != 9 || result.Logs[5].Message != "rewritten" || result.Logs[8].Message != "message 8" {
+		t.Errorf("expected the repaired records and the new one, got %+v", result.Logs)
+	}
+}
+
+func TestRepair_WaitsForReadersOfReplacedSegment(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 400, 0)
+	setupRepair(t, 4)
+
+	leader, server := newMemLeader(t)
+	leader.append(20)
+
+	service := replicaOf(t, leader)
+	defer service.Close()
+
+	// The repaired first record is longer, so every later record moves
+	leader.mu.Lock()
+	leader.logs[0].Message = "a much longer message 0"
+	leader.mu.Unlock()
+
+	p, _ := service.partition(0, false)
+	segments, next, release := p.readSnapshot()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := service.Repair(context.Background(), 0, server.URL)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected the repair to wait for the reader, it finished with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	result, err := readPage(segments, next, 1, 100, 0)
+	release()
+	if err != nil || len(result.Logs) != 19 || len(result.Corrupt) != 0 {
+		t.Errorf("expected the old segments to be read, got %d logs, %v and %v", len(result.Logs), result.Corrupt, err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(tmpDir, "partition-0", "segment-00001.log")); !strings.Contains(string(data), "a much longer") {
+		t.Errorf("expected the first segment to be rewritten")
+	}
+}
+
+func TestRepair_KeepsRecordsPastTheEndOfThePeer(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 400, 0)
+
+	leader, server := newMemLeader(t)
+	leader.append(20)
+
+	service := replicaOf(t, leader)
+	defer service.Close()
+
+	// The leader lost records this node has, after a failover for example
+	leader.mu.Lock()
+	leader.logs = leader.logs[:15]
+	leader.mu.Unlock()
+
+	report, err := service.Repair(context.Background(), 0, server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Extra == nil || *report.Extra != (OffsetRange{First: 15, End: 20}) || len(report.Divergent) != 0 {
+		t.Errorf("expected offsets 15 to 20 to be reported as extra, got %+v", report)
+	}
+
+	// Truncating them is out of scope, they are still read
+	result, _ := service.ReadFrom(0, 0, 100, 0)
+	if len(result.Logs) != 20 {
+		t.Errorf("expected the extra records to be kept, got %d logs", len(result.Logs))
+	}
+}
+
+func TestRepair_ConsistentReplica(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 400, 0)
+
+	leader, server := newMemLeader(t)
+	leader.append(20)
+
+	service := replicaOf(t, leader)
+	defer service.Close()
+
+	// The leader is ahead, the missing records are left to replication
+	leader.append(5)
+
+	report, err := service.Repair(context.Background(), 0, server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.EndOffset != 20 || len(report.Divergent) != 0 || len(report.SegmentsRepaired) != 0 {
+		t.Errorf("expected no divergence, got %+v", report)
+	}
+}
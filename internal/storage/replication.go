@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
+)
+
+// ReplicationFetchInterval is how long a follower waits before fetching
+// again once it failed to reach its leader.
+// This can be overridden for testing or configuration.
+var ReplicationFetchInterval = 500 * time.Millisecond
+
+// ReplicationFetchBytes caps every page a follower fetches from its leader.
+// This can be overridden for testing or configuration.
+var ReplicationFetchBytes int64 = 1024 * 1024
+
+// ReplicationFetchWait is how long a leader holds the fetch of a follower
+// that has caught up until new records arrive.
+// This can be overridden for testing or configuration.
+var ReplicationFetchWait = 500 * time.Millisecond
+
+// NodeID identifies this node to the leaders of the partitions it follows.
+// This can be overridden for testing or configuration.
+var NodeID = "localhost:8081"
+
+// replicationFetchLimit bounds the number of records of every fetched page.
+const replicationFetchLimit = 1000
+
+// ErrNotFollower is returned when promoting a partition this node does not
+// follow.
+var ErrNotFollower = apierror.New(http.StatusConflict, "partition is not followed by this node")
+
+// ReplicaStatus describes a partition this node follows. Lag is how many
+// offsets the follower was behind its leader after the last fetch.
+type ReplicaStatus struct {
+	Partition       int        `json:"partition"`
+	Leader          string     `json:"leader"`
+	NextOffset      uint64     `json:"next_offset"`
+	LeaderEndOffset uint64     `json:"leader_end_offset"`
+	Lag             uint64     `json:"lag"`
+	LastFetch       *time.Time `json:"last_fetch,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// follower pulls the records of a partition from its leader.
+type follower struct {
+	stop chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	status ReplicaStatus
+}
+
+func (f *follower) update(change func(status *ReplicaStatus)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	change(&f.status)
+}
+
+// Follow makes this node a follower of partition on leader. The partition is
+// fenced so it only receives records fetched from the leader, and is fetched
+// from the offset this node already has. Following the current leader again
+// has no effect.
+func (s *Service) Follow(partition int, leader string) error {
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	p, err := s.partition(partition, true)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	current, ok := s.followers[partition]
+	s.mu.Unlock()
+
+	if ok && current.leader() == leader {
+		return nil
+	}
+	if ok {
+		s.stopFollowing(partition)
+	}
+
+	if err := s.Fence(partition); err != nil {
+		return err
+	}
+
+	_, next := p.snapshot()
+	f := &follower{
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		status: ReplicaStatus{Partition: partition, Leader: leader, NextOffset: next},
+	}
+
+	s.mu.Lock()
+	if s.followers == nil {
+		s.followers = make(map[int]*follower)
+	}
+	s.followers[partition] = f
+	s.mu.Unlock()
+
+	stop := s.stopChan()
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.runFollower(f, stop)
+	}()
+
+	fmt.Println("[STORAGE/REPLICATION]", "partition=", partition, "following=", leader, "from_offset=", next)
+
+	return nil
+}
+
+// Promote stops following the leader of partition and lets the partition
+// accept writes, making this node its leader.
+func (s *Service) Promote(partition int) error {
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	if !s.stopFollowing(partition) {
+		return fmt.Errorf("partition %d: %w", partition, ErrNotFollower)
+	}
+
+	if err := s.Unfence(partition); err != nil {
+		return err
+	}
+
+	fmt.Println("[STORAGE/REPLICATION]", "partition=", partition, "promoted to leader")
+
+	return nil
+}
+
+// stopFollowing stops the follower of partition and waits for it to exit. It
+// reports whether the partition was followed.
+func (s *Service) stopFollowing(partition int) bool {
+	s.mu.Lock()
+	f, ok := s.followers[partition]
+	delete(s.followers, partition)
+	s.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	close(f.stop)
+	<-f.done
+
+	return true
+}
+
+// ReplicationStatus returns the partitions this node follows.
+func (s *Service) ReplicationStatus() []ReplicaStatus {
+	s.mu.Lock()
+	followers := make([]*follower, 0, len(s.followers))
+	for _, f := range s.followers {
+		followers = append(followers, f)
+	}
+	s.mu.Unlock()
+
+	statuses := []ReplicaStatus{}
+	for _, f := range followers {
+		f.mu.Lock()
+		statuses = append(statuses, f.status)
+		f.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Partition < statuses[j].Partition
+	})
+
+	return statuses
+}
+
+func (f *follower) leader() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.status.Leader
+}
+
+// runFollower fetches pages from the leader until it is stopped, waiting
+// ReplicationFetchInterval whenever the fetch failed.
+func (s *Service) runFollower(f *follower, stop chan struct{}) {
+	defer close(f.done)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	partition := f.status.Partition
+
+	for {
+		err := s.fetch(client, f)
+		if err != nil {
+			fmt.Println("[STORAGE/REPLICATION]", "partition=", partition, "error=", err)
+			f.update(func(status *ReplicaStatus) { status.Error = err.Error() })
+		}
+
+		// The leader held the fetch until it had new records or
+		// ReplicationFetchWait passed, so there is no need to wait here.
+		if err == nil {
+			select {
+			case <-f.stop:
+				return
+			case <-stop:
+				return
+			default:
+			}
+			continue
+		}
+
+		timer := time.NewTimer(ReplicationFetchInterval)
+		select {
+		case <-timer.C:
+		case <-f.stop:
+			timer.Stop()
+			return
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fetch copies the next page of the partition from the leader.
+func (s *Service) fetch(client *http.Client, f *follower) error {
+	f.mu.Lock()
+	partition, leader, next := f.status.Partition, f.status.Leader, f.status.NextOffset
+	f.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-f.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	query := url.Values{}
+	query.Set("partition", strconv.Itoa(partition))
+	query.Set("from_offset", strconv.FormatUint(next, 10))
+	query.Set("max_bytes", strconv.FormatInt(ReplicationFetchBytes, 10))
+	query.Set("replica", NodeID)
+	query.Set("max_wait", ReplicationFetchWait.String())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leader+"/v1/fetch?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader %s answered with status %d", leader, response.StatusCode)
+	}
+
+	var page ReadResult
+	if err := json.NewDecoder(response.Body).Decode(&page); err != nil {
+		return fmt.Errorf("invalid response from leader %s: %w", leader, err)
+	}
+
+	if len(page.Logs) > 0 {
+		if next, err = s.Replicate(partition, page.Logs); err != nil {
+			return err
+		}
+	} else if page.NextOffset > next {
+		// The page only held corrupt records the leader skipped.
+		next = page.NextOffset
+	}
+
+	now := time.Now()
+	f.update(func(status *ReplicaStatus) {
+		status.NextOffset = next
+		status.LeaderEndOffset = page.EndOffset
+		status.Lag = 0
+		if page.EndOffset > next {
+			status.Lag = page.EndOffset - next
+		}
+		status.LastFetch = &now
+		status.Error = ""
+	})
+
+	return nil
+}
+
+// Fetch returns the page of partition starting at from to the follower
+// replica and records that replica has every record below from, which
+// decides whether it is in sync. When replica has caught up, Fetch waits up
+// to wait for new records before returning an empty page.
+func (s *Service) Fetch(partition int, replica string, from uint64, maxBytes int64, wait time.Duration) (ReadResult, error) {
+	stop := s.stopChan()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		appended := s.replicas.appended.wait(partition)
+
+		result, err := s.ReadFrom(partition, from, replicationFetchLimit, maxBytes)
+		if errors.Is(err, ErrPartitionNotFound) {
+			// Nothing was written to the partition yet.
+			result, err = ReadResult{Logs: []LogEntry{}, NextOffset: from}, nil
+		}
+		if err != nil {
+			return ReadResult{}, err
+		}
+
+		s.replicas.fetched(partition, replica, from, result.EndOffset, time.Now())
+
+		if len(result.Logs) > 0 || result.NextOffset > from {
+			return result, nil
+		}
+
+		select {
+		case <-appended:
+		case <-timer.C:
+			return result, nil
+		case <-stop:
+			return result, nil
+		}
+	}
+}
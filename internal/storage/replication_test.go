@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupReplication(t *testing.T, interval time.Duration) {
+	originalInterval, originalWait := ReplicationFetchInterval, ReplicationFetchWait
+	ReplicationFetchInterval, ReplicationFetchWait = interval, interval
+
+	t.Cleanup(func() {
+		ReplicationFetchInterval, ReplicationFetchWait = originalInterval, originalWait
+	})
+}
+
+// memLeader is a leader serving the pages of a single partition from memory
+type memLeader struct {
+	mu   sync.Mutex
+	logs []LogEntry
+}
+
+func newMemLeader(t *testing.T) (*memLeader, *httptest.Server) {
+	leader := &memLeader{}
+
+	server := httptest.NewServer(http.HandlerFunc(leader.handle))
+	t.Cleanup(server.Close)
+
+	return leader, server
+}
+
+func (l *memLeader) append(count int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		offset := uint64(len(l.logs))
+		l.logs = append(l.logs, LogEntry{Offset: offset, Message: "message " + strconv.FormatUint(offset, 10)})
+	}
+}
+
+func (l *memLeader) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/digest" {
+		l.digest(w, r)
+		return
+	}
+
+	from, _ := strconv.ParseUint(r.URL.Query().Get("from_offset"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("max_wait"))
+
+	l.mu.Lock()
+	end := uint64(len(l.logs))
+	result := ReadResult{Logs: []LogEntry{}, NextOffset: from, EndOffset: end}
+	for _, log := range l.logs {
+		if log.Offset >= from && len(result.Logs) < replicationFetchLimit {
+			result.Logs = append(result.Logs, log)
+			result.NextOffset = log.Offset + 1
+		}
+	}
+	l.mu.Unlock()
+
+	// Fetches of followers that caught up are held like on a real leader
+	if len(result.Logs) == 0 {
+		time.Sleep(wait)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// waitForReplica waits until the follower of partition reports done.
+func waitForReplica(t *testing.T, service *Service, partition int, done func(status ReplicaStatus) bool) ReplicaStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		for _, status := range service.ReplicationStatus() {
+			if status.Partition == partition && done(status) {
+				return status
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower of partition %d did not get there: %+v", partition, service.ReplicationStatus())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollow_CatchesUpWithLeader(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupReplication(t, 5*time.Millisecond)
+
+	leader, server := newMemLeader(t)
+	leader.append(5)
+
+	service := &Service{}
+	defer service.Close()
+
+	if err := service.Follow(0, server.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	status := waitForReplica(t, service, 0, func(status ReplicaStatus) bool { return status.NextOffset == 5 })
+	if status.Lag != 0 || status.LeaderEndOffset != 5 || status.Leader != server.URL || status.LastFetch == nil {
+		t.Errorf("unexpected replica status: %+v", status)
+	}
+
+	// Records written to the leader later are fetched as well
+	leader.append(3)
+	waitForReplica(t, service, 0, func(status ReplicaStatus) bool { return status.NextOffset == 8 })
+
+	result, err := service.ReadFrom(0, 0, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 8 {
+		t.Fatalf("expected 8 logs on the follower, got %d", len(result.Logs))
+	}
+	for i, log := range result.Logs {
+		if log.Offset != uint64(i) || log.Message != "message "+strconv.Itoa(i) {
+			t.Errorf("log %d was not replicated as is: %+v", i, log)
+		}
+	}
+
+	// Only the leader accepts writes
+	if _, err := service.Store(0, []LogEntry{{Message: "follower"}}); !errors.Is(err, ErrPartitionFenced) {
+		t.Errorf("expected ErrPartitionFenced on the follower, got %v", err)
+	}
+}
+
+func TestFollow_ReportsLeaderErrors(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupReplication(t, 5*time.Millisecond)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	service := &Service{}
+	defer service.Close()
+
+	if err := service.Follow(0, server.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	status := waitForReplica(t, service, 0, func(status ReplicaStatus) bool { return status.Error != "" })
+	if status.LastFetch != nil {
+		t.Errorf("expected no successful fetch, got %+v", status)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupReplication(t, 5*time.Millisecond)
+
+	leader, server := newMemLeader(t)
+	leader.append(3)
+
+	service := &Service{}
+	defer service.Close()
+
+	if err := service.Promote(0); !errors.Is(err, ErrNotFollower) {
+		t.Fatalf("expected ErrNotFollower, got %v", err)
+	}
+
+	if err := service.Follow(0, server.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForReplica(t, service, 0, func(status ReplicaStatus) bool { return status.NextOffset == 3 })
+
+	if err := service.Promote(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if statuses := service.ReplicationStatus(); len(statuses) != 0 {
+		t.Errorf("expected no followed partitions, got %+v", statuses)
+	}
+
+	// The promoted partition continues after the replicated records and
+	// no longer fetches from the old leader
+	result, err := service.Store(0, []LogEntry{{Message: "new leader"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 3 {
+		t.Errorf("expected offset 3, got %d", result.BaseOffset)
+	}
+
+	leader.append(2)
+	time.Sleep(20 * time.Millisecond)
+
+	logs, err := service.Read(0, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) != 4 || logs[3].Message != "new leader" {
+		t.Errorf("unexpected logs after promotion: %+v", logs)
+	}
+}
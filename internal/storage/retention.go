@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RetentionMaxAge is how long records are kept. The age of a record is taken
+// from its received_at, or its timestamp when it was never enriched by an
+// ingest node. Zero keeps records regardless of their age.
+// This can be overridden for testing or configuration.
+var RetentionMaxAge time.Duration
+
+// RetentionMaxBytes caps the size of every partition on disk. Zero disables
+// size based retention.
+// This can be overridden for testing or configuration.
+var RetentionMaxBytes int64
+
+// RetentionCheckInterval is how often the retention policy is enforced.
+// This can be overridden for testing or configuration.
+var RetentionCheckInterval = time.Minute
+
+// maxRetentionHistory bounds how many deleted segments are remembered for
+// /v1/retention.
+const maxRetentionHistory = 100
+
+// DeletedSegment is a sealed segment removed by retention.
+type DeletedSegment struct {
+	Partition  int       `json:"partition"`
+	Segment    string    `json:"segment"`
+	BaseOffset uint64    `json:"base_offset"`
+	Bytes      int64     `json:"bytes"`
+	Reason     string    `json:"reason"`
+	DeletedAt  time.Time `json:"deleted_at"`
+}
+
+// PartitionRetention is what retention reclaimed from a partition since the
+// storage node started.
+type PartitionRetention struct {
+	Partition       int    `json:"partition"`
+	FirstOffset     uint64 `json:"first_offset"` // oldest offset still stored
+	SegmentsDeleted int    `json:"segments_deleted"`
+	BytesReclaimed  int64  `json:"bytes_reclaimed"`
+}
+
+// RetentionStats describes the retention policy of the node and what it has
+// reclaimed so far.
+type RetentionStats struct {
+	MaxAge          string               `json:"max_age"`
+	MaxBytes        int64                `json:"max_bytes"`
+	LastRun         *time.Time           `json:"last_run,omitempty"`
+	SegmentsDeleted int                  `json:"segments_deleted"`
+	BytesReclaimed  int64                `json:"bytes_reclaimed"`
+	Partitions      []PartitionRetention `json:"partitions"`
+	Recent          []DeletedSegment     `json:"recent"`
+}
+
+// retentionLog records the segments deleted by retention.
+type retentionLog struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	totals  map[int]*PartitionRetention
+	recent  []DeletedSegment
+}
+
+func (l *retentionLog) record(now time.Time, deleted []DeletedSegment) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastRun = now
+	if l.totals == nil {
+		l.totals = make(map[int]*PartitionRetention)
+	}
+
+	for _, d := range deleted {
+		totals, ok := l.totals[d.Partition]
+		if !ok {
+			totals = &PartitionRetention{Partition: d.Partition}
+			l.totals[d.Partition] = totals
+		}
+		totals.SegmentsDeleted++
+		totals.BytesReclaimed += d.Bytes
+	}
+
+	l.recent = append(l.recent, deleted...)
+	if len(l.recent) > maxRetentionHistory {
+		l.recent = append([]DeletedSegment(nil), l.recent[len(l.recent)-maxRetentionHistory:]...)
+	}
+}
+
+// StartRetention enforces the retention policy every RetentionCheckInterval
+// until the service is closed. Nothing is started when no policy is
+// configured.
+func (s *Service) StartRetention() {
+	if RetentionMaxAge <= 0 && RetentionMaxBytes <= 0 {
+		return
+	}
+
+	stop := s.stopChan()
+	s.background.Add(1)
+
+	go func() {
+		defer s.background.Done()
+
+		ticker := time.NewTicker(RetentionCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.EnforceRetention(time.Now()); err != nil {
+					fmt.Println("[STORAGE/RETENTION]", "error=", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// EnforceRetention deletes the sealed segments of every partition that fall
+// outside the retention policy at now and returns them. Active segments are
+// never deleted.
+func (s *Service) EnforceRetention(now time.Time) ([]DeletedSegment, error) {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	var deleted []DeletedSegment
+	var errs []error
+	for _, p := range s.openPartitions() {
+		d, err := p.enforceRetention(now)
+		deleted = append(deleted, d...)
+		errs = append(errs, err)
+	}
+
+	s.retention.record(now, deleted)
+
+	for _, d := range deleted {
+		fmt.Println(
+			"[STORAGE/RETENTION]",
+			"partition=", d.Partition,
+			"deleted=", d.Segment,
+			"bytes=", d.Bytes,
+			"reason=", d.Reason,
+		)
+	}
+
+	return deleted, errors.Join(errs...)
+}
+
+// RetentionStats returns the retention policy and what it has reclaimed.
+func (s *Service) RetentionStats() RetentionStats {
+	stats := RetentionStats{
+		MaxAge:     RetentionMaxAge.String(),
+		MaxBytes:   RetentionMaxBytes,
+		Partitions: []PartitionRetention{},
+		Recent:     []DeletedSegment{},
+	}
+
+	partitions := s.openPartitions()
+
+	s.retention.mu.Lock()
+	defer s.retention.mu.Unlock()
+
+	if !s.retention.lastRun.IsZero() {
+		lastRun := s.retention.lastRun
+		stats.LastRun = &lastRun
+	}
+	stats.Recent = append(stats.Recent, s.retention.recent...)
+
+	for _, p := range partitions {
+		partitionStats := PartitionRetention{Partition: p.id}
+		if totals, ok := s.retention.totals[p.id]; ok {
+			partitionStats = *totals
+		}
+
+		segments, _ := p.snapshot()
+		partitionStats.FirstOffset = segments[0].baseOffset
+
+		stats.SegmentsDeleted += partitionStats.SegmentsDeleted
+		stats.BytesReclaimed += partitionStats.BytesReclaimed
+		stats.Partitions = append(stats.Partitions, partitionStats)
+	}
+
+	return stats
+}
+
+// enforceRetention deletes the oldest sealed segments of the partition while
+// it is larger than RetentionMaxBytes or their newest record is older than
+// RetentionMaxAge. Segments are only deleted oldest first so a partition
+// never has gaps.
+func (p *partition) enforceRetention(now time.Time) ([]DeletedSegment, error) {
+	segments, _ := p.snapshot()
+
+	var size int64
+	for _, seg := range segments {
+		size += seg.diskSize()
+	}
+
+	sealed := segments[:len(segments)-1]
+
+	// The next offset is recovered from the newest record on disk, so the
+	// last sealed segment stays while the active one is still empty.
+	if len(sealed) > 0 && segments[len(segments)-1].size == 0 {
+		sealed = sealed[:len(sealed)-1]
+	}
+
+	var expired []DeletedSegment
+	for _, seg := range sealed {
+		reason := ""
+
+		if RetentionMaxBytes > 0 && size > RetentionMaxBytes {
+			reason = "size"
+		} else if RetentionMaxAge > 0 {
+			newest, err := p.newestRecord(seg)
+			if err != nil {
+				return nil, err
+			}
+			if newest.Before(now.Add(-RetentionMaxAge)) {
+				reason = "age"
+			}
+		}
+
+		if reason == "" {
+			break
+		}
+
+		size -= seg.diskSize()
+		expired = append(expired, DeletedSegment{
+			Partition:  p.id,
+			Segment:    filepath.Base(seg.filePath()),
+			BaseOffset: seg.baseOffset,
+			Bytes:      seg.diskSize(),
+			Reason:     reason,
+			DeletedAt:  now,
+		})
+	}
+
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	return p.deleteOldest(sealed[:len(expired)], expired)
+}
+
+// deleteOldest drops segments from the front of the partition and removes
+// their files. Segments that are no longer the oldest of the partition are
+// left alone.
+func (p *partition) deleteOldest(segments []segment, expired []DeletedSegment) ([]DeletedSegment, error) {
+	p.mu.Lock()
+	n := 0
+	for n < len(segments) && n < len(p.segments)-1 && p.segments[n].id == segments[n].id {
+		delete(p.newest, segments[n].id)
+		n++
+	}
+	p.segments = append([]*segment(nil), p.segments[n:]...)
+	p.mu.Unlock()
+
+	var errs []error
+	for _, seg := range segments[:n] {
+		errs = append(errs,
+			removeIfExists(seg.path),
+			removeIfExists(seg.path+compressedSuffix),
+			removeIfExists(indexPath(seg.path)),
+		)
+	}
+	errs = append(errs, syncDir(p.dir))
+
+	return expired[:n], errors.Join(errs...)
+}
+
+// newestRecord returns the time of the newest record of a sealed segment.
+// Sealed segments never change, so the result is cached.
+func (p *partition) newestRecord(seg segment) (time.Time, error) {
+	p.mu.Lock()
+	newest, ok := p.newest[seg.id]
+	p.mu.Unlock()
+	if ok {
+		return newest, nil
+	}
+
+	records, closer, err := seg.records(0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer closer.Close()
+
+	var newestMillis int64
+	for {
+		log, _, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := asCorruptRecord(err); ok {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if millis := recordTime(log); millis > newestMillis {
+			newestMillis = millis
+		}
+	}
+
+	if newestMillis > 0 {
+		newest = time.UnixMilli(newestMillis)
+	} else {
+		// Without any timestamps the last write to the segment is the best
+		// estimate of its age.
+		info, err := os.Stat(seg.filePath())
+		if err != nil {
+			return time.Time{}, err
+		}
+		newest = info.ModTime()
+	}
+
+	p.mu.Lock()
+	if p.newest == nil {
+		p.newest = make(map[int]time.Time)
+	}
+	p.newest[seg.id] = newest
+	p.mu.Unlock()
+
+	return newest, nil
+}
+
+// recordTime returns the age reference of a record in milliseconds since the
+// epoch.
+func recordTime(log LogEntry) int64 {
+	if log.ReceivedAt > 0 {
+		return log.ReceivedAt
+	}
+
+	return int64(log.Timestamp)
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
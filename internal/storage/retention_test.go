@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupRetention overrides the retention policy for a single test
+func setupRetention(t *testing.T, maxAge time.Duration, maxBytes int64) {
+	originalMaxAge, originalMaxBytes := RetentionMaxAge, RetentionMaxBytes
+	RetentionMaxAge, RetentionMaxBytes = maxAge, maxBytes
+
+	t.Cleanup(func() {
+		RetentionMaxAge, RetentionMaxBytes = originalMaxAge, originalMaxBytes
+	})
+}
+
+// storeReceivedAt stores count logs, each in its own segment, received at the
+// given time.
+func storeReceivedAt(t *testing.T, service *Service, count int, receivedAt time.Time) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		log := LogEntry{Service: "test-service", Message: "retained", ReceivedAt: receivedAt.UnixMilli()}
+		if _, err := service.Store(0, []LogEntry{log}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestRetention_DeletesSegmentsOlderThanMaxAge(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 10, 0)
+	setupRetention(t, time.Hour, 0)
+
+	service := &Service{}
+	defer service.Close()
+
+	now := time.Now()
+	storeReceivedAt(t, service, 3, now.Add(-2*time.Hour))
+	storeReceivedAt(t, service, 2, now)
+
+	deleted, err := service.EnforceRetention(now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deleted) != 3 {
+		t.Fatalf("expected the 3 expired segments to be deleted, got %+v", deleted)
+	}
+	for _, d := range deleted {
+		if d.Reason != "age" {
+			t.Errorf("expected age as the reason, got %q", d.Reason)
+		}
+	}
+
+	files := segmentFiles(t, filepath.Join(tmpDir, "partition-0"))
+	if len(files) != 2 || files[0] != "segment-00004.log" {
+		t.Fatalf("expected the 2 recent segments to remain, got %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "partition-0", "segment-00001.index")); !os.IsNotExist(err) {
+		t.Error("expected the index of a deleted segment to be removed")
+	}
+
+	read, err := service.ReadFrom(0, 0, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(read.Logs) != 2 || read.Logs[0].Offset != 3 {
+		t.Errorf("expected reads to start at offset 3, got %+v", read.Logs)
+	}
+}
+
+func TestRetention_DeletesOldestSegmentsOverMaxBytes(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 10, 0)
+
+	service := &Service{}
+	defer service.Close()
+
+	storeMessages(t, service, 0, 6)
+
+	p, _ := service.partition(0, false)
+	segments, _ := p.snapshot()
+	segmentSize := segments[0].size
+
+	setupRetention(t, 0, 3*segmentSize)
+
+	deleted, err := service.EnforceRetention(time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deleted) != 3 || deleted[0].BaseOffset != 0 || deleted[0].Reason != "size" {
+		t.Fatalf("expected the 3 oldest segments to be deleted for size, got %+v", deleted)
+	}
+
+	logs, _ := service.Read(0, 10)
+	if len(logs) != 3 || logs[0].Offset != 3 {
+		t.Errorf("expected offsets 3 to 5 to remain, got %+v", logs)
+	}
+}
+
+func TestRetention_KeepsActiveSegment(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupRetention(t, time.Hour, 1)
+
+	service := &Service{}
+	defer service.Close()
+
+	storeReceivedAt(t, service, 3, time.Now().Add(-2*time.Hour))
+
+	deleted, err := service.EnforceRetention(time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("expected the active segment to be kept, got %+v", deleted)
+	}
+
+	logs, _ := service.Read(0, 10)
+	if len(logs) != 3 {
+		t.Errorf("expected 3 logs, got %d", len(logs))
+	}
+}
+
+func TestRetention_KeepsOffsetsAcrossRestart(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 10, 0)
+	setupRetention(t, time.Hour, 0)
+
+	service := &Service{}
+	storeReceivedAt(t, service, 3, time.Now().Add(-2*time.Hour))
+
+	// Seal the last segment so only an empty active segment would remain
+	p, _ := service.partition(0, false)
+	p.mu.Lock()
+	p.roll()
+	p.mu.Unlock()
+
+	if _, err := service.EnforceRetention(time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service.Close()
+
+	restarted := &Service{}
+	defer restarted.Close()
+
+	result, err := restarted.Store(0, []LogEntry{{Message: "after retention"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 3 {
+		t.Errorf("expected offset 3 after restart, got %d", result.BaseOffset)
+	}
+}
+
+func TestRetentionStats(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 10, 0)
+	setupRetention(t, time.Hour, 0)
+
+	service := &Service{}
+	defer service.Close()
+
+	storeReceivedAt(t, service, 2, time.Now().Add(-2*time.Hour))
+	storeReceivedAt(t, service, 1, time.Now())
+	service.EnforceRetention(time.Now())
+
+	stats := service.RetentionStats()
+	if stats.LastRun == nil || stats.SegmentsDeleted != 2 || len(stats.Recent) != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(stats.Partitions) != 1 || stats.Partitions[0].FirstOffset != 2 {
+		t.Errorf("expected partition 0 to start at offset 2, got %+v", stats.Partitions)
+	}
+	if stats.BytesReclaimed != stats.Recent[0].Bytes+stats.Recent[1].Bytes {
+		t.Errorf("expected reclaimed bytes to add up, got %+v", stats)
+	}
+}
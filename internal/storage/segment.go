@@ -0,0 +1,464 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSegmentBytes is the size after which the active segment of a partition
+// is sealed and a new one is started.
+// This can be overridden for testing or configuration.
+var MaxSegmentBytes int64 = 16 * 1024 * 1024
+
+// MaxSegmentAge is how long a segment may stay active before it is sealed,
+// regardless of its size. Zero disables time based rotation.
+// This can be overridden for testing or configuration.
+var MaxSegmentAge = 24 * time.Hour
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+)
+
+// segment is a single file of a partition. Only the last segment of a
+// partition is active and receives appends, all others are sealed.
+type segment struct {
+	id         int
+	path       string
+	size       int64
+	createdAt  time.Time
+	baseOffset uint64 // offset of the first record in the segment
+
+	// Sealed segments may be stored gzipped as segment-NNNNN.log.gz, size is
+	// always the uncompressed size.
+	compressed     bool
+	compressedSize int64
+
+	index       []indexEntry
+	lastIndexed int64 // position of the last indexed record
+}
+
+// partition is the set of segments stored under partition-N/.
+type partition struct {
+	mu         sync.Mutex
+	id         int
+	dir        string
+	segments   []*segment // oldest first, the last one is active
+	nextOffset uint64     // offset assigned to the next appended record
+
+	dirty  map[string]struct{} // segments written since the last group fsync
+	syncer *groupSyncer
+
+	newest map[int]time.Time // newest record of sealed segments, by segment id
+
+	// Held shared while the files of a snapshot are read and exclusively
+	// while repair replaces the file of a sealed segment, so readers never
+	// look up the positions of the old file in the new one.
+	files sync.RWMutex
+
+	// The writer goroutine owns the handles of the active segment.
+	file       *os.File
+	indexFile  *os.File
+	appends    chan appendRequest
+	closing    chan struct{}
+	writerDone chan struct{}
+	closed     bool
+
+	// Set when the records of a failed write could not be removed, which
+	// fails every later write.
+	failed error
+}
+
+func partitionDir(partition int) string {
+	return filepath.Join(BaseLogDir, fmt.Sprintf("partition-%d", partition))
+}
+
+// legacyPartitionLogFilePath is where partitions were stored before they were
+// split into segments.
+func legacyPartitionLogFilePath(partition int) string {
+	return filepath.Join(BaseLogDir, fmt.Sprintf("partition-%d.log", partition))
+}
+
+func segmentFileName(id int) string {
+	return fmt.Sprintf("%s%05d%s", segmentPrefix, id, segmentSuffix)
+}
+
+func parseSegmentFileName(name string) (int, bool) {
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+
+	var id int
+	_, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), "%d", &id)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// partitionExists reports whether anything has ever been written to the
+// partition, either as segments or as a legacy single file.
+func partitionExists(id int) bool {
+	if _, err := os.Stat(partitionDir(id)); err == nil {
+		return true
+	}
+	if _, err := os.Stat(legacyPartitionLogFilePath(id)); err == nil {
+		return true
+	}
+
+	return false
+}
+
+// openPartition loads the segments of a partition from disk, creating the
+// partition directory and its first segment when needed.
+func openPartition(id int) (*partition, error) {
+	p := &partition{id: id, dir: partitionDir(id)}
+
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := p.adoptLegacyFile(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		seg, err := p.loadSegment(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seg != nil {
+			p.segments = append(p.segments, seg)
+		}
+	}
+
+	sort.Slice(p.segments, func(i, j int) bool {
+		return p.segments[i].id < p.segments[j].id
+	})
+
+	for _, seg := range p.segments {
+		if err := seg.convertUnframed(); err != nil {
+			return nil, err
+		}
+		if err := seg.loadIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.segments) > 0 {
+		if err := p.active().recoverTail(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.segments) == 0 {
+		if _, err := p.newSegment(1); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.loadOffsets(); err != nil {
+		return nil, err
+	}
+
+	p.startWriter()
+
+	return p, nil
+}
+
+// loadSegment describes the segment stored in entry, or returns nil when
+// entry is not a segment.
+func (p *partition) loadSegment(entry os.DirEntry) (*segment, error) {
+	name := entry.Name()
+	if entry.IsDir() {
+		return nil, nil
+	}
+
+	// Left behind by a compression that did not finish.
+	if strings.HasSuffix(name, compressedSuffix+".tmp") {
+		return nil, os.Remove(filepath.Join(p.dir, name))
+	}
+
+	compressed := strings.HasSuffix(name, compressedSuffix)
+	segmentID, ok := parseSegmentFileName(strings.TrimSuffix(name, compressedSuffix))
+	if !ok {
+		return nil, nil
+	}
+
+	seg := &segment{id: segmentID, path: filepath.Join(p.dir, segmentFileName(segmentID))}
+
+	if compressed {
+		// A crash after compressing but before removing the original leaves
+		// both files. The original is complete and wins.
+		if _, err := os.Stat(seg.path); err == nil {
+			return nil, os.Remove(seg.path + compressedSuffix)
+		}
+		seg.compressed = true
+	}
+
+	info, err := entry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	// The real creation time is not portable, the last modification is the
+	// closest we get for segments written by a previous run.
+	seg.createdAt = info.ModTime()
+	seg.size = info.Size()
+
+	if compressed {
+		seg.compressedSize = info.Size()
+		if seg.size, err = compressedRawSize(seg.filePath()); err != nil {
+			return nil, err
+		}
+	}
+
+	return seg, nil
+}
+
+// loadOffsets recovers the base offset of every segment from its index and
+// the next offset of the partition from the tail of the last segment.
+func (p *partition) loadOffsets() error {
+	var next uint64
+	for _, seg := range p.segments {
+		seg.baseOffset = next
+		if len(seg.index) == 0 {
+			continue
+		}
+
+		seg.baseOffset = seg.index[0].offset
+
+		last, err := seg.lastOffset()
+		if err != nil {
+			return err
+		}
+		next = last + 1
+	}
+
+	p.nextOffset = next
+
+	return nil
+}
+
+// lastOffset scans the segment from its last index entry to find the offset
+// of its last record.
+func (seg *segment) lastOffset() (uint64, error) {
+	records, closer, err := seg.records(seg.index[len(seg.index)-1].position)
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+
+	last := seg.index[len(seg.index)-1].offset
+	for {
+		log, _, err := records.next()
+		if err == io.EOF {
+			return last, nil
+		}
+		if _, ok := asCorruptRecord(err); ok {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		last = log.Offset
+	}
+}
+
+// adoptLegacyFile turns a single file partition-N.log into the first segment
+// of the partition. Legacy records carry no offsets, so they are rewritten
+// with offsets assigned in file order.
+//
+// The legacy file is moved aside to partition-N.log.adopting before the
+// segment is renamed into place and removed after, so a crash at any point
+// either redoes the conversion or finishes it on the next start.
+func (p *partition) adoptLegacyFile() error {
+	legacyPath := legacyPartitionLogFilePath(p.id)
+	adoptingPath := legacyPath + ".adopting"
+	firstSegmentPath := filepath.Join(p.dir, segmentFileName(1))
+
+	if _, err := os.Stat(adoptingPath); err == nil {
+		if _, err := os.Stat(firstSegmentPath); err == nil {
+			return os.Remove(adoptingPath)
+		}
+		if err := os.Rename(adoptingPath, legacyPath); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(legacyPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := os.Stat(firstSegmentPath); err == nil {
+		return fmt.Errorf("partition %d has both %s and %s", p.id, legacyPath, firstSegmentPath)
+	}
+
+	fmt.Println("[STORAGE/SEGMENT]", "partition=", p.id, "adopting", legacyPath)
+
+	legacy, err := os.Open(legacyPath)
+	if err != nil {
+		return err
+	}
+	defer legacy.Close()
+
+	var offset uint64
+	tmpPath := firstSegmentPath + ".tmp"
+	_, rejected, err := writeFramed(legacy, tmpPath, func(log *LogEntry) {
+		log.Offset = offset
+		offset++
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeRejected(firstSegmentPath+rejectedSuffix, rejected); err != nil {
+		return err
+	}
+
+	if err := os.Rename(legacyPath, adoptingPath); err != nil {
+		return err
+	}
+	if err := syncDir(BaseLogDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, firstSegmentPath); err != nil {
+		return err
+	}
+	if err := syncDir(p.dir); err != nil {
+		return err
+	}
+
+	return os.Remove(adoptingPath)
+}
+
+func (p *partition) newSegment(id int) (*segment, error) {
+	path := filepath.Join(p.dir, segmentFileName(id))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Close()
+	if err == nil {
+		err = os.WriteFile(indexPath(path), nil, 0644)
+	}
+	if err == nil {
+		err = syncDir(p.dir)
+	}
+	if err != nil {
+		// The next roll creates the segment again
+		os.Remove(path)
+		os.Remove(indexPath(path))
+		return nil, err
+	}
+
+	seg := &segment{id: id, path: path, createdAt: time.Now(), baseOffset: p.nextOffset}
+	p.segments = append(p.segments, seg)
+
+	return seg, nil
+}
+
+func (p *partition) active() *segment {
+	return p.segments[len(p.segments)-1]
+}
+
+// shouldRoll reports whether the active segment has to be sealed before
+// another n bytes are appended to it. Empty segments are never rolled so a
+// single oversized record still gets written.
+func (p *partition) shouldRoll(n int64) bool {
+	active := p.active()
+	if active.size == 0 {
+		return false
+	}
+	if MaxSegmentBytes > 0 && active.size+n > MaxSegmentBytes {
+		return true
+	}
+	if MaxSegmentAge > 0 && time.Since(active.createdAt) >= MaxSegmentAge {
+		return true
+	}
+
+	return false
+}
+
+// snapshot returns a copy of the segment list that is safe to read without
+// holding the partition lock, together with the next offset of the
+// partition. Sizes are frozen so readers never see a record that is still
+// being written.
+func (p *partition) snapshot() ([]segment, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	segments := make([]segment, len(p.segments))
+	for i, seg := range p.segments {
+		segments[i] = *seg
+	}
+
+	return segments, p.nextOffset
+}
+
+// readSnapshot is snapshot for readers of the segment files. The files of
+// the snapshot are not replaced until release is called.
+func (p *partition) readSnapshot() (segments []segment, next uint64, release func()) {
+	p.files.RLock()
+	segments, next = p.snapshot()
+
+	return segments, next, p.files.RUnlock
+}
+
+// records returns a reader over the records of the segment starting at
+// position. The returned closer releases the underlying file.
+func (seg segment) records(position int64) (*recordReader, io.Closer, error) {
+	r, err := seg.openAt(position)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := newRecordReader(r, position)
+	records.segment = seg.path
+
+	return records, r, nil
+}
+
+// open returns a reader over the part of the segment that existed when the
+// snapshot was taken.
+func (seg segment) open() (io.ReadCloser, error) {
+	return seg.openAt(0)
+}
+
+// openAt is like open but starts reading at position.
+func (seg segment) openAt(position int64) (io.ReadCloser, error) {
+	if seg.compressed {
+		return seg.openCompressedAt(position)
+	}
+
+	f, err := os.Open(seg.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Compressed after the snapshot was taken.
+		return seg.openCompressedAt(position)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(position, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, seg.size-position), f}, nil
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupSegmentLimits overrides the rotation settings for a single test
+func setupSegmentLimits(t *testing.T, maxBytes int64, maxAge time.Duration) {
+	originalMaxBytes, originalMaxAge := MaxSegmentBytes, MaxSegmentAge
+	MaxSegmentBytes, MaxSegmentAge = maxBytes, maxAge
+
+	t.Cleanup(func() {
+		MaxSegmentBytes, MaxSegmentAge = originalMaxBytes, originalMaxAge
+	})
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read partition dir: %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if _, ok := parseSegmentFileName(entry.Name()); ok {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
+
+func TestStore_RollsSegmentsBySize(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 200, 0)
+
+	service := &Service{}
+
+	for i := 0; i < 10; i++ {
+		_, err := service.Store(0, []LogEntry{{Service: "test-service", Message: "rotating message"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	files := segmentFiles(t, filepath.Join(tmpDir, "partition-0"))
+	if len(files) < 2 {
+		t.Fatalf("expected the partition to be split into segments, got %v", files)
+	}
+	if files[0] != "segment-00001.log" || files[1] != "segment-00002.log" {
+		t.Errorf("unexpected segment names %v", files)
+	}
+
+	for _, name := range files {
+		info, _ := os.Stat(filepath.Join(tmpDir, "partition-0", name))
+		if info.Size() > 200 {
+			t.Errorf("segment %s is %d bytes, larger than the limit", name, info.Size())
+		}
+	}
+
+	logs, err := service.Read(0, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) != 10 {
+		t.Errorf("expected 10 logs across segments, got %d", len(logs))
+	}
+}
+
+func TestStore_RollsSegmentsByAge(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 0, time.Hour)
+
+	service := &Service{}
+
+	if _, err := service.Store(0, []LogEntry{{Message: "first"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p, _ := service.partition(0, false)
+	p.active().createdAt = time.Now().Add(-2 * time.Hour)
+
+	if _, err := service.Store(0, []LogEntry{{Message: "second"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files := segmentFiles(t, filepath.Join(tmpDir, "partition-0"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 segments after the active one aged out, got %v", files)
+	}
+}
+
+func TestStore_OversizedRecordIsWritten(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 10, 0)
+
+	service := &Service{}
+
+	_, err := service.Store(0, []LogEntry{{Message: "a message much longer than ten bytes"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logs, _ := service.Read(0, 10)
+	if len(logs) != 1 {
+		t.Errorf("expected the oversized log to be stored, got %d logs", len(logs))
+	}
+}
+
+func TestOpen_AdoptsLegacyPartitionFile(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	f, _ := os.Create(filepath.Join(tmpDir, "partition-2.log"))
+	encoder := json.NewEncoder(f)
+	encoder.Encode(LogEntry{Message: "legacy 1"})
+	encoder.Encode(LogEntry{Message: "legacy 2"})
+	f.Close()
+
+	service := &Service{}
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "partition-2.log")); !os.IsNotExist(err) {
+		t.Error("expected the legacy file to be moved")
+	}
+
+	files := segmentFiles(t, filepath.Join(tmpDir, "partition-2"))
+	if len(files) != 1 || files[0] != "segment-00001.log" {
+		t.Fatalf("expected legacy file to become segment-00001.log, got %v", files)
+	}
+
+	if _, err := service.Store(2, []LogEntry{{Message: "new"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logs, _ := service.Read(2, 10)
+	if len(logs) != 3 || logs[0].Message != "legacy 1" || logs[2].Message != "new" {
+		t.Errorf("unexpected logs after adopting legacy file: %+v", logs)
+	}
+	for i, log := range logs {
+		if log.Offset != uint64(i) {
+			t.Errorf("expected adopted log %d to have offset %d, got %d", i, i, log.Offset)
+		}
+	}
+}
+
+func TestOpen_FinishesInterruptedAdoption(t *testing.T) {
+	tmpDir, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	legacyPath := filepath.Join(tmpDir, "partition-2.log")
+	os.WriteFile(legacyPath, []byte(`{"message":"legacy 1"}`+"\n"+"not json\n"+`{"message":"legacy 2"}`+"\n"), 0644)
+
+	// Crash after the legacy file was moved aside, before the segment was
+	// renamed into place.
+	os.MkdirAll(filepath.Join(tmpDir, "partition-2"), 0755)
+	os.Rename(legacyPath, legacyPath+".adopting")
+
+	service := &Service{}
+	if err := service.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logs, _ := service.Read(2, 10)
+	if len(logs) != 2 || logs[1].Message != "legacy 2" || logs[1].Offset != 1 {
+		t.Errorf("unexpected logs after adopting legacy file: %+v", logs)
+	}
+	rejected, _ := os.ReadFile(filepath.Join(tmpDir, "partition-2", "segment-00001.log.rejected"))
+	if string(rejected) != "not json\n" {
+		t.Errorf("expected the line that does not parse to be kept, got %q", rejected)
+	}
+
+	// Crash after the segment was renamed into place, before the legacy file
+	// was removed.
+	os.WriteFile(legacyPath+".adopting", []byte(`{"message":"legacy 1"}`+"\n"), 0644)
+
+	restarted := &Service{}
+	if err := restarted.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(legacyPath + ".adopting"); !os.IsNotExist(err) {
+		t.Error("expected the adopted legacy file to be removed")
+	}
+	if logs, _ := restarted.Read(2, 10); len(logs) != 2 {
+		t.Errorf("expected the adopted logs to be kept, got %+v", logs)
+	}
+}
+
+func TestOpen_ReloadsSegments(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 200, 0)
+
+	service := &Service{}
+	for i := 0; i < 10; i++ {
+		service.Store(1, []LogEntry{{Message: "before restart"}})
+	}
+
+	restarted := &Service{}
+	if err := restarted.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p, err := restarted.partition(1, false)
+	if err != nil {
+		t.Fatalf("expected partition to be loaded: %v", err)
+	}
+	original, _ := service.partition(1, false)
+	if len(p.segments) != len(original.segments) {
+		t.Errorf("expected %d segments after reload, got %d", len(original.segments), len(p.segments))
+	}
+
+	restarted.Store(1, []LogEntry{{Message: "after restart"}})
+
+	logs, _ := restarted.Read(1, 100)
+	if len(logs) != 11 {
+		t.Fatalf("expected 11 logs, got %d", len(logs))
+	}
+	if logs[10].Message != "after restart" {
+		t.Errorf("expected the new log to be last, got %q", logs[10].Message)
+	}
+}
@@ -1,41 +1,323 @@
 package storage
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bonniesimon/log-go/internal/apierror"
 )
 
 // BaseLogDir is the base directory for partition log files.
 // This can be overridden for testing.
 var BaseLogDir = "tmp"
 
-type Service struct{}
+// AppendResult is the range of offsets assigned to a stored batch.
+type AppendResult struct {
+	BaseOffset uint64 `json:"base_offset"`
+	LastOffset uint64 `json:"last_offset"`
+}
+
+// ReadResult is a page of a partition and the offset the next page starts at.
+// Corrupt lists records that were skipped because they failed their checks.
+// EndOffset is the offset the next record appended to the partition gets.
+type ReadResult struct {
+	Logs       []LogEntry            `json:"logs"`
+	Corrupt    []*CorruptRecordError `json:"corrupt,omitempty"`
+	NextOffset uint64                `json:"next_offset"`
+	EndOffset  uint64                `json:"end_offset"`
+}
+
+type Service struct {
+	mu         sync.Mutex
+	partitions map[int]*partition
+	fenced     map[int]bool // partitions being moved away, see Fence
+	dedup      map[int]*partitionDedup
+
+	replicationMu sync.Mutex        // serializes Follow and Promote
+	followers     map[int]*follower // partitions fetched from a leader
+	replicas      replicaTracker    // followers of the partitions led here
+
+	maintenanceMu sync.Mutex // serializes retention, compression and repair runs
+	retention     retentionLog
+	repairs       repairLog
+
+	// Background jobs run until stop is closed.
+	stop       chan struct{}
+	background sync.WaitGroup
+}
+
+// Open loads every partition found under BaseLogDir, picking up partitions
+// that were written as a single partition-N.log file as their first segment.
+func (s *Service) Open() error {
+	entries, err := os.ReadDir(BaseLogDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "partition-") {
+			continue
+		}
+
+		if strings.HasSuffix(name, fenceSuffix) {
+			id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "partition-"), fenceSuffix))
+			if err == nil && id >= 0 {
+				s.mu.Lock()
+				if s.fenced == nil {
+					s.fenced = make(map[int]bool)
+				}
+				s.fenced[id] = true
+				s.mu.Unlock()
+			}
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "partition-"), ".log"))
+		if err != nil || id < 0 {
+			continue
+		}
+
+		if _, err := s.partition(id, true); err != nil {
+			return fmt.Errorf("failed to open partition %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// Store appends logs to the partition and returns the offsets assigned to them
+// once they are durable according to Durability.
+func (s *Service) Store(partition int, logs []LogEntry) (AppendResult, error) {
+	return s.StoreAcks(context.Background(), partition, logs, AcksLeader)
+}
+
+// StoreAcks appends logs to the partition and returns the offsets assigned
+// to them once acks is satisfied: right away for AcksNone, once they are
+// durable for AcksLeader, and once every in-sync follower has fetched them
+// as well for AcksAll, which stops waiting once ctx is done.
+func (s *Service) StoreAcks(ctx context.Context, partition int, logs []LogEntry, acks Acks) (AppendResult, error) {
+	if len(logs) == 0 {
+		return AppendResult{}, errors.New("no logs to store")
+	}
+
+	if s.isFenced(partition) {
+		return AppendResult{}, fmt.Errorf("partition %d: %w", partition, ErrPartitionFenced)
+	}
+
+	if acks == AcksAll {
+		if inSync := s.InSyncReplicas(partition); inSync < MinInSyncReplicas {
+			return AppendResult{}, fmt.Errorf("partition %d has %d of %d in-sync replicas: %w", partition, inSync, MinInSyncReplicas, ErrNotEnoughReplicas)
+		}
+	}
+
+	p, err := s.partition(partition, true)
+	if err != nil {
+		return AppendResult{}, err
+	}
 
-func (s *Service) Store(partition int, logs []LogEntry) error {
 	for _, log := range logs {
 		logPrint(log, partition)
+	}
 
-		filePath := partitionLogFilePath(partition)
-		err := writeLogToPartition(filePath, log)
-		if err != nil {
-			return err
+	result, err := p.append(logs)
+	if err != nil {
+		return AppendResult{}, err
+	}
+	s.replicas.appended.notify(partition)
+
+	if acks == AcksNone {
+		return result, nil
+	}
+
+	if err := p.waitForSync(); err != nil {
+		return AppendResult{}, err
+	}
+
+	if acks == AcksAll {
+		if err := s.awaitReplicas(ctx, partition, result.LastOffset+1); err != nil {
+			return result, err
 		}
 	}
 
-	return nil
+	return result, nil
 }
 
+// StoreBatch stores the logs of several partitions concurrently and returns
+// the result of every partition in the order of batches, and whether it was
+// a duplicate of a batch stored with the same key. A failed partition does
+// not affect the others.
+func (s *Service) StoreBatch(ctx context.Context, batches []PartitionBatch, acks Acks) ([]AppendResult, []bool, []error) {
+	results := make([]AppendResult, len(batches))
+	duplicates := make([]bool, len(batches))
+	errs := make([]error, len(batches))
+
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], duplicates[i], errs[i] = s.StoreOnce(ctx, batch.Partition, batch.Key, batch.Logs, acks)
+		}()
+	}
+	wg.Wait()
+
+	return results, duplicates, errs
+}
+
+// Close stops background jobs and the partition writers, waits for pending
+// group fsyncs and closes all open segments. Partitions are reopened from
+// disk on next use.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	s.background.Wait()
+
+	s.mu.Lock()
+	partitions := s.partitions
+	s.partitions = nil
+	s.followers = nil
+	s.dedup = nil
+	s.mu.Unlock()
+
+	var errs []error
+	for _, p := range partitions {
+		errs = append(errs, p.close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Read returns the last limit entries of the partition.
 func (s *Service) Read(partition int, limit int) ([]LogEntry, error) {
-	partitionFilePath := partitionLogFilePath(partition)
-	logs, err := readLogFromPartition(partitionFilePath, limit)
+	result, err := s.ReadLast(partition, limit, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	return logs, nil
+	return result.Logs, nil
+}
+
+// ReadLast returns the last limit entries of the partition, capped at
+// maxBytes of records when maxBytes is positive.
+func (s *Service) ReadLast(partition int, limit int, maxBytes int64) (ReadResult, error) {
+	p, err := s.partition(partition, false)
+	if err != nil {
+		return ReadResult{}, err
+	}
+
+	segments, next, release := p.readSnapshot()
+	defer release()
+
+	// The last limit entries start limit offsets before the end of the log.
+	var from uint64
+	if uint64(limit) < next {
+		from = next - uint64(limit)
+	}
+
+	return readPage(segments, next, from, limit, maxBytes)
+}
+
+// ReadFrom returns up to limit entries of the partition starting at offset
+// from, capped at maxBytes of records when maxBytes is positive. At least one
+// entry is returned when available so a consumer always makes progress.
+func (s *Service) ReadFrom(partition int, from uint64, limit int, maxBytes int64) (ReadResult, error) {
+	p, err := s.partition(partition, false)
+	if err != nil {
+		return ReadResult{}, err
+	}
+
+	segments, next, release := p.readSnapshot()
+	defer release()
+
+	return readPage(segments, next, from, limit, maxBytes)
+}
+
+func readPage(segments []segment, next uint64, from uint64, limit int, maxBytes int64) (ReadResult, error) {
+	pg, err := readLogFromPartition(segments, from, limit, maxBytes)
+	if err != nil {
+		return ReadResult{}, err
+	}
+
+	for _, corrupt := range pg.corrupt {
+		fmt.Println("[STORAGE/CORRUPT]", corrupt)
+	}
+
+	result := ReadResult{Logs: pg.logs, Corrupt: pg.corrupt, NextOffset: from, EndOffset: next}
+	if len(pg.logs) > 0 {
+		result.NextOffset = pg.logs[len(pg.logs)-1].Offset + 1
+	}
+	if result.NextOffset > next {
+		result.NextOffset = next
+	}
+
+	return result, nil
+}
+
+// stopChan returns the channel closed when the service is closed.
+func (s *Service) stopChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+
+	return s.stop
+}
+
+// ErrPartitionNotFound is returned for partitions that were never written to
+// this node. It is an os.ErrNotExist.
+var ErrPartitionNotFound = &apierror.Error{
+	Status:  http.StatusNotFound,
+	Code:    apierror.CodeNotFound,
+	Message: "partition not found",
+	Err:     os.ErrNotExist,
+}
+
+// partition returns the already opened partition or loads it from disk.
+// Unless create is set, partitions that were never written to are reported
+// as ErrPartitionNotFound.
+func (s *Service) partition(id int, create bool) (*partition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.partitions[id]; ok {
+		return p, nil
+	}
+
+	if !create && !partitionExists(id) {
+		return nil, fmt.Errorf("partition %d: %w", id, ErrPartitionNotFound)
+	}
+
+	p, err := openPartition(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.partitions == nil {
+		s.partitions = make(map[int]*partition)
+	}
+	s.partitions[id] = p
+
+	return p, nil
 }
 
 func logPrint(log LogEntry, partition int) {
@@ -49,55 +331,101 @@ func logPrint(log LogEntry, partition int) {
 	)
 }
 
-func writeLogToPartition(partitionFilePath string, log LogEntry) error {
-	f, err := os.OpenFile(partitionFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return err
+// readLogFromPartition returns up to limit entries of the partition starting
+// at offset from, stopping before maxBytes of records when maxBytes is
+// positive. The segment holding from is located by its base offset and the
+// read seeks to the closest indexed position instead of scanning the segment
+// from its start.
+func readLogFromPartition(segments []segment, from uint64, limit int, maxBytes int64) (*page, error) {
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].baseOffset > from
+	})
+	if i > 0 {
+		i--
 	}
 
-	defer f.Close()
+	pg := &page{limit: limit, maxBytes: maxBytes}
+
+	for ; i < len(segments) && !pg.full(); i++ {
+		if err := readLogFromSegment(segments[i], from, pg); err != nil {
+			return nil, err
+		}
+	}
 
-	enc := json.NewEncoder(f)
-	return enc.Encode(log)
+	return pg, nil
 }
 
-func readLogFromPartition(partitionFilePath string, limit int) ([]LogEntry, error) {
-	f, err := os.Open(partitionFilePath)
-	if err != nil {
-		return nil, err
+// page collects the entries of a read together with the corrupt records
+// found between them.
+type page struct {
+	limit    int
+	maxBytes int64
+	bytes    int64
+	done     bool
+
+	logs    []LogEntry
+	corrupt []*CorruptRecordError
+}
+
+func (pg *page) full() bool {
+	return pg.done || len(pg.logs) >= pg.limit
+}
+
+// add appends log if a record of size bytes still fits into the page. The
+// first record always fits.
+func (pg *page) add(log LogEntry, size int64) bool {
+	if pg.maxBytes > 0 && len(pg.logs) > 0 && pg.bytes+size > pg.maxBytes {
+		pg.done = true
+		return false
 	}
-	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	pg.logs = append(pg.logs, log)
+	pg.bytes += size
+
+	return true
+}
 
-	var all []LogEntry
-	for scanner.Scan() {
-		line := scanner.Bytes()
+func readLogFromSegment(seg segment, from uint64, pg *page) error {
+	records, closer, err := seg.records(seg.lookup(from))
+	if errors.Is(err, os.ErrNotExist) {
+		// Deleted by retention after the snapshot was taken.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
 
-		if len(line) == 0 {
+	// Corrupt records are only reported once a record at or after from
+	// shows they are not part of what the index seek skipped over.
+	var pending []*CorruptRecordError
+	for !pg.full() {
+		log, start, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if corrupt, ok := asCorruptRecord(err); ok {
+			pending = append(pending, corrupt)
 			continue
 		}
+		if err != nil {
+			return err
+		}
 
-		var log LogEntry
-
-		if err := json.Unmarshal(line, &log); err != nil {
+		if log.Offset < from {
+			pending = nil
 			continue
 		}
 
-		all = append(all, log)
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
+		pg.corrupt = append(pg.corrupt, pending...)
+		pending = nil
 
-	if len(all) > limit {
-		all = all[len(all)-limit:]
+		if !pg.add(log, records.position-start) {
+			break
+		}
 	}
 
-	return all, nil
-}
+	pg.corrupt = append(pg.corrupt, pending...)
 
-func partitionLogFilePath(partition int) string {
-	return filepath.Join(BaseLogDir, fmt.Sprintf("partition-%d.log", partition))
+	return nil
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -30,14 +31,14 @@ func TestServiceStore(t *testing.T) {
 		},
 	}
 
-	err := service.Store(0, logs)
+	_, err := service.Store(0, logs)
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Verify file was created and contains logs
-	filePath := filepath.Join(tmpDir, "partition-0.log")
+	// Verify segment was created and contains logs
+	filePath := filepath.Join(tmpDir, "partition-0", "segment-00001.log")
 	f, err := os.Open(filePath)
 	if err != nil {
 		t.Fatalf("failed to open log file: %v", err)
@@ -45,10 +46,13 @@ func TestServiceStore(t *testing.T) {
 	defer f.Close()
 
 	var storedLogs []LogEntry
-	decoder := json.NewDecoder(f)
-	for decoder.More() {
-		var log LogEntry
-		if err := decoder.Decode(&log); err != nil {
+	records := newRecordReader(f, 0)
+	for {
+		log, _, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			t.Fatalf("failed to decode log: %v", err)
 		}
 		storedLogs = append(storedLogs, log)
@@ -74,22 +78,22 @@ func TestServiceStore_DifferentPartitions(t *testing.T) {
 	logs0 := []LogEntry{{Message: "partition 0 log"}}
 	logs1 := []LogEntry{{Message: "partition 1 log"}}
 
-	err := service.Store(0, logs0)
+	_, err := service.Store(0, logs0)
 	if err != nil {
 		t.Fatalf("unexpected error storing to partition 0: %v", err)
 	}
 
-	err = service.Store(1, logs1)
+	_, err = service.Store(1, logs1)
 	if err != nil {
 		t.Fatalf("unexpected error storing to partition 1: %v", err)
 	}
 
-	// Verify both partition files exist
-	if _, err := os.Stat(filepath.Join(tmpDir, "partition-0.log")); os.IsNotExist(err) {
-		t.Error("expected partition-0.log to be created")
+	// Verify both partitions have a segment
+	if _, err := os.Stat(filepath.Join(tmpDir, "partition-0", "segment-00001.log")); os.IsNotExist(err) {
+		t.Error("expected partition-0/segment-00001.log to be created")
 	}
-	if _, err := os.Stat(filepath.Join(tmpDir, "partition-1.log")); os.IsNotExist(err) {
-		t.Error("expected partition-1.log to be created")
+	if _, err := os.Stat(filepath.Join(tmpDir, "partition-1", "segment-00001.log")); os.IsNotExist(err) {
+		t.Error("expected partition-1/segment-00001.log to be created")
 	}
 }
 
@@ -170,3 +174,117 @@ func TestServiceRead_FileNotExists(t *testing.T) {
 		t.Error("expected error for non-existent partition file, got nil")
 	}
 }
+
+func TestServiceStore_AssignsOffsets(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 200, 0)
+
+	service := &Service{}
+	t.Cleanup(func() { service.Close() })
+
+	first, err := service.Store(0, []LogEntry{{Message: "a"}, {Message: "b"}, {Message: "c"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.BaseOffset != 0 || first.LastOffset != 2 {
+		t.Errorf("expected offsets 0-2, got %d-%d", first.BaseOffset, first.LastOffset)
+	}
+
+	second, err := service.Store(0, []LogEntry{{Message: "d"}, {Message: "e"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.BaseOffset != 3 || second.LastOffset != 4 {
+		t.Errorf("expected offsets 3-4, got %d-%d", second.BaseOffset, second.LastOffset)
+	}
+
+	other, err := service.Store(1, []LogEntry{{Message: "other partition"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if other.BaseOffset != 0 {
+		t.Errorf("expected offsets to be per partition, got base %d", other.BaseOffset)
+	}
+
+	// Offsets continue after a restart
+	if err := service.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	restarted := &Service{}
+	t.Cleanup(func() { restarted.Close() })
+
+	third, err := restarted.Store(0, []LogEntry{{Message: "f"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if third.BaseOffset != 5 {
+		t.Errorf("expected offset 5 after restart, got %d", third.BaseOffset)
+	}
+
+	logs, err := restarted.Read(0, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) != 6 {
+		t.Fatalf("expected 6 logs, got %d", len(logs))
+	}
+	for i, log := range logs {
+		if log.Offset != uint64(i) {
+			t.Errorf("expected log %d to have offset %d, got %d", i, i, log.Offset)
+		}
+	}
+}
+
+func TestServiceStore_EmptyBatch(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+
+	if _, err := service.Store(0, nil); err == nil {
+		t.Error("expected error for empty batch, got nil")
+	}
+}
+
+func TestServiceReadFrom(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	service.Store(0, []LogEntry{{Message: "a"}, {Message: "b"}, {Message: "c"}, {Message: "d"}})
+
+	result, err := service.ReadFrom(0, 1, 2, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 2 || result.Logs[0].Message != "b" || result.NextOffset != 3 {
+		t.Errorf("unexpected page %+v", result)
+	}
+
+	result, _ = service.ReadFrom(0, 3, 10, 0)
+	if len(result.Logs) != 1 || result.NextOffset != 4 {
+		t.Errorf("unexpected last page %+v", result)
+	}
+
+	result, _ = service.ReadFrom(0, 4, 10, 0)
+	if len(result.Logs) != 0 || result.NextOffset != 4 {
+		t.Errorf("expected an empty page at the end, got %+v", result)
+	}
+}
+
+func TestServiceReadLast_NextOffset(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	service.Store(0, []LogEntry{{Message: "a"}, {Message: "b"}, {Message: "c"}})
+
+	result, err := service.ReadLast(0, 2, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 2 || result.Logs[0].Message != "b" || result.NextOffset != 3 {
+		t.Errorf("unexpected page %+v", result)
+	}
+}
@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// maxGroupCommit bounds how many concurrent batches are coalesced into a
+// single write.
+const maxGroupCommit = 256
+
+var errPartitionClosed = errors.New("partition is closed")
+
+type appendRequest struct {
+	logs []LogEntry
+	// Replicated logs keep the offsets they were assigned on another node.
+	replicated bool
+	done       chan appendResponse
+}
+
+type appendResponse struct {
+	result AppendResult
+	next   uint64 // next offset of the partition after the commit
+	err    error
+}
+
+// append hands logs to the partition writer and waits until they have been
+// written. Batches of concurrent callers are never interleaved.
+func (p *partition) append(logs []LogEntry) (AppendResult, error) {
+	resp := p.submit(appendRequest{logs: logs})
+
+	return resp.result, resp.err
+}
+
+// appendReplicated is like append but keeps the offsets of logs, which must
+// be increasing. Logs below the next offset of the partition are already
+// stored and skipped. It returns the next offset of the partition.
+func (p *partition) appendReplicated(logs []LogEntry) (uint64, error) {
+	resp := p.submit(appendRequest{logs: logs, replicated: true})
+
+	return resp.next, resp.err
+}
+
+func (p *partition) submit(req appendRequest) appendResponse {
+	req.done = make(chan appendResponse, 1)
+
+	select {
+	case p.appends <- req:
+	case <-p.closing:
+		return appendResponse{err: errPartitionClosed}
+	}
+
+	return <-req.done
+}
+
+func (p *partition) startWriter() {
+	p.appends = make(chan appendRequest)
+	p.closing = make(chan struct{})
+	p.writerDone = make(chan struct{})
+
+	go p.runWriter()
+}
+
+// close stops the writer goroutine, waits for pending group fsyncs and
+// closes the active segment.
+func (p *partition) close() error {
+	close(p.closing)
+	<-p.writerDone
+
+	p.mu.Lock()
+	syncer := p.syncer
+	p.syncer = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	if syncer != nil {
+		syncer.close()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closeActive()
+}
+
+// runWriter serializes all appends to the partition. Whatever batches are
+// waiting when it picks up work are committed together with one write and,
+// depending on Durability, one fsync.
+func (p *partition) runWriter() {
+	defer close(p.writerDone)
+
+	for {
+		select {
+		case req := <-p.appends:
+			group := []appendRequest{req}
+
+		drain:
+			for len(group) < maxGroupCommit {
+				select {
+				case req := <-p.appends:
+					group = append(group, req)
+				default:
+					break drain
+				}
+			}
+
+			p.commit(group)
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// commit writes a group of batches and answers every request in it.
+func (p *partition) commit(group []appendRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failed != nil {
+		for _, req := range group {
+			req.done <- appendResponse{err: p.failed}
+		}
+		return
+	}
+
+	results := make([]AppendResult, len(group))
+	buffered := make([]bool, len(group))
+	err := p.writeGroup(group, results, buffered)
+
+	for i, req := range group {
+		// Batches that made it to disk before a failure still succeeded.
+		if err != nil && (!buffered[i] || results[i].LastOffset >= p.nextOffset) {
+			req.done <- appendResponse{err: err}
+			continue
+		}
+		req.done <- appendResponse{result: results[i], next: p.nextOffset}
+	}
+}
+
+// writeGroup encodes the batches of a group, assigns their offsets and
+// writes them out, marking every batch whose records were all buffered.
+func (p *partition) writeGroup(group []appendRequest, results []AppendResult, buffered []bool) error {
+	w := groupWriter{p: p}
+	w.reset()
+	start := p.groupStart()
+
+	for i, req := range group {
+		results[i].BaseOffset = w.nextOffset
+
+		for _, log := range req.logs {
+			if req.replicated {
+				if log.Offset < w.nextOffset {
+					continue
+				}
+				w.skipTo(log.Offset)
+			}
+			log.Offset = w.nextOffset
+
+			record, err := encodeLog(log)
+			if err != nil {
+				return w.abort(err)
+			}
+
+			if p.shouldRoll(int64(len(record))) {
+				if err := w.flush(); err != nil {
+					return err
+				}
+				if err := p.roll(); err != nil {
+					return p.rollback(start, err)
+				}
+				w.reset()
+			}
+
+			w.add(record)
+		}
+
+		results[i].LastOffset = w.nextOffset - 1
+		buffered[i] = true
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	if err := p.syncActive(); err != nil {
+		return p.rollback(start, err)
+	}
+
+	return nil
+}
+
+// groupStart is the state of a partition before a group was written.
+type groupStart struct {
+	segments    int
+	size        int64
+	index       int
+	lastIndexed int64
+	baseOffset  uint64
+	nextOffset  uint64
+}
+
+func (p *partition) groupStart() groupStart {
+	active := p.active()
+
+	return groupStart{
+		segments:    len(p.segments),
+		size:        active.size,
+		index:       len(active.index),
+		lastIndexed: active.lastIndexed,
+		baseOffset:  active.baseOffset,
+		nextOffset:  p.nextOffset,
+	}
+}
+
+// rollback removes the records of a group that were written but could not
+// be made durable, so none of its batches is stored although it failed:
+// segments started by the group are removed and the segment that was active
+// is truncated back. A partition that cannot be rolled back fails every
+// later write, since it would hand out the offsets of records still in it.
+func (p *partition) rollback(start groupStart, err error) error {
+	errs := []error{p.closeActive()}
+
+	for _, seg := range p.segments[start.segments:] {
+		errs = append(errs, os.Remove(seg.path), os.Remove(indexPath(seg.path)))
+		delete(p.dirty, seg.path)
+	}
+	p.segments = p.segments[:start.segments]
+
+	active := p.active()
+	active.size = start.size
+	active.index = active.index[:start.index]
+	active.lastIndexed = start.lastIndexed
+	active.baseOffset = start.baseOffset
+	errs = append(errs,
+		os.Truncate(active.path, start.size),
+		os.Truncate(indexPath(active.path), int64(start.index*indexEntrySize)),
+	)
+	p.nextOffset = start.nextOffset
+
+	if rollbackErr := errors.Join(errs...); rollbackErr != nil {
+		p.failed = fmt.Errorf("partition %d failed: %w", p.id, errors.Join(err, rollbackErr))
+		fmt.Println("[STORAGE/WRITE]", "partition=", p.id, "rollback error=", rollbackErr)
+	}
+
+	return err
+}
+
+// groupWriter buffers the records of a group destined for the active
+// segment so they reach the file in a single write.
+type groupWriter struct {
+	p *partition
+
+	data  bytes.Buffer
+	index bytes.Buffer
+
+	// State of the active segment before the buffered records, restored
+	// when the write fails.
+	startSize  int64
+	startIndex int
+	startLast  int64
+	startBase  uint64
+	nextOffset uint64
+}
+
+func (w *groupWriter) reset() {
+	active := w.p.active()
+
+	w.data.Reset()
+	w.index.Reset()
+	w.startSize = active.size
+	w.startIndex = len(active.index)
+	w.startLast = active.lastIndexed
+	w.startBase = active.baseOffset
+	w.nextOffset = w.p.nextOffset
+}
+
+// skipTo moves the next offset forward to offset, leaving a gap like
+// retention or a corrupt record on the node the logs are replicated from.
+func (w *groupWriter) skipTo(offset uint64) {
+	w.nextOffset = offset
+
+	if active := w.p.active(); active.size == 0 {
+		active.baseOffset = offset
+	}
+}
+
+func (w *groupWriter) add(record []byte) {
+	active := w.p.active()
+	position := active.size
+
+	if active.needsIndexEntry(position) {
+		entry := indexEntry{offset: w.nextOffset, position: position}
+		active.addIndexEntry(entry)
+		w.index.Write(entry.marshal())
+	}
+
+	w.data.Write(record)
+	active.size += int64(len(record))
+	w.nextOffset++
+}
+
+// flush writes the buffered records and index entries to the active segment.
+func (w *groupWriter) flush() error {
+	if w.data.Len() == 0 {
+		return nil
+	}
+
+	if err := w.p.openActive(); err != nil {
+		return w.abort(err)
+	}
+
+	if _, err := w.p.file.Write(w.data.Bytes()); err != nil {
+		return w.abort(err)
+	}
+	if _, err := w.p.indexFile.Write(w.index.Bytes()); err != nil {
+		return w.abort(err)
+	}
+
+	w.p.nextOffset = w.nextOffset
+	w.data.Reset()
+	w.index.Reset()
+
+	return nil
+}
+
+// abort drops the buffered records and cuts anything that might have been
+// partially written off the active segment.
+func (w *groupWriter) abort(err error) error {
+	active := w.p.active()
+
+	active.size = w.startSize
+	active.index = active.index[:w.startIndex]
+	active.lastIndexed = w.startLast
+	active.baseOffset = w.startBase
+
+	if w.p.file != nil {
+		w.p.file.Truncate(w.startSize)
+	}
+	if w.p.indexFile != nil {
+		w.p.indexFile.Truncate(int64(w.startIndex * indexEntrySize))
+	}
+
+	return err
+}
+
+// openActive opens the active segment and its index for appending unless
+// they are already open.
+func (p *partition) openActive() error {
+	if p.file != nil {
+		return nil
+	}
+
+	active := p.active()
+
+	f, err := os.OpenFile(active.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	idx, err := os.OpenFile(indexPath(active.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	p.file, p.indexFile = f, idx
+
+	return nil
+}
+
+// syncActive makes the writes to the active segment durable according to
+// Durability. Indexes are never fsynced since they can be rebuilt from the
+// log.
+func (p *partition) syncActive() error {
+	if p.file == nil {
+		return nil
+	}
+
+	switch Durability {
+	case DurabilityRequest:
+		return p.file.Sync()
+	case DurabilityInterval:
+		if p.dirty == nil {
+			p.dirty = make(map[string]struct{})
+		}
+		p.dirty[p.active().path] = struct{}{}
+	}
+
+	return nil
+}
+
+func (p *partition) closeActive() error {
+	if p.file == nil {
+		return nil
+	}
+
+	err := errors.Join(p.file.Close(), p.indexFile.Close())
+	p.file, p.indexFile = nil, nil
+
+	return err
+}
+
+// roll seals the active segment and starts a new one.
+func (p *partition) roll() error {
+	sealed := p.active()
+
+	if err := p.syncActive(); err != nil {
+		return err
+	}
+	if err := p.closeActive(); err != nil {
+		return err
+	}
+
+	if _, err := p.newSegment(sealed.id + 1); err != nil {
+		return err
+	}
+
+	fmt.Println("[STORAGE/SEGMENT]", "partition=", p.id, "sealed=", filepath.Base(sealed.path), "size=", sealed.size)
+
+	return nil
+}
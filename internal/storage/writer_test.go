@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStore_ConcurrentBatchesDoNotInterleave(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 4096, 0)
+
+	service := &Service{}
+	defer service.Close()
+
+	const writers = 20
+	const batchSize = 15
+
+	results := make([]AppendResult, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			batch := make([]LogEntry, batchSize)
+			for i := range batch {
+				batch[i] = LogEntry{Service: fmt.Sprintf("writer-%d", w), Message: fmt.Sprintf("%d", i)}
+			}
+
+			result, err := service.Store(0, batch)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results[w] = result
+		}()
+	}
+	wg.Wait()
+
+	logs, err := service.Read(0, writers*batchSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) != writers*batchSize {
+		t.Fatalf("expected %d logs, got %d", writers*batchSize, len(logs))
+	}
+
+	for w, result := range results {
+		if result.LastOffset-result.BaseOffset != batchSize-1 {
+			t.Fatalf("writer %d got offsets %d-%d", w, result.BaseOffset, result.LastOffset)
+		}
+
+		for i := 0; i < batchSize; i++ {
+			log := logs[result.BaseOffset+uint64(i)]
+			if log.Service != fmt.Sprintf("writer-%d", w) || log.Message != fmt.Sprintf("%d", i) {
+				t.Fatalf("batch of writer %d is interleaved at offset %d: %+v", w, log.Offset, log)
+			}
+		}
+	}
+}
+
+func TestCommit_CoalescesBatches(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	defer service.Close()
+
+	p, err := service.partition(0, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	group := []appendRequest{
+		{logs: []LogEntry{{Message: "a"}, {Message: "b"}}, done: make(chan appendResponse, 1)},
+		{logs: []LogEntry{{Message: "c"}}, done: make(chan appendResponse, 1)},
+	}
+	p.commit(group)
+
+	first, second := <-group[0].done, <-group[1].done
+	if first.err != nil || second.err != nil {
+		t.Fatalf("unexpected errors: %v, %v", first.err, second.err)
+	}
+	if first.result.BaseOffset != 0 || first.result.LastOffset != 1 {
+		t.Errorf("unexpected offsets for the first batch: %+v", first.result)
+	}
+	if second.result.BaseOffset != 2 || second.result.LastOffset != 2 {
+		t.Errorf("unexpected offsets for the second batch: %+v", second.result)
+	}
+
+	if p.file == nil {
+		t.Error("expected the active segment to stay open between writes")
+	}
+}
+
+func TestStore_AfterCloseReopensPartition(t *testing.T) {
+	_, cleanup := setupTempDir(t)
+	defer cleanup()
+
+	service := &Service{}
+	service.Store(0, []LogEntry{{Message: "before close"}})
+
+	p, _ := service.partition(0, false)
+	if err := service.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := p.append([]LogEntry{{Message: "closed"}}); err != errPartitionClosed {
+		t.Errorf("expected errPartitionClosed, got %v", err)
+	}
+
+	result, err := service.Store(0, []LogEntry{{Message: "after close"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 1 {
+		t.Errorf("expected offset 1 after reopening, got %d", result.BaseOffset)
+	}
+}
+
+func TestCommit_FailedRollRemovesTheGroup(t *testing.T) {
+	dir, cleanup := setupTempDir(t)
+	defer cleanup()
+	setupSegmentLimits(t, 64, 0)
+
+	service := &Service{}
+	defer service.Close()
+
+	if _, err := service.partition(0, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The next segment cannot be created, so the group fails after its
+	// first records were written
+	blocker := filepath.Join(dir, "partition-0", segmentFileName(2))
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	batch := make([]LogEntry, 10)
+	for i := range batch {
+		batch[i] = LogEntry{Message: fmt.Sprintf("message %d", i)}
+	}
+	if _, err := service.Store(0, batch); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	logs, err := service.Read(0, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) != 0 {
+		t.Fatalf("expected the failed batch not to be stored, got %d logs", len(logs))
+	}
+
+	os.Remove(blocker)
+	result, err := service.Store(0, batch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.BaseOffset != 0 || result.LastOffset != 9 {
+		t.Errorf("expected offsets 0-9 for the retry, got %+v", result)
+	}
+
+	logs, err = service.Read(0, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) != 10 || logs[0].Message != "message 0" {
+		t.Errorf("expected the batch stored once, got %d logs", len(logs))
+	}
+}